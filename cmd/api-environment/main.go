@@ -1,15 +1,27 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+	// The time zones used by the noise indicators must be available in minimal images
+	_ "time/tzdata"
 
 	"github.com/diwise/api-environment/internal/pkg/application"
 	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
 	"github.com/diwise/api-environment/internal/pkg/presentation/api"
+	// The entity types that are provided are the ones whose packages are imported
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/airqualityobserved"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/indoorenvironmentobserved"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/noiselevelobserved"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/waterqualityobserved"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/weatherobserved"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,14 +29,64 @@ func main() {
 	serviceName := "api-environment"
 
 	logger := log.With().Str("service", strings.ToLower(serviceName)).Logger()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		err := runMigrate(logger, os.Args[2:])
+		if err != nil {
+			logger.Fatal().Err(err).Msg("migration failed")
+		}
+		return
+	}
+
 	logger.Info().Msg("starting up ...")
 
 	db, err := database.NewDatabaseConnection(database.NewPostgreSQLConnector(logger))
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to connect to database, shutting down... ")
+		log.Fatal().Err(err).Msg("failed to connect to or migrate the database, shutting down... ")
+	}
+
+	aqiScale := os.Getenv("AQI_SCALE")
+	if aqiScale == "" {
+		aqiScale = application.AQIScaleCAQI
+	}
+
+	aqi, err := application.NewAQICalculator(aqiScale)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid AQI_SCALE, shutting down... ")
 	}
 
-	app := application.NewEnvironmentApp(db, logger)
+	duplicates := os.Getenv("DUPLICATE_OBSERVATIONS")
+	if duplicates == "" {
+		duplicates = string(database.DuplicatesIgnore)
+	}
+
+	onDuplicate, err := database.ParseDuplicatePolicy(duplicates)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid DUPLICATE_OBSERVATIONS, shutting down... ")
+	}
+
+	notifier := startNotificationDispatcher(db, logger)
+
+	options := []application.AppOption{
+		application.WithSubscriptions(api.NotificationEntityRenderer(), notifier),
+		application.WithLivenessTracker(startLivenessTracker(db, logger)),
+	}
+
+	if config := os.Getenv("ALERT_RULES"); config != "" {
+		rules, err := application.ParseAlertRules(config)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid ALERT_RULES, shutting down... ")
+		}
+
+		logger.Info().Int("rules", len(rules)).Msg("evaluating alert rules")
+		options = append(options, application.WithAlertRules(rules))
+	}
+
+	app := application.NewEnvironmentApp(db, aqi, onDuplicate, logger, options...)
+
+	if os.Getenv("RETENTION_ENABLED") == "true" {
+		startRetentionWorker(db, logger)
+	}
 
 	r := chi.NewRouter()
 	r.Use(httplog.RequestLogger(
@@ -32,7 +94,14 @@ func main() {
 			JSON: true,
 		}),
 	))
-	api.RegisterHandlers(r, app, logger)
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		logger.Warn().Msg("ADMIN_TOKEN is not set, the admin endpoints will refuse all requests")
+	}
+
+	api.RegisterHandlers(r, app, adminToken, logger)
+
+	startMetricsListener(logger)
 
 	port := os.Getenv("SERVICE_PORT")
 	if port == "" {
@@ -46,3 +115,102 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to listen for connections")
 	}
 }
+
+func startMetricsListener(logger zerolog.Logger) {
+	port := os.Getenv("METRICS_PORT")
+	if port == "" {
+		port = "8081"
+	}
+
+	r := chi.NewRouter()
+	api.RegisterMetricsHandlers(r)
+
+	logger.Info().Str("port", port).Msg("starting to listen for metrics requests")
+
+	go func() {
+		err := http.ListenAndServe(":"+port, r)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to listen for metrics requests")
+		}
+	}()
+}
+
+func startNotificationDispatcher(db database.Datastore, logger zerolog.Logger) application.Notifier {
+	workers := 4
+	if value := os.Getenv("NOTIFICATION_WORKERS"); value != "" {
+		var err error
+		workers, err = strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			logger.Fatal().Str("workers", value).Msg("invalid NOTIFICATION_WORKERS, shutting down... ")
+		}
+	}
+
+	retry := application.DefaultRetryPolicy()
+	if value := os.Getenv("NOTIFICATION_MAX_ATTEMPTS"); value != "" {
+		var err error
+		retry.MaxAttempts, err = strconv.Atoi(value)
+		if err != nil || retry.MaxAttempts < 1 {
+			logger.Fatal().Str("attempts", value).Msg("invalid NOTIFICATION_MAX_ATTEMPTS, shutting down... ")
+		}
+	}
+
+	client := application.NewNotificationClient(10 * time.Second)
+
+	dispatcher := application.NewNotificationDispatcher(db, client, retry, logger)
+	go dispatcher.Run(context.Background(), workers)
+
+	return dispatcher
+}
+
+func startLivenessTracker(db database.Datastore, logger zerolog.Logger) *application.LivenessTracker {
+	config := application.DefaultLivenessConfig()
+
+	if value := os.Getenv("LIVENESS_DEFAULT_INTERVAL"); value != "" {
+		var err error
+		config.DefaultInterval, err = time.ParseDuration(value)
+		if err != nil || config.DefaultInterval <= 0 {
+			logger.Fatal().Str("interval", value).Msg("invalid LIVENESS_DEFAULT_INTERVAL, shutting down... ")
+		}
+	}
+
+	if value := os.Getenv("LIVENESS_MISSED_REPORTS"); value != "" {
+		var err error
+		config.MissedReports, err = strconv.Atoi(value)
+		if err != nil || config.MissedReports < 1 {
+			logger.Fatal().Str("reports", value).Msg("invalid LIVENESS_MISSED_REPORTS, shutting down... ")
+		}
+	}
+
+	tracker := application.NewLivenessTracker(db, config, logger)
+	go tracker.Run(context.Background(), time.Minute)
+
+	return tracker
+}
+
+func startRetentionWorker(db database.Datastore, logger zerolog.Logger) {
+	policies := application.DefaultRetentionPolicies()
+
+	if config := os.Getenv("RETENTION_POLICIES"); config != "" {
+		var err error
+		policies, err = application.ParseRetentionPolicies(config)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid RETENTION_POLICIES, shutting down... ")
+		}
+	}
+
+	interval := time.Hour
+	if value := os.Getenv("RETENTION_INTERVAL"); value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			logger.Fatal().Str("interval", value).Msg("invalid RETENTION_INTERVAL, shutting down... ")
+		}
+	}
+
+	dryRun := os.Getenv("RETENTION_DRY_RUN") == "true"
+
+	logger.Info().Dur("interval", interval).Bool("dryRun", dryRun).Msg("starting retention worker")
+
+	worker := application.NewRetentionWorker(db, policies, dryRun, logger)
+	go worker.Run(context.Background(), interval)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/rs/zerolog"
+)
+
+//runMigrate implements the migrate subcommand, i.e. api-environment migrate up|down|status
+func runMigrate(logger zerolog.Logger, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: api-environment migrate up|down|status")
+	}
+
+	migrator, err := database.NewMigrator(database.NewPostgreSQLConnector(logger))
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		logger.Info().Int("count", count).Msg("applied schema migrations")
+	case "down":
+		return migrator.Down()
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		printMigrationStatus(status)
+	default:
+		return fmt.Errorf("unknown migrate command %s, expected up, down or status", args[0])
+	}
+
+	return nil
+}
+
+func printMigrationStatus(status []database.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+
+	for _, s := range status {
+		state, appliedAt := "pending", ""
+
+		if s.Applied {
+			state = "applied"
+			appliedAt = s.AppliedAt.UTC().Format("2006-01-02T15:04:05Z")
+		}
+
+		if s.Unknown {
+			state = "unknown (schema is ahead of this binary)"
+		} else if s.Modified {
+			state = "modified (checksum mismatch)"
+		}
+
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+	}
+
+	w.Flush()
+}
@@ -6,7 +6,9 @@ require (
 	github.com/diwise/ngsi-ld-golang v0.0.0-20220316192820-be9523ddfd17
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/go-chi/httplog v0.2.1
+	github.com/google/uuid v1.3.0
 	github.com/matryer/is v1.4.0
+	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/rs/cors v1.8.2
 	github.com/rs/zerolog v1.26.1
 	gorm.io/driver/postgres v1.3.1
@@ -15,7 +17,6 @@ require (
 )
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
 	github.com/jackc/pgconn v1.10.1 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
@@ -26,7 +27,6 @@ require (
 	github.com/jackc/pgx/v4 v4.14.1 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.4 // indirect
-	github.com/mattn/go-sqlite3 v1.14.9 // indirect
 	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
@@ -0,0 +1,437 @@
+package application
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+)
+
+//AlertDirection tells whether an alert rule is breached by values above, or below, its threshold
+type AlertDirection string
+
+const (
+	AlertAbove AlertDirection = "above"
+	AlertBelow AlertDirection = "below"
+)
+
+//AlertRule raises an alert when an attribute of the observations of a device has been past the
+//Threshold, in the given Direction, for at least Duration. The alert is cleared when the value
+//has returned past the threshold by more than Hysteresis, e.g. below 800 for a rule on values
+//above 1000 with a hysteresis of 200. An empty list of Devices applies the rule to all devices.
+type AlertRule struct {
+	Name       string
+	Attribute  string
+	Threshold  float64
+	Direction  AlertDirection
+	Duration   time.Duration
+	Hysteresis float64
+	Devices    []string
+	Severity   string
+}
+
+//alertRuleJSON is the configuration format of an AlertRule, with durations such as "10m"
+type alertRuleJSON struct {
+	Name       string   `json:"name"`
+	Attribute  string   `json:"attribute"`
+	Threshold  *float64 `json:"threshold"`
+	Direction  string   `json:"direction"`
+	Duration   string   `json:"duration,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+	Devices    []string `json:"devices,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+}
+
+//alertSeverities are the severities of the FIWARE Alert data model
+var alertSeverities = map[string]bool{
+	"informational": true, "low": true, "medium": true, "high": true, "critical": true,
+}
+
+//ParseAlertRules parses a JSON array of alert rules, e.g.
+//[{"name": "classroom-co2", "attribute": "CO2", "threshold": 1000, "direction": "above", "duration": "10m", "hysteresis": 200}]
+func ParseAlertRules(config string) ([]AlertRule, error) {
+	rulesJSON := []alertRuleJSON{}
+
+	err := json.Unmarshal([]byte(config), &rulesJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse alert rules: %w", err)
+	}
+
+	measurements := models.AirQualityMeasurements{}.Attributes()
+
+	rules := []AlertRule{}
+	names := map[string]bool{}
+
+	for _, r := range rulesJSON {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("every alert rule must have a unique name")
+		}
+		names[r.Name] = true
+
+		if _, ok := measurements[r.Attribute]; !ok {
+			return nil, fmt.Errorf("alert rule %s refers to %q, which is not a measurement", r.Name, r.Attribute)
+		}
+
+		if r.Threshold == nil {
+			return nil, fmt.Errorf("alert rule %s has no threshold", r.Name)
+		}
+
+		rule := AlertRule{
+			Name:       r.Name,
+			Attribute:  r.Attribute,
+			Threshold:  *r.Threshold,
+			Direction:  AlertDirection(r.Direction),
+			Hysteresis: r.Hysteresis,
+			Devices:    r.Devices,
+			Severity:   r.Severity,
+		}
+
+		if rule.Direction != AlertAbove && rule.Direction != AlertBelow {
+			return nil, fmt.Errorf("the direction of alert rule %s must be above or below", r.Name)
+		}
+
+		if rule.Hysteresis < 0 {
+			return nil, fmt.Errorf("the hysteresis of alert rule %s must not be negative", r.Name)
+		}
+
+		if r.Duration != "" {
+			rule.Duration, err = time.ParseDuration(r.Duration)
+			if err != nil || rule.Duration < 0 {
+				return nil, fmt.Errorf("invalid duration %q for alert rule %s", r.Duration, r.Name)
+			}
+		}
+
+		if rule.Severity == "" {
+			rule.Severity = "medium"
+		} else if !alertSeverities[rule.Severity] {
+			return nil, fmt.Errorf("unknown severity %s for alert rule %s", rule.Severity, r.Name)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+//breached returns true if a value is past the threshold of the rule
+func (r AlertRule) breached(value float64) bool {
+	if r.Direction == AlertBelow {
+		return value < r.Threshold
+	}
+	return value > r.Threshold
+}
+
+//cleared returns true if a value has returned past the threshold by more than the hysteresis
+func (r AlertRule) cleared(value float64) bool {
+	if r.Direction == AlertBelow {
+		return value > r.Threshold+r.Hysteresis
+	}
+	return value < r.Threshold-r.Hysteresis
+}
+
+func (r AlertRule) appliesTo(deviceId string) bool {
+	if len(r.Devices) == 0 {
+		return true
+	}
+
+	for _, d := range r.Devices {
+		if d == deviceId {
+			return true
+		}
+	}
+
+	return false
+}
+
+//WithAlertRules makes the app evaluate the alert rules against every stored observation. Raised
+//and cleared alerts are sent to subscribers of Alert entities, if subscriptions are enabled.
+func WithAlertRules(rules []AlertRule) AppOption {
+	return func(a *app) {
+		a.alerts = newAlertTracker(rules)
+	}
+}
+
+//alertMetrics is published as the expvar "alerts", keyed by rule and event
+var alertMetrics = expvar.NewMap("alerts")
+
+type alertKey struct {
+	rule   string
+	source string
+}
+
+//alertState is the state of a rule for a single device. A breach is pending until it has lasted
+//for the duration of the rule, and the alert is set while it is active.
+type alertState struct {
+	lastObserved time.Time
+	breachedAt   time.Time
+	alert        *raisedAlert
+}
+
+//raisedAlert is an alert that has been raised by the tracker. Alerts are stored after the tracker
+//has been unlocked, so stored is closed once the alert has been stored, or failed to be with err.
+type raisedAlert struct {
+	models.Alert
+	stored chan struct{}
+	err    error
+}
+
+func newRaisedAlert(alert models.Alert) *raisedAlert {
+	return &raisedAlert{Alert: alert, stored: make(chan struct{})}
+}
+
+//wait blocks until the alert has been stored, and returns the error if that failed
+func (r *raisedAlert) wait() error {
+	<-r.stored
+	return r.err
+}
+
+//alertChange is an alert that has been raised, or cleared, when the tracker evaluated an observation
+type alertChange struct {
+	rule   AlertRule
+	source string
+	state  *alertState
+	alert  *raisedAlert
+	clear  bool
+	at     time.Time
+	value  float64
+}
+
+//alertTracker keeps the alert state per rule and device. Active alerts are loaded from the
+//Datastore before the first evaluation, so that they can be cleared after a restart. The state
+//is only locked while it is updated, and the changes are stored in the Datastore afterwards.
+type alertTracker struct {
+	mu     sync.Mutex
+	rules  []AlertRule
+	states map[alertKey]*alertState
+	loaded bool
+}
+
+func newAlertTracker(rules []AlertRule) *alertTracker {
+	return &alertTracker{rules: rules, states: map[alertKey]*alertState{}}
+}
+
+func (t *alertTracker) load(db database.Datastore) error {
+	t.mu.Lock()
+	loaded := t.loaded
+	t.mu.Unlock()
+
+	if loaded {
+		return nil
+	}
+
+	active, err := db.GetAlerts("", time.Time{}, time.Time{}, true, 0)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	//the alerts may have been loaded by a concurrent evaluation while the tracker was unlocked
+	if t.loaded {
+		return nil
+	}
+
+	for _, alert := range active {
+		raised := newRaisedAlert(alert)
+		close(raised.stored)
+
+		t.states[alertKey{rule: alert.Rule, source: alertSource(alert.DeviceId, alert.EntityId)}] = &alertState{
+			lastObserved: alert.RaisedAt,
+			breachedAt:   alert.BreachedAt,
+			alert:        raised,
+		}
+	}
+
+	t.loaded = true
+	return nil
+}
+
+//alertSource is the key that alert state is kept per, which is the device, or the entity for
+//observations that were not made by a known device
+func alertSource(deviceId, entityId string) string {
+	if deviceId != "" {
+		return deviceId
+	}
+	return "entity:" + entityId
+}
+
+//evaluateAlerts updates the alert state of every rule that applies to an observation, and raises
+//or clears alerts as needed. Observations that are older than the latest evaluated observation
+//of a device are ignored. Alerts are only raised by air quality observations, since an alert of
+//an observation without a device refers to an AirQualityObserved entity.
+func (a *app) evaluateAlerts(kind *database.ObservationKind, observation database.Observation) {
+	if a.alerts == nil || kind != database.AirQualityObservedKind {
+		return
+	}
+
+	changed := a.alerts.evaluate(a, observation)
+
+	for _, alert := range changed {
+		a.notifySubscribers(alert)
+	}
+}
+
+func (t *alertTracker) evaluate(a *app, observation database.Observation) []models.Alert {
+	err := t.load(a.db)
+	if err != nil {
+		a.log.Error().Err(err).Msg("failed to load active alerts")
+		return nil
+	}
+
+	return t.store(a, t.update(observation))
+}
+
+//update evaluates the rules that apply to an observation and returns the alerts to raise or clear
+func (t *alertTracker) update(observation database.Observation) []alertChange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changes := []alertChange{}
+	attributes := observation.Attributes()
+	entityId, _ := observation.Key()
+	deviceId, observedAt := observation.Source()
+	latitude, longitude := observation.Position()
+	source := alertSource(deviceId, entityId)
+
+	for _, rule := range t.rules {
+		value := attributes[rule.Attribute]
+		if value == nil || !rule.appliesTo(deviceId) {
+			continue
+		}
+
+		key := alertKey{rule: rule.Name, source: source}
+		state, ok := t.states[key]
+		if !ok {
+			state = &alertState{}
+			t.states[key] = state
+		}
+
+		if observedAt.Before(state.lastObserved) {
+			continue
+		}
+		state.lastObserved = observedAt
+
+		if state.alert != nil {
+			if !rule.cleared(*value) {
+				continue
+			}
+
+			changes = append(changes, alertChange{
+				rule: rule, source: source, state: state, alert: state.alert, clear: true, at: observedAt, value: *value,
+			})
+
+			state.alert = nil
+			state.breachedAt = time.Time{}
+			continue
+		}
+
+		if !rule.breached(*value) {
+			state.breachedAt = time.Time{}
+			continue
+		}
+
+		if state.breachedAt.IsZero() {
+			state.breachedAt = observedAt
+		}
+
+		if observedAt.Sub(state.breachedAt) < rule.Duration {
+			continue
+		}
+
+		state.alert = newRaisedAlert(models.Alert{
+			Rule:       rule.Name,
+			DeviceId:   deviceId,
+			EntityId:   entityId,
+			Attribute:  rule.Attribute,
+			Direction:  string(rule.Direction),
+			Threshold:  rule.Threshold,
+			Severity:   rule.Severity,
+			Latitude:   latitude,
+			Longitude:  longitude,
+			BreachedAt: state.breachedAt,
+			RaisedAt:   observedAt,
+			Value:      *value,
+		})
+
+		changes = append(changes, alertChange{
+			rule: rule, source: source, state: state, alert: state.alert, at: observedAt, value: *value,
+		})
+	}
+
+	return changes
+}
+
+//store writes the changes to the Datastore and returns the alerts that were raised or cleared. A
+//change that fails to be stored is reverted, unless the state has changed since. Alerts are raised
+//before any are cleared, since clearing an alert waits until it has been stored.
+func (t *alertTracker) store(a *app, changes []alertChange) []models.Alert {
+	changed := []models.Alert{}
+
+	for _, c := range changes {
+		if c.clear {
+			continue
+		}
+
+		c.alert.err = a.db.CreateAlert(&c.alert.Alert)
+		close(c.alert.stored)
+
+		if c.alert.err != nil {
+			a.log.Error().Err(c.alert.err).Str("rule", c.rule.Name).Str("source", c.source).Msg("failed to raise alert")
+
+			t.mu.Lock()
+			if c.state.alert == c.alert {
+				c.state.alert = nil
+			}
+			t.mu.Unlock()
+			continue
+		}
+
+		changed = append(changed, c.alert.Alert)
+		alertMetrics.Add(c.rule.Name+".raised", 1)
+
+		a.log.Info().Str("rule", c.rule.Name).Str("source", c.source).Float64("value", c.value).Msg("alert raised")
+	}
+
+	for _, c := range changes {
+		if !c.clear {
+			continue
+		}
+
+		//an alert that could not be stored has nothing to clear
+		if c.alert.wait() != nil {
+			continue
+		}
+
+		err := a.db.ClearAlert(c.alert.ID, c.at, c.value)
+		if err != nil {
+			a.log.Error().Err(err).Str("rule", c.rule.Name).Str("source", c.source).Msg("failed to clear alert")
+
+			t.mu.Lock()
+			if c.state.alert == nil && c.state.breachedAt.IsZero() {
+				c.state.alert = c.alert
+				c.state.breachedAt = c.alert.BreachedAt
+			}
+			t.mu.Unlock()
+			continue
+		}
+
+		cleared := c.alert.Alert
+		clearedAt, value := c.at.UTC(), c.value
+		cleared.ClearedAt, cleared.ClearValue = &clearedAt, &value
+		changed = append(changed, cleared)
+		alertMetrics.Add(c.rule.Name+".cleared", 1)
+	}
+
+	return changed
+}
+
+//RetrieveAlerts returns the alerts, optionally of a single device, that were raised within a
+//time span, the most recent first
+func (a *app) RetrieveAlerts(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+	return a.db.GetAlerts(deviceId, from, to, activeOnly, limit)
+}
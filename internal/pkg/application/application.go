@@ -1,6 +1,8 @@
 package application
 
 import (
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
@@ -8,37 +10,300 @@ import (
 	"github.com/rs/zerolog"
 )
 
+//ErrNotFound is returned when a requested entity does not exist
+var ErrNotFound = database.ErrNotFound
+
+//ErrAlreadyExists is returned when a duplicate observation is rejected
+var ErrAlreadyExists = database.ErrDuplicate
+
 type EnvironmentApp interface {
-	RetrieveAirQualityObserveds(deviceId string, from, to time.Time, limit uint64) ([]models.AirQualityObserved, error)
-	StoreAirQualityObserved(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) error
+	RetrieveObservation(kind *database.ObservationKind, entityId string) (database.Observation, error)
+	RetrieveObservations(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error)
+	RetrieveAggregatedObservations(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error)
+	StoreObservation(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error)
+	StoreObservations(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error)
+	UpdateObservation(kind *database.ObservationKind, entityId string, update ObservationUpdate) error
+	DeleteObservations(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error)
+	DeleteObservationsOfDevice(deviceId string, from, to time.Time, purge bool) (int64, error)
+	DeleteMeasurement(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error
+
+	CreateSubscription(subscription Subscription) (string, error)
+	RetrieveSubscription(id string) (*Subscription, error)
+	RetrieveSubscriptions() ([]Subscription, error)
+	UpdateSubscription(subscription Subscription) error
+	DeleteSubscription(id string) error
+
+	RetrieveAlerts(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error)
+
+	RetrieveDeviceStatuses() ([]DeviceStatus, error)
+	UpdateExpectedReportingInterval(deviceId string, interval time.Duration) error
+	RetrieveReportingGaps(deviceId string, from, to time.Time) ([]DeviceGaps, error)
 }
 
+//ObservationUpdate returns the new observation of a partial update of an entity, given the latest
+//stored observation of the entity
+type ObservationUpdate func(latest database.Observation) (database.Observation, error)
+
 type app struct {
-	db  database.Datastore
-	log zerolog.Logger
+	db          database.Datastore
+	aqi         AQICalculator
+	onDuplicate database.DuplicatePolicy
+	log         zerolog.Logger
+
+	render        EntityRenderer
+	notifier      Notifier
+	subscriptions *subscriptionCache
+
+	alerts   *alertTracker
+	liveness *LivenessTracker
 }
 
-func NewEnvironmentApp(db database.Datastore, log zerolog.Logger) EnvironmentApp {
+//NewEnvironmentApp creates the application. New observations of an entity at a point in time
+//that has already been observed are handled according to onDuplicate.
+func NewEnvironmentApp(db database.Datastore, aqi AQICalculator, onDuplicate database.DuplicatePolicy, log zerolog.Logger, options ...AppOption) EnvironmentApp {
 	newApp := &app{
-		db:  db,
-		log: log,
+		db:            db,
+		aqi:           aqi,
+		onDuplicate:   onDuplicate,
+		log:           log,
+		subscriptions: newSubscriptionCache(),
+	}
+
+	for _, option := range options {
+		option(newApp)
 	}
 
 	return newApp
 }
 
-func (a *app) StoreAirQualityObserved(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) error {
-	_, err := a.db.StoreAirQualityObserved(entityId, deviceId, co2, humidity, temperature, timestamp)
+//StoreObservation stores an observation of any kind. Duplicates are handled according to the
+//configured policy.
+func (a *app) StoreObservation(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+	return a.store(kind, observation, a.onDuplicate)
+}
+
+func (a *app) store(kind *database.ObservationKind, observation database.Observation, onDuplicate database.DuplicatePolicy) (database.StoreResult, error) {
+	err := validatePosition(observation.Position())
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	stored, result, err := a.db.StoreObservation(kind, observation, onDuplicate)
+	if err == nil && result != database.StoreResultIgnored && stored != nil {
+		a.notifySubscribers(stored)
+		a.evaluateAlerts(kind, stored)
+	}
+
+	if err == nil {
+		a.seen(observation.Source())
+	}
+
+	return result, err
+}
+
+//StoreObservations stores a batch of observations of any kind and returns the outcome of every
+//observation, in the same order. Duplicates are handled according to the configured policy, or
+//always overwrite the existing observations when upsert is set.
+func (a *app) StoreObservations(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+	evaluate := []database.Observation{}
+
+	results, err := storeBatch(len(observations),
+		func(idx int) error {
+			return validatePosition(observations[idx].Position())
+		},
+		func(indices []int) ([]database.BatchStoreResult, error) {
+			valid := []database.Observation{}
+			for _, idx := range indices {
+				valid = append(valid, observations[idx])
+			}
+			return a.db.StoreObservations(kind, valid, a.duplicatePolicy(upsert))
+		},
+		func(idx int, result database.StoreResult) {
+			if result != database.StoreResultIgnored {
+				a.notifySubscribers(observations[idx])
+				evaluate = append(evaluate, observations[idx])
+			}
+			a.seen(observations[idx].Source())
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	//alert rules ignore observations that are older than the latest one of a device, so the
+	//observations of a batch are evaluated in the order they were made
+	sort.SliceStable(evaluate, func(i, j int) bool {
+		_, ti := evaluate[i].Source()
+		_, tj := evaluate[j].Source()
+		return ti.Before(tj)
+	})
+
+	for _, o := range evaluate {
+		a.evaluateAlerts(kind, o)
+	}
+
+	return results, nil
+}
+
+//duplicatePolicy returns the configured policy for duplicates in batches, unless upsert is set
+func (a *app) duplicatePolicy(upsert bool) database.DuplicatePolicy {
+	if upsert {
+		return database.DuplicatesOverwrite
+	}
+	return a.onDuplicate
+}
+
+//seen records that a device has reported an observation, if liveness is tracked
+func (a *app) seen(deviceId string, observedAt time.Time) {
+	if a.liveness != nil {
+		a.liveness.Seen(deviceId, observedAt)
+	}
+}
+
+//storeBatch stores the observations of a batch that pass validate, by passing their indices to
+//store, and returns the outcome of every observation in the same order. Every observation that
+//was stored, or ignored as a duplicate, is then passed to stored along with its outcome.
+func storeBatch(count int, validate func(idx int) error, store func(indices []int) ([]database.BatchStoreResult, error), stored func(idx int, result database.StoreResult)) ([]database.BatchStoreResult, error) {
+	results := make([]database.BatchStoreResult, count)
+	validIdx := []int{}
+
+	for idx := range results {
+		err := validate(idx)
+		if err != nil {
+			results[idx].Err = err
+			continue
+		}
+
+		validIdx = append(validIdx, idx)
+	}
+
+	if len(validIdx) == 0 {
+		return results, nil
+	}
+
+	storeResults, err := store(validIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, result := range storeResults {
+		results[validIdx[idx]] = result
+
+		if result.Err == nil {
+			stored(validIdx[idx], result.Result)
+		}
+	}
+
+	return results, nil
+}
+
+//DeleteObservations deletes all observations of a set of entities and returns an error, or nil,
+//for every entity. Entities without any observations are reported as ErrNotFound. Deleted
+//observations are kept in the database, unless purge is set.
+func (a *app) DeleteObservations(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+	deleted, err := a.db.DeleteObservations(kind, entityIds, purge)
+	if err != nil {
+		return nil, err
+	}
+
+	return deleteResults(entityIds, deleted), nil
+}
+
+//deleteResults converts the number of deleted observations per entity into an error, or nil,
+//for every entity. Entities without any observations are reported as ErrNotFound.
+func deleteResults(entityIds []string, deleted map[string]int64) []error {
+	errs := make([]error, len(entityIds))
+	for idx, entityId := range entityIds {
+		if deleted[entityId] == 0 {
+			errs[idx] = fmt.Errorf("%w: entity %s", ErrNotFound, entityId)
+		}
+	}
+
+	return errs
+}
+
+//DeleteObservationsOfDevice deletes the observations of every kind that a device has reported
+//within a time span, e.g. because the device was faulty, and returns the number of deleted observations
+func (a *app) DeleteObservationsOfDevice(deviceId string, from, to time.Time, purge bool) (int64, error) {
+	if deviceId == "" || from.IsZero() || to.IsZero() || !from.Before(to) {
+		return 0, fmt.Errorf("a device and a valid time span are required")
+	}
+
+	return a.db.DeleteObservationsOfDevice(deviceId, from, to, purge)
+}
+
+//DeleteMeasurement removes a single measurement from an observation
+func (a *app) DeleteMeasurement(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error {
+	return a.db.DeleteMeasurement(kind, entityId, instanceId, column, purge)
+}
+
+//UpdateObservation appends a new observation to an existing entity, which update derives from the
+//latest stored observation. An update at the time of an existing observation always replaces that
+//observation.
+func (a *app) UpdateObservation(kind *database.ObservationKind, entityId string, update ObservationUpdate) error {
+	latest, err := a.db.GetObservation(kind, entityId)
 	if err != nil {
 		return err
 	}
+
+	observation, err := update(latest)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.store(kind, observation, database.DuplicatesOverwrite)
 	return err
 }
 
-func (a *app) RetrieveAirQualityObserveds(deviceId string, from, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-	results, err := a.db.GetAirQualityObserveds(deviceId, from, to, limit)
+//RetrieveObservation returns the most recent observation of an entity
+func (a *app) RetrieveObservation(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+	observation, err := a.db.GetObservation(kind, entityId)
+	if err != nil {
+		return nil, err
+	}
+
+	a.addAirQualityIndex(observation)
+
+	return observation, nil
+}
+
+//RetrieveObservations returns the observations, optionally of a single device, that were made
+//within a time span and match the options, the most recent first
+func (a *app) RetrieveObservations(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+	observations, err := a.db.GetObservations(kind, deviceId, from, to, limit, options...)
 	if err != nil {
 		return nil, err
 	}
-	return results, err
+
+	for _, o := range observations {
+		a.addAirQualityIndex(o)
+	}
+
+	return observations, nil
+}
+
+//addAirQualityIndex derives the air quality index and level of an air quality observation from
+//the observed pollutants
+func (a *app) addAirQualityIndex(observation database.Observation) {
+	if aqo, ok := observation.(*models.AirQualityObserved); ok && a.aqi != nil {
+		aqo.AirQualityIndex, aqo.AirQualityLevel = a.aqi.Calculate(aqo.AirQualityMeasurements)
+	}
+}
+
+//RetrieveAggregatedObservations returns the aggregated measurements of the matching entities,
+//grouped into periods of the requested length
+func (a *app) RetrieveAggregatedObservations(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+	return a.db.GetAggregatedObservations(kind, deviceId, from, to, period, options...)
+}
+
+//validatePosition makes sure that a position is within the valid ranges of WGS84
+func validatePosition(latitude, longitude float64) error {
+	if latitude < -90.0 || latitude > 90.0 {
+		return fmt.Errorf("latitude %f is outside the valid range [-90, 90]", latitude)
+	}
+
+	if longitude < -180.0 || longitude > 180.0 {
+		return fmt.Errorf("longitude %f is outside the valid range [-180, 180]", longitude)
+	}
+
+	return nil
 }
@@ -4,6 +4,7 @@
 package application
 
 import (
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
 	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
 	"sync"
 	"time"
@@ -19,11 +20,59 @@ var _ EnvironmentApp = &EnvironmentAppMock{}
 //
 // 		// make and configure a mocked EnvironmentApp
 // 		mockedEnvironmentApp := &EnvironmentAppMock{
-// 			RetrieveAirQualityObservedsFunc: func(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-// 				panic("mock out the RetrieveAirQualityObserveds method")
+// 			CreateSubscriptionFunc: func(subscription Subscription) (string, error) {
+// 				panic("mock out the CreateSubscription method")
 // 			},
-// 			StoreAirQualityObservedFunc: func(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) error {
-// 				panic("mock out the StoreAirQualityObserved method")
+// 			DeleteMeasurementFunc: func(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error {
+// 				panic("mock out the DeleteMeasurement method")
+// 			},
+// 			DeleteObservationsFunc: func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+// 				panic("mock out the DeleteObservations method")
+// 			},
+// 			DeleteObservationsOfDeviceFunc: func(deviceId string, from time.Time, to time.Time, purge bool) (int64, error) {
+// 				panic("mock out the DeleteObservationsOfDevice method")
+// 			},
+// 			DeleteSubscriptionFunc: func(id string) error {
+// 				panic("mock out the DeleteSubscription method")
+// 			},
+// 			RetrieveAggregatedObservationsFunc: func(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+// 				panic("mock out the RetrieveAggregatedObservations method")
+// 			},
+// 			RetrieveAlertsFunc: func(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+// 				panic("mock out the RetrieveAlerts method")
+// 			},
+// 			RetrieveDeviceStatusesFunc: func() ([]DeviceStatus, error) {
+// 				panic("mock out the RetrieveDeviceStatuses method")
+// 			},
+// 			RetrieveObservationFunc: func(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+// 				panic("mock out the RetrieveObservation method")
+// 			},
+// 			RetrieveObservationsFunc: func(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+// 				panic("mock out the RetrieveObservations method")
+// 			},
+// 			RetrieveReportingGapsFunc: func(deviceId string, from time.Time, to time.Time) ([]DeviceGaps, error) {
+// 				panic("mock out the RetrieveReportingGaps method")
+// 			},
+// 			RetrieveSubscriptionFunc: func(id string) (*Subscription, error) {
+// 				panic("mock out the RetrieveSubscription method")
+// 			},
+// 			RetrieveSubscriptionsFunc: func() ([]Subscription, error) {
+// 				panic("mock out the RetrieveSubscriptions method")
+// 			},
+// 			StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+// 				panic("mock out the StoreObservation method")
+// 			},
+// 			StoreObservationsFunc: func(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+// 				panic("mock out the StoreObservations method")
+// 			},
+// 			UpdateExpectedReportingIntervalFunc: func(deviceId string, interval time.Duration) error {
+// 				panic("mock out the UpdateExpectedReportingInterval method")
+// 			},
+// 			UpdateObservationFunc: func(kind *database.ObservationKind, entityId string, update ObservationUpdate) error {
+// 				panic("mock out the UpdateObservation method")
+// 			},
+// 			UpdateSubscriptionFunc: func(subscription Subscription) error {
+// 				panic("mock out the UpdateSubscription method")
 // 			},
 // 		}
 //
@@ -32,135 +81,905 @@ var _ EnvironmentApp = &EnvironmentAppMock{}
 //
 // 	}
 type EnvironmentAppMock struct {
-	// RetrieveAirQualityObservedsFunc mocks the RetrieveAirQualityObserveds method.
-	RetrieveAirQualityObservedsFunc func(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error)
+	// CreateSubscriptionFunc mocks the CreateSubscription method.
+	CreateSubscriptionFunc func(subscription Subscription) (string, error)
+
+	// DeleteMeasurementFunc mocks the DeleteMeasurement method.
+	DeleteMeasurementFunc func(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error
+
+	// DeleteObservationsFunc mocks the DeleteObservations method.
+	DeleteObservationsFunc func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error)
+
+	// DeleteObservationsOfDeviceFunc mocks the DeleteObservationsOfDevice method.
+	DeleteObservationsOfDeviceFunc func(deviceId string, from time.Time, to time.Time, purge bool) (int64, error)
+
+	// DeleteSubscriptionFunc mocks the DeleteSubscription method.
+	DeleteSubscriptionFunc func(id string) error
+
+	// RetrieveAggregatedObservationsFunc mocks the RetrieveAggregatedObservations method.
+	RetrieveAggregatedObservationsFunc func(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error)
 
-	// StoreAirQualityObservedFunc mocks the StoreAirQualityObserved method.
-	StoreAirQualityObservedFunc func(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) error
+	// RetrieveAlertsFunc mocks the RetrieveAlerts method.
+	RetrieveAlertsFunc func(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error)
+
+	// RetrieveDeviceStatusesFunc mocks the RetrieveDeviceStatuses method.
+	RetrieveDeviceStatusesFunc func() ([]DeviceStatus, error)
+
+	// RetrieveObservationFunc mocks the RetrieveObservation method.
+	RetrieveObservationFunc func(kind *database.ObservationKind, entityId string) (database.Observation, error)
+
+	// RetrieveObservationsFunc mocks the RetrieveObservations method.
+	RetrieveObservationsFunc func(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error)
+
+	// RetrieveReportingGapsFunc mocks the RetrieveReportingGaps method.
+	RetrieveReportingGapsFunc func(deviceId string, from time.Time, to time.Time) ([]DeviceGaps, error)
+
+	// RetrieveSubscriptionFunc mocks the RetrieveSubscription method.
+	RetrieveSubscriptionFunc func(id string) (*Subscription, error)
+
+	// RetrieveSubscriptionsFunc mocks the RetrieveSubscriptions method.
+	RetrieveSubscriptionsFunc func() ([]Subscription, error)
+
+	// StoreObservationFunc mocks the StoreObservation method.
+	StoreObservationFunc func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error)
+
+	// StoreObservationsFunc mocks the StoreObservations method.
+	StoreObservationsFunc func(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error)
+
+	// UpdateExpectedReportingIntervalFunc mocks the UpdateExpectedReportingInterval method.
+	UpdateExpectedReportingIntervalFunc func(deviceId string, interval time.Duration) error
+
+	// UpdateObservationFunc mocks the UpdateObservation method.
+	UpdateObservationFunc func(kind *database.ObservationKind, entityId string, update ObservationUpdate) error
+
+	// UpdateSubscriptionFunc mocks the UpdateSubscription method.
+	UpdateSubscriptionFunc func(subscription Subscription) error
 
 	// calls tracks calls to the methods.
 	calls struct {
-		// RetrieveAirQualityObserveds holds details about calls to the RetrieveAirQualityObserveds method.
-		RetrieveAirQualityObserveds []struct {
+		// CreateSubscription holds details about calls to the CreateSubscription method.
+		CreateSubscription []struct {
+			// Subscription is the subscription argument value.
+			Subscription Subscription
+		}
+		// DeleteMeasurement holds details about calls to the DeleteMeasurement method.
+		DeleteMeasurement []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// EntityId is the entityId argument value.
+			EntityId string
+			// InstanceId is the instanceId argument value.
+			InstanceId uint
+			// Column is the column argument value.
+			Column string
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteObservations holds details about calls to the DeleteObservations method.
+		DeleteObservations []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// EntityIds is the entityIds argument value.
+			EntityIds []string
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteObservationsOfDevice holds details about calls to the DeleteObservationsOfDevice method.
+		DeleteObservationsOfDevice []struct {
 			// DeviceId is the deviceId argument value.
 			DeviceId string
 			// From is the from argument value.
 			From time.Time
 			// To is the to argument value.
 			To time.Time
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteSubscription holds details about calls to the DeleteSubscription method.
+		DeleteSubscription []struct {
+			// ID is the id argument value.
+			ID string
+		}
+		// RetrieveAggregatedObservations holds details about calls to the RetrieveAggregatedObservations method.
+		RetrieveAggregatedObservations []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// Period is the period argument value.
+			Period database.AggregationPeriod
+			// Options is the options argument value.
+			Options []database.QueryOption
+		}
+		// RetrieveAlerts holds details about calls to the RetrieveAlerts method.
+		RetrieveAlerts []struct {
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// ActiveOnly is the activeOnly argument value.
+			ActiveOnly bool
 			// Limit is the limit argument value.
 			Limit uint64
 		}
-		// StoreAirQualityObserved holds details about calls to the StoreAirQualityObserved method.
-		StoreAirQualityObserved []struct {
+		// RetrieveDeviceStatuses holds details about calls to the RetrieveDeviceStatuses method.
+		RetrieveDeviceStatuses []struct {
+		}
+		// RetrieveObservation holds details about calls to the RetrieveObservation method.
+		RetrieveObservation []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
 			// EntityId is the entityId argument value.
 			EntityId string
+		}
+		// RetrieveObservations holds details about calls to the RetrieveObservations method.
+		RetrieveObservations []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// Limit is the limit argument value.
+			Limit uint64
+			// Options is the options argument value.
+			Options []database.QueryOption
+		}
+		// RetrieveReportingGaps holds details about calls to the RetrieveReportingGaps method.
+		RetrieveReportingGaps []struct {
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+		}
+		// RetrieveSubscription holds details about calls to the RetrieveSubscription method.
+		RetrieveSubscription []struct {
+			// ID is the id argument value.
+			ID string
+		}
+		// RetrieveSubscriptions holds details about calls to the RetrieveSubscriptions method.
+		RetrieveSubscriptions []struct {
+		}
+		// StoreObservation holds details about calls to the StoreObservation method.
+		StoreObservation []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// Observation is the observation argument value.
+			Observation database.Observation
+		}
+		// StoreObservations holds details about calls to the StoreObservations method.
+		StoreObservations []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// Observations is the observations argument value.
+			Observations []database.Observation
+			// Upsert is the upsert argument value.
+			Upsert bool
+		}
+		// UpdateExpectedReportingInterval holds details about calls to the UpdateExpectedReportingInterval method.
+		UpdateExpectedReportingInterval []struct {
 			// DeviceId is the deviceId argument value.
 			DeviceId string
-			// Co2 is the co2 argument value.
-			Co2 float64
-			// Humidity is the humidity argument value.
-			Humidity float64
-			// Temperature is the temperature argument value.
-			Temperature float64
-			// Timestamp is the timestamp argument value.
-			Timestamp time.Time
+			// Interval is the interval argument value.
+			Interval time.Duration
+		}
+		// UpdateObservation holds details about calls to the UpdateObservation method.
+		UpdateObservation []struct {
+			// Kind is the kind argument value.
+			Kind *database.ObservationKind
+			// EntityId is the entityId argument value.
+			EntityId string
+			// Update is the update argument value.
+			Update ObservationUpdate
+		}
+		// UpdateSubscription holds details about calls to the UpdateSubscription method.
+		UpdateSubscription []struct {
+			// Subscription is the subscription argument value.
+			Subscription Subscription
 		}
 	}
-	lockRetrieveAirQualityObserveds sync.RWMutex
-	lockStoreAirQualityObserved     sync.RWMutex
+	lockCreateSubscription              sync.RWMutex
+	lockDeleteMeasurement               sync.RWMutex
+	lockDeleteObservations              sync.RWMutex
+	lockDeleteObservationsOfDevice      sync.RWMutex
+	lockDeleteSubscription              sync.RWMutex
+	lockRetrieveAggregatedObservations  sync.RWMutex
+	lockRetrieveAlerts                  sync.RWMutex
+	lockRetrieveDeviceStatuses          sync.RWMutex
+	lockRetrieveObservation             sync.RWMutex
+	lockRetrieveObservations            sync.RWMutex
+	lockRetrieveReportingGaps           sync.RWMutex
+	lockRetrieveSubscription            sync.RWMutex
+	lockRetrieveSubscriptions           sync.RWMutex
+	lockStoreObservation                sync.RWMutex
+	lockStoreObservations               sync.RWMutex
+	lockUpdateExpectedReportingInterval sync.RWMutex
+	lockUpdateObservation               sync.RWMutex
+	lockUpdateSubscription              sync.RWMutex
+}
+
+// CreateSubscription calls CreateSubscriptionFunc.
+func (mock *EnvironmentAppMock) CreateSubscription(subscription Subscription) (string, error) {
+	if mock.CreateSubscriptionFunc == nil {
+		panic("EnvironmentAppMock.CreateSubscriptionFunc: method is nil but EnvironmentApp.CreateSubscription was just called")
+	}
+	callInfo := struct {
+		Subscription Subscription
+	}{
+		Subscription: subscription,
+	}
+	mock.lockCreateSubscription.Lock()
+	mock.calls.CreateSubscription = append(mock.calls.CreateSubscription, callInfo)
+	mock.lockCreateSubscription.Unlock()
+	return mock.CreateSubscriptionFunc(subscription)
+}
+
+// CreateSubscriptionCalls gets all the calls that were made to CreateSubscription.
+// Check the length with:
+//     len(mockedEnvironmentApp.CreateSubscriptionCalls())
+func (mock *EnvironmentAppMock) CreateSubscriptionCalls() []struct {
+	Subscription Subscription
+} {
+	var calls []struct {
+		Subscription Subscription
+	}
+	mock.lockCreateSubscription.RLock()
+	calls = mock.calls.CreateSubscription
+	mock.lockCreateSubscription.RUnlock()
+	return calls
+}
+
+// DeleteMeasurement calls DeleteMeasurementFunc.
+func (mock *EnvironmentAppMock) DeleteMeasurement(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error {
+	if mock.DeleteMeasurementFunc == nil {
+		panic("EnvironmentAppMock.DeleteMeasurementFunc: method is nil but EnvironmentApp.DeleteMeasurement was just called")
+	}
+	callInfo := struct {
+		Kind       *database.ObservationKind
+		EntityId   string
+		InstanceId uint
+		Column     string
+		Purge      bool
+	}{
+		Kind:       kind,
+		EntityId:   entityId,
+		InstanceId: instanceId,
+		Column:     column,
+		Purge:      purge,
+	}
+	mock.lockDeleteMeasurement.Lock()
+	mock.calls.DeleteMeasurement = append(mock.calls.DeleteMeasurement, callInfo)
+	mock.lockDeleteMeasurement.Unlock()
+	return mock.DeleteMeasurementFunc(kind, entityId, instanceId, column, purge)
+}
+
+// DeleteMeasurementCalls gets all the calls that were made to DeleteMeasurement.
+// Check the length with:
+//     len(mockedEnvironmentApp.DeleteMeasurementCalls())
+func (mock *EnvironmentAppMock) DeleteMeasurementCalls() []struct {
+	Kind       *database.ObservationKind
+	EntityId   string
+	InstanceId uint
+	Column     string
+	Purge      bool
+} {
+	var calls []struct {
+		Kind       *database.ObservationKind
+		EntityId   string
+		InstanceId uint
+		Column     string
+		Purge      bool
+	}
+	mock.lockDeleteMeasurement.RLock()
+	calls = mock.calls.DeleteMeasurement
+	mock.lockDeleteMeasurement.RUnlock()
+	return calls
+}
+
+// DeleteObservations calls DeleteObservationsFunc.
+func (mock *EnvironmentAppMock) DeleteObservations(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+	if mock.DeleteObservationsFunc == nil {
+		panic("EnvironmentAppMock.DeleteObservationsFunc: method is nil but EnvironmentApp.DeleteObservations was just called")
+	}
+	callInfo := struct {
+		Kind      *database.ObservationKind
+		EntityIds []string
+		Purge     bool
+	}{
+		Kind:      kind,
+		EntityIds: entityIds,
+		Purge:     purge,
+	}
+	mock.lockDeleteObservations.Lock()
+	mock.calls.DeleteObservations = append(mock.calls.DeleteObservations, callInfo)
+	mock.lockDeleteObservations.Unlock()
+	return mock.DeleteObservationsFunc(kind, entityIds, purge)
+}
+
+// DeleteObservationsCalls gets all the calls that were made to DeleteObservations.
+// Check the length with:
+//     len(mockedEnvironmentApp.DeleteObservationsCalls())
+func (mock *EnvironmentAppMock) DeleteObservationsCalls() []struct {
+	Kind      *database.ObservationKind
+	EntityIds []string
+	Purge     bool
+} {
+	var calls []struct {
+		Kind      *database.ObservationKind
+		EntityIds []string
+		Purge     bool
+	}
+	mock.lockDeleteObservations.RLock()
+	calls = mock.calls.DeleteObservations
+	mock.lockDeleteObservations.RUnlock()
+	return calls
+}
+
+// DeleteObservationsOfDevice calls DeleteObservationsOfDeviceFunc.
+func (mock *EnvironmentAppMock) DeleteObservationsOfDevice(deviceId string, from time.Time, to time.Time, purge bool) (int64, error) {
+	if mock.DeleteObservationsOfDeviceFunc == nil {
+		panic("EnvironmentAppMock.DeleteObservationsOfDeviceFunc: method is nil but EnvironmentApp.DeleteObservationsOfDevice was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Purge    bool
+	}{
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+		Purge:    purge,
+	}
+	mock.lockDeleteObservationsOfDevice.Lock()
+	mock.calls.DeleteObservationsOfDevice = append(mock.calls.DeleteObservationsOfDevice, callInfo)
+	mock.lockDeleteObservationsOfDevice.Unlock()
+	return mock.DeleteObservationsOfDeviceFunc(deviceId, from, to, purge)
+}
+
+// DeleteObservationsOfDeviceCalls gets all the calls that were made to DeleteObservationsOfDevice.
+// Check the length with:
+//     len(mockedEnvironmentApp.DeleteObservationsOfDeviceCalls())
+func (mock *EnvironmentAppMock) DeleteObservationsOfDeviceCalls() []struct {
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	Purge    bool
+} {
+	var calls []struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Purge    bool
+	}
+	mock.lockDeleteObservationsOfDevice.RLock()
+	calls = mock.calls.DeleteObservationsOfDevice
+	mock.lockDeleteObservationsOfDevice.RUnlock()
+	return calls
+}
+
+// DeleteSubscription calls DeleteSubscriptionFunc.
+func (mock *EnvironmentAppMock) DeleteSubscription(id string) error {
+	if mock.DeleteSubscriptionFunc == nil {
+		panic("EnvironmentAppMock.DeleteSubscriptionFunc: method is nil but EnvironmentApp.DeleteSubscription was just called")
+	}
+	callInfo := struct {
+		ID string
+	}{
+		ID: id,
+	}
+	mock.lockDeleteSubscription.Lock()
+	mock.calls.DeleteSubscription = append(mock.calls.DeleteSubscription, callInfo)
+	mock.lockDeleteSubscription.Unlock()
+	return mock.DeleteSubscriptionFunc(id)
+}
+
+// DeleteSubscriptionCalls gets all the calls that were made to DeleteSubscription.
+// Check the length with:
+//     len(mockedEnvironmentApp.DeleteSubscriptionCalls())
+func (mock *EnvironmentAppMock) DeleteSubscriptionCalls() []struct {
+	ID string
+} {
+	var calls []struct {
+		ID string
+	}
+	mock.lockDeleteSubscription.RLock()
+	calls = mock.calls.DeleteSubscription
+	mock.lockDeleteSubscription.RUnlock()
+	return calls
+}
+
+// RetrieveAggregatedObservations calls RetrieveAggregatedObservationsFunc.
+func (mock *EnvironmentAppMock) RetrieveAggregatedObservations(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+	if mock.RetrieveAggregatedObservationsFunc == nil {
+		panic("EnvironmentAppMock.RetrieveAggregatedObservationsFunc: method is nil but EnvironmentApp.RetrieveAggregatedObservations was just called")
+	}
+	callInfo := struct {
+		Kind     *database.ObservationKind
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Period   database.AggregationPeriod
+		Options  []database.QueryOption
+	}{
+		Kind:     kind,
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+		Period:   period,
+		Options:  options,
+	}
+	mock.lockRetrieveAggregatedObservations.Lock()
+	mock.calls.RetrieveAggregatedObservations = append(mock.calls.RetrieveAggregatedObservations, callInfo)
+	mock.lockRetrieveAggregatedObservations.Unlock()
+	return mock.RetrieveAggregatedObservationsFunc(kind, deviceId, from, to, period, options...)
 }
 
-// RetrieveAirQualityObserveds calls RetrieveAirQualityObservedsFunc.
-func (mock *EnvironmentAppMock) RetrieveAirQualityObserveds(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-	if mock.RetrieveAirQualityObservedsFunc == nil {
-		panic("EnvironmentAppMock.RetrieveAirQualityObservedsFunc: method is nil but EnvironmentApp.RetrieveAirQualityObserveds was just called")
+// RetrieveAggregatedObservationsCalls gets all the calls that were made to RetrieveAggregatedObservations.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveAggregatedObservationsCalls())
+func (mock *EnvironmentAppMock) RetrieveAggregatedObservationsCalls() []struct {
+	Kind     *database.ObservationKind
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	Period   database.AggregationPeriod
+	Options  []database.QueryOption
+} {
+	var calls []struct {
+		Kind     *database.ObservationKind
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Period   database.AggregationPeriod
+		Options  []database.QueryOption
+	}
+	mock.lockRetrieveAggregatedObservations.RLock()
+	calls = mock.calls.RetrieveAggregatedObservations
+	mock.lockRetrieveAggregatedObservations.RUnlock()
+	return calls
+}
+
+// RetrieveAlerts calls RetrieveAlertsFunc.
+func (mock *EnvironmentAppMock) RetrieveAlerts(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+	if mock.RetrieveAlertsFunc == nil {
+		panic("EnvironmentAppMock.RetrieveAlertsFunc: method is nil but EnvironmentApp.RetrieveAlerts was just called")
 	}
 	callInfo := struct {
+		DeviceId   string
+		From       time.Time
+		To         time.Time
+		ActiveOnly bool
+		Limit      uint64
+	}{
+		DeviceId:   deviceId,
+		From:       from,
+		To:         to,
+		ActiveOnly: activeOnly,
+		Limit:      limit,
+	}
+	mock.lockRetrieveAlerts.Lock()
+	mock.calls.RetrieveAlerts = append(mock.calls.RetrieveAlerts, callInfo)
+	mock.lockRetrieveAlerts.Unlock()
+	return mock.RetrieveAlertsFunc(deviceId, from, to, activeOnly, limit)
+}
+
+// RetrieveAlertsCalls gets all the calls that were made to RetrieveAlerts.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveAlertsCalls())
+func (mock *EnvironmentAppMock) RetrieveAlertsCalls() []struct {
+	DeviceId   string
+	From       time.Time
+	To         time.Time
+	ActiveOnly bool
+	Limit      uint64
+} {
+	var calls []struct {
+		DeviceId   string
+		From       time.Time
+		To         time.Time
+		ActiveOnly bool
+		Limit      uint64
+	}
+	mock.lockRetrieveAlerts.RLock()
+	calls = mock.calls.RetrieveAlerts
+	mock.lockRetrieveAlerts.RUnlock()
+	return calls
+}
+
+// RetrieveDeviceStatuses calls RetrieveDeviceStatusesFunc.
+func (mock *EnvironmentAppMock) RetrieveDeviceStatuses() ([]DeviceStatus, error) {
+	if mock.RetrieveDeviceStatusesFunc == nil {
+		panic("EnvironmentAppMock.RetrieveDeviceStatusesFunc: method is nil but EnvironmentApp.RetrieveDeviceStatuses was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockRetrieveDeviceStatuses.Lock()
+	mock.calls.RetrieveDeviceStatuses = append(mock.calls.RetrieveDeviceStatuses, callInfo)
+	mock.lockRetrieveDeviceStatuses.Unlock()
+	return mock.RetrieveDeviceStatusesFunc()
+}
+
+// RetrieveDeviceStatusesCalls gets all the calls that were made to RetrieveDeviceStatuses.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveDeviceStatusesCalls())
+func (mock *EnvironmentAppMock) RetrieveDeviceStatusesCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockRetrieveDeviceStatuses.RLock()
+	calls = mock.calls.RetrieveDeviceStatuses
+	mock.lockRetrieveDeviceStatuses.RUnlock()
+	return calls
+}
+
+// RetrieveObservation calls RetrieveObservationFunc.
+func (mock *EnvironmentAppMock) RetrieveObservation(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+	if mock.RetrieveObservationFunc == nil {
+		panic("EnvironmentAppMock.RetrieveObservationFunc: method is nil but EnvironmentApp.RetrieveObservation was just called")
+	}
+	callInfo := struct {
+		Kind     *database.ObservationKind
+		EntityId string
+	}{
+		Kind:     kind,
+		EntityId: entityId,
+	}
+	mock.lockRetrieveObservation.Lock()
+	mock.calls.RetrieveObservation = append(mock.calls.RetrieveObservation, callInfo)
+	mock.lockRetrieveObservation.Unlock()
+	return mock.RetrieveObservationFunc(kind, entityId)
+}
+
+// RetrieveObservationCalls gets all the calls that were made to RetrieveObservation.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveObservationCalls())
+func (mock *EnvironmentAppMock) RetrieveObservationCalls() []struct {
+	Kind     *database.ObservationKind
+	EntityId string
+} {
+	var calls []struct {
+		Kind     *database.ObservationKind
+		EntityId string
+	}
+	mock.lockRetrieveObservation.RLock()
+	calls = mock.calls.RetrieveObservation
+	mock.lockRetrieveObservation.RUnlock()
+	return calls
+}
+
+// RetrieveObservations calls RetrieveObservationsFunc.
+func (mock *EnvironmentAppMock) RetrieveObservations(kind *database.ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+	if mock.RetrieveObservationsFunc == nil {
+		panic("EnvironmentAppMock.RetrieveObservationsFunc: method is nil but EnvironmentApp.RetrieveObservations was just called")
+	}
+	callInfo := struct {
+		Kind     *database.ObservationKind
 		DeviceId string
 		From     time.Time
 		To       time.Time
 		Limit    uint64
+		Options  []database.QueryOption
 	}{
+		Kind:     kind,
 		DeviceId: deviceId,
 		From:     from,
 		To:       to,
 		Limit:    limit,
+		Options:  options,
 	}
-	mock.lockRetrieveAirQualityObserveds.Lock()
-	mock.calls.RetrieveAirQualityObserveds = append(mock.calls.RetrieveAirQualityObserveds, callInfo)
-	mock.lockRetrieveAirQualityObserveds.Unlock()
-	return mock.RetrieveAirQualityObservedsFunc(deviceId, from, to, limit)
+	mock.lockRetrieveObservations.Lock()
+	mock.calls.RetrieveObservations = append(mock.calls.RetrieveObservations, callInfo)
+	mock.lockRetrieveObservations.Unlock()
+	return mock.RetrieveObservationsFunc(kind, deviceId, from, to, limit, options...)
 }
 
-// RetrieveAirQualityObservedsCalls gets all the calls that were made to RetrieveAirQualityObserveds.
+// RetrieveObservationsCalls gets all the calls that were made to RetrieveObservations.
 // Check the length with:
-//     len(mockedEnvironmentApp.RetrieveAirQualityObservedsCalls())
-func (mock *EnvironmentAppMock) RetrieveAirQualityObservedsCalls() []struct {
+//     len(mockedEnvironmentApp.RetrieveObservationsCalls())
+func (mock *EnvironmentAppMock) RetrieveObservationsCalls() []struct {
+	Kind     *database.ObservationKind
 	DeviceId string
 	From     time.Time
 	To       time.Time
 	Limit    uint64
+	Options  []database.QueryOption
 } {
 	var calls []struct {
+		Kind     *database.ObservationKind
 		DeviceId string
 		From     time.Time
 		To       time.Time
 		Limit    uint64
+		Options  []database.QueryOption
+	}
+	mock.lockRetrieveObservations.RLock()
+	calls = mock.calls.RetrieveObservations
+	mock.lockRetrieveObservations.RUnlock()
+	return calls
+}
+
+// RetrieveReportingGaps calls RetrieveReportingGapsFunc.
+func (mock *EnvironmentAppMock) RetrieveReportingGaps(deviceId string, from time.Time, to time.Time) ([]DeviceGaps, error) {
+	if mock.RetrieveReportingGapsFunc == nil {
+		panic("EnvironmentAppMock.RetrieveReportingGapsFunc: method is nil but EnvironmentApp.RetrieveReportingGaps was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+	}{
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+	}
+	mock.lockRetrieveReportingGaps.Lock()
+	mock.calls.RetrieveReportingGaps = append(mock.calls.RetrieveReportingGaps, callInfo)
+	mock.lockRetrieveReportingGaps.Unlock()
+	return mock.RetrieveReportingGapsFunc(deviceId, from, to)
+}
+
+// RetrieveReportingGapsCalls gets all the calls that were made to RetrieveReportingGaps.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveReportingGapsCalls())
+func (mock *EnvironmentAppMock) RetrieveReportingGapsCalls() []struct {
+	DeviceId string
+	From     time.Time
+	To       time.Time
+} {
+	var calls []struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+	}
+	mock.lockRetrieveReportingGaps.RLock()
+	calls = mock.calls.RetrieveReportingGaps
+	mock.lockRetrieveReportingGaps.RUnlock()
+	return calls
+}
+
+// RetrieveSubscription calls RetrieveSubscriptionFunc.
+func (mock *EnvironmentAppMock) RetrieveSubscription(id string) (*Subscription, error) {
+	if mock.RetrieveSubscriptionFunc == nil {
+		panic("EnvironmentAppMock.RetrieveSubscriptionFunc: method is nil but EnvironmentApp.RetrieveSubscription was just called")
+	}
+	callInfo := struct {
+		ID string
+	}{
+		ID: id,
+	}
+	mock.lockRetrieveSubscription.Lock()
+	mock.calls.RetrieveSubscription = append(mock.calls.RetrieveSubscription, callInfo)
+	mock.lockRetrieveSubscription.Unlock()
+	return mock.RetrieveSubscriptionFunc(id)
+}
+
+// RetrieveSubscriptionCalls gets all the calls that were made to RetrieveSubscription.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveSubscriptionCalls())
+func (mock *EnvironmentAppMock) RetrieveSubscriptionCalls() []struct {
+	ID string
+} {
+	var calls []struct {
+		ID string
+	}
+	mock.lockRetrieveSubscription.RLock()
+	calls = mock.calls.RetrieveSubscription
+	mock.lockRetrieveSubscription.RUnlock()
+	return calls
+}
+
+// RetrieveSubscriptions calls RetrieveSubscriptionsFunc.
+func (mock *EnvironmentAppMock) RetrieveSubscriptions() ([]Subscription, error) {
+	if mock.RetrieveSubscriptionsFunc == nil {
+		panic("EnvironmentAppMock.RetrieveSubscriptionsFunc: method is nil but EnvironmentApp.RetrieveSubscriptions was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockRetrieveSubscriptions.Lock()
+	mock.calls.RetrieveSubscriptions = append(mock.calls.RetrieveSubscriptions, callInfo)
+	mock.lockRetrieveSubscriptions.Unlock()
+	return mock.RetrieveSubscriptionsFunc()
+}
+
+// RetrieveSubscriptionsCalls gets all the calls that were made to RetrieveSubscriptions.
+// Check the length with:
+//     len(mockedEnvironmentApp.RetrieveSubscriptionsCalls())
+func (mock *EnvironmentAppMock) RetrieveSubscriptionsCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockRetrieveSubscriptions.RLock()
+	calls = mock.calls.RetrieveSubscriptions
+	mock.lockRetrieveSubscriptions.RUnlock()
+	return calls
+}
+
+// StoreObservation calls StoreObservationFunc.
+func (mock *EnvironmentAppMock) StoreObservation(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+	if mock.StoreObservationFunc == nil {
+		panic("EnvironmentAppMock.StoreObservationFunc: method is nil but EnvironmentApp.StoreObservation was just called")
+	}
+	callInfo := struct {
+		Kind        *database.ObservationKind
+		Observation database.Observation
+	}{
+		Kind:        kind,
+		Observation: observation,
+	}
+	mock.lockStoreObservation.Lock()
+	mock.calls.StoreObservation = append(mock.calls.StoreObservation, callInfo)
+	mock.lockStoreObservation.Unlock()
+	return mock.StoreObservationFunc(kind, observation)
+}
+
+// StoreObservationCalls gets all the calls that were made to StoreObservation.
+// Check the length with:
+//     len(mockedEnvironmentApp.StoreObservationCalls())
+func (mock *EnvironmentAppMock) StoreObservationCalls() []struct {
+	Kind        *database.ObservationKind
+	Observation database.Observation
+} {
+	var calls []struct {
+		Kind        *database.ObservationKind
+		Observation database.Observation
+	}
+	mock.lockStoreObservation.RLock()
+	calls = mock.calls.StoreObservation
+	mock.lockStoreObservation.RUnlock()
+	return calls
+}
+
+// StoreObservations calls StoreObservationsFunc.
+func (mock *EnvironmentAppMock) StoreObservations(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+	if mock.StoreObservationsFunc == nil {
+		panic("EnvironmentAppMock.StoreObservationsFunc: method is nil but EnvironmentApp.StoreObservations was just called")
+	}
+	callInfo := struct {
+		Kind         *database.ObservationKind
+		Observations []database.Observation
+		Upsert       bool
+	}{
+		Kind:         kind,
+		Observations: observations,
+		Upsert:       upsert,
+	}
+	mock.lockStoreObservations.Lock()
+	mock.calls.StoreObservations = append(mock.calls.StoreObservations, callInfo)
+	mock.lockStoreObservations.Unlock()
+	return mock.StoreObservationsFunc(kind, observations, upsert)
+}
+
+// StoreObservationsCalls gets all the calls that were made to StoreObservations.
+// Check the length with:
+//     len(mockedEnvironmentApp.StoreObservationsCalls())
+func (mock *EnvironmentAppMock) StoreObservationsCalls() []struct {
+	Kind         *database.ObservationKind
+	Observations []database.Observation
+	Upsert       bool
+} {
+	var calls []struct {
+		Kind         *database.ObservationKind
+		Observations []database.Observation
+		Upsert       bool
+	}
+	mock.lockStoreObservations.RLock()
+	calls = mock.calls.StoreObservations
+	mock.lockStoreObservations.RUnlock()
+	return calls
+}
+
+// UpdateExpectedReportingInterval calls UpdateExpectedReportingIntervalFunc.
+func (mock *EnvironmentAppMock) UpdateExpectedReportingInterval(deviceId string, interval time.Duration) error {
+	if mock.UpdateExpectedReportingIntervalFunc == nil {
+		panic("EnvironmentAppMock.UpdateExpectedReportingIntervalFunc: method is nil but EnvironmentApp.UpdateExpectedReportingInterval was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		Interval time.Duration
+	}{
+		DeviceId: deviceId,
+		Interval: interval,
+	}
+	mock.lockUpdateExpectedReportingInterval.Lock()
+	mock.calls.UpdateExpectedReportingInterval = append(mock.calls.UpdateExpectedReportingInterval, callInfo)
+	mock.lockUpdateExpectedReportingInterval.Unlock()
+	return mock.UpdateExpectedReportingIntervalFunc(deviceId, interval)
+}
+
+// UpdateExpectedReportingIntervalCalls gets all the calls that were made to UpdateExpectedReportingInterval.
+// Check the length with:
+//     len(mockedEnvironmentApp.UpdateExpectedReportingIntervalCalls())
+func (mock *EnvironmentAppMock) UpdateExpectedReportingIntervalCalls() []struct {
+	DeviceId string
+	Interval time.Duration
+} {
+	var calls []struct {
+		DeviceId string
+		Interval time.Duration
+	}
+	mock.lockUpdateExpectedReportingInterval.RLock()
+	calls = mock.calls.UpdateExpectedReportingInterval
+	mock.lockUpdateExpectedReportingInterval.RUnlock()
+	return calls
+}
+
+// UpdateObservation calls UpdateObservationFunc.
+func (mock *EnvironmentAppMock) UpdateObservation(kind *database.ObservationKind, entityId string, update ObservationUpdate) error {
+	if mock.UpdateObservationFunc == nil {
+		panic("EnvironmentAppMock.UpdateObservationFunc: method is nil but EnvironmentApp.UpdateObservation was just called")
+	}
+	callInfo := struct {
+		Kind     *database.ObservationKind
+		EntityId string
+		Update   ObservationUpdate
+	}{
+		Kind:     kind,
+		EntityId: entityId,
+		Update:   update,
+	}
+	mock.lockUpdateObservation.Lock()
+	mock.calls.UpdateObservation = append(mock.calls.UpdateObservation, callInfo)
+	mock.lockUpdateObservation.Unlock()
+	return mock.UpdateObservationFunc(kind, entityId, update)
+}
+
+// UpdateObservationCalls gets all the calls that were made to UpdateObservation.
+// Check the length with:
+//     len(mockedEnvironmentApp.UpdateObservationCalls())
+func (mock *EnvironmentAppMock) UpdateObservationCalls() []struct {
+	Kind     *database.ObservationKind
+	EntityId string
+	Update   ObservationUpdate
+} {
+	var calls []struct {
+		Kind     *database.ObservationKind
+		EntityId string
+		Update   ObservationUpdate
 	}
-	mock.lockRetrieveAirQualityObserveds.RLock()
-	calls = mock.calls.RetrieveAirQualityObserveds
-	mock.lockRetrieveAirQualityObserveds.RUnlock()
+	mock.lockUpdateObservation.RLock()
+	calls = mock.calls.UpdateObservation
+	mock.lockUpdateObservation.RUnlock()
 	return calls
 }
 
-// StoreAirQualityObserved calls StoreAirQualityObservedFunc.
-func (mock *EnvironmentAppMock) StoreAirQualityObserved(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) error {
-	if mock.StoreAirQualityObservedFunc == nil {
-		panic("EnvironmentAppMock.StoreAirQualityObservedFunc: method is nil but EnvironmentApp.StoreAirQualityObserved was just called")
+// UpdateSubscription calls UpdateSubscriptionFunc.
+func (mock *EnvironmentAppMock) UpdateSubscription(subscription Subscription) error {
+	if mock.UpdateSubscriptionFunc == nil {
+		panic("EnvironmentAppMock.UpdateSubscriptionFunc: method is nil but EnvironmentApp.UpdateSubscription was just called")
 	}
 	callInfo := struct {
-		EntityId    string
-		DeviceId    string
-		Co2         float64
-		Humidity    float64
-		Temperature float64
-		Timestamp   time.Time
+		Subscription Subscription
 	}{
-		EntityId:    entityId,
-		DeviceId:    deviceId,
-		Co2:         co2,
-		Humidity:    humidity,
-		Temperature: temperature,
-		Timestamp:   timestamp,
+		Subscription: subscription,
 	}
-	mock.lockStoreAirQualityObserved.Lock()
-	mock.calls.StoreAirQualityObserved = append(mock.calls.StoreAirQualityObserved, callInfo)
-	mock.lockStoreAirQualityObserved.Unlock()
-	return mock.StoreAirQualityObservedFunc(entityId, deviceId, co2, humidity, temperature, timestamp)
+	mock.lockUpdateSubscription.Lock()
+	mock.calls.UpdateSubscription = append(mock.calls.UpdateSubscription, callInfo)
+	mock.lockUpdateSubscription.Unlock()
+	return mock.UpdateSubscriptionFunc(subscription)
 }
 
-// StoreAirQualityObservedCalls gets all the calls that were made to StoreAirQualityObserved.
+// UpdateSubscriptionCalls gets all the calls that were made to UpdateSubscription.
 // Check the length with:
-//     len(mockedEnvironmentApp.StoreAirQualityObservedCalls())
-func (mock *EnvironmentAppMock) StoreAirQualityObservedCalls() []struct {
-	EntityId    string
-	DeviceId    string
-	Co2         float64
-	Humidity    float64
-	Temperature float64
-	Timestamp   time.Time
+//     len(mockedEnvironmentApp.UpdateSubscriptionCalls())
+func (mock *EnvironmentAppMock) UpdateSubscriptionCalls() []struct {
+	Subscription Subscription
 } {
 	var calls []struct {
-		EntityId    string
-		DeviceId    string
-		Co2         float64
-		Humidity    float64
-		Temperature float64
-		Timestamp   time.Time
+		Subscription Subscription
 	}
-	mock.lockStoreAirQualityObserved.RLock()
-	calls = mock.calls.StoreAirQualityObserved
-	mock.lockStoreAirQualityObserved.RUnlock()
+	mock.lockUpdateSubscription.RLock()
+	calls = mock.calls.UpdateSubscription
+	mock.lockUpdateSubscription.RUnlock()
 	return calls
 }
@@ -1,6 +1,11 @@
 package application
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -12,19 +17,545 @@ import (
 
 func newAppForTesting() (*database.DatastoreMock, EnvironmentApp) {
 	db := &database.DatastoreMock{
-		StoreAirQualityObservedFunc: func(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error) {
-			return nil, nil
+		GetObservationFunc: func(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+			if entityId != "aqoID" {
+				return nil, database.ErrNotFound
+			}
+			co2, temperature := 400.0, 10.0
+			return &models.AirQualityObserved{
+				EntityId:  entityId,
+				DeviceId:  "refDeviceId",
+				Latitude:  62.3908,
+				Longitude: 17.3069,
+				Timestamp: time.Now().UTC().Add(-time.Hour),
+				AirQualityMeasurements: models.AirQualityMeasurements{
+					CO2:         &co2,
+					Temperature: &temperature,
+				},
+			}, nil
+		},
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation, onDuplicate database.DuplicatePolicy) (database.Observation, database.StoreResult, error) {
+			return nil, database.StoreResultCreated, nil
 		},
 	}
 
-	return db, NewEnvironmentApp(db, log.Logger)
+	aqi, _ := NewAQICalculator(AQIScaleCAQI)
+
+	return db, NewEnvironmentApp(db, aqi, database.DuplicatesReject, log.Logger)
 }
 
 func TestStoreAirQuality(t *testing.T) {
 	is := is.New(t)
 	db, app := newAppForTesting()
 
-	err := app.StoreAirQualityObserved("aqoID", "refDeviceId", 0.0, 0.0, 0.0, time.Now().UTC())
+	_, err := app.StoreObservation(database.AirQualityObservedKind, &models.AirQualityObserved{EntityId: "aqoID", DeviceId: "refDeviceId", Latitude: 62.3908, Longitude: 17.3069, Timestamp: time.Now().UTC()})
+	is.NoErr(err)
+	is.Equal(len(db.StoreObservationCalls()), 1)
+	is.Equal(db.StoreObservationCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(db.StoreObservationCalls()[0].OnDuplicate, database.DuplicatesReject) // the configured policy should be used
+
+	latitude, longitude := db.StoreObservationCalls()[0].Observation.Position()
+	is.Equal(latitude, 62.3908)
+	is.Equal(longitude, 17.3069)
+}
+
+func TestStoreAirQualityFailsWithInvalidPosition(t *testing.T) {
+	is := is.New(t)
+	db, app := newAppForTesting()
+
+	_, err := app.StoreObservation(database.AirQualityObservedKind, &models.AirQualityObserved{EntityId: "aqoID", DeviceId: "refDeviceId", Latitude: 17.3069, Longitude: 182.3908, Timestamp: time.Now().UTC()})
+	is.True(err != nil) // longitude outside of valid range should fail
+	is.Equal(len(db.StoreObservationCalls()), 0)
+}
+
+func TestUpdateIsBasedOnTheLatestObservation(t *testing.T) {
+	is := is.New(t)
+	db, app := newAppForTesting()
+
+	now := time.Now().UTC()
+
+	err := app.UpdateObservation(database.AirQualityObservedKind, "aqoID", func(latest database.Observation) (database.Observation, error) {
+		aqo := *latest.(*models.AirQualityObserved)
+		aqo.Timestamp = now
+		return &aqo, nil
+	})
+	is.NoErr(err)
+
+	stored := db.StoreObservationCalls()[0]
+	is.Equal(stored.Observation.(*models.AirQualityObserved).DeviceId, "refDeviceId")
+	is.Equal(*stored.Observation.(*models.AirQualityObserved).CO2, 400.0) // the update should be passed the latest state
+	is.Equal(stored.Observation.(*models.AirQualityObserved).Timestamp, now)
+	is.Equal(stored.OnDuplicate, database.DuplicatesOverwrite) // an update at the same time should replace the observation
+}
+
+func TestUpdateUnknownAirQualityFails(t *testing.T) {
+	is := is.New(t)
+	db, app := newAppForTesting()
+
+	err := app.UpdateObservation(database.AirQualityObservedKind, "unknown", func(latest database.Observation) (database.Observation, error) {
+		return latest, nil
+	})
+	is.True(errors.Is(err, ErrNotFound))
+	is.Equal(len(db.StoreObservationCalls()), 0)
+}
+
+func TestStoreBatchSkipsInvalidPositions(t *testing.T) {
+	is := is.New(t)
+	db, app := newAppForTesting()
+	db.StoreObservationsFunc = func(kind *database.ObservationKind, observations []database.Observation, onDuplicate database.DuplicatePolicy) ([]database.BatchStoreResult, error) {
+		return []database.BatchStoreResult{{Result: database.StoreResultCreated}, {Err: database.ErrDuplicate}}, nil
+	}
+
+	results, err := app.StoreObservations(database.AirQualityObservedKind, []database.Observation{
+		&models.AirQualityObserved{EntityId: "aqo1", Latitude: 62.39, Longitude: 17.30},
+		&models.AirQualityObserved{EntityId: "aqo2", Latitude: 162.39, Longitude: 17.30},
+		&models.AirQualityObserved{EntityId: "aqo3", Latitude: 62.39, Longitude: 17.30},
+	}, true)
+	is.NoErr(err)
+
+	is.Equal(len(db.StoreObservationsCalls()[0].Observations), 2)
+	is.Equal(db.StoreObservationsCalls()[0].OnDuplicate, database.DuplicatesOverwrite) // upserts should always overwrite
+	is.NoErr(results[0].Err)
+	is.True(results[1].Err != nil) // the invalid latitude should be reported
+	is.True(errors.Is(results[2].Err, ErrAlreadyExists))
+}
+
+func TestCAQIUsesTheHighestSubIndex(t *testing.T) {
+	is := is.New(t)
+	aqi, err := NewAQICalculator(AQIScaleCAQI)
+	is.NoErr(err)
+
+	no2, pm10 := 150.0, 20.0
+	index, level := aqi.Calculate(models.AirQualityMeasurements{NO2: &no2, PM10: &pm10})
+	is.Equal(*index, 63.0) // NO2 150 is halfway between 100 (50) and 200 (75)
+	is.Equal(level, "medium")
+
+	no2 = 500.0
+	index, level = aqi.Calculate(models.AirQualityMeasurements{NO2: &no2})
+	is.Equal(*index, 113.0) // concentrations above the grid should be extrapolated
+	is.Equal(level, "veryHigh")
+}
+
+func TestEPAAirQualityIndex(t *testing.T) {
+	is := is.New(t)
+	aqi, err := NewAQICalculator(AQIScaleEPA)
+	is.NoErr(err)
+
+	pm25 := 55.4
+	index, level := aqi.Calculate(models.AirQualityMeasurements{PM25: &pm25})
+	is.Equal(*index, 150.0)
+	is.Equal(level, "unhealthyForSensitiveGroups")
+
+	pm25 = 900.0
+	index, level = aqi.Calculate(models.AirQualityMeasurements{PM25: &pm25})
+	is.Equal(*index, 500.0) // the EPA index should be capped at 500
+	is.Equal(level, "hazardous")
+}
+
+func TestAirQualityIndexRequiresPollutants(t *testing.T) {
+	is := is.New(t)
+	aqi, _ := NewAQICalculator(AQIScaleEPA)
+
+	index, level := aqi.Calculate(models.AirQualityMeasurements{Temperature: float64Ptr(20.0)})
+	is.True(index == nil) // temperature is not part of the index
+	is.Equal(level, "")
+
+	_, err := NewAQICalculator("unknown")
+	is.True(err != nil)
+}
+
+func TestRetrievedAirQualityIncludesIndex(t *testing.T) {
+	is := is.New(t)
+	db, app := newAppForTesting()
+	db.GetObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		return []database.Observation{
+			&models.AirQualityObserved{EntityId: "aqoID", AirQualityMeasurements: models.AirQualityMeasurements{PM10: float64Ptr(50.0)}},
+		}, nil
+	}
+
+	observations, err := app.RetrieveObservations(database.AirQualityObservedKind, "", time.Time{}, time.Time{}, 10)
+	is.NoErr(err)
+
+	aqo := observations[0].(*models.AirQualityObserved)
+	is.Equal(*aqo.AirQualityIndex, 50.0)
+	is.Equal(aqo.AirQualityLevel, "low")
+}
+
+func TestParseRetentionPolicies(t *testing.T) {
+	is := is.New(t)
+
+	policies, err := ParseRetentionPolicies(`{"AirQualityObserved": {"rawTTL": "90d", "downsampleInterval": "1h", "aggregateTTL": "5y"}}`)
+	is.NoErr(err)
+	is.Equal(policies["AirQualityObserved"].RawTTL, 90*24*time.Hour)
+	is.Equal(policies["AirQualityObserved"].DownsampleInterval, time.Hour)
+	is.Equal(policies["AirQualityObserved"].AggregateTTL, 5*365*24*time.Hour)
+
+	_, err = ParseRetentionPolicies(`{"Unknown": {"rawTTL": "90d", "downsampleInterval": "1h"}}`)
+	is.True(err != nil) // unsupported entity types should be rejected
+
+	_, err = ParseRetentionPolicies(`{"AirQualityObserved": {"rawTTL": "90d", "downsampleInterval": "1h", "aggregateTTL": "30d"}}`)
+	is.True(err != nil) // aggregates must be kept at least as long as the raw observations
+}
+
+func TestRetentionWorkerAppliesPolicies(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+	db.ApplyRetentionFunc = func(kind *database.ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (database.RetentionResult, error) {
+		return database.RetentionResult{RolledUp: 10, AggregatesWritten: 2}, nil
+	}
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	worker := NewRetentionWorker(db, DefaultRetentionPolicies(), true, log.Logger)
+	is.NoErr(worker.ApplyPolicies(now))
+
+	call := db.ApplyRetentionCalls()[0]
+	is.Equal(call.Kind, database.AirQualityObservedKind)
+	is.Equal(call.RawBefore, now.AddDate(0, 0, -90))
+	is.Equal(call.Interval, time.Hour)
+	is.True(call.AggregatesBefore.IsZero()) // aggregates should be kept forever by default
+	is.True(call.DryRun)
+	is.Equal(retentionMetrics.Get("AirQualityObserved.dryRun.rolledUpObservations").String(), "10")
+}
+
+func TestSubscriptionsAreNotifiedOfMatchingObservations(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+
+	filter := database.Filter{Attribute: "CO2", Operator: database.FilterGreater, Values: []interface{}{1000.0}}
+	filterJSON, _ := json.Marshal(filter)
+
+	db.GetSubscriptionsFunc = func() ([]models.Subscription, error) {
+		return []models.Subscription{
+			{ID: "co2", EntityType: "AirQualityObserved", WatchedAttributes: "CO2", Filter: string(filterJSON), Endpoint: "http://alerts", Accept: "application/json", IsActive: true, Throttling: 60},
+			{ID: "temperature", EntityType: "AirQualityObserved", WatchedAttributes: "temperature", Endpoint: "http://alerts", IsActive: true},
+			{ID: "beaches", EntityType: "Beach", Endpoint: "http://alerts", IsActive: true},
+			{ID: "paused", EntityType: "AirQualityObserved", Endpoint: "http://alerts", IsActive: false},
+		}, nil
+	}
+	db.StoreObservationFunc = storeAsGiven
+
+	render := func(e interface{}) (map[string]interface{}, error) {
+		aqo := e.(*models.AirQualityObserved)
+		entity := map[string]interface{}{"id": "urn:ngsi-ld:AirQualityObserved:" + aqo.EntityId, "type": "AirQualityObserved", "@context": "ctx"}
+		if aqo.CO2 != nil {
+			entity["CO2"] = map[string]interface{}{"type": "Property", "value": *aqo.CO2}
+		}
+		return entity, nil
+	}
+
+	notifications := []Notification{}
+	notifier := notifierFunc(func(n Notification) { notifications = append(notifications, n) })
+
+	app := NewEnvironmentApp(db, nil, database.DuplicatesReject, log.Logger, WithSubscriptions(render, notifier))
+
+	m := models.AirQualityMeasurements{CO2: float64Ptr(1200.0)}
+	_, err := storeAirQuality(app, "aqo1", "", m, time.Now().UTC())
+	is.NoErr(err)
+	is.Equal(len(notifications), 1)
+	is.Equal(notifications[0].SubscriptionID, "co2")
+	is.Equal(notifications[0].Data[0]["@context"], nil) // the endpoint only accepts plain json
+
+	m = models.AirQualityMeasurements{CO2: float64Ptr(1300.0)}
+	storeAirQuality(app, "aqo1", "", m, time.Now().UTC())
+	is.Equal(len(notifications), 1) // the second notification should be throttled
+
+	m = models.AirQualityMeasurements{CO2: float64Ptr(500.0)}
+	storeAirQuality(app, "aqo2", "", m, time.Now().UTC())
+	is.Equal(len(notifications), 1)              // the q filter should not match
+	is.Equal(len(db.GetSubscriptionsCalls()), 1) // subscriptions should be cached
+}
+
+func TestFilterMatchesEntity(t *testing.T) {
+	is := is.New(t)
+
+	entity := map[string]interface{}{
+		"CO2":       map[string]interface{}{"type": "Property", "value": 800.0},
+		"refDevice": map[string]interface{}{"type": "Relationship", "object": "urn:ngsi-ld:Device:dev1"},
+	}
+
+	co2 := func(op string, values ...interface{}) database.Filter {
+		return database.Filter{Attribute: "CO2", Operator: op, Values: values}
+	}
+
+	is.True(filterMatches(co2(database.FilterGreaterOrEqual, 800.0), entity))
+	is.True(!filterMatches(co2(database.FilterLess, 800.0), entity))
+	is.True(filterMatches(co2(database.FilterEqual, 400.0, 800.0), entity))
+	is.True(filterMatches(database.Filter{Attribute: "CO2", Operator: database.FilterNotEqual, Values: []interface{}{900.0, 1000.0}, IsRange: true}, entity))
+	is.True(!filterMatches(co2(database.FilterEqual, "800"), entity)) // numbers never match text
+	is.True(!filterMatches(database.Filter{Attribute: "temperature"}, entity))
+	is.True(filterMatches(database.Filter{Logical: database.FilterOr, Terms: []database.Filter{
+		{Attribute: "temperature"},
+		{Attribute: "refDevice", Operator: database.FilterEqual, Values: []interface{}{"urn:ngsi-ld:Device:dev1"}},
+	}}, entity))
+}
+
+func TestNotificationDeliveryIsRetried(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+	db.RecordNotificationFunc = func(id string, notifiedAt time.Time, success bool) error {
+		return nil
+	}
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		payload := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		is.Equal(payload["subscriptionId"], "s1")
+		is.Equal(r.Header.Get("Content-Type"), "application/json")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	dispatcher := NewNotificationDispatcher(db, server.Client(), retry, log.Logger)
+
+	n := Notification{ID: "n1", SubscriptionID: "s1", Endpoint: server.URL, Accept: "application/json", NotifiedAt: time.Now()}
+	is.NoErr(dispatcher.deliver(context.Background(), n))
+	is.Equal(attempts, 3)
+	is.True(db.RecordNotificationCalls()[0].Success)
+
+	attempts = -10
+	is.True(dispatcher.deliver(context.Background(), n) != nil) // all attempts should fail
+	is.Equal(attempts, -7)
+	is.True(!db.RecordNotificationCalls()[1].Success)
+}
+
+func TestNotificationsAreNotSentToTheInternalNetwork(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+	db.RecordNotificationFunc = func(id string, notifiedAt time.Time, success bool) error {
+		return nil
+	}
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	retry := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	dispatcher := NewNotificationDispatcher(db, NewNotificationClient(time.Second), retry, log.Logger)
+
+	n := Notification{ID: "n1", SubscriptionID: "s1", Endpoint: server.URL, Accept: "application/json", NotifiedAt: time.Now()}
+	err := dispatcher.deliver(context.Background(), n)
+	is.True(errors.Is(err, ErrForbiddenEndpoint)) // the test server listens on the loopback interface
+	is.Equal(attempts, 0)
+	is.Equal(len(db.RecordNotificationCalls()), 1) // forbidden endpoints should not be retried
+	is.True(!db.RecordNotificationCalls()[0].Success)
+
+	for _, endpoint := range []string{"http://localhost:8080/notify", "http://127.0.0.1/", "http://169.254.169.254/latest/meta-data", "http://10.0.0.1/", "http://[::1]/"} {
+		_, err = Subscription{EntityType: "AirQualityObserved", Endpoint: endpoint}.model()
+		is.True(errors.Is(err, ErrInvalidSubscription)) // endpoints in the internal network should be refused
+	}
+
+	_, err = Subscription{EntityType: "AirQualityObserved", Endpoint: "http://alerts.example.com/notify"}.model()
 	is.NoErr(err)
-	is.Equal(len(db.StoreAirQualityObservedCalls()), 1)
+}
+
+func TestParseAlertRules(t *testing.T) {
+	is := is.New(t)
+
+	rules, err := ParseAlertRules(`[{"name": "co2", "attribute": "CO2", "threshold": 1000, "direction": "above", "duration": "10m", "hysteresis": 200}]`)
+	is.NoErr(err)
+	is.Equal(len(rules), 1)
+	is.Equal(rules[0].Duration, 10*time.Minute)
+	is.Equal(rules[0].Severity, "medium")
+
+	_, err = ParseAlertRules(`[{"name": "co2", "attribute": "CO2", "direction": "above"}]`)
+	is.True(err != nil) // a threshold is required
+
+	_, err = ParseAlertRules(`[{"name": "co2", "attribute": "CO2", "threshold": 1000, "direction": "sideways"}]`)
+	is.True(err != nil)
+
+	_, err = ParseAlertRules(`[{"name": "noise", "attribute": "LAeq", "threshold": 70, "direction": "above"}]`)
+	is.True(err != nil) // not a measurement
+}
+
+func TestAlertIsRaisedAndClearedWithHysteresis(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+
+	alerts := []*models.Alert{}
+	db.GetAlertsFunc = func(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+		return []models.Alert{}, nil
+	}
+	db.CreateAlertFunc = func(alert *models.Alert) error {
+		alert.ID = uint(len(alerts) + 1)
+		alerts = append(alerts, alert)
+		return nil
+	}
+	db.ClearAlertFunc = func(id uint, clearedAt time.Time, value float64) error {
+		return nil
+	}
+	db.GetSubscriptionsFunc = func() ([]models.Subscription, error) {
+		return []models.Subscription{}, nil
+	}
+	db.StoreObservationFunc = storeAsGiven
+
+	rules, _ := ParseAlertRules(`[{"name": "co2", "attribute": "CO2", "threshold": 1000, "direction": "above", "duration": "10m", "hysteresis": 200, "devices": ["dev1"]}]`)
+	app := NewEnvironmentApp(db, nil, database.DuplicatesReject, log.Logger, WithAlertRules(rules))
+
+	start := time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := func(deviceId string, minutes int, co2 float64) {
+		m := models.AirQualityMeasurements{CO2: float64Ptr(co2)}
+		_, err := storeAirQuality(app, "aqo", deviceId, m, start.Add(time.Duration(minutes)*time.Minute))
+		is.NoErr(err)
+	}
+
+	store("dev1", 0, 1100)
+	store("dev1", 5, 900) // the breach is reset
+	store("dev1", 6, 1100)
+	store("dev1", 15, 1200)
+	is.Equal(len(alerts), 0) // the breach has not lasted for 10 minutes
+
+	store("dev1", 16, 1200)
+	is.Equal(len(alerts), 1)
+	is.Equal(alerts[0].BreachedAt, start.Add(6*time.Minute))
+	is.Equal(alerts[0].Value, 1200.0)
+
+	store("dev1", 30, 1300)
+	store("dev1", 31, 850)
+	store("dev1", 2, 500) // out of order observations are ignored
+	store("dev2", 40, 2000)
+	is.Equal(len(alerts), 1)
+	is.Equal(len(db.ClearAlertCalls()), 0) // 850 is within the hysteresis
+
+	store("dev1", 32, 790)
+	is.Equal(len(db.ClearAlertCalls()), 1)
+	is.Equal(db.ClearAlertCalls()[0].Value, 790.0)
+
+	is.Equal(len(db.GetAlertsCalls()), 1) // active alerts should only be loaded once
+}
+
+func TestAlertsOfABatchAreEvaluatedInTheOrderOfTheObservations(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+
+	rules, _ := ParseAlertRules(`[{"name": "co2", "attribute": "CO2", "threshold": 1000, "direction": "above", "duration": "10m"}]`)
+	environmentApp := NewEnvironmentApp(db, nil, database.DuplicatesReject, log.Logger, WithAlertRules(rules))
+	tracker := environmentApp.(*app).alerts
+
+	db.GetAlertsFunc = func(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+		return []models.Alert{}, nil
+	}
+	db.CreateAlertFunc = func(alert *models.Alert) error {
+		tracker.mu.Lock() // the tracker should not be locked while alerts are stored
+		defer tracker.mu.Unlock()
+		alert.ID = 1
+		return nil
+	}
+	db.GetSubscriptionsFunc = func() ([]models.Subscription, error) {
+		return []models.Subscription{}, nil
+	}
+	db.StoreObservationsFunc = func(kind *database.ObservationKind, observations []database.Observation, onDuplicate database.DuplicatePolicy) ([]database.BatchStoreResult, error) {
+		return make([]database.BatchStoreResult, len(observations)), nil
+	}
+
+	start := time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)
+	observation := func(minutes int) database.Observation {
+		return &models.AirQualityObserved{
+			EntityId: "aqo", DeviceId: "dev1", Latitude: 62.3908, Longitude: 17.3069,
+			Timestamp:              start.Add(time.Duration(minutes) * time.Minute),
+			AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(1100)},
+		}
+	}
+
+	_, err := environmentApp.StoreObservations(database.AirQualityObservedKind, []database.Observation{observation(10), observation(0), observation(5)}, false)
+	is.NoErr(err)
+	is.Equal(len(db.CreateAlertCalls()), 1) // the breach should last from the earliest observation
+	is.Equal(db.CreateAlertCalls()[0].Alert.BreachedAt, start)
+	is.Equal(db.CreateAlertCalls()[0].Alert.RaisedAt, start.Add(10*time.Minute))
+}
+
+func TestLivenessTrackerLearnsIntervalsAndFlagsStaleDevices(t *testing.T) {
+	is := is.New(t)
+	db, _ := newAppForTesting()
+
+	configured := int64(60)
+	db.GetDevicesFunc = func() ([]models.Device, error) {
+		return []models.Device{{DeviceId: "configured", LastSeen: time.Now().UTC().Add(-2 * time.Minute), ExpectedInterval: &configured}}, nil
+	}
+	db.SaveDevicesFunc = func(devices []models.Device) error {
+		return nil
+	}
+	db.StoreObservationFunc = storeAsGiven
+
+	tracker := NewLivenessTracker(db, DefaultLivenessConfig(), log.Logger)
+	app := NewEnvironmentApp(db, nil, database.DuplicatesReject, log.Logger, WithLivenessTracker(tracker))
+
+	now := time.Now().UTC()
+	for _, minutes := range []int{100, 85, 70, 55, 40, 41} {
+		_, err := storeAirQuality(app, "aqo", "dev1", models.AirQualityMeasurements{}, now.Add(-time.Duration(minutes)*time.Minute))
+		is.NoErr(err)
+	}
+
+	statuses, err := app.RetrieveDeviceStatuses()
+	is.NoErr(err)
+	is.Equal(len(statuses), 2)
+	is.Equal(statuses[0].IntervalSource, IntervalConfigured)
+	is.True(!statuses[0].Stale) // two minutes is less than three missed reports
+
+	is.Equal(statuses[1].DeviceId, "dev1")
+	is.Equal(statuses[1].LastSeen, now.Add(-40*time.Minute)) // the late observation should be ignored
+	is.Equal(statuses[1].Interval, 15*time.Minute)
+	is.Equal(statuses[1].IntervalSource, IntervalLearned)
+	is.True(!statuses[1].Stale)
+
+	tracker.check(now.Add(10 * time.Minute))
+	is.True(tracker.devices["dev1"].stale) // not seen for 50 minutes, with a 15 minute interval
+
+	tracker.save()
+	is.Equal(len(db.SaveDevicesCalls()), 1)
+	is.Equal(len(db.SaveDevicesCalls()[0].Devices), 1) // only the changed device should be saved
+	is.Equal(*db.SaveDevicesCalls()[0].Devices[0].LearnedInterval, int64(900))
+
+	is.True(errors.Is(app.UpdateExpectedReportingInterval("unknown", time.Minute), ErrNotFound))
+}
+
+func TestFindGaps(t *testing.T) {
+	is := is.New(t)
+
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return from.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	observationGaps := []database.ObservationGap{{From: from, To: at(10)}, {From: at(20), To: at(90)}, {From: at(100), To: at(240)}}
+
+	gaps := findGaps(observationGaps, 30*time.Minute)
+	is.Equal(len(gaps), 2)
+	is.Equal(gaps[0], ReportingGap{From: at(20), To: at(90)})
+	is.Equal(gaps[1], ReportingGap{From: at(100), To: at(240)})
+
+	gaps = findGaps(observationGaps, 3*time.Hour)
+	is.Equal(len(gaps), 0) // the gaps are shorter than the missed reports of a device with a longer interval
+}
+
+//storeAsGiven is a StoreObservationFunc that stores every observation as it is
+func storeAsGiven(kind *database.ObservationKind, observation database.Observation, onDuplicate database.DuplicatePolicy) (database.Observation, database.StoreResult, error) {
+	return observation, database.StoreResultCreated, nil
+}
+
+//storeAirQuality stores an observation of an air quality entity at a valid position
+func storeAirQuality(app EnvironmentApp, entityId, deviceId string, measurements models.AirQualityMeasurements, timestamp time.Time) (database.StoreResult, error) {
+	return app.StoreObservation(database.AirQualityObservedKind, &models.AirQualityObserved{
+		EntityId: entityId, DeviceId: deviceId, Latitude: 62.3908, Longitude: 17.3069, Timestamp: timestamp, AirQualityMeasurements: measurements,
+	})
+}
+
+type notifierFunc func(Notification)
+
+func (fn notifierFunc) Notify(n Notification) {
+	fn(n)
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
 }
@@ -0,0 +1,147 @@
+package application
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+)
+
+const (
+	//AQIScaleCAQI is the European Common Air Quality Index (hourly, background)
+	AQIScaleCAQI string = "caqi"
+	//AQIScaleEPA is the US EPA Air Quality Index
+	AQIScaleEPA string = "epa"
+)
+
+//AQICalculator derives an air quality index and level from a set of pollutant concentrations
+type AQICalculator interface {
+	//Calculate returns the index and level, or nil and an empty level if none of the
+	//pollutants used by the index were observed
+	Calculate(m models.AirQualityMeasurements) (*float64, string)
+}
+
+//NewAQICalculator returns a calculator for one of the supported AQI scales
+func NewAQICalculator(scale string) (AQICalculator, error) {
+	switch scale {
+	case AQIScaleCAQI:
+		return caqi, nil
+	case AQIScaleEPA:
+		return epa, nil
+	default:
+		return nil, fmt.Errorf("unsupported air quality index scale %s", scale)
+	}
+}
+
+//breakpoint maps a concentration to an index value. Sub-indices are interpolated linearly
+//between the breakpoints of a pollutant.
+type breakpoint struct {
+	concentration float64
+	index         float64
+}
+
+type aqiPollutant struct {
+	value func(m models.AirQualityMeasurements) *float64
+	//conversion converts the stored concentration into the unit used by the breakpoints
+	conversion  float64
+	breakpoints []breakpoint
+}
+
+type aqiLevel struct {
+	maxIndex float64
+	name     string
+}
+
+type aqiScale struct {
+	pollutants []aqiPollutant
+	levels     []aqiLevel
+	//extrapolate continues the last segment of the breakpoints for concentrations above the
+	//highest breakpoint, instead of capping the index at the highest breakpoint
+	extrapolate bool
+	round       bool
+}
+
+//Calculate returns the highest sub-index of the observed pollutants
+func (s aqiScale) Calculate(m models.AirQualityMeasurements) (*float64, string) {
+	var index *float64
+
+	for _, p := range s.pollutants {
+		concentration := p.value(m)
+		if concentration == nil {
+			continue
+		}
+
+		subIndex := s.subIndex(*concentration*p.conversion, p.breakpoints)
+		if index == nil || subIndex > *index {
+			index = &subIndex
+		}
+	}
+
+	if index == nil {
+		return nil, ""
+	}
+
+	if s.round {
+		*index = math.Round(*index)
+	}
+
+	for _, level := range s.levels {
+		if *index <= level.maxIndex {
+			return index, level.name
+		}
+	}
+
+	return index, s.levels[len(s.levels)-1].name
+}
+
+func (s aqiScale) subIndex(concentration float64, breakpoints []breakpoint) float64 {
+	concentration = math.Max(concentration, 0)
+
+	for idx := 1; idx < len(breakpoints); idx++ {
+		lo, hi := breakpoints[idx-1], breakpoints[idx]
+		if concentration <= hi.concentration || (idx == len(breakpoints)-1 && s.extrapolate) {
+			return lo.index + (concentration-lo.concentration)*(hi.index-lo.index)/(hi.concentration-lo.concentration)
+		}
+	}
+
+	return breakpoints[len(breakpoints)-1].index
+}
+
+// Factors used to convert µg/m³ into ppb (and mg/m³ into ppm) at 25°C and 1 atm
+const (
+	o3ToPPB  float64 = 24.45 / 48.00
+	no2ToPPB float64 = 24.45 / 46.01
+	so2ToPPB float64 = 24.45 / 64.07
+	coToPPM  float64 = 24.45 / 28.01
+)
+
+var caqi = aqiScale{
+	pollutants: []aqiPollutant{
+		{func(m models.AirQualityMeasurements) *float64 { return m.NO2 }, 1, []breakpoint{{0, 0}, {50, 25}, {100, 50}, {200, 75}, {400, 100}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.PM10 }, 1, []breakpoint{{0, 0}, {25, 25}, {50, 50}, {90, 75}, {180, 100}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.PM25 }, 1, []breakpoint{{0, 0}, {15, 25}, {30, 50}, {55, 75}, {110, 100}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.O3 }, 1, []breakpoint{{0, 0}, {60, 25}, {120, 50}, {180, 75}, {240, 100}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.SO2 }, 1, []breakpoint{{0, 0}, {50, 25}, {100, 50}, {350, 75}, {500, 100}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.CO }, 1, []breakpoint{{0, 0}, {5, 25}, {7.5, 50}, {10, 75}, {20, 100}}},
+	},
+	levels: []aqiLevel{
+		{25, "veryLow"}, {50, "low"}, {75, "medium"}, {100, "high"}, {math.MaxFloat64, "veryHigh"},
+	},
+	extrapolate: true,
+	round:       true,
+}
+
+var epa = aqiScale{
+	pollutants: []aqiPollutant{
+		{func(m models.AirQualityMeasurements) *float64 { return m.PM25 }, 1, []breakpoint{{0, 0}, {12.0, 50}, {35.4, 100}, {55.4, 150}, {150.4, 200}, {250.4, 300}, {350.4, 400}, {500.4, 500}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.PM10 }, 1, []breakpoint{{0, 0}, {54, 50}, {154, 100}, {254, 150}, {354, 200}, {424, 300}, {504, 400}, {604, 500}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.O3 }, o3ToPPB, []breakpoint{{0, 0}, {54, 50}, {70, 100}, {85, 150}, {105, 200}, {200, 300}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.NO2 }, no2ToPPB, []breakpoint{{0, 0}, {53, 50}, {100, 100}, {360, 150}, {649, 200}, {1249, 300}, {1649, 400}, {2049, 500}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.SO2 }, so2ToPPB, []breakpoint{{0, 0}, {35, 50}, {75, 100}, {185, 150}, {304, 200}, {604, 300}, {804, 400}, {1004, 500}}},
+		{func(m models.AirQualityMeasurements) *float64 { return m.CO }, coToPPM, []breakpoint{{0, 0}, {4.4, 50}, {9.4, 100}, {12.4, 150}, {15.4, 200}, {30.4, 300}, {40.4, 400}, {50.4, 500}}},
+	},
+	levels: []aqiLevel{
+		{50, "good"}, {100, "moderate"}, {150, "unhealthyForSensitiveGroups"}, {200, "unhealthy"}, {300, "veryUnhealthy"}, {math.MaxFloat64, "hazardous"},
+	},
+	round: true,
+}
@@ -0,0 +1,478 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/rs/zerolog"
+)
+
+//ErrLivenessNotTracked is returned when device liveness is requested from an app without a LivenessTracker
+var ErrLivenessNotTracked = errors.New("device liveness is not tracked")
+
+const (
+	//learningWindow is the number of recent reporting intervals that the interval of a device is learned from
+	learningWindow int = 16
+	//minLearningSamples is the number of reporting intervals required before an interval is learned
+	minLearningSamples int = 4
+)
+
+//Sources of the reporting interval of a device
+const (
+	IntervalConfigured string = "configured"
+	IntervalLearned    string = "learned"
+	IntervalDefault    string = "default"
+)
+
+//livenessMetrics is published as the expvar "liveness"
+var livenessMetrics = expvar.NewMap("liveness")
+
+//LivenessConfig controls when devices are considered to be stale. A device is stale, and a gap
+//is found in its observations, when it has not reported for MissedReports reporting intervals.
+//DefaultInterval is used for devices that have neither an expected, nor a learned, interval.
+type LivenessConfig struct {
+	DefaultInterval time.Duration
+	MissedReports   int
+}
+
+//DefaultLivenessConfig considers devices to be stale when three reports have been missed, and
+//expects devices with an unknown reporting interval to report every hour
+func DefaultLivenessConfig() LivenessConfig {
+	return LivenessConfig{DefaultInterval: time.Hour, MissedReports: 3}
+}
+
+//DeviceStatus is the liveness of a device, as of when it was retrieved
+type DeviceStatus struct {
+	DeviceId       string
+	LastSeen       time.Time
+	Interval       time.Duration
+	IntervalSource string
+	Stale          bool
+}
+
+//ReportingGap is a period within which a device did not report any observations
+type ReportingGap struct {
+	From time.Time
+	To   time.Time
+}
+
+//DeviceGaps lists the gaps in the observations of a device, in chronological order
+type DeviceGaps struct {
+	DeviceId string
+	Interval time.Duration
+	Gaps     []ReportingGap
+}
+
+//deviceLiveness is the in memory state of a device. Dirty devices have changed since they
+//were last saved to the Datastore.
+type deviceLiveness struct {
+	lastSeen  time.Time
+	intervals []time.Duration
+	expected  time.Duration
+	learned   time.Duration
+	stale     bool
+	dirty     bool
+}
+
+//LivenessTracker records when every device last reported an observation, learns how often the
+//devices report, and flags devices that have stopped reporting as stale. The state is saved to,
+//and loaded from, the Datastore so that it survives restarts.
+type LivenessTracker struct {
+	db     database.Datastore
+	config LivenessConfig
+	log    zerolog.Logger
+
+	mu      sync.Mutex
+	devices map[string]*deviceLiveness
+	loaded  bool
+}
+
+//NewLivenessTracker creates a tracker. Devices are saved, and checked for staleness, when Run is called.
+func NewLivenessTracker(db database.Datastore, config LivenessConfig, log zerolog.Logger) *LivenessTracker {
+	if config.DefaultInterval <= 0 {
+		config.DefaultInterval = DefaultLivenessConfig().DefaultInterval
+	}
+
+	if config.MissedReports < 1 {
+		config.MissedReports = DefaultLivenessConfig().MissedReports
+	}
+
+	return &LivenessTracker{
+		db:      db,
+		config:  config,
+		log:     log,
+		devices: map[string]*deviceLiveness{},
+	}
+}
+
+//WithLivenessTracker makes the app report every stored observation to the tracker
+func WithLivenessTracker(tracker *LivenessTracker) AppOption {
+	return func(a *app) {
+		a.liveness = tracker
+	}
+}
+
+//Run saves the changed devices and flags stale devices with the given interval, until the
+//context is cancelled
+func (t *LivenessTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.save()
+			return
+		case <-ticker.C:
+			t.save()
+			t.check(time.Now().UTC())
+		}
+	}
+}
+
+//Seen records that a device reported an observation at a point in time. Observations that are
+//older than the latest observation of the device, e.g. late arrivals, do not change its state.
+func (t *LivenessTracker) Seen(deviceId string, observedAt time.Time) {
+	if deviceId == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.load()
+	if err != nil {
+		t.log.Error().Err(err).Msg("failed to load devices")
+		return
+	}
+
+	device, ok := t.devices[deviceId]
+	if !ok {
+		device = &deviceLiveness{}
+		t.devices[deviceId] = device
+	}
+
+	if !observedAt.After(device.lastSeen) {
+		return
+	}
+
+	if !device.lastSeen.IsZero() {
+		device.intervals = append(device.intervals, observedAt.Sub(device.lastSeen))
+		if len(device.intervals) > learningWindow {
+			device.intervals = device.intervals[1:]
+		}
+
+		if len(device.intervals) >= minLearningSamples {
+			device.learned = median(device.intervals)
+		}
+	}
+
+	device.lastSeen = observedAt
+	device.dirty = true
+
+	if device.stale {
+		device.stale = false
+		livenessMetrics.Add("stale", -1)
+		t.log.Info().Str("deviceId", deviceId).Msg("device has started to report again")
+	}
+}
+
+func (t *LivenessTracker) load() error {
+	if t.loaded {
+		return nil
+	}
+
+	devices, err := t.db.GetDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		t.devices[d.DeviceId] = &deviceLiveness{
+			lastSeen: d.LastSeen,
+			expected: secondsToDuration(d.ExpectedInterval),
+			learned:  secondsToDuration(d.LearnedInterval),
+		}
+	}
+
+	t.loaded = true
+	return nil
+}
+
+//save stores the devices that have changed since they were last saved
+func (t *LivenessTracker) save() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	devices := []models.Device{}
+	for deviceId, d := range t.devices {
+		if d.dirty {
+			devices = append(devices, models.Device{
+				DeviceId:         deviceId,
+				LastSeen:         d.lastSeen,
+				ExpectedInterval: durationToSeconds(d.expected),
+				LearnedInterval:  durationToSeconds(d.learned),
+			})
+		}
+	}
+
+	err := t.db.SaveDevices(devices)
+	if err != nil {
+		t.log.Error().Err(err).Int("devices", len(devices)).Msg("failed to save devices")
+		return
+	}
+
+	for _, d := range devices {
+		t.devices[d.DeviceId].dirty = false
+	}
+}
+
+//check flags the devices that have missed too many reports as stale
+func (t *LivenessTracker) check(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.load()
+	if err != nil {
+		t.log.Error().Err(err).Msg("failed to load devices")
+		return
+	}
+
+	stale := int64(0)
+
+	for deviceId, d := range t.devices {
+		interval, _ := t.interval(d)
+		isStale := t.isStale(d, interval, now)
+
+		if isStale && !d.stale {
+			t.log.Warn().Str("deviceId", deviceId).Time("lastSeen", d.lastSeen).Dur("interval", interval).Msg("device has stopped reporting")
+		}
+
+		d.stale = isStale
+		if isStale {
+			stale++
+		}
+	}
+
+	devices, staleDevices := &expvar.Int{}, &expvar.Int{}
+	devices.Set(int64(len(t.devices)))
+	staleDevices.Set(stale)
+
+	livenessMetrics.Set("devices", devices)
+	livenessMetrics.Set("stale", staleDevices)
+}
+
+//interval returns the reporting interval of a device, and where it came from
+func (t *LivenessTracker) interval(d *deviceLiveness) (time.Duration, string) {
+	if d.expected > 0 {
+		return d.expected, IntervalConfigured
+	}
+
+	if d.learned > 0 {
+		return d.learned, IntervalLearned
+	}
+
+	return t.config.DefaultInterval, IntervalDefault
+}
+
+func (t *LivenessTracker) isStale(d *deviceLiveness, interval time.Duration, now time.Time) bool {
+	return now.Sub(d.lastSeen) > time.Duration(t.config.MissedReports)*interval
+}
+
+//Statuses returns the liveness of all devices, ordered by device
+func (t *LivenessTracker) Statuses(now time.Time) ([]DeviceStatus, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []DeviceStatus{}
+
+	for deviceId, d := range t.devices {
+		interval, source := t.interval(d)
+		statuses = append(statuses, DeviceStatus{
+			DeviceId:       deviceId,
+			LastSeen:       d.lastSeen,
+			Interval:       interval,
+			IntervalSource: source,
+			Stale:          t.isStale(d, interval, now),
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DeviceId < statuses[j].DeviceId
+	})
+
+	return statuses, nil
+}
+
+//SetExpectedInterval configures the reporting interval of a known device. An interval of 0
+//removes the configured interval, so that the learned interval is used instead.
+func (t *LivenessTracker) SetExpectedInterval(deviceId string, interval time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.load()
+	if err != nil {
+		return err
+	}
+
+	device, ok := t.devices[deviceId]
+	if !ok {
+		return ErrNotFound
+	}
+
+	err = t.db.UpdateDeviceExpectedInterval(deviceId, durationToSeconds(interval))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			// The device has not been saved yet, so the interval is saved with it instead
+			device.dirty = true
+		} else {
+			return err
+		}
+	}
+
+	device.expected = interval
+	return nil
+}
+
+//Gaps returns the periods within a time span, for all devices or a single known device, in
+//which a device missed too many reports. Periods that have not yet ended, i.e. after now, are
+//not included.
+func (t *LivenessTracker) Gaps(deviceId string, from, to, now time.Time) ([]DeviceGaps, error) {
+	t.mu.Lock()
+
+	err := t.load()
+	if err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+
+	intervals := map[string]time.Duration{}
+	for id, d := range t.devices {
+		if deviceId == "" || id == deviceId {
+			intervals[id], _ = t.interval(d)
+		}
+	}
+
+	t.mu.Unlock()
+
+	if deviceId != "" && len(intervals) == 0 {
+		return nil, ErrNotFound
+	}
+
+	if to.After(now) {
+		to = now
+	}
+
+	// Only the gaps that are long enough for at least one of the devices are found by the database
+	minGap := time.Duration(0)
+	for _, interval := range intervals {
+		maxInterval := time.Duration(t.config.MissedReports) * interval
+		if minGap == 0 || maxInterval < minGap {
+			minGap = maxInterval
+		}
+	}
+
+	found, err := t.db.GetObservationGaps(deviceId, from, to, minGap)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []DeviceGaps{}
+
+	for id, interval := range intervals {
+		observationGaps, reported := found[id]
+		if !reported {
+			// A device that did not report at all is missing for the whole time span
+			observationGaps = []database.ObservationGap{{From: from, To: to}}
+		}
+
+		result = append(result, DeviceGaps{
+			DeviceId: id,
+			Interval: interval,
+			Gaps:     findGaps(observationGaps, time.Duration(t.config.MissedReports)*interval),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DeviceId < result[j].DeviceId
+	})
+
+	return result, nil
+}
+
+//findGaps returns the gaps in the observations of a device that are longer than maxInterval
+func findGaps(observationGaps []database.ObservationGap, maxInterval time.Duration) []ReportingGap {
+	gaps := []ReportingGap{}
+
+	for _, g := range observationGaps {
+		if g.To.Sub(g.From) > maxInterval {
+			gaps = append(gaps, ReportingGap{From: g.From, To: g.To})
+		}
+	}
+
+	return gaps
+}
+
+func median(durations []time.Duration) time.Duration {
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+func durationToSeconds(d time.Duration) *int64 {
+	if d <= 0 {
+		return nil
+	}
+
+	seconds := int64(d.Seconds())
+	return &seconds
+}
+
+func secondsToDuration(seconds *int64) time.Duration {
+	if seconds == nil {
+		return 0
+	}
+	return time.Duration(*seconds) * time.Second
+}
+
+//RetrieveDeviceStatuses returns the liveness of all devices that have reported observations
+func (a *app) RetrieveDeviceStatuses() ([]DeviceStatus, error) {
+	if a.liveness == nil {
+		return nil, ErrLivenessNotTracked
+	}
+	return a.liveness.Statuses(time.Now().UTC())
+}
+
+//UpdateExpectedReportingInterval configures how often a device is expected to report. An
+//interval of 0 makes the device use the interval that has been learned from its observations.
+func (a *app) UpdateExpectedReportingInterval(deviceId string, interval time.Duration) error {
+	if a.liveness == nil {
+		return ErrLivenessNotTracked
+	}
+	return a.liveness.SetExpectedInterval(deviceId, interval)
+}
+
+//RetrieveReportingGaps returns the gaps in the observations of all devices, or a single device,
+//within a time span
+func (a *app) RetrieveReportingGaps(deviceId string, from, to time.Time) ([]DeviceGaps, error) {
+	if a.liveness == nil {
+		return nil, ErrLivenessNotTracked
+	}
+	return a.liveness.Gaps(deviceId, from, to, time.Now().UTC())
+}
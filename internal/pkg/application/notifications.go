@@ -0,0 +1,222 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/rs/zerolog"
+)
+
+//notificationQueueSize is the number of notifications that may wait for delivery before new
+//notifications are dropped
+const notificationQueueSize int = 1000
+
+//notificationMetrics is published as the expvar "notifications"
+var notificationMetrics = expvar.NewMap("notifications")
+
+//ErrForbiddenEndpoint is returned when a notification endpoint resolves to a loopback, link local,
+//private or unspecified address. Notifications are never sent to the internal network.
+var ErrForbiddenEndpoint = errors.New("notification endpoint resolves to a forbidden address")
+
+//isForbiddenAddress reports whether notifications must not be sent to ip
+func isForbiddenAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+//NewNotificationClient creates an http client that refuses to connect to forbidden addresses.
+//The address is checked when the connection is made, after the host name has been resolved, so
+//that neither redirects nor a changed DNS record can steer a notification into the internal network.
+func NewNotificationClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || isForbiddenAddress(ip) {
+				return fmt.Errorf("%w: %s", ErrForbiddenEndpoint, host)
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	//a proxy would make the dialer check the address of the proxy instead of the endpoint
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+//RetryPolicy controls how many times the delivery of a notification is attempted, and how long
+//to wait between the attempts. The backoff is doubled after every failed attempt.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+//DefaultRetryPolicy makes up to five attempts, starting with a backoff of one second
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute}
+}
+
+//notificationPayload is the NGSI-LD representation of a Notification
+type notificationPayload struct {
+	ID             string                   `json:"id"`
+	Type           string                   `json:"type"`
+	SubscriptionID string                   `json:"subscriptionId"`
+	NotifiedAt     string                   `json:"notifiedAt"`
+	Data           []map[string]interface{} `json:"data"`
+}
+
+//NotificationDispatcher is a Notifier that delivers notifications to HTTP endpoints in the
+//background, and records the outcome of every delivery in the Datastore
+type NotificationDispatcher struct {
+	db     database.Datastore
+	client *http.Client
+	retry  RetryPolicy
+	queue  chan Notification
+	log    zerolog.Logger
+}
+
+//NewNotificationDispatcher creates a dispatcher. Notifications are queued until Run is called.
+func NewNotificationDispatcher(db database.Datastore, client *http.Client, retry RetryPolicy, log zerolog.Logger) *NotificationDispatcher {
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+
+	return &NotificationDispatcher{
+		db:     db,
+		client: client,
+		retry:  retry,
+		queue:  make(chan Notification, notificationQueueSize),
+		log:    log,
+	}
+}
+
+//Notify queues a notification for delivery. Storing observations should never have to wait
+//for slow endpoints, so the notification is dropped if the queue is full.
+func (d *NotificationDispatcher) Notify(notification Notification) {
+	select {
+	case d.queue <- notification:
+	default:
+		notificationMetrics.Add("dropped", 1)
+		d.log.Warn().Str("subscriptionId", notification.SubscriptionID).Msg("notification queue is full, dropping notification")
+	}
+}
+
+//Run delivers the queued notifications with a number of concurrent workers, until the context is cancelled
+func (d *NotificationDispatcher) Run(ctx context.Context, workers int) {
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case notification := <-d.queue:
+					d.deliver(ctx, notification)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+//deliver posts a notification to its endpoint. Attempts that fail because the endpoint could not
+//be reached, or responded with 429 or a server error, are retried with an exponential backoff.
+func (d *NotificationDispatcher) deliver(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notificationPayload{
+		ID:             notification.ID,
+		Type:           "Notification",
+		SubscriptionID: notification.SubscriptionID,
+		NotifiedAt:     notification.NotifiedAt.UTC().Format(time.RFC3339),
+		Data:           notification.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	backoff := d.retry.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		retryable, err := d.post(ctx, notification, body)
+		if err == nil {
+			notificationMetrics.Add("sent", 1)
+			d.record(notification, true)
+			return nil
+		}
+
+		if !retryable || attempt >= d.retry.MaxAttempts {
+			notificationMetrics.Add("failed", 1)
+			d.log.Error().Err(err).Str("subscriptionId", notification.SubscriptionID).Int("attempts", attempt).Msg("failed to deliver notification")
+			d.record(notification, false)
+			return err
+		}
+
+		notificationMetrics.Add("retries", 1)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > d.retry.MaxBackoff {
+			backoff = d.retry.MaxBackoff
+		}
+	}
+}
+
+//post makes a single delivery attempt and returns whether a failed attempt should be retried
+func (d *NotificationDispatcher) post(ctx context.Context, notification Notification, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notification.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Add("Content-Type", notification.Accept)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, ErrForbiddenEndpoint), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+}
+
+func (d *NotificationDispatcher) record(notification Notification, success bool) {
+	err := d.db.RecordNotification(notification.SubscriptionID, time.Now().UTC(), success)
+	if err != nil {
+		d.log.Error().Err(err).Str("subscriptionId", notification.SubscriptionID).Msg("failed to record notification")
+	}
+}
@@ -0,0 +1,190 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/rs/zerolog"
+)
+
+//RetentionPolicy controls how long observations of an entity type are kept. Raw observations
+//older than RawTTL are rolled up into aggregates of DownsampleInterval and deleted, and the
+//aggregates are deleted once they are older than AggregateTTL. A zero AggregateTTL keeps the
+//aggregates forever.
+type RetentionPolicy struct {
+	RawTTL             time.Duration
+	DownsampleInterval time.Duration
+	AggregateTTL       time.Duration
+}
+
+//retentionPolicyJSON is the configuration format of a RetentionPolicy, with durations such as "90d" or "1h"
+type retentionPolicyJSON struct {
+	RawTTL             string `json:"rawTTL"`
+	DownsampleInterval string `json:"downsampleInterval"`
+	AggregateTTL       string `json:"aggregateTTL,omitempty"`
+}
+
+//retentionTargets maps the entity types that support retention to the kind of their observations
+var retentionTargets = map[string]*database.ObservationKind{
+	database.AirQualityObservedKind.Name: database.AirQualityObservedKind,
+}
+
+//DefaultRetentionPolicies keeps raw observations for 90 days and hourly aggregates forever
+func DefaultRetentionPolicies() map[string]RetentionPolicy {
+	return map[string]RetentionPolicy{
+		"AirQualityObserved": {RawTTL: 90 * 24 * time.Hour, DownsampleInterval: time.Hour},
+	}
+}
+
+//ParseRetentionPolicies parses a JSON object that maps entity types to retention policies, e.g.
+//{"AirQualityObserved": {"rawTTL": "90d", "downsampleInterval": "1h", "aggregateTTL": "5y"}}
+func ParseRetentionPolicies(config string) (map[string]RetentionPolicy, error) {
+	policiesJSON := map[string]retentionPolicyJSON{}
+
+	err := json.Unmarshal([]byte(config), &policiesJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse retention policies: %w", err)
+	}
+
+	policies := map[string]RetentionPolicy{}
+
+	for entityType, p := range policiesJSON {
+		if _, ok := retentionTargets[entityType]; !ok {
+			return nil, fmt.Errorf("retention is not supported for entity type %s", entityType)
+		}
+
+		policy := RetentionPolicy{}
+
+		policy.RawTTL, err = parseRetentionDuration(p.RawTTL)
+		if err != nil || policy.RawTTL <= 0 {
+			return nil, fmt.Errorf("invalid rawTTL %q for %s", p.RawTTL, entityType)
+		}
+
+		policy.DownsampleInterval, err = parseRetentionDuration(p.DownsampleInterval)
+		if err != nil || policy.DownsampleInterval < time.Second {
+			return nil, fmt.Errorf("invalid downsampleInterval %q for %s", p.DownsampleInterval, entityType)
+		}
+
+		if p.AggregateTTL != "" {
+			policy.AggregateTTL, err = parseRetentionDuration(p.AggregateTTL)
+			if err != nil || policy.AggregateTTL < policy.RawTTL {
+				return nil, fmt.Errorf("invalid aggregateTTL %q for %s, it must not be shorter than the rawTTL", p.AggregateTTL, entityType)
+			}
+		}
+
+		policies[entityType] = policy
+	}
+
+	return policies, nil
+}
+
+//parseRetentionDuration parses a Go duration, or a number of days ("90d") or years ("5y")
+func parseRetentionDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "y": 365 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			count, err := strconv.ParseUint(strings.TrimSuffix(value, suffix), 10, 32)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
+
+//retentionMetrics is published as the expvar "retention", keyed by entity type and metric name
+var retentionMetrics = expvar.NewMap("retention")
+
+//RetentionWorker applies retention policies to the Datastore at a regular interval
+type RetentionWorker struct {
+	db       database.Datastore
+	policies map[string]RetentionPolicy
+	dryRun   bool
+	log      zerolog.Logger
+}
+
+//NewRetentionWorker creates a worker for a set of policies. In dry run mode the worker only
+//reports what it would have rolled up and deleted.
+func NewRetentionWorker(db database.Datastore, policies map[string]RetentionPolicy, dryRun bool, log zerolog.Logger) *RetentionWorker {
+	return &RetentionWorker{db: db, policies: policies, dryRun: dryRun, log: log}
+}
+
+//Run applies the policies immediately and then once every interval, until the context is cancelled
+func (w *RetentionWorker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.ApplyPolicies(time.Now().UTC())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//ApplyPolicies applies every policy relative to now. A failing policy does not stop the
+//remaining policies from being applied, and the first error is returned.
+func (w *RetentionWorker) ApplyPolicies(now time.Time) error {
+	var firstErr error
+
+	entityTypes := []string{}
+	for entityType := range w.policies {
+		entityTypes = append(entityTypes, entityType)
+	}
+	sort.Strings(entityTypes)
+
+	for _, entityType := range entityTypes {
+		policy := w.policies[entityType]
+
+		aggregatesBefore := time.Time{}
+		if policy.AggregateTTL > 0 {
+			aggregatesBefore = now.Add(-policy.AggregateTTL)
+		}
+
+		started := time.Now()
+		result, err := w.db.ApplyRetention(retentionTargets[entityType], now.Add(-policy.RawTTL), policy.DownsampleInterval, aggregatesBefore, w.dryRun)
+
+		prefix := entityType + "."
+		if w.dryRun {
+			prefix += "dryRun."
+		}
+
+		retentionMetrics.Add(prefix+"runs", 1)
+
+		if err != nil {
+			retentionMetrics.Add(prefix+"failures", 1)
+			w.log.Error().Err(err).Str("entityType", entityType).Msg("failed to apply retention policy")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		retentionMetrics.Add(prefix+"rolledUpObservations", result.RolledUp)
+		retentionMetrics.Add(prefix+"aggregatesWritten", result.AggregatesWritten)
+		retentionMetrics.Add(prefix+"aggregatesDeleted", result.AggregatesDeleted)
+		retentionMetrics.Add(prefix+"durationMilliseconds", time.Since(started).Milliseconds())
+
+		w.log.Info().
+			Str("entityType", entityType).
+			Bool("dryRun", w.dryRun).
+			Time("cutoff", result.Cutoff).
+			Int64("rolledUp", result.RolledUp).
+			Int64("aggregatesWritten", result.AggregatesWritten).
+			Int64("aggregatesDeleted", result.AggregatesDeleted).
+			Msg("applied retention policy")
+	}
+
+	return firstErr
+}
@@ -0,0 +1,579 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/google/uuid"
+)
+
+//SubscriptionIDPrefix is the prefix of the ids that are generated for new subscriptions
+const SubscriptionIDPrefix string = "urn:ngsi-ld:Subscription:"
+
+//ErrSubscriptionExists is returned when a subscription is created with the id of an existing one
+var ErrSubscriptionExists = database.ErrSubscriptionExists
+
+//ErrInvalidSubscription is returned when a subscription is created, or updated, with invalid settings
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+//subscriptionRefreshInterval is how long subscriptions are cached before they are reloaded, so
+//that changes made through other instances of the service are picked up
+const subscriptionRefreshInterval time.Duration = time.Minute
+
+//Subscription asks for a notification to be sent to Endpoint whenever an observation of an
+//entity of EntityType is stored, that contains at least one of the WatchedAttributes and
+//matches the Filter that Q was parsed into. Empty lists and a nil Filter match everything.
+type Subscription struct {
+	ID                     string
+	Description            string
+	EntityType             string
+	EntityID               string
+	WatchedAttributes      []string
+	Q                      string
+	Filter                 *database.Filter
+	NotificationAttributes []string
+	Endpoint               string
+	Accept                 string
+	//Throttling is the minimum time between two notifications
+	Throttling time.Duration
+	IsActive   bool
+
+	CreatedAt        time.Time
+	ModifiedAt       time.Time
+	TimesSent        int64
+	LastNotification time.Time
+	LastSuccess      time.Time
+	LastFailure      time.Time
+}
+
+//Notification is sent to the endpoint of a subscription. Data holds the matching entity,
+//restricted to the notification attributes of the subscription.
+type Notification struct {
+	ID             string
+	SubscriptionID string
+	NotifiedAt     time.Time
+	Endpoint       string
+	Accept         string
+	Data           []map[string]interface{}
+}
+
+//Notifier delivers notifications to the endpoints of subscriptions
+type Notifier interface {
+	Notify(notification Notification)
+}
+
+//EntityRenderer converts an observation, or an alert, into the NGSI-LD entity that is sent in
+//notifications, keyed on the attribute names
+type EntityRenderer func(entity interface{}) (map[string]interface{}, error)
+
+//AppOption is used to pass optional features to NewEnvironmentApp
+type AppOption func(*app)
+
+//WithSubscriptions makes the app evaluate the subscriptions whenever an observation has been
+//stored, and hand a notification to the notifier for every matching subscription
+func WithSubscriptions(render EntityRenderer, notifier Notifier) AppOption {
+	return func(a *app) {
+		a.render = render
+		a.notifier = notifier
+	}
+}
+
+//CreateSubscription validates and stores a new subscription, and returns its id. An id is
+//generated unless the subscription already has one.
+func (a *app) CreateSubscription(subscription Subscription) (string, error) {
+	if subscription.ID == "" {
+		subscription.ID = SubscriptionIDPrefix + uuid.NewString()
+	}
+
+	s, err := subscription.model()
+	if err != nil {
+		return "", err
+	}
+
+	err = a.db.CreateSubscription(s)
+	if err != nil {
+		return "", err
+	}
+
+	a.subscriptions.invalidate()
+
+	return subscription.ID, nil
+}
+
+//RetrieveSubscription returns a subscription, or ErrNotFound
+func (a *app) RetrieveSubscription(id string) (*Subscription, error) {
+	s, err := a.db.GetSubscription(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSubscription(*s)
+}
+
+//RetrieveSubscriptions returns all subscriptions, the oldest first
+func (a *app) RetrieveSubscriptions() ([]Subscription, error) {
+	stored, err := a.db.GetSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []Subscription{}
+
+	for _, s := range stored {
+		subscription, err := newSubscription(s)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *subscription)
+	}
+
+	return subscriptions, nil
+}
+
+//UpdateSubscription validates and replaces the settings of an existing subscription
+func (a *app) UpdateSubscription(subscription Subscription) error {
+	s, err := subscription.model()
+	if err != nil {
+		return err
+	}
+
+	err = a.db.UpdateSubscription(s)
+	if err != nil {
+		return err
+	}
+
+	a.subscriptions.invalidate()
+
+	return nil
+}
+
+//DeleteSubscription deletes a subscription, or returns ErrNotFound
+func (a *app) DeleteSubscription(id string) error {
+	err := a.db.DeleteSubscription(id)
+	if err != nil {
+		return err
+	}
+
+	a.subscriptions.invalidate()
+
+	return nil
+}
+
+//notifySubscribers evaluates the active subscriptions against a stored observation, or a raised
+//or cleared alert, and hands a notification to the notifier for every subscription that matches
+//and is not throttled
+func (a *app) notifySubscribers(source interface{}) {
+	if a.notifier == nil || a.render == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	subscriptions, err := a.subscriptions.get(a.db, now)
+	if err != nil {
+		a.log.Error().Err(err).Msg("failed to load subscriptions")
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	if aqo, ok := source.(*models.AirQualityObserved); ok {
+		indexed := *aqo
+		a.addAirQualityIndex(&indexed)
+		source = &indexed
+	}
+
+	entity, err := a.render(source)
+	if err != nil {
+		a.log.Error().Err(err).Msg("failed to render entity for notifications")
+		return
+	}
+
+	for _, s := range subscriptions {
+		if !s.matches(entity) || !a.subscriptions.acquire(s, now) {
+			continue
+		}
+
+		a.notifier.Notify(Notification{
+			ID:             "urn:ngsi-ld:Notification:" + uuid.NewString(),
+			SubscriptionID: s.ID,
+			NotifiedAt:     now,
+			Endpoint:       s.Endpoint,
+			Accept:         s.Accept,
+			Data:           []map[string]interface{}{s.notificationData(entity)},
+		})
+	}
+}
+
+//matches returns true if a rendered entity is of the subscribed type, contains at least one of
+//the watched attributes, and matches the filter
+func (s Subscription) matches(entity map[string]interface{}) bool {
+	if !s.IsActive || entity["type"] != s.EntityType {
+		return false
+	}
+
+	if s.EntityID != "" && entity["id"] != s.EntityID {
+		return false
+	}
+
+	if len(s.WatchedAttributes) > 0 {
+		watched := false
+		for _, attribute := range s.WatchedAttributes {
+			_, ok := entity[attribute]
+			watched = watched || ok
+		}
+
+		if !watched {
+			return false
+		}
+	}
+
+	return s.Filter == nil || filterMatches(*s.Filter, entity)
+}
+
+//notificationData restricts an entity to the notification attributes of the subscription, and
+//leaves out the @context unless the endpoint accepts JSON-LD
+func (s Subscription) notificationData(entity map[string]interface{}) map[string]interface{} {
+	data := map[string]interface{}{}
+
+	for name, value := range entity {
+		switch name {
+		case "id", "type":
+		case "@context":
+			if s.Accept != "application/ld+json" {
+				continue
+			}
+		default:
+			if !isRequestedAttribute(name, s.NotificationAttributes) {
+				continue
+			}
+		}
+
+		data[name] = value
+	}
+
+	return data
+}
+
+//filterMatches evaluates a filter against the attributes of a rendered entity, with the same
+//semantics as the filter has when it is applied to stored observations
+func filterMatches(f database.Filter, entity map[string]interface{}) bool {
+	if f.Logical != "" {
+		for _, term := range f.Terms {
+			matches := filterMatches(term, entity)
+			if f.Logical == database.FilterOr && matches {
+				return true
+			}
+			if f.Logical == database.FilterAnd && !matches {
+				return false
+			}
+		}
+
+		return f.Logical == database.FilterAnd
+	}
+
+	value, ok := attributeValue(entity, f.Attribute)
+	if !ok || f.Operator == "" {
+		return ok
+	}
+
+	if len(f.Values) == 0 {
+		return false
+	}
+
+	if f.IsRange {
+		if len(f.Values) != 2 {
+			return false
+		}
+
+		lower, ok1 := compareValues(value, f.Values[0])
+		upper, ok2 := compareValues(value, f.Values[1])
+		if !ok1 || !ok2 {
+			return false
+		}
+
+		within := lower >= 0 && upper <= 0
+		return within == (f.Operator == database.FilterEqual)
+	}
+
+	if len(f.Values) > 1 {
+		found := false
+		for _, v := range f.Values {
+			c, ok := compareValues(value, v)
+			if !ok {
+				return false
+			}
+			found = found || c == 0
+		}
+
+		return found == (f.Operator == database.FilterEqual)
+	}
+
+	c, ok := compareValues(value, f.Values[0])
+	if !ok {
+		return false
+	}
+
+	switch f.Operator {
+	case database.FilterEqual:
+		return c == 0
+	case database.FilterNotEqual:
+		return c != 0
+	case database.FilterGreater:
+		return c > 0
+	case database.FilterGreaterOrEqual:
+		return c >= 0
+	case database.FilterLess:
+		return c < 0
+	case database.FilterLessOrEqual:
+		return c <= 0
+	default:
+		return false
+	}
+}
+
+//attributeValue returns the value of a property, or the object of a relationship
+func attributeValue(entity map[string]interface{}, name string) (interface{}, bool) {
+	for attribute, a := range entity {
+		if !strings.EqualFold(attribute, name) {
+			continue
+		}
+
+		if property, ok := a.(map[string]interface{}); ok {
+			if value, ok := property["value"]; ok {
+				return value, true
+			}
+			if object, ok := property["object"]; ok {
+				return object, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+//compareValues compares two numbers, or two strings. Values of different types can not be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	default:
+		return 0, false
+	}
+}
+
+func isRequestedAttribute(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+
+	for _, attribute := range attributes {
+		if attribute == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+//model validates a subscription and converts it into its stored representation
+func (s Subscription) model() (models.Subscription, error) {
+	if s.EntityType == "" {
+		return models.Subscription{}, fmt.Errorf("%w: an entity type is required", ErrInvalidSubscription)
+	}
+
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return models.Subscription{}, fmt.Errorf("%w: the notification endpoint must be an absolute http or https url", ErrInvalidSubscription)
+	}
+
+	if host := endpoint.Hostname(); strings.EqualFold(host, "localhost") {
+		return models.Subscription{}, fmt.Errorf("%w: notifications can not be sent to localhost", ErrInvalidSubscription)
+	} else if ip := net.ParseIP(host); ip != nil && isForbiddenAddress(ip) {
+		return models.Subscription{}, fmt.Errorf("%w: notifications can not be sent to %s", ErrInvalidSubscription, host)
+	}
+
+	accept := s.Accept
+	if accept == "" {
+		accept = "application/json"
+	}
+
+	if accept != "application/json" && accept != "application/ld+json" {
+		return models.Subscription{}, fmt.Errorf("%w: notifications can not be sent as %s", ErrInvalidSubscription, accept)
+	}
+
+	if s.Throttling < 0 {
+		return models.Subscription{}, fmt.Errorf("%w: throttling must not be negative", ErrInvalidSubscription)
+	}
+
+	filter := ""
+	if s.Filter != nil {
+		bytes, err := json.Marshal(s.Filter)
+		if err != nil {
+			return models.Subscription{}, err
+		}
+		filter = string(bytes)
+	}
+
+	return models.Subscription{
+		ID:                     s.ID,
+		Description:            s.Description,
+		EntityType:             s.EntityType,
+		EntityID:               s.EntityID,
+		WatchedAttributes:      strings.Join(s.WatchedAttributes, ","),
+		Q:                      s.Q,
+		Filter:                 filter,
+		NotificationAttributes: strings.Join(s.NotificationAttributes, ","),
+		Endpoint:               s.Endpoint,
+		Accept:                 accept,
+		Throttling:             int64(s.Throttling.Seconds()),
+		IsActive:               s.IsActive,
+	}, nil
+}
+
+//newSubscription converts a stored subscription
+func newSubscription(s models.Subscription) (*Subscription, error) {
+	subscription := &Subscription{
+		ID:                     s.ID,
+		Description:            s.Description,
+		EntityType:             s.EntityType,
+		EntityID:               s.EntityID,
+		WatchedAttributes:      splitAttributes(s.WatchedAttributes),
+		Q:                      s.Q,
+		NotificationAttributes: splitAttributes(s.NotificationAttributes),
+		Endpoint:               s.Endpoint,
+		Accept:                 s.Accept,
+		Throttling:             time.Duration(s.Throttling) * time.Second,
+		IsActive:               s.IsActive,
+		CreatedAt:              s.CreatedAt,
+		ModifiedAt:             s.UpdatedAt,
+		TimesSent:              s.TimesSent,
+	}
+
+	if s.Filter != "" {
+		subscription.Filter = &database.Filter{}
+		err := json.Unmarshal([]byte(s.Filter), subscription.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the filter of subscription %s: %w", s.ID, err)
+		}
+	}
+
+	for _, t := range []struct {
+		stored *time.Time
+		target *time.Time
+	}{
+		{s.LastNotification, &subscription.LastNotification},
+		{s.LastSuccess, &subscription.LastSuccess},
+		{s.LastFailure, &subscription.LastFailure},
+	} {
+		if t.stored != nil {
+			*t.target = *t.stored
+		}
+	}
+
+	return subscription, nil
+}
+
+func splitAttributes(attributes string) []string {
+	if attributes == "" {
+		return nil
+	}
+	return strings.Split(attributes, ",")
+}
+
+//subscriptionCache holds the active subscriptions, and the time every subscription was last
+//notified by this instance, which is needed for throttling
+type subscriptionCache struct {
+	mu            sync.Mutex
+	subscriptions []Subscription
+	loadedAt      time.Time
+	lastNotified  map[string]time.Time
+}
+
+func newSubscriptionCache() *subscriptionCache {
+	return &subscriptionCache{lastNotified: map[string]time.Time{}}
+}
+
+//get returns the active subscriptions, and reloads them if they are older than the refresh interval
+func (c *subscriptionCache) get(db database.Datastore, now time.Time) ([]Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subscriptions != nil && now.Sub(c.loadedAt) < subscriptionRefreshInterval {
+		return c.subscriptions, nil
+	}
+
+	stored, err := db.GetSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []Subscription{}
+
+	for _, s := range stored {
+		subscription, err := newSubscription(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if subscription.IsActive {
+			subscriptions = append(subscriptions, *subscription)
+		}
+	}
+
+	c.subscriptions, c.loadedAt = subscriptions, now
+
+	return subscriptions, nil
+}
+
+//acquire returns true, and records the notification, unless the subscription has been notified
+//within its throttling period
+func (c *subscriptionCache) acquire(s Subscription, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := s.LastNotification
+	if notified, ok := c.lastNotified[s.ID]; ok && notified.After(last) {
+		last = notified
+	}
+
+	if s.Throttling > 0 && !last.IsZero() && now.Sub(last) < s.Throttling {
+		return false
+	}
+
+	c.lastNotified[s.ID] = now
+	return true
+}
+
+//invalidate makes the next call to get reload the subscriptions
+func (c *subscriptionCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscriptions = nil
+}
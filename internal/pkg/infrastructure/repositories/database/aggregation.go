@@ -0,0 +1,378 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+//AggregationPeriod is the length of the periods that observations are grouped into when aggregated
+type AggregationPeriod string
+
+const (
+	//AggregationPeriodNone aggregates all matching observations of an entity into a single period
+	AggregationPeriodNone   AggregationPeriod = ""
+	AggregationPeriodMinute AggregationPeriod = "minute"
+	AggregationPeriodHour   AggregationPeriod = "hour"
+	AggregationPeriodDay    AggregationPeriod = "day"
+	AggregationPeriodWeek   AggregationPeriod = "week"
+	AggregationPeriodMonth  AggregationPeriod = "month"
+	AggregationPeriodYear   AggregationPeriod = "year"
+)
+
+//measurementColumns lists the columns of the stored measurements in the same order
+//as the fields returned by measurementFields
+var measurementColumns = []string{
+	"co2", "humidity", "temperature", "pm10", "pm25", "pm1", "no2", "no", "o3", "so2", "co", "benzene", "voc",
+}
+
+func measurementFields(m *models.AirQualityMeasurements) []**float64 {
+	return []**float64{
+		&m.CO2, &m.Humidity, &m.Temperature, &m.PM10, &m.PM25, &m.PM1, &m.NO2, &m.NO, &m.O3, &m.SO2, &m.CO, &m.Benzene, &m.VOC,
+	}
+}
+
+//periodStartSQL returns an expression that truncates the timestamp of an observation to the
+//start of its period, using date_trunc on PostgreSQL and strftime on SQLite
+func (p AggregationPeriod) periodStartSQL(dialect string) (string, error) {
+	return p.truncateSQL(dialect, `"timestamp"`)
+}
+
+//truncateSQL returns an expression that truncates a time column to the start of its period
+func (p AggregationPeriod) truncateSQL(dialect, column string) (string, error) {
+	switch p {
+	case AggregationPeriodMinute, AggregationPeriodHour, AggregationPeriodDay, AggregationPeriodWeek, AggregationPeriodMonth, AggregationPeriodYear:
+	default:
+		return "", fmt.Errorf("aggregation period %s is not supported", p)
+	}
+
+	if dialect == "postgres" {
+		return fmt.Sprintf(`date_trunc('%s', %s AT TIME ZONE 'UTC')`, p, column), nil
+	}
+
+	formats := map[AggregationPeriod]string{
+		AggregationPeriodMinute: `strftime('%Y-%m-%dT%H:%M:00Z', ` + column + `)`,
+		AggregationPeriodHour:   `strftime('%Y-%m-%dT%H:00:00Z', ` + column + `)`,
+		AggregationPeriodDay:    `strftime('%Y-%m-%dT00:00:00Z', ` + column + `)`,
+		// Step back six days and then forward to the closest monday, as date_trunc does
+		AggregationPeriodWeek:  `strftime('%Y-%m-%dT00:00:00Z', ` + column + `, '-6 days', 'weekday 1')`,
+		AggregationPeriodMonth: `strftime('%Y-%m-01T00:00:00Z', ` + column + `)`,
+		AggregationPeriodYear:  `strftime('%Y-01-01T00:00:00Z', ` + column + `)`,
+	}
+
+	return formats[p], nil
+}
+
+//periodEnd returns the (exclusive) end of the period that starts at start
+func (p AggregationPeriod) periodEnd(start time.Time) time.Time {
+	switch p {
+	case AggregationPeriodMinute:
+		return start.Add(time.Minute)
+	case AggregationPeriodHour:
+		return start.Add(time.Hour)
+	case AggregationPeriodDay:
+		return start.AddDate(0, 0, 1)
+	case AggregationPeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case AggregationPeriodMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+//ObservationAggregate contains the aggregated measurements of an entity during a period of time,
+//keyed on their columns. TotalCount holds the number of observed values of each measurement, while
+//the other aggregates are nil for measurements that were not observed at all during the period.
+type ObservationAggregate struct {
+	EntityId    string
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Average     map[string]*float64
+	Minimum     map[string]*float64
+	Maximum     map[string]*float64
+	Sum         map[string]*float64
+	TotalCount  map[string]*float64
+}
+
+//GetAggregatedObservations groups the matching observations of a kind per entity and period and
+//returns the average, minimum, maximum, sum and count of every measurement within each period.
+//Air quality observations that have been rolled up by a retention policy are included in the
+//periods that their rollups start in. The aggregates are ordered by entity and then chronologically.
+func (db *myDB) GetAggregatedObservations(kind *ObservationKind, deviceId string, from, to time.Time, period AggregationPeriod, options ...QueryOption) ([]ObservationAggregate, error) {
+	qo := newQueryOptions(options)
+
+	query, err := db.aggregatedObservationsQuery(kind, deviceId, from, to, period, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []ObservationAggregate{}
+
+	for rows.Next() {
+		aggregate := ObservationAggregate{}
+		values := [5][]*float64{}
+		fields := [5][]**float64{}
+
+		for method := range values {
+			values[method] = make([]*float64, len(kind.Columns))
+			for idx := range kind.Columns {
+				fields[method] = append(fields[method], &values[method][idx])
+			}
+		}
+
+		aggregate.PeriodStart, aggregate.PeriodEnd, err = scanAggregate(rows, period, &aggregate.EntityId, fields[0], fields[1], fields[2], fields[3], fields[4])
+		if err != nil {
+			return nil, err
+		}
+
+		byColumn := func(values []*float64) map[string]*float64 {
+			m := map[string]*float64{}
+			for idx, column := range kind.Columns {
+				m[column] = values[idx]
+			}
+			return m
+		}
+
+		aggregate.Average = byColumn(values[0])
+		aggregate.Minimum = byColumn(values[1])
+		aggregate.Maximum = byColumn(values[2])
+		aggregate.Sum = byColumn(values[3])
+		aggregate.TotalCount = byColumn(values[4])
+
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, rows.Err()
+}
+
+//aggregatedObservationsQuery returns the query that aggregates the observations of a kind. Air
+//quality observations are aggregated together with their rollups, or from the continuous
+//aggregates when possible.
+func (db *myDB) aggregatedObservationsQuery(kind *ObservationKind, deviceId string, from, to time.Time, period AggregationPeriod, qo *queryOptions) (*gorm.DB, error) {
+	if kind != AirQualityObservedKind {
+		return db.aggregationQuery(db.observations(kind), kind, period, deviceId, from, to, qo)
+	}
+
+	hasRollups, err := db.hasRollups(deviceId, from, to, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasRollups {
+		return db.rollupAggregationQuery(period, deviceId, from, to, qo)
+	}
+
+	if db.timescale && canUseContinuousAggregate(period, from, to, qo) {
+		return db.continuousAggregateQuery(period, deviceId, from, to, qo), nil
+	}
+
+	return db.aggregationQuery(db.airQualityObserveds(), kind, period, deviceId, from, to, qo)
+}
+
+//scanAggregate scans a row that has been selected by aggregationQuery into the entity id and the
+//fields of an aggregate, and returns the start and (exclusive) end of the aggregated period. The
+//fields hold the averages, minimums, maximums, sums and counts in the order of the aggregated columns.
+func scanAggregate(rows *sql.Rows, period AggregationPeriod, entityId *string, averages, minimums, maximums, sums, counts []**float64) (time.Time, time.Time, error) {
+	var periodStart, periodEnd string
+	dest := []interface{}{entityId, &periodStart}
+	if period == AggregationPeriodNone {
+		dest = append(dest, &periodEnd)
+	}
+
+	for idx := range averages {
+		dest = append(dest, averages[idx], minimums[idx], maximums[idx], sums[idx], counts[idx])
+	}
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	start, err := parseTimestamp(periodStart)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if period != AggregationPeriodNone {
+		return start, period.periodEnd(start), nil
+	}
+
+	end, err := parseTimestamp(periodEnd)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return start, end, nil
+}
+
+//aggregationQuery aggregates the columns of the observations of a kind that are selected by source
+func (db *myDB) aggregationQuery(source *gorm.DB, kind *ObservationKind, period AggregationPeriod, deviceId string, from, to time.Time, qo *queryOptions) (*gorm.DB, error) {
+	dialect := db.impl.Dialector.Name()
+	timeColumn := `"` + kind.TimeColumn + `"`
+
+	selects := []string{"entity_id"}
+	groupBy := "entity_id"
+
+	if period == AggregationPeriodNone {
+		if dialect == "postgres" {
+			selects = append(selects, "MIN("+timeColumn+")", "MAX("+timeColumn+")")
+		} else {
+			selects = append(selects,
+				"strftime('%Y-%m-%dT%H:%M:%fZ', MIN(julianday("+timeColumn+")))",
+				"strftime('%Y-%m-%dT%H:%M:%fZ', MAX(julianday("+timeColumn+")))",
+			)
+		}
+	} else {
+		periodStart, err := period.truncateSQL(dialect, timeColumn)
+		if err != nil {
+			return nil, err
+		}
+
+		selects = append(selects, periodStart+" AS period_start")
+		groupBy = "entity_id, period_start"
+	}
+
+	for _, column := range kind.Columns {
+		for _, fn := range []string{"AVG", "MIN", "MAX", "SUM", "COUNT"} {
+			selects = append(selects, fmt.Sprintf(`%s("%s")`, fn, column))
+		}
+	}
+
+	query, err := applyQueryFilters(source, kind, deviceId, from, to, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	return query.Select(strings.Join(selects, ", ")).Group(groupBy).Order(groupBy), nil
+}
+
+//rollupsQuery selects the rolled up observations that match a query. The rollups can not be
+//filtered on measurements, and periods match if they start within the time span.
+func (db *myDB) rollupsQuery(deviceId string, from, to time.Time, qo *queryOptions) *gorm.DB {
+	query := insertTemporalSQL(db.impl.Table(aggregatesTable), "period_start", from, to)
+
+	if deviceId != "" {
+		query = query.Where("device_id = ?", deviceId)
+	}
+
+	if qo.entityId != "" {
+		query = query.Where("entity_id = ?", qo.entityId)
+	}
+
+	if qo.geoQuery != nil {
+		query = insertGeoSQL(query, *qo.geoQuery)
+	}
+
+	return query
+}
+
+//hasRollups returns true if any rolled up observations match a query that can be answered with
+//rollups, i.e. one that does not filter on measurements
+func (db *myDB) hasRollups(deviceId string, from, to time.Time, qo *queryOptions) (bool, error) {
+	if qo.filter != nil {
+		return false, nil
+	}
+
+	if qo.geoQuery != nil {
+		if err := qo.geoQuery.Validate(); err != nil {
+			return false, err
+		}
+	}
+
+	var count int64
+	err := db.rollupsQuery(deviceId, from, to, qo).Limit(1).Count(&count).Error
+	return count > 0, err
+}
+
+//rollupAggregationQuery aggregates the raw observations together with the observations that have
+//been rolled up by a retention policy. Every observation is either raw or rolled up, so the
+//minimums, maximums, sums and counts of both are combined per entity and period.
+func (db *myDB) rollupAggregationQuery(period AggregationPeriod, deviceId string, from, to time.Time, qo *queryOptions) (*gorm.DB, error) {
+	dialect := db.impl.Dialector.Name()
+
+	raw := []string{"entity_id"}
+	rollups := []string{"entity_id"}
+	selects := []string{"entity_id"}
+	groupBy := "entity_id"
+
+	if period == AggregationPeriodNone {
+		raw = append(raw, `MIN("timestamp") AS first`, `MAX("timestamp") AS last`)
+		rollups = append(rollups, "MIN(period_start) AS first", "MAX(period_end) AS last")
+
+		if dialect == "postgres" {
+			selects = append(selects, "MIN(first)", "MAX(last)")
+		} else {
+			selects = append(selects,
+				`strftime('%Y-%m-%dT%H:%M:%fZ', MIN(julianday(first)))`,
+				`strftime('%Y-%m-%dT%H:%M:%fZ', MAX(julianday(last)))`,
+			)
+		}
+	} else {
+		rawStart, err := period.periodStartSQL(dialect)
+		if err != nil {
+			return nil, err
+		}
+		rollupStart, _ := period.truncateSQL(dialect, "period_start")
+
+		raw = append(raw, rawStart+" AS bucket")
+		rollups = append(rollups, rollupStart+" AS bucket")
+		selects = append(selects, "bucket")
+		groupBy = "entity_id, bucket"
+	}
+
+	for _, column := range measurementColumns {
+		raw = append(raw,
+			fmt.Sprintf(`MIN("%s") AS "%s_min"`, column, column),
+			fmt.Sprintf(`MAX("%s") AS "%s_max"`, column, column),
+			fmt.Sprintf(`SUM("%s") AS "%s_sum"`, column, column),
+			fmt.Sprintf(`COUNT("%s") AS "%s_count"`, column, column),
+		)
+
+		for _, fn := range []string{"MIN", "MAX", "SUM"} {
+			name := fmt.Sprintf(`"%s_%s"`, column, strings.ToLower(fn))
+			rollups = append(rollups, fmt.Sprintf("%s(%s) AS %s", fn, name, name))
+		}
+		rollups = append(rollups, fmt.Sprintf(`SUM("%s_count") AS "%s_count"`, column, column))
+
+		selects = append(selects,
+			fmt.Sprintf(`SUM("%s_sum") / NULLIF(SUM("%s_count"), 0)`, column, column),
+			fmt.Sprintf(`MIN("%s_min")`, column),
+			fmt.Sprintf(`MAX("%s_max")`, column),
+			fmt.Sprintf(`SUM("%s_sum")`, column),
+			fmt.Sprintf(`SUM("%s_count")`, column),
+		)
+	}
+
+	rawQuery, err := applyQueryFilters(db.airQualityObserveds(), AirQualityObservedKind, deviceId, from, to, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	rawQuery = rawQuery.Select(strings.Join(raw, ", ")).Group(groupBy)
+	rollupQuery := db.rollupsQuery(deviceId, from, to, qo).Select(strings.Join(rollups, ", ")).Group(groupBy)
+
+	return db.impl.Table("(? UNION ALL ?) AS sources", rawQuery, rollupQuery).
+		Select(strings.Join(selects, ", ")).Group(groupBy).Order(groupBy), nil
+}
+
+//parseTimestamp parses a timestamp that has been returned as text by the database driver
+func parseTimestamp(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse timestamp %s", value)
+}
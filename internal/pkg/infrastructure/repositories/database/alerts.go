@@ -0,0 +1,59 @@
+package database
+
+import (
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+)
+
+//CreateAlert stores a new alert and sets its ID
+func (db *myDB) CreateAlert(alert *models.Alert) error {
+	alert.BreachedAt = alert.BreachedAt.UTC()
+	alert.RaisedAt = alert.RaisedAt.UTC()
+
+	return db.impl.Create(alert).Error
+}
+
+//ClearAlert clears an active alert, or returns ErrNotFound if there is no such active alert
+func (db *myDB) ClearAlert(id uint, clearedAt time.Time, value float64) error {
+	result := db.impl.Model(&models.Alert{}).Where("id = ? AND cleared_at IS NULL", id).Updates(map[string]interface{}{
+		"cleared_at":  clearedAt.UTC(),
+		"clear_value": value,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetAlerts returns the alerts, optionally of a single device, that were raised within a time
+//span, the most recent first. A limit of 0 returns all matching alerts.
+func (db *myDB) GetAlerts(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+	alerts := []models.Alert{}
+
+	query := insertTemporalSQL(db.impl.Order("raised_at DESC, id DESC"), "raised_at", from, to)
+
+	if deviceId != "" {
+		query = query.Where("device_id = ?", deviceId)
+	}
+
+	if activeOnly {
+		query = query.Where("cleared_at IS NULL")
+	}
+
+	if limit > 0 {
+		query = query.Limit(int(limit))
+	}
+
+	err := query.Find(&alerts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
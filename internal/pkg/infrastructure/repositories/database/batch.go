@@ -0,0 +1,197 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+//batchSize is the number of rows that are inserted, or looked up, per statement in batch operations
+const batchSize int = 100
+
+//BatchStoreResult is the outcome of storing one of the observations in a batch. Err is set if
+//the observation could not be stored, e.g. because it was a rejected duplicate.
+type BatchStoreResult struct {
+	Result StoreResult
+	Err    error
+}
+
+type observationKey struct {
+	entityId  string
+	timestamp int64
+}
+
+func keyOf(aqo models.AirQualityObserved) observationKey {
+	return observationKey{entityId: aqo.EntityId, timestamp: aqo.Timestamp.UnixNano()}
+}
+
+//storeAirQualityObserveds stores a batch of observations in a single transaction and returns
+//the outcome of every observation, in the same order. Duplicates, of stored observations as
+//well as within the batch, are handled according to onDuplicate and do not fail the batch.
+func (db *myDB) storeAirQualityObserveds(observations []models.AirQualityObserved, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error) {
+	results := make([]BatchStoreResult, len(observations))
+
+	// The span of the stored observations that were overwritten or replaced
+	var from, to time.Time
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		existing, err := findExistingObservations(tx, observations)
+		if err != nil {
+			return err
+		}
+
+		toCreate := []models.AirQualityObserved{}
+		pending := map[observationKey]int{}
+
+		for idx, o := range observations {
+			aqo := models.AirQualityObserved{
+				EntityId:               o.EntityId,
+				DeviceId:               o.DeviceId,
+				Latitude:               o.Latitude,
+				Longitude:              o.Longitude,
+				Timestamp:              o.Timestamp.UTC(),
+				AirQualityMeasurements: o.AirQualityMeasurements,
+			}
+			key := keyOf(aqo)
+
+			if pos, ok := pending[key]; ok {
+				// A duplicate within the batch itself
+				results[idx] = duplicateResult(aqo, onDuplicate)
+				if results[idx].Result == StoreResultOverwritten {
+					toCreate[pos] = aqo
+				}
+				continue
+			}
+
+			if e, ok := existing[key]; ok {
+				if !e.DeletedAt.Valid {
+					results[idx] = duplicateResult(aqo, onDuplicate)
+					if results[idx].Result != StoreResultOverwritten {
+						continue
+					}
+				}
+
+				// Overwritten and deleted observations are replaced
+				aqo.ID = e.ID
+				aqo.CreatedAt = e.CreatedAt
+
+				err = db.decompressChunks(tx, aqo.Timestamp, aqo.Timestamp)
+				if err != nil {
+					return err
+				}
+
+				err = tx.Unscoped().Save(&aqo).Error
+				if err != nil {
+					return err
+				}
+
+				existing[key] = aqo
+
+				if from.IsZero() || aqo.Timestamp.Before(from) {
+					from = aqo.Timestamp
+				}
+				if aqo.Timestamp.After(to) {
+					to = aqo.Timestamp
+				}
+				continue
+			}
+
+			pending[key] = len(toCreate)
+			toCreate = append(toCreate, aqo)
+		}
+
+		if len(toCreate) > 0 {
+			return tx.CreateInBatches(&toCreate, batchSize).Error
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !from.IsZero() {
+		db.refreshContinuousAggregates(from, to)
+	}
+
+	return results, nil
+}
+
+//storeInBatch stores a number of observations in a single transaction, using store to store the
+//observation at an index, and returns the outcome of every observation in the same order. Rejected
+//duplicates are reported as the outcome of their observation and do not fail the batch.
+func (db *myDB) storeInBatch(count int, store func(tx *gorm.DB, idx int) (StoreResult, error)) ([]BatchStoreResult, error) {
+	results := make([]BatchStoreResult, count)
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		for idx := range results {
+			result, err := store(tx, idx)
+			if errors.Is(err, ErrDuplicate) {
+				results[idx].Err = err
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			results[idx].Result = result
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func duplicateResult(aqo models.AirQualityObserved, onDuplicate DuplicatePolicy) BatchStoreResult {
+	switch onDuplicate {
+	case DuplicatesIgnore:
+		return BatchStoreResult{Result: StoreResultIgnored}
+	case DuplicatesOverwrite:
+		return BatchStoreResult{Result: StoreResultOverwritten}
+	default:
+		return BatchStoreResult{Err: fmt.Errorf("%w (%s at %s)", ErrDuplicate, aqo.EntityId, aqo.Timestamp.Format(time.RFC3339))}
+	}
+}
+
+//findExistingObservations returns the stored observations, including deleted ones, that have
+//the same entity and time as any of the observations
+func findExistingObservations(tx *gorm.DB, observations []models.AirQualityObserved) (map[observationKey]models.AirQualityObserved, error) {
+	existing := map[observationKey]models.AirQualityObserved{}
+
+	for start := 0; start < len(observations); start += batchSize {
+		end := start + batchSize
+		if end > len(observations) {
+			end = len(observations)
+		}
+
+		rows := []string{}
+		keys := []interface{}{}
+		for _, aqo := range observations[start:end] {
+			rows = append(rows, "(?, ?)")
+			keys = append(keys, aqo.EntityId, aqo.Timestamp.UTC())
+		}
+
+		// The entity and time of each observation are matched as a row value against a VALUES list
+		found := []models.AirQualityObserved{}
+		err := tx.Unscoped().Where(`(entity_id, "timestamp") IN (VALUES `+strings.Join(rows, ", ")+")", keys...).Find(&found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, aqo := range found {
+			existing[keyOf(aqo)] = aqo
+		}
+	}
+
+	return existing, nil
+}
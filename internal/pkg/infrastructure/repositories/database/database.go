@@ -1,11 +1,15 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
@@ -13,14 +17,123 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+//ErrNotFound is returned when a requested entity does not exist in the Datastore
+var ErrNotFound = errors.New("not found")
+
+//ErrDuplicate is returned when an observation is rejected because the entity already has an
+//observation at the same point in time
+var ErrDuplicate = errors.New("an observation of this entity at this time already exists")
+
+//DuplicatePolicy decides what happens when an observation is stored for an entity that already
+//has an observation at the same point in time
+type DuplicatePolicy string
+
+const (
+	//DuplicatesIgnore keeps the existing observation and discards the new one
+	DuplicatesIgnore DuplicatePolicy = "ignore"
+	//DuplicatesOverwrite replaces the existing observation with the new one
+	DuplicatesOverwrite DuplicatePolicy = "overwrite"
+	//DuplicatesReject fails with ErrDuplicate
+	DuplicatesReject DuplicatePolicy = "reject"
+)
+
+//ParseDuplicatePolicy returns the DuplicatePolicy with the given name
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case DuplicatesIgnore, DuplicatesOverwrite, DuplicatesReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown duplicate policy %s", name)
+	}
+}
+
+//StoreResult describes what happened when an observation was stored
+type StoreResult int
+
+const (
+	//StoreResultCreated means that the observation was new and has been stored
+	StoreResultCreated StoreResult = iota
+	//StoreResultIgnored means that the observation was a duplicate and has been discarded
+	StoreResultIgnored
+	//StoreResultOverwritten means that the observation was a duplicate and has replaced the existing one
+	StoreResultOverwritten
+)
+
+//Datastore stores the observations of every registered kind, together with the subscriptions,
+//alerts and devices of the application
 type Datastore interface {
-	GetAirQualityObserveds(deviceId string, from, to time.Time, limit uint64) ([]models.AirQualityObserved, error)
-	StoreAirQualityObserved(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error)
+	GetObservation(kind *ObservationKind, entityId string) (Observation, error)
+	GetObservations(kind *ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...QueryOption) ([]Observation, error)
+	GetAggregatedObservations(kind *ObservationKind, deviceId string, from, to time.Time, period AggregationPeriod, options ...QueryOption) ([]ObservationAggregate, error)
+	StoreObservation(kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error)
+	StoreObservations(kind *ObservationKind, observations []Observation, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error)
+	DeleteObservations(kind *ObservationKind, entityIds []string, purge bool) (map[string]int64, error)
+	DeleteObservationsOfDevice(deviceId string, from, to time.Time, purge bool) (int64, error)
+	DeleteMeasurement(kind *ObservationKind, entityId string, id uint, column string, purge bool) error
+	ApplyRetention(kind *ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error)
+
+	CreateSubscription(subscription models.Subscription) error
+	GetSubscription(id string) (*models.Subscription, error)
+	GetSubscriptions() ([]models.Subscription, error)
+	UpdateSubscription(subscription models.Subscription) error
+	DeleteSubscription(id string) error
+	RecordNotification(id string, notifiedAt time.Time, success bool) error
+
+	CreateAlert(alert *models.Alert) error
+	ClearAlert(id uint, clearedAt time.Time, value float64) error
+	GetAlerts(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error)
+
+	GetDevices() ([]models.Device, error)
+	SaveDevices(devices []models.Device) error
+	UpdateDeviceExpectedInterval(deviceId string, interval *int64) error
+	GetObservationGaps(deviceId string, from, to time.Time, minGap time.Duration) (map[string][]ObservationGap, error)
+}
+
+//QueryOption is used to pass additional restrictions to queries against the Datastore
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	entityId       string
+	geoQuery       *GeoQuery
+	filter         *Filter
+	limitPerEntity uint64
+}
+
+//WithEntityID restricts a query to observations of a single entity
+func WithEntityID(entityId string) QueryOption {
+	return func(qo *queryOptions) {
+		qo.entityId = entityId
+	}
+}
+
+//WithGeoQuery restricts a query to entities matching the supplied GeoQuery
+func WithGeoQuery(gq GeoQuery) QueryOption {
+	return func(qo *queryOptions) {
+		qo.geoQuery = &gq
+	}
+}
+
+//WithLimitPerEntity restricts a query to the most recent observations of every entity, instead of
+//the most recent observations of all entities together
+func WithLimitPerEntity(limit uint64) QueryOption {
+	return func(qo *queryOptions) {
+		qo.limitPerEntity = limit
+	}
+}
+
+func newQueryOptions(options []QueryOption) *queryOptions {
+	qo := &queryOptions{}
+	for _, option := range options {
+		option(qo)
+	}
+	return qo
 }
 
 type myDB struct {
 	impl *gorm.DB
 	log  zerolog.Logger
+	//timescale is set when the observations are stored in a TimescaleDB hypertable
+	timescale bool
 }
 
 func getEnv(key, fallback string) string {
@@ -33,14 +146,36 @@ func getEnv(key, fallback string) string {
 //ConnectorFunc is used to inject a database connection method into NewDatabaseConnection
 type ConnectorFunc func() (*gorm.DB, zerolog.Logger, error)
 
+const sqliteDriverName string = "sqlite3_environment"
+
+var registerSQLiteDriver sync.Once
+
 //NewSQLiteConnector opens a connection to a local sqlite database
 func NewSQLiteConnector(log zerolog.Logger) ConnectorFunc {
+	registerSQLiteDriver.Do(func() {
+		// Register a driver that adds the functions needed to approximate PostGIS
+		sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				err := conn.RegisterFunc("haversine", haversine, true)
+				if err != nil {
+					return err
+				}
+				return conn.RegisterFunc("point_in_polygon", pointInPolygon, true)
+			},
+		})
+	})
+
 	return func() (*gorm.DB, zerolog.Logger, error) {
-		db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		dialector := &sqlite.Dialector{DriverName: sqliteDriverName, DSN: "file::memory:"}
+		db, err := gorm.Open(dialector, &gorm.Config{
 			Logger: logger.Default.LogMode(logger.Silent),
 		})
 
 		if err == nil {
+			// Every connection to an in-memory database gets a database of its own
+			sqlDB, _ := db.DB()
+			sqlDB.SetMaxOpenConns(1)
+
 			db.Exec("PRAGMA foreign_keys = ON")
 		}
 
@@ -97,52 +232,131 @@ func NewDatabaseConnection(connect ConnectorFunc) (Datastore, error) {
 		log:  log,
 	}
 
-	db.impl.AutoMigrate(
-		&models.AirQualityObserved{},
-	)
+	if db.impl.Dialector.Name() == "postgres" {
+		// PostGIS is needed for geo-queries against PostgreSQL
+		err = db.impl.Exec("CREATE EXTENSION IF NOT EXISTS postgis").Error
+		if err != nil {
+			log.Error().Err(err).Msg("failed to enable the postgis extension, geo-queries will not work")
+		}
+	}
+
+	migrator, err := newMigrator(db.impl, log)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := migrator.Up()
+	if err != nil {
+		return nil, err
+	}
+
+	if count > 0 {
+		log.Info().Int("count", count).Msg("applied schema migrations")
+	}
+
+	db.timescale = setupTimescaleDB(db.impl, log)
 
 	return db, nil
 }
 
-func (db *myDB) StoreAirQualityObserved(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error) {
-	aqo := models.AirQualityObserved{
-		EntityId:    entityId,
-		DeviceId:    deviceId,
-		CO2:         co2,
-		Humidity:    humidity,
-		Temperature: temperature,
-		Timestamp:   timestamp,
+//storeAirQualityObserved stores an air quality observation, and keeps the continuous aggregates
+//up to date when a stored observation is replaced
+func (db *myDB) storeAirQualityObserved(aqo *models.AirQualityObserved, onDuplicate DuplicatePolicy) (Observation, StoreResult, error) {
+	aqo.Timestamp = aqo.Timestamp.UTC()
+
+	existing := models.AirQualityObserved{}
+	key := duplicateKey{Columns: []string{"entity_id", "timestamp"}, EntityId: aqo.EntityId, ObservedAt: aqo.Timestamp}
+
+	// Compressed chunks of the hypertable must be decompressed before a stored observation can be replaced
+	decompress := func(tx *gorm.DB) error {
+		return db.decompressChunks(tx, aqo.Timestamp, aqo.Timestamp)
 	}
 
-	result := db.impl.Create(&aqo)
-	if result.Error != nil {
-		return nil, result.Error
+	result, err := storeWithDuplicatePolicy(db.impl, aqo, &existing, key, onDuplicate, decompress)
+	if err != nil {
+		return nil, StoreResultCreated, err
 	}
 
-	return &aqo, nil
-}
+	if result == StoreResultIgnored {
+		return &existing, result, nil
+	}
 
-func (db *myDB) GetAirQualityObserveds(deviceId string, from, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-	aqos := []models.AirQualityObserved{}
-	gorm := db.impl.Order("timestamp DESC")
+	if existing.ID != 0 {
+		db.refreshContinuousAggregates(aqo.Timestamp, aqo.Timestamp)
+	}
 
+	return aqo, result, nil
+}
+
+//applyQueryFilters restricts a query to observations of a kind matching the device, time interval
+//and options. Observations made over intervals match if their intervals overlap the time interval.
+func applyQueryFilters(gorm *gorm.DB, kind *ObservationKind, deviceId string, from, to time.Time, qo *queryOptions) (*gorm.DB, error) {
 	if deviceId != "" {
-		gorm = gorm.Where("device = ?", deviceId)
+		gorm = gorm.Where("device_id = ?", deviceId)
 	}
 
-	if !from.IsZero() || !to.IsZero() {
-		gorm = insertTemporalSQL(gorm, "timestamp", from, to)
+	if kind.EndTimeColumn != "" {
+		if !from.IsZero() {
+			gorm = gorm.Where(fmt.Sprintf(`"%s" > ?`, kind.EndTimeColumn), from)
+		}
+
+		if !to.IsZero() {
+			gorm = gorm.Where(fmt.Sprintf(`"%s" < ?`, kind.TimeColumn), to)
+		}
+	} else if !from.IsZero() || !to.IsZero() {
+		gorm = insertTemporalSQL(gorm, `"`+kind.TimeColumn+`"`, from, to)
 		if gorm.Error != nil {
 			return nil, gorm.Error
 		}
 	}
 
-	result := gorm.Limit(int(limit)).Find(&aqos)
-	if result.Error != nil {
-		return nil, result.Error
+	if qo.entityId != "" {
+		gorm = gorm.Where("entity_id = ?", qo.entityId)
+	}
+
+	if qo.geoQuery != nil {
+		err := qo.geoQuery.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		gorm = insertGeoSQL(gorm, *qo.geoQuery)
+	}
+
+	if qo.filter != nil {
+		condition, args, err := qo.filter.sql(kind.Columns, kind.TextColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		gorm = gorm.Where(condition, args...)
 	}
 
-	return aqos, nil
+	return gorm, nil
+}
+
+//limitPerEntity keeps the most recent observations of every entity, ordered by the time column of
+//the kind, if a limit per entity was requested. The observations are ranked in a subquery that is
+//aliased as the table of the kind, so that the returned query can be used like the one that was passed in.
+func (db *myDB) limitPerEntity(query *gorm.DB, kind *ObservationKind, qo *queryOptions) (*gorm.DB, error) {
+	if qo.limitPerEntity == 0 {
+		return query, nil
+	}
+
+	model := kind.New()
+	column := `"` + kind.TimeColumn + `"`
+
+	stmt := &gorm.Statement{DB: db.impl}
+	err := stmt.Parse(model)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := query.Model(model).Select(fmt.Sprintf("*, ROW_NUMBER() OVER (PARTITION BY entity_id ORDER BY %s DESC) AS entity_rank", column))
+
+	return db.impl.Model(model).Table("(?) AS "+stmt.Schema.Table, ranked).
+		Where("entity_rank <= ?", qo.limitPerEntity).
+		Order(column + " DESC"), nil
 }
 
 func insertTemporalSQL(gorm *gorm.DB, property string, from, to time.Time) *gorm.DB {
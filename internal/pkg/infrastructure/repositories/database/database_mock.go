@@ -19,11 +19,71 @@ var _ Datastore = &DatastoreMock{}
 //
 // 		// make and configure a mocked Datastore
 // 		mockedDatastore := &DatastoreMock{
-// 			GetAirQualityObservedsFunc: func(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-// 				panic("mock out the GetAirQualityObserveds method")
+// 			ApplyRetentionFunc: func(kind *ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error) {
+// 				panic("mock out the ApplyRetention method")
 // 			},
-// 			StoreAirQualityObservedFunc: func(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error) {
-// 				panic("mock out the StoreAirQualityObserved method")
+// 			ClearAlertFunc: func(id uint, clearedAt time.Time, value float64) error {
+// 				panic("mock out the ClearAlert method")
+// 			},
+// 			CreateAlertFunc: func(alert *models.Alert) error {
+// 				panic("mock out the CreateAlert method")
+// 			},
+// 			CreateSubscriptionFunc: func(subscription models.Subscription) error {
+// 				panic("mock out the CreateSubscription method")
+// 			},
+// 			DeleteMeasurementFunc: func(kind *ObservationKind, entityId string, id uint, column string, purge bool) error {
+// 				panic("mock out the DeleteMeasurement method")
+// 			},
+// 			DeleteObservationsFunc: func(kind *ObservationKind, entityIds []string, purge bool) (map[string]int64, error) {
+// 				panic("mock out the DeleteObservations method")
+// 			},
+// 			DeleteObservationsOfDeviceFunc: func(deviceId string, from time.Time, to time.Time, purge bool) (int64, error) {
+// 				panic("mock out the DeleteObservationsOfDevice method")
+// 			},
+// 			DeleteSubscriptionFunc: func(id string) error {
+// 				panic("mock out the DeleteSubscription method")
+// 			},
+// 			GetAggregatedObservationsFunc: func(kind *ObservationKind, deviceId string, from time.Time, to time.Time, period AggregationPeriod, options ...QueryOption) ([]ObservationAggregate, error) {
+// 				panic("mock out the GetAggregatedObservations method")
+// 			},
+// 			GetAlertsFunc: func(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+// 				panic("mock out the GetAlerts method")
+// 			},
+// 			GetDevicesFunc: func() ([]models.Device, error) {
+// 				panic("mock out the GetDevices method")
+// 			},
+// 			GetObservationFunc: func(kind *ObservationKind, entityId string) (Observation, error) {
+// 				panic("mock out the GetObservation method")
+// 			},
+// 			GetObservationGapsFunc: func(deviceId string, from time.Time, to time.Time, minGap time.Duration) (map[string][]ObservationGap, error) {
+// 				panic("mock out the GetObservationGaps method")
+// 			},
+// 			GetObservationsFunc: func(kind *ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...QueryOption) ([]Observation, error) {
+// 				panic("mock out the GetObservations method")
+// 			},
+// 			GetSubscriptionFunc: func(id string) (*models.Subscription, error) {
+// 				panic("mock out the GetSubscription method")
+// 			},
+// 			GetSubscriptionsFunc: func() ([]models.Subscription, error) {
+// 				panic("mock out the GetSubscriptions method")
+// 			},
+// 			RecordNotificationFunc: func(id string, notifiedAt time.Time, success bool) error {
+// 				panic("mock out the RecordNotification method")
+// 			},
+// 			SaveDevicesFunc: func(devices []models.Device) error {
+// 				panic("mock out the SaveDevices method")
+// 			},
+// 			StoreObservationFunc: func(kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error) {
+// 				panic("mock out the StoreObservation method")
+// 			},
+// 			StoreObservationsFunc: func(kind *ObservationKind, observations []Observation, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error) {
+// 				panic("mock out the StoreObservations method")
+// 			},
+// 			UpdateDeviceExpectedIntervalFunc: func(deviceId string, interval *int64) error {
+// 				panic("mock out the UpdateDeviceExpectedInterval method")
+// 			},
+// 			UpdateSubscriptionFunc: func(subscription models.Subscription) error {
+// 				panic("mock out the UpdateSubscription method")
 // 			},
 // 		}
 //
@@ -32,135 +92,1113 @@ var _ Datastore = &DatastoreMock{}
 //
 // 	}
 type DatastoreMock struct {
-	// GetAirQualityObservedsFunc mocks the GetAirQualityObserveds method.
-	GetAirQualityObservedsFunc func(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error)
+	// ApplyRetentionFunc mocks the ApplyRetention method.
+	ApplyRetentionFunc func(kind *ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error)
+
+	// ClearAlertFunc mocks the ClearAlert method.
+	ClearAlertFunc func(id uint, clearedAt time.Time, value float64) error
+
+	// CreateAlertFunc mocks the CreateAlert method.
+	CreateAlertFunc func(alert *models.Alert) error
+
+	// CreateSubscriptionFunc mocks the CreateSubscription method.
+	CreateSubscriptionFunc func(subscription models.Subscription) error
+
+	// DeleteMeasurementFunc mocks the DeleteMeasurement method.
+	DeleteMeasurementFunc func(kind *ObservationKind, entityId string, id uint, column string, purge bool) error
 
-	// StoreAirQualityObservedFunc mocks the StoreAirQualityObserved method.
-	StoreAirQualityObservedFunc func(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error)
+	// DeleteObservationsFunc mocks the DeleteObservations method.
+	DeleteObservationsFunc func(kind *ObservationKind, entityIds []string, purge bool) (map[string]int64, error)
+
+	// DeleteObservationsOfDeviceFunc mocks the DeleteObservationsOfDevice method.
+	DeleteObservationsOfDeviceFunc func(deviceId string, from time.Time, to time.Time, purge bool) (int64, error)
+
+	// DeleteSubscriptionFunc mocks the DeleteSubscription method.
+	DeleteSubscriptionFunc func(id string) error
+
+	// GetAggregatedObservationsFunc mocks the GetAggregatedObservations method.
+	GetAggregatedObservationsFunc func(kind *ObservationKind, deviceId string, from time.Time, to time.Time, period AggregationPeriod, options ...QueryOption) ([]ObservationAggregate, error)
+
+	// GetAlertsFunc mocks the GetAlerts method.
+	GetAlertsFunc func(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error)
+
+	// GetDevicesFunc mocks the GetDevices method.
+	GetDevicesFunc func() ([]models.Device, error)
+
+	// GetObservationFunc mocks the GetObservation method.
+	GetObservationFunc func(kind *ObservationKind, entityId string) (Observation, error)
+
+	// GetObservationGapsFunc mocks the GetObservationGaps method.
+	GetObservationGapsFunc func(deviceId string, from time.Time, to time.Time, minGap time.Duration) (map[string][]ObservationGap, error)
+
+	// GetObservationsFunc mocks the GetObservations method.
+	GetObservationsFunc func(kind *ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...QueryOption) ([]Observation, error)
+
+	// GetSubscriptionFunc mocks the GetSubscription method.
+	GetSubscriptionFunc func(id string) (*models.Subscription, error)
+
+	// GetSubscriptionsFunc mocks the GetSubscriptions method.
+	GetSubscriptionsFunc func() ([]models.Subscription, error)
+
+	// RecordNotificationFunc mocks the RecordNotification method.
+	RecordNotificationFunc func(id string, notifiedAt time.Time, success bool) error
+
+	// SaveDevicesFunc mocks the SaveDevices method.
+	SaveDevicesFunc func(devices []models.Device) error
+
+	// StoreObservationFunc mocks the StoreObservation method.
+	StoreObservationFunc func(kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error)
+
+	// StoreObservationsFunc mocks the StoreObservations method.
+	StoreObservationsFunc func(kind *ObservationKind, observations []Observation, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error)
+
+	// UpdateDeviceExpectedIntervalFunc mocks the UpdateDeviceExpectedInterval method.
+	UpdateDeviceExpectedIntervalFunc func(deviceId string, interval *int64) error
+
+	// UpdateSubscriptionFunc mocks the UpdateSubscription method.
+	UpdateSubscriptionFunc func(subscription models.Subscription) error
 
 	// calls tracks calls to the methods.
 	calls struct {
-		// GetAirQualityObserveds holds details about calls to the GetAirQualityObserveds method.
-		GetAirQualityObserveds []struct {
+		// ApplyRetention holds details about calls to the ApplyRetention method.
+		ApplyRetention []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// RawBefore is the rawBefore argument value.
+			RawBefore time.Time
+			// Interval is the interval argument value.
+			Interval time.Duration
+			// AggregatesBefore is the aggregatesBefore argument value.
+			AggregatesBefore time.Time
+			// DryRun is the dryRun argument value.
+			DryRun bool
+		}
+		// ClearAlert holds details about calls to the ClearAlert method.
+		ClearAlert []struct {
+			// ID is the id argument value.
+			ID uint
+			// ClearedAt is the clearedAt argument value.
+			ClearedAt time.Time
+			// Value is the value argument value.
+			Value float64
+		}
+		// CreateAlert holds details about calls to the CreateAlert method.
+		CreateAlert []struct {
+			// Alert is the alert argument value.
+			Alert *models.Alert
+		}
+		// CreateSubscription holds details about calls to the CreateSubscription method.
+		CreateSubscription []struct {
+			// Subscription is the subscription argument value.
+			Subscription models.Subscription
+		}
+		// DeleteMeasurement holds details about calls to the DeleteMeasurement method.
+		DeleteMeasurement []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// EntityId is the entityId argument value.
+			EntityId string
+			// ID is the id argument value.
+			ID uint
+			// Column is the column argument value.
+			Column string
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteObservations holds details about calls to the DeleteObservations method.
+		DeleteObservations []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// EntityIds is the entityIds argument value.
+			EntityIds []string
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteObservationsOfDevice holds details about calls to the DeleteObservationsOfDevice method.
+		DeleteObservationsOfDevice []struct {
 			// DeviceId is the deviceId argument value.
 			DeviceId string
 			// From is the from argument value.
 			From time.Time
 			// To is the to argument value.
 			To time.Time
+			// Purge is the purge argument value.
+			Purge bool
+		}
+		// DeleteSubscription holds details about calls to the DeleteSubscription method.
+		DeleteSubscription []struct {
+			// ID is the id argument value.
+			ID string
+		}
+		// GetAggregatedObservations holds details about calls to the GetAggregatedObservations method.
+		GetAggregatedObservations []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// Period is the period argument value.
+			Period AggregationPeriod
+			// Options is the options argument value.
+			Options []QueryOption
+		}
+		// GetAlerts holds details about calls to the GetAlerts method.
+		GetAlerts []struct {
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// ActiveOnly is the activeOnly argument value.
+			ActiveOnly bool
 			// Limit is the limit argument value.
 			Limit uint64
 		}
-		// StoreAirQualityObserved holds details about calls to the StoreAirQualityObserved method.
-		StoreAirQualityObserved []struct {
+		// GetDevices holds details about calls to the GetDevices method.
+		GetDevices []struct {
+		}
+		// GetObservation holds details about calls to the GetObservation method.
+		GetObservation []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
 			// EntityId is the entityId argument value.
 			EntityId string
+		}
+		// GetObservationGaps holds details about calls to the GetObservationGaps method.
+		GetObservationGaps []struct {
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// MinGap is the minGap argument value.
+			MinGap time.Duration
+		}
+		// GetObservations holds details about calls to the GetObservations method.
+		GetObservations []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
 			// DeviceId is the deviceId argument value.
 			DeviceId string
-			// Co2 is the co2 argument value.
-			Co2 float64
-			// Humidity is the humidity argument value.
-			Humidity float64
-			// Temperature is the temperature argument value.
-			Temperature float64
-			// Timestamp is the timestamp argument value.
-			Timestamp time.Time
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// Limit is the limit argument value.
+			Limit uint64
+			// Options is the options argument value.
+			Options []QueryOption
+		}
+		// GetSubscription holds details about calls to the GetSubscription method.
+		GetSubscription []struct {
+			// ID is the id argument value.
+			ID string
+		}
+		// GetSubscriptions holds details about calls to the GetSubscriptions method.
+		GetSubscriptions []struct {
+		}
+		// RecordNotification holds details about calls to the RecordNotification method.
+		RecordNotification []struct {
+			// ID is the id argument value.
+			ID string
+			// NotifiedAt is the notifiedAt argument value.
+			NotifiedAt time.Time
+			// Success is the success argument value.
+			Success bool
+		}
+		// SaveDevices holds details about calls to the SaveDevices method.
+		SaveDevices []struct {
+			// Devices is the devices argument value.
+			Devices []models.Device
+		}
+		// StoreObservation holds details about calls to the StoreObservation method.
+		StoreObservation []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// Observation is the observation argument value.
+			Observation Observation
+			// OnDuplicate is the onDuplicate argument value.
+			OnDuplicate DuplicatePolicy
+		}
+		// StoreObservations holds details about calls to the StoreObservations method.
+		StoreObservations []struct {
+			// Kind is the kind argument value.
+			Kind *ObservationKind
+			// Observations is the observations argument value.
+			Observations []Observation
+			// OnDuplicate is the onDuplicate argument value.
+			OnDuplicate DuplicatePolicy
 		}
+		// UpdateDeviceExpectedInterval holds details about calls to the UpdateDeviceExpectedInterval method.
+		UpdateDeviceExpectedInterval []struct {
+			// DeviceId is the deviceId argument value.
+			DeviceId string
+			// Interval is the interval argument value.
+			Interval *int64
+		}
+		// UpdateSubscription holds details about calls to the UpdateSubscription method.
+		UpdateSubscription []struct {
+			// Subscription is the subscription argument value.
+			Subscription models.Subscription
+		}
+	}
+	lockApplyRetention               sync.RWMutex
+	lockClearAlert                   sync.RWMutex
+	lockCreateAlert                  sync.RWMutex
+	lockCreateSubscription           sync.RWMutex
+	lockDeleteMeasurement            sync.RWMutex
+	lockDeleteObservations           sync.RWMutex
+	lockDeleteObservationsOfDevice   sync.RWMutex
+	lockDeleteSubscription           sync.RWMutex
+	lockGetAggregatedObservations    sync.RWMutex
+	lockGetAlerts                    sync.RWMutex
+	lockGetDevices                   sync.RWMutex
+	lockGetObservation               sync.RWMutex
+	lockGetObservationGaps           sync.RWMutex
+	lockGetObservations              sync.RWMutex
+	lockGetSubscription              sync.RWMutex
+	lockGetSubscriptions             sync.RWMutex
+	lockRecordNotification           sync.RWMutex
+	lockSaveDevices                  sync.RWMutex
+	lockStoreObservation             sync.RWMutex
+	lockStoreObservations            sync.RWMutex
+	lockUpdateDeviceExpectedInterval sync.RWMutex
+	lockUpdateSubscription           sync.RWMutex
+}
+
+// ApplyRetention calls ApplyRetentionFunc.
+func (mock *DatastoreMock) ApplyRetention(kind *ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error) {
+	if mock.ApplyRetentionFunc == nil {
+		panic("DatastoreMock.ApplyRetentionFunc: method is nil but Datastore.ApplyRetention was just called")
+	}
+	callInfo := struct {
+		Kind             *ObservationKind
+		RawBefore        time.Time
+		Interval         time.Duration
+		AggregatesBefore time.Time
+		DryRun           bool
+	}{
+		Kind:             kind,
+		RawBefore:        rawBefore,
+		Interval:         interval,
+		AggregatesBefore: aggregatesBefore,
+		DryRun:           dryRun,
+	}
+	mock.lockApplyRetention.Lock()
+	mock.calls.ApplyRetention = append(mock.calls.ApplyRetention, callInfo)
+	mock.lockApplyRetention.Unlock()
+	return mock.ApplyRetentionFunc(kind, rawBefore, interval, aggregatesBefore, dryRun)
+}
+
+// ApplyRetentionCalls gets all the calls that were made to ApplyRetention.
+// Check the length with:
+//     len(mockedDatastore.ApplyRetentionCalls())
+func (mock *DatastoreMock) ApplyRetentionCalls() []struct {
+	Kind             *ObservationKind
+	RawBefore        time.Time
+	Interval         time.Duration
+	AggregatesBefore time.Time
+	DryRun           bool
+} {
+	var calls []struct {
+		Kind             *ObservationKind
+		RawBefore        time.Time
+		Interval         time.Duration
+		AggregatesBefore time.Time
+		DryRun           bool
+	}
+	mock.lockApplyRetention.RLock()
+	calls = mock.calls.ApplyRetention
+	mock.lockApplyRetention.RUnlock()
+	return calls
+}
+
+// ClearAlert calls ClearAlertFunc.
+func (mock *DatastoreMock) ClearAlert(id uint, clearedAt time.Time, value float64) error {
+	if mock.ClearAlertFunc == nil {
+		panic("DatastoreMock.ClearAlertFunc: method is nil but Datastore.ClearAlert was just called")
+	}
+	callInfo := struct {
+		ID        uint
+		ClearedAt time.Time
+		Value     float64
+	}{
+		ID:        id,
+		ClearedAt: clearedAt,
+		Value:     value,
+	}
+	mock.lockClearAlert.Lock()
+	mock.calls.ClearAlert = append(mock.calls.ClearAlert, callInfo)
+	mock.lockClearAlert.Unlock()
+	return mock.ClearAlertFunc(id, clearedAt, value)
+}
+
+// ClearAlertCalls gets all the calls that were made to ClearAlert.
+// Check the length with:
+//     len(mockedDatastore.ClearAlertCalls())
+func (mock *DatastoreMock) ClearAlertCalls() []struct {
+	ID        uint
+	ClearedAt time.Time
+	Value     float64
+} {
+	var calls []struct {
+		ID        uint
+		ClearedAt time.Time
+		Value     float64
+	}
+	mock.lockClearAlert.RLock()
+	calls = mock.calls.ClearAlert
+	mock.lockClearAlert.RUnlock()
+	return calls
+}
+
+// CreateAlert calls CreateAlertFunc.
+func (mock *DatastoreMock) CreateAlert(alert *models.Alert) error {
+	if mock.CreateAlertFunc == nil {
+		panic("DatastoreMock.CreateAlertFunc: method is nil but Datastore.CreateAlert was just called")
+	}
+	callInfo := struct {
+		Alert *models.Alert
+	}{
+		Alert: alert,
+	}
+	mock.lockCreateAlert.Lock()
+	mock.calls.CreateAlert = append(mock.calls.CreateAlert, callInfo)
+	mock.lockCreateAlert.Unlock()
+	return mock.CreateAlertFunc(alert)
+}
+
+// CreateAlertCalls gets all the calls that were made to CreateAlert.
+// Check the length with:
+//     len(mockedDatastore.CreateAlertCalls())
+func (mock *DatastoreMock) CreateAlertCalls() []struct {
+	Alert *models.Alert
+} {
+	var calls []struct {
+		Alert *models.Alert
+	}
+	mock.lockCreateAlert.RLock()
+	calls = mock.calls.CreateAlert
+	mock.lockCreateAlert.RUnlock()
+	return calls
+}
+
+// CreateSubscription calls CreateSubscriptionFunc.
+func (mock *DatastoreMock) CreateSubscription(subscription models.Subscription) error {
+	if mock.CreateSubscriptionFunc == nil {
+		panic("DatastoreMock.CreateSubscriptionFunc: method is nil but Datastore.CreateSubscription was just called")
+	}
+	callInfo := struct {
+		Subscription models.Subscription
+	}{
+		Subscription: subscription,
+	}
+	mock.lockCreateSubscription.Lock()
+	mock.calls.CreateSubscription = append(mock.calls.CreateSubscription, callInfo)
+	mock.lockCreateSubscription.Unlock()
+	return mock.CreateSubscriptionFunc(subscription)
+}
+
+// CreateSubscriptionCalls gets all the calls that were made to CreateSubscription.
+// Check the length with:
+//     len(mockedDatastore.CreateSubscriptionCalls())
+func (mock *DatastoreMock) CreateSubscriptionCalls() []struct {
+	Subscription models.Subscription
+} {
+	var calls []struct {
+		Subscription models.Subscription
+	}
+	mock.lockCreateSubscription.RLock()
+	calls = mock.calls.CreateSubscription
+	mock.lockCreateSubscription.RUnlock()
+	return calls
+}
+
+// DeleteMeasurement calls DeleteMeasurementFunc.
+func (mock *DatastoreMock) DeleteMeasurement(kind *ObservationKind, entityId string, id uint, column string, purge bool) error {
+	if mock.DeleteMeasurementFunc == nil {
+		panic("DatastoreMock.DeleteMeasurementFunc: method is nil but Datastore.DeleteMeasurement was just called")
+	}
+	callInfo := struct {
+		Kind     *ObservationKind
+		EntityId string
+		ID       uint
+		Column   string
+		Purge    bool
+	}{
+		Kind:     kind,
+		EntityId: entityId,
+		ID:       id,
+		Column:   column,
+		Purge:    purge,
+	}
+	mock.lockDeleteMeasurement.Lock()
+	mock.calls.DeleteMeasurement = append(mock.calls.DeleteMeasurement, callInfo)
+	mock.lockDeleteMeasurement.Unlock()
+	return mock.DeleteMeasurementFunc(kind, entityId, id, column, purge)
+}
+
+// DeleteMeasurementCalls gets all the calls that were made to DeleteMeasurement.
+// Check the length with:
+//     len(mockedDatastore.DeleteMeasurementCalls())
+func (mock *DatastoreMock) DeleteMeasurementCalls() []struct {
+	Kind     *ObservationKind
+	EntityId string
+	ID       uint
+	Column   string
+	Purge    bool
+} {
+	var calls []struct {
+		Kind     *ObservationKind
+		EntityId string
+		ID       uint
+		Column   string
+		Purge    bool
+	}
+	mock.lockDeleteMeasurement.RLock()
+	calls = mock.calls.DeleteMeasurement
+	mock.lockDeleteMeasurement.RUnlock()
+	return calls
+}
+
+// DeleteObservations calls DeleteObservationsFunc.
+func (mock *DatastoreMock) DeleteObservations(kind *ObservationKind, entityIds []string, purge bool) (map[string]int64, error) {
+	if mock.DeleteObservationsFunc == nil {
+		panic("DatastoreMock.DeleteObservationsFunc: method is nil but Datastore.DeleteObservations was just called")
+	}
+	callInfo := struct {
+		Kind      *ObservationKind
+		EntityIds []string
+		Purge     bool
+	}{
+		Kind:      kind,
+		EntityIds: entityIds,
+		Purge:     purge,
+	}
+	mock.lockDeleteObservations.Lock()
+	mock.calls.DeleteObservations = append(mock.calls.DeleteObservations, callInfo)
+	mock.lockDeleteObservations.Unlock()
+	return mock.DeleteObservationsFunc(kind, entityIds, purge)
+}
+
+// DeleteObservationsCalls gets all the calls that were made to DeleteObservations.
+// Check the length with:
+//     len(mockedDatastore.DeleteObservationsCalls())
+func (mock *DatastoreMock) DeleteObservationsCalls() []struct {
+	Kind      *ObservationKind
+	EntityIds []string
+	Purge     bool
+} {
+	var calls []struct {
+		Kind      *ObservationKind
+		EntityIds []string
+		Purge     bool
+	}
+	mock.lockDeleteObservations.RLock()
+	calls = mock.calls.DeleteObservations
+	mock.lockDeleteObservations.RUnlock()
+	return calls
+}
+
+// DeleteObservationsOfDevice calls DeleteObservationsOfDeviceFunc.
+func (mock *DatastoreMock) DeleteObservationsOfDevice(deviceId string, from time.Time, to time.Time, purge bool) (int64, error) {
+	if mock.DeleteObservationsOfDeviceFunc == nil {
+		panic("DatastoreMock.DeleteObservationsOfDeviceFunc: method is nil but Datastore.DeleteObservationsOfDevice was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Purge    bool
+	}{
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+		Purge:    purge,
+	}
+	mock.lockDeleteObservationsOfDevice.Lock()
+	mock.calls.DeleteObservationsOfDevice = append(mock.calls.DeleteObservationsOfDevice, callInfo)
+	mock.lockDeleteObservationsOfDevice.Unlock()
+	return mock.DeleteObservationsOfDeviceFunc(deviceId, from, to, purge)
+}
+
+// DeleteObservationsOfDeviceCalls gets all the calls that were made to DeleteObservationsOfDevice.
+// Check the length with:
+//     len(mockedDatastore.DeleteObservationsOfDeviceCalls())
+func (mock *DatastoreMock) DeleteObservationsOfDeviceCalls() []struct {
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	Purge    bool
+} {
+	var calls []struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Purge    bool
+	}
+	mock.lockDeleteObservationsOfDevice.RLock()
+	calls = mock.calls.DeleteObservationsOfDevice
+	mock.lockDeleteObservationsOfDevice.RUnlock()
+	return calls
+}
+
+// DeleteSubscription calls DeleteSubscriptionFunc.
+func (mock *DatastoreMock) DeleteSubscription(id string) error {
+	if mock.DeleteSubscriptionFunc == nil {
+		panic("DatastoreMock.DeleteSubscriptionFunc: method is nil but Datastore.DeleteSubscription was just called")
+	}
+	callInfo := struct {
+		ID string
+	}{
+		ID: id,
+	}
+	mock.lockDeleteSubscription.Lock()
+	mock.calls.DeleteSubscription = append(mock.calls.DeleteSubscription, callInfo)
+	mock.lockDeleteSubscription.Unlock()
+	return mock.DeleteSubscriptionFunc(id)
+}
+
+// DeleteSubscriptionCalls gets all the calls that were made to DeleteSubscription.
+// Check the length with:
+//     len(mockedDatastore.DeleteSubscriptionCalls())
+func (mock *DatastoreMock) DeleteSubscriptionCalls() []struct {
+	ID string
+} {
+	var calls []struct {
+		ID string
+	}
+	mock.lockDeleteSubscription.RLock()
+	calls = mock.calls.DeleteSubscription
+	mock.lockDeleteSubscription.RUnlock()
+	return calls
+}
+
+// GetAggregatedObservations calls GetAggregatedObservationsFunc.
+func (mock *DatastoreMock) GetAggregatedObservations(kind *ObservationKind, deviceId string, from time.Time, to time.Time, period AggregationPeriod, options ...QueryOption) ([]ObservationAggregate, error) {
+	if mock.GetAggregatedObservationsFunc == nil {
+		panic("DatastoreMock.GetAggregatedObservationsFunc: method is nil but Datastore.GetAggregatedObservations was just called")
+	}
+	callInfo := struct {
+		Kind     *ObservationKind
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Period   AggregationPeriod
+		Options  []QueryOption
+	}{
+		Kind:     kind,
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+		Period:   period,
+		Options:  options,
+	}
+	mock.lockGetAggregatedObservations.Lock()
+	mock.calls.GetAggregatedObservations = append(mock.calls.GetAggregatedObservations, callInfo)
+	mock.lockGetAggregatedObservations.Unlock()
+	return mock.GetAggregatedObservationsFunc(kind, deviceId, from, to, period, options...)
+}
+
+// GetAggregatedObservationsCalls gets all the calls that were made to GetAggregatedObservations.
+// Check the length with:
+//     len(mockedDatastore.GetAggregatedObservationsCalls())
+func (mock *DatastoreMock) GetAggregatedObservationsCalls() []struct {
+	Kind     *ObservationKind
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	Period   AggregationPeriod
+	Options  []QueryOption
+} {
+	var calls []struct {
+		Kind     *ObservationKind
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		Period   AggregationPeriod
+		Options  []QueryOption
+	}
+	mock.lockGetAggregatedObservations.RLock()
+	calls = mock.calls.GetAggregatedObservations
+	mock.lockGetAggregatedObservations.RUnlock()
+	return calls
+}
+
+// GetAlerts calls GetAlertsFunc.
+func (mock *DatastoreMock) GetAlerts(deviceId string, from time.Time, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+	if mock.GetAlertsFunc == nil {
+		panic("DatastoreMock.GetAlertsFunc: method is nil but Datastore.GetAlerts was just called")
+	}
+	callInfo := struct {
+		DeviceId   string
+		From       time.Time
+		To         time.Time
+		ActiveOnly bool
+		Limit      uint64
+	}{
+		DeviceId:   deviceId,
+		From:       from,
+		To:         to,
+		ActiveOnly: activeOnly,
+		Limit:      limit,
+	}
+	mock.lockGetAlerts.Lock()
+	mock.calls.GetAlerts = append(mock.calls.GetAlerts, callInfo)
+	mock.lockGetAlerts.Unlock()
+	return mock.GetAlertsFunc(deviceId, from, to, activeOnly, limit)
+}
+
+// GetAlertsCalls gets all the calls that were made to GetAlerts.
+// Check the length with:
+//     len(mockedDatastore.GetAlertsCalls())
+func (mock *DatastoreMock) GetAlertsCalls() []struct {
+	DeviceId   string
+	From       time.Time
+	To         time.Time
+	ActiveOnly bool
+	Limit      uint64
+} {
+	var calls []struct {
+		DeviceId   string
+		From       time.Time
+		To         time.Time
+		ActiveOnly bool
+		Limit      uint64
+	}
+	mock.lockGetAlerts.RLock()
+	calls = mock.calls.GetAlerts
+	mock.lockGetAlerts.RUnlock()
+	return calls
+}
+
+// GetDevices calls GetDevicesFunc.
+func (mock *DatastoreMock) GetDevices() ([]models.Device, error) {
+	if mock.GetDevicesFunc == nil {
+		panic("DatastoreMock.GetDevicesFunc: method is nil but Datastore.GetDevices was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockGetDevices.Lock()
+	mock.calls.GetDevices = append(mock.calls.GetDevices, callInfo)
+	mock.lockGetDevices.Unlock()
+	return mock.GetDevicesFunc()
+}
+
+// GetDevicesCalls gets all the calls that were made to GetDevices.
+// Check the length with:
+//     len(mockedDatastore.GetDevicesCalls())
+func (mock *DatastoreMock) GetDevicesCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockGetDevices.RLock()
+	calls = mock.calls.GetDevices
+	mock.lockGetDevices.RUnlock()
+	return calls
+}
+
+// GetObservation calls GetObservationFunc.
+func (mock *DatastoreMock) GetObservation(kind *ObservationKind, entityId string) (Observation, error) {
+	if mock.GetObservationFunc == nil {
+		panic("DatastoreMock.GetObservationFunc: method is nil but Datastore.GetObservation was just called")
+	}
+	callInfo := struct {
+		Kind     *ObservationKind
+		EntityId string
+	}{
+		Kind:     kind,
+		EntityId: entityId,
+	}
+	mock.lockGetObservation.Lock()
+	mock.calls.GetObservation = append(mock.calls.GetObservation, callInfo)
+	mock.lockGetObservation.Unlock()
+	return mock.GetObservationFunc(kind, entityId)
+}
+
+// GetObservationCalls gets all the calls that were made to GetObservation.
+// Check the length with:
+//     len(mockedDatastore.GetObservationCalls())
+func (mock *DatastoreMock) GetObservationCalls() []struct {
+	Kind     *ObservationKind
+	EntityId string
+} {
+	var calls []struct {
+		Kind     *ObservationKind
+		EntityId string
+	}
+	mock.lockGetObservation.RLock()
+	calls = mock.calls.GetObservation
+	mock.lockGetObservation.RUnlock()
+	return calls
+}
+
+// GetObservationGaps calls GetObservationGapsFunc.
+func (mock *DatastoreMock) GetObservationGaps(deviceId string, from time.Time, to time.Time, minGap time.Duration) (map[string][]ObservationGap, error) {
+	if mock.GetObservationGapsFunc == nil {
+		panic("DatastoreMock.GetObservationGapsFunc: method is nil but Datastore.GetObservationGaps was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		MinGap   time.Duration
+	}{
+		DeviceId: deviceId,
+		From:     from,
+		To:       to,
+		MinGap:   minGap,
+	}
+	mock.lockGetObservationGaps.Lock()
+	mock.calls.GetObservationGaps = append(mock.calls.GetObservationGaps, callInfo)
+	mock.lockGetObservationGaps.Unlock()
+	return mock.GetObservationGapsFunc(deviceId, from, to, minGap)
+}
+
+// GetObservationGapsCalls gets all the calls that were made to GetObservationGaps.
+// Check the length with:
+//     len(mockedDatastore.GetObservationGapsCalls())
+func (mock *DatastoreMock) GetObservationGapsCalls() []struct {
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	MinGap   time.Duration
+} {
+	var calls []struct {
+		DeviceId string
+		From     time.Time
+		To       time.Time
+		MinGap   time.Duration
 	}
-	lockGetAirQualityObserveds  sync.RWMutex
-	lockStoreAirQualityObserved sync.RWMutex
+	mock.lockGetObservationGaps.RLock()
+	calls = mock.calls.GetObservationGaps
+	mock.lockGetObservationGaps.RUnlock()
+	return calls
 }
 
-// GetAirQualityObserveds calls GetAirQualityObservedsFunc.
-func (mock *DatastoreMock) GetAirQualityObserveds(deviceId string, from time.Time, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-	if mock.GetAirQualityObservedsFunc == nil {
-		panic("DatastoreMock.GetAirQualityObservedsFunc: method is nil but Datastore.GetAirQualityObserveds was just called")
+// GetObservations calls GetObservationsFunc.
+func (mock *DatastoreMock) GetObservations(kind *ObservationKind, deviceId string, from time.Time, to time.Time, limit uint64, options ...QueryOption) ([]Observation, error) {
+	if mock.GetObservationsFunc == nil {
+		panic("DatastoreMock.GetObservationsFunc: method is nil but Datastore.GetObservations was just called")
 	}
 	callInfo := struct {
+		Kind     *ObservationKind
 		DeviceId string
 		From     time.Time
 		To       time.Time
 		Limit    uint64
+		Options  []QueryOption
 	}{
+		Kind:     kind,
 		DeviceId: deviceId,
 		From:     from,
 		To:       to,
 		Limit:    limit,
+		Options:  options,
 	}
-	mock.lockGetAirQualityObserveds.Lock()
-	mock.calls.GetAirQualityObserveds = append(mock.calls.GetAirQualityObserveds, callInfo)
-	mock.lockGetAirQualityObserveds.Unlock()
-	return mock.GetAirQualityObservedsFunc(deviceId, from, to, limit)
+	mock.lockGetObservations.Lock()
+	mock.calls.GetObservations = append(mock.calls.GetObservations, callInfo)
+	mock.lockGetObservations.Unlock()
+	return mock.GetObservationsFunc(kind, deviceId, from, to, limit, options...)
 }
 
-// GetAirQualityObservedsCalls gets all the calls that were made to GetAirQualityObserveds.
+// GetObservationsCalls gets all the calls that were made to GetObservations.
 // Check the length with:
-//     len(mockedDatastore.GetAirQualityObservedsCalls())
-func (mock *DatastoreMock) GetAirQualityObservedsCalls() []struct {
+//     len(mockedDatastore.GetObservationsCalls())
+func (mock *DatastoreMock) GetObservationsCalls() []struct {
+	Kind     *ObservationKind
 	DeviceId string
 	From     time.Time
 	To       time.Time
 	Limit    uint64
+	Options  []QueryOption
 } {
 	var calls []struct {
+		Kind     *ObservationKind
 		DeviceId string
 		From     time.Time
 		To       time.Time
 		Limit    uint64
+		Options  []QueryOption
+	}
+	mock.lockGetObservations.RLock()
+	calls = mock.calls.GetObservations
+	mock.lockGetObservations.RUnlock()
+	return calls
+}
+
+// GetSubscription calls GetSubscriptionFunc.
+func (mock *DatastoreMock) GetSubscription(id string) (*models.Subscription, error) {
+	if mock.GetSubscriptionFunc == nil {
+		panic("DatastoreMock.GetSubscriptionFunc: method is nil but Datastore.GetSubscription was just called")
+	}
+	callInfo := struct {
+		ID string
+	}{
+		ID: id,
+	}
+	mock.lockGetSubscription.Lock()
+	mock.calls.GetSubscription = append(mock.calls.GetSubscription, callInfo)
+	mock.lockGetSubscription.Unlock()
+	return mock.GetSubscriptionFunc(id)
+}
+
+// GetSubscriptionCalls gets all the calls that were made to GetSubscription.
+// Check the length with:
+//     len(mockedDatastore.GetSubscriptionCalls())
+func (mock *DatastoreMock) GetSubscriptionCalls() []struct {
+	ID string
+} {
+	var calls []struct {
+		ID string
+	}
+	mock.lockGetSubscription.RLock()
+	calls = mock.calls.GetSubscription
+	mock.lockGetSubscription.RUnlock()
+	return calls
+}
+
+// GetSubscriptions calls GetSubscriptionsFunc.
+func (mock *DatastoreMock) GetSubscriptions() ([]models.Subscription, error) {
+	if mock.GetSubscriptionsFunc == nil {
+		panic("DatastoreMock.GetSubscriptionsFunc: method is nil but Datastore.GetSubscriptions was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockGetSubscriptions.Lock()
+	mock.calls.GetSubscriptions = append(mock.calls.GetSubscriptions, callInfo)
+	mock.lockGetSubscriptions.Unlock()
+	return mock.GetSubscriptionsFunc()
+}
+
+// GetSubscriptionsCalls gets all the calls that were made to GetSubscriptions.
+// Check the length with:
+//     len(mockedDatastore.GetSubscriptionsCalls())
+func (mock *DatastoreMock) GetSubscriptionsCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockGetSubscriptions.RLock()
+	calls = mock.calls.GetSubscriptions
+	mock.lockGetSubscriptions.RUnlock()
+	return calls
+}
+
+// RecordNotification calls RecordNotificationFunc.
+func (mock *DatastoreMock) RecordNotification(id string, notifiedAt time.Time, success bool) error {
+	if mock.RecordNotificationFunc == nil {
+		panic("DatastoreMock.RecordNotificationFunc: method is nil but Datastore.RecordNotification was just called")
+	}
+	callInfo := struct {
+		ID         string
+		NotifiedAt time.Time
+		Success    bool
+	}{
+		ID:         id,
+		NotifiedAt: notifiedAt,
+		Success:    success,
+	}
+	mock.lockRecordNotification.Lock()
+	mock.calls.RecordNotification = append(mock.calls.RecordNotification, callInfo)
+	mock.lockRecordNotification.Unlock()
+	return mock.RecordNotificationFunc(id, notifiedAt, success)
+}
+
+// RecordNotificationCalls gets all the calls that were made to RecordNotification.
+// Check the length with:
+//     len(mockedDatastore.RecordNotificationCalls())
+func (mock *DatastoreMock) RecordNotificationCalls() []struct {
+	ID         string
+	NotifiedAt time.Time
+	Success    bool
+} {
+	var calls []struct {
+		ID         string
+		NotifiedAt time.Time
+		Success    bool
+	}
+	mock.lockRecordNotification.RLock()
+	calls = mock.calls.RecordNotification
+	mock.lockRecordNotification.RUnlock()
+	return calls
+}
+
+// SaveDevices calls SaveDevicesFunc.
+func (mock *DatastoreMock) SaveDevices(devices []models.Device) error {
+	if mock.SaveDevicesFunc == nil {
+		panic("DatastoreMock.SaveDevicesFunc: method is nil but Datastore.SaveDevices was just called")
+	}
+	callInfo := struct {
+		Devices []models.Device
+	}{
+		Devices: devices,
+	}
+	mock.lockSaveDevices.Lock()
+	mock.calls.SaveDevices = append(mock.calls.SaveDevices, callInfo)
+	mock.lockSaveDevices.Unlock()
+	return mock.SaveDevicesFunc(devices)
+}
+
+// SaveDevicesCalls gets all the calls that were made to SaveDevices.
+// Check the length with:
+//     len(mockedDatastore.SaveDevicesCalls())
+func (mock *DatastoreMock) SaveDevicesCalls() []struct {
+	Devices []models.Device
+} {
+	var calls []struct {
+		Devices []models.Device
+	}
+	mock.lockSaveDevices.RLock()
+	calls = mock.calls.SaveDevices
+	mock.lockSaveDevices.RUnlock()
+	return calls
+}
+
+// StoreObservation calls StoreObservationFunc.
+func (mock *DatastoreMock) StoreObservation(kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error) {
+	if mock.StoreObservationFunc == nil {
+		panic("DatastoreMock.StoreObservationFunc: method is nil but Datastore.StoreObservation was just called")
+	}
+	callInfo := struct {
+		Kind        *ObservationKind
+		Observation Observation
+		OnDuplicate DuplicatePolicy
+	}{
+		Kind:        kind,
+		Observation: observation,
+		OnDuplicate: onDuplicate,
+	}
+	mock.lockStoreObservation.Lock()
+	mock.calls.StoreObservation = append(mock.calls.StoreObservation, callInfo)
+	mock.lockStoreObservation.Unlock()
+	return mock.StoreObservationFunc(kind, observation, onDuplicate)
+}
+
+// StoreObservationCalls gets all the calls that were made to StoreObservation.
+// Check the length with:
+//     len(mockedDatastore.StoreObservationCalls())
+func (mock *DatastoreMock) StoreObservationCalls() []struct {
+	Kind        *ObservationKind
+	Observation Observation
+	OnDuplicate DuplicatePolicy
+} {
+	var calls []struct {
+		Kind        *ObservationKind
+		Observation Observation
+		OnDuplicate DuplicatePolicy
+	}
+	mock.lockStoreObservation.RLock()
+	calls = mock.calls.StoreObservation
+	mock.lockStoreObservation.RUnlock()
+	return calls
+}
+
+// StoreObservations calls StoreObservationsFunc.
+func (mock *DatastoreMock) StoreObservations(kind *ObservationKind, observations []Observation, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error) {
+	if mock.StoreObservationsFunc == nil {
+		panic("DatastoreMock.StoreObservationsFunc: method is nil but Datastore.StoreObservations was just called")
+	}
+	callInfo := struct {
+		Kind         *ObservationKind
+		Observations []Observation
+		OnDuplicate  DuplicatePolicy
+	}{
+		Kind:         kind,
+		Observations: observations,
+		OnDuplicate:  onDuplicate,
+	}
+	mock.lockStoreObservations.Lock()
+	mock.calls.StoreObservations = append(mock.calls.StoreObservations, callInfo)
+	mock.lockStoreObservations.Unlock()
+	return mock.StoreObservationsFunc(kind, observations, onDuplicate)
+}
+
+// StoreObservationsCalls gets all the calls that were made to StoreObservations.
+// Check the length with:
+//     len(mockedDatastore.StoreObservationsCalls())
+func (mock *DatastoreMock) StoreObservationsCalls() []struct {
+	Kind         *ObservationKind
+	Observations []Observation
+	OnDuplicate  DuplicatePolicy
+} {
+	var calls []struct {
+		Kind         *ObservationKind
+		Observations []Observation
+		OnDuplicate  DuplicatePolicy
+	}
+	mock.lockStoreObservations.RLock()
+	calls = mock.calls.StoreObservations
+	mock.lockStoreObservations.RUnlock()
+	return calls
+}
+
+// UpdateDeviceExpectedInterval calls UpdateDeviceExpectedIntervalFunc.
+func (mock *DatastoreMock) UpdateDeviceExpectedInterval(deviceId string, interval *int64) error {
+	if mock.UpdateDeviceExpectedIntervalFunc == nil {
+		panic("DatastoreMock.UpdateDeviceExpectedIntervalFunc: method is nil but Datastore.UpdateDeviceExpectedInterval was just called")
+	}
+	callInfo := struct {
+		DeviceId string
+		Interval *int64
+	}{
+		DeviceId: deviceId,
+		Interval: interval,
+	}
+	mock.lockUpdateDeviceExpectedInterval.Lock()
+	mock.calls.UpdateDeviceExpectedInterval = append(mock.calls.UpdateDeviceExpectedInterval, callInfo)
+	mock.lockUpdateDeviceExpectedInterval.Unlock()
+	return mock.UpdateDeviceExpectedIntervalFunc(deviceId, interval)
+}
+
+// UpdateDeviceExpectedIntervalCalls gets all the calls that were made to UpdateDeviceExpectedInterval.
+// Check the length with:
+//     len(mockedDatastore.UpdateDeviceExpectedIntervalCalls())
+func (mock *DatastoreMock) UpdateDeviceExpectedIntervalCalls() []struct {
+	DeviceId string
+	Interval *int64
+} {
+	var calls []struct {
+		DeviceId string
+		Interval *int64
 	}
-	mock.lockGetAirQualityObserveds.RLock()
-	calls = mock.calls.GetAirQualityObserveds
-	mock.lockGetAirQualityObserveds.RUnlock()
+	mock.lockUpdateDeviceExpectedInterval.RLock()
+	calls = mock.calls.UpdateDeviceExpectedInterval
+	mock.lockUpdateDeviceExpectedInterval.RUnlock()
 	return calls
 }
 
-// StoreAirQualityObserved calls StoreAirQualityObservedFunc.
-func (mock *DatastoreMock) StoreAirQualityObserved(entityId string, deviceId string, co2 float64, humidity float64, temperature float64, timestamp time.Time) (*models.AirQualityObserved, error) {
-	if mock.StoreAirQualityObservedFunc == nil {
-		panic("DatastoreMock.StoreAirQualityObservedFunc: method is nil but Datastore.StoreAirQualityObserved was just called")
+// UpdateSubscription calls UpdateSubscriptionFunc.
+func (mock *DatastoreMock) UpdateSubscription(subscription models.Subscription) error {
+	if mock.UpdateSubscriptionFunc == nil {
+		panic("DatastoreMock.UpdateSubscriptionFunc: method is nil but Datastore.UpdateSubscription was just called")
 	}
 	callInfo := struct {
-		EntityId    string
-		DeviceId    string
-		Co2         float64
-		Humidity    float64
-		Temperature float64
-		Timestamp   time.Time
+		Subscription models.Subscription
 	}{
-		EntityId:    entityId,
-		DeviceId:    deviceId,
-		Co2:         co2,
-		Humidity:    humidity,
-		Temperature: temperature,
-		Timestamp:   timestamp,
+		Subscription: subscription,
 	}
-	mock.lockStoreAirQualityObserved.Lock()
-	mock.calls.StoreAirQualityObserved = append(mock.calls.StoreAirQualityObserved, callInfo)
-	mock.lockStoreAirQualityObserved.Unlock()
-	return mock.StoreAirQualityObservedFunc(entityId, deviceId, co2, humidity, temperature, timestamp)
+	mock.lockUpdateSubscription.Lock()
+	mock.calls.UpdateSubscription = append(mock.calls.UpdateSubscription, callInfo)
+	mock.lockUpdateSubscription.Unlock()
+	return mock.UpdateSubscriptionFunc(subscription)
 }
 
-// StoreAirQualityObservedCalls gets all the calls that were made to StoreAirQualityObserved.
+// UpdateSubscriptionCalls gets all the calls that were made to UpdateSubscription.
 // Check the length with:
-//     len(mockedDatastore.StoreAirQualityObservedCalls())
-func (mock *DatastoreMock) StoreAirQualityObservedCalls() []struct {
-	EntityId    string
-	DeviceId    string
-	Co2         float64
-	Humidity    float64
-	Temperature float64
-	Timestamp   time.Time
+//     len(mockedDatastore.UpdateSubscriptionCalls())
+func (mock *DatastoreMock) UpdateSubscriptionCalls() []struct {
+	Subscription models.Subscription
 } {
 	var calls []struct {
-		EntityId    string
-		DeviceId    string
-		Co2         float64
-		Humidity    float64
-		Temperature float64
-		Timestamp   time.Time
+		Subscription models.Subscription
 	}
-	mock.lockStoreAirQualityObserved.RLock()
-	calls = mock.calls.StoreAirQualityObserved
-	mock.lockStoreAirQualityObserved.RUnlock()
+	mock.lockUpdateSubscription.RLock()
+	calls = mock.calls.UpdateSubscription
+	mock.lockUpdateSubscription.RUnlock()
 	return calls
 }
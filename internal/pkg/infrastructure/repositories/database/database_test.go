@@ -1,32 +1,954 @@
 package database
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
 	"github.com/matryer/is"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 )
 
 func TestThatStoreAirQualityObservedStoresStuffCorrectly(t *testing.T) {
 	is, db := setupTest(t)
 
-	aqo, err := db.StoreAirQualityObserved("entityId", "deviceId", 15.0, 20.0, 25.0, time.Now().UTC())
+	aqo, _, err := storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), time.Now().UTC(), DuplicatesIgnore)
 	is.NoErr(err) // error when storing new air quality observed...
 	is.Equal(aqo.DeviceId, "deviceId")
 }
 
+func TestThatStoredLocationIsReturnedFromGetAirQualityObserveds(t *testing.T) {
+	is, db := setupTest(t)
+
+	_, _, err := storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), time.Now().UTC(), DuplicatesIgnore)
+	is.NoErr(err)
+
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000)
+	is.NoErr(err)
+	is.Equal(len(aqos), 1)
+	is.Equal(aqos[0].Latitude, 62.3908)
+	is.Equal(aqos[0].Longitude, 17.3069)
+}
+
 func TestThatGetEntitiesReturnsAllStoredAirQualityObserveds(t *testing.T) {
 	is, db := setupTest(t)
 
 	createAirQualityObserveds(db, 3)
 
-	aqos, err := db.GetAirQualityObserveds("", time.Time{}, time.Time{}, 1000)
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000)
+	is.NoErr(err)
+	is.Equal(len(aqos), 3)
+}
+
+func TestThatAllPollutantsAreStoredAndReturned(t *testing.T) {
+	is, db := setupTest(t)
+
+	m := models.AirQualityMeasurements{
+		CO2: float64Ptr(400.0), PM10: float64Ptr(12.0), PM25: float64Ptr(8.0), PM1: float64Ptr(3.0),
+		NO2: float64Ptr(21.0), NO: float64Ptr(4.0), O3: float64Ptr(60.0), SO2: float64Ptr(2.0),
+		CO: float64Ptr(0.3), Benzene: float64Ptr(1.1), VOC: float64Ptr(110.0),
+	}
+
+	_, _, err := storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, m, time.Now().UTC(), DuplicatesIgnore)
+	is.NoErr(err)
+
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000)
+	is.NoErr(err)
+	is.Equal(*aqos[0].PM10, 12.0)
+	is.Equal(*aqos[0].VOC, 110.0)
+}
+
+func TestThatMissingMeasurementsAreStoredAsNull(t *testing.T) {
+	is, db := setupTest(t)
+
+	m := models.AirQualityMeasurements{Temperature: float64Ptr(12.0)}
+
+	_, _, err := storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, m, time.Now().UTC(), DuplicatesIgnore)
+	is.NoErr(err)
+
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000)
+	is.NoErr(err)
+	is.Equal(*aqos[0].Temperature, 12.0)
+	is.True(aqos[0].CO2 == nil)      // CO2 was not observed and should be nil
+	is.True(aqos[0].Humidity == nil) // humidity was not observed and should be nil
+}
+
+func TestThatGetAirQualityObservedReturnsTheLatestObservation(t *testing.T) {
+	is, db := setupTest(t)
+
+	now := time.Now().UTC()
+	storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), now.Add(-time.Hour), DuplicatesIgnore)
+	storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), now, DuplicatesIgnore)
+	storeAirQuality(db, "otherId", "deviceId", 62.3908, 17.3069, measurements(), now.Add(time.Hour), DuplicatesIgnore)
+
+	aqo, err := getAirQuality(db, "entityId")
+	is.NoErr(err)
+	is.True(aqo.Timestamp.Equal(now)) // expected the most recent observation of the entity
+}
+
+func TestThatGetAirQualityObservedReturnsErrNotFoundForUnknownEntity(t *testing.T) {
+	is, db := setupTest(t)
+
+	_, err := getAirQuality(db, "unknown")
+	is.True(errors.Is(err, ErrNotFound))
+}
+
+func TestThatGetAirQualityObservedsCanBeRestrictedToAnEntity(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObserveds(db, 3)
+
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithEntityID("entityId1"))
+	is.NoErr(err)
+	is.Equal(len(aqos), 1)
+	is.Equal(aqos[0].EntityId, "entityId1")
+}
+
+func TestThatGetAirQualityObservedsCanBeLimitedPerEntity(t *testing.T) {
+	is, db := setupTest(t)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for minutes := 0; minutes < 5; minutes++ {
+		storeAirQuality(db, "busy", "dev1", 62.3908, 17.3069, measurements(), observedAt.Add(time.Duration(minutes)*time.Minute), DuplicatesReject)
+	}
+	storeAirQuality(db, "quiet", "dev2", 62.3908, 17.3069, measurements(), observedAt, DuplicatesReject)
+
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 0, WithLimitPerEntity(2))
+	is.NoErr(err)
+	is.Equal(len(aqos), 3)
+	is.Equal(aqos[0].Timestamp, observedAt.Add(4*time.Minute)) // the most recent observations should be kept
+	is.Equal(aqos[1].Timestamp, observedAt.Add(3*time.Minute))
+	is.Equal(aqos[2].EntityId, "quiet")
+
+	aqos, err = getAirQualities(db, "", time.Time{}, time.Time{}, 0, WithLimitPerEntity(1), WithEntityID("unknown"))
+	is.NoErr(err)
+	is.Equal(len(aqos), 0)
+}
+
+func TestThatGeoQueryNearPointReturnsObservationsWithinDistance(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObservedsAtPositions(db)
+
+	gq := NewNearPointGeoQuery(17.3069, 62.3908, 1000)
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithGeoQuery(gq))
+	is.NoErr(err)
+	is.Equal(len(aqos), 2) // expected two observations within 1000 meters of the point
+}
+
+func TestThatGeoQueryWithinPolygonReturnsObservationsInsidePolygon(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObservedsAtPositions(db)
+
+	gq := GeoQuery{
+		Relation:    GeoRelationWithin,
+		Geometry:    GeometryPolygon,
+		Coordinates: [][2]float64{{17.30, 62.38}, {17.32, 62.38}, {17.32, 62.40}, {17.30, 62.40}, {17.30, 62.38}},
+	}
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithGeoQuery(gq))
+	is.NoErr(err)
+	is.Equal(len(aqos), 2)
+}
+
+func TestThatGeoQueryIntersectsPointReturnsObservationsAtThatPosition(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObservedsAtPositions(db)
+
+	gq := GeoQuery{
+		Relation:    GeoRelationIntersects,
+		Geometry:    GeometryPoint,
+		Coordinates: [][2]float64{{-3.712247, 40.423852}},
+	}
+	aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithGeoQuery(gq))
+	is.NoErr(err)
+	is.Equal(len(aqos), 1)
+	is.Equal(aqos[0].EntityId, "madrid")
+}
+
+func TestThatInvalidGeoQueryFails(t *testing.T) {
+	is, db := setupTest(t)
+
+	gq := GeoQuery{Relation: GeoRelationWithin, Geometry: GeometryPoint, Coordinates: [][2]float64{{17.3, 62.3}}}
+	_, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithGeoQuery(gq))
+	is.True(err != nil) // within is not defined for a Point
+}
+
+func TestThatAggregatedAirQualityObservedsAreGroupedPerHour(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for idx, temperature := range []float64{10.0, 12.0, 14.0, 20.0} {
+		m := models.AirQualityMeasurements{Temperature: float64Ptr(temperature)}
+		if idx == 0 {
+			m.CO2 = float64Ptr(400.0)
+		}
+		storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, m, start.Add(time.Duration(idx)*25*time.Minute), DuplicatesIgnore)
+	}
+
+	aggregates, err := db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodHour)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 2) // observations at 10:00, 10:25, 10:50 and 11:15 should end up in two periods
+
+	is.Equal(aggregates[0].PeriodStart, start)
+	is.Equal(aggregates[0].PeriodEnd, start.Add(time.Hour))
+	is.Equal(*aggregates[0].Average["temperature"], 12.0)
+	is.Equal(*aggregates[0].Minimum["temperature"], 10.0)
+	is.Equal(*aggregates[0].Maximum["temperature"], 14.0)
+	is.Equal(*aggregates[0].Sum["temperature"], 36.0)
+	is.Equal(*aggregates[0].TotalCount["temperature"], 3.0)
+	is.Equal(*aggregates[0].TotalCount["co2"], 1.0)
+
+	is.Equal(aggregates[1].PeriodStart, start.Add(time.Hour))
+	is.True(aggregates[1].Average["co2"] == nil) // CO2 was not observed during the second period
+	is.Equal(*aggregates[1].TotalCount["co2"], 0.0)
+}
+
+func TestThatAggregatedAirQualityObservedsCanBeGroupedPerDayAndWeek(t *testing.T) {
+	is, db := setupTest(t)
+
+	// 2022-03-06 is a sunday and 2022-03-07 is a monday
+	storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), time.Date(2022, 3, 6, 23, 0, 0, 0, time.UTC), DuplicatesIgnore)
+	storeAirQuality(db, "entityId", "deviceId", 62.3908, 17.3069, measurements(), time.Date(2022, 3, 7, 1, 0, 0, 0, time.UTC), DuplicatesIgnore)
+
+	aggregates, err := db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodDay)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 2)
+
+	aggregates, err = db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodWeek)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 2)
+	is.Equal(aggregates[0].PeriodStart, time.Date(2022, 2, 28, 0, 0, 0, 0, time.UTC))
+	is.Equal(aggregates[1].PeriodStart, time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC))
+}
+
+func TestThatAggregatedAirQualityObservedsWithoutPeriodSpanAllObservations(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObservedsAtPositions(db)
+	first := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	storeAirQuality(db, "madrid", "device4", 40.423852, -3.712247, measurements(), first, DuplicatesIgnore)
+
+	aggregates, err := db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodNone, WithEntityID("madrid"))
+	is.NoErr(err)
+	is.Equal(len(aggregates), 1)
+	is.Equal(aggregates[0].PeriodStart, first)
+	is.True(aggregates[0].PeriodEnd.After(first))
+	is.Equal(*aggregates[0].TotalCount["co2"], 2.0)
+}
+
+func TestThatFilterRestrictsObservationsByMeasurementValues(t *testing.T) {
+	is, db := setupTest(t)
+
+	now := time.Now().UTC()
+	for idx, co2 := range []float64{400.0, 800.0, 1200.0} {
+		m := models.AirQualityMeasurements{CO2: float64Ptr(co2)}
+		if idx == 2 {
+			m.Temperature = float64Ptr(22.0)
+		}
+		storeAirQuality(db, fmt.Sprintf("entity%d", idx), fmt.Sprintf("device%d", idx), 62.3908, 17.3069, m, now, DuplicatesIgnore)
+	}
+
+	count := func(f Filter) int {
+		aqos, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithFilter(f))
+		is.NoErr(err)
+		return len(aqos)
+	}
+
+	is.Equal(count(Filter{Column: "co2", Operator: FilterGreater, Values: []interface{}{1000.0}}), 1)
+	is.Equal(count(Filter{Column: "co2", Operator: FilterEqual, Values: []interface{}{400.0, 800.0}}), 2)
+	is.Equal(count(Filter{Column: "co2", Operator: FilterEqual, Values: []interface{}{500.0, 1500.0}, IsRange: true}), 2)
+	is.Equal(count(Filter{Column: "co2", Operator: FilterNotEqual, Values: []interface{}{500.0, 1500.0}, IsRange: true}), 1)
+	is.Equal(count(Filter{Column: "temperature"}), 1)                                                        // only one entity has a temperature
+	is.Equal(count(Filter{Column: "temperature", Operator: FilterNotEqual, Values: []interface{}{10.0}}), 1) // unobserved values should not match
+	is.Equal(count(Filter{Column: "device_id", Operator: FilterEqual, Values: []interface{}{"device1"}}), 1)
+	is.Equal(count(Filter{Column: "co2", Operator: FilterEqual, Values: []interface{}{"400"}}), 0) // text never matches a measurement
+	is.Equal(count(Filter{Attribute: "unknown", Operator: FilterGreater, Values: []interface{}{0.0}}), 0)
+
+	is.Equal(count(Filter{Logical: FilterOr, Terms: []Filter{
+		{Column: "co2", Operator: FilterLess, Values: []interface{}{500.0}},
+		{Logical: FilterAnd, Terms: []Filter{
+			{Column: "co2", Operator: FilterGreaterOrEqual, Values: []interface{}{1000.0}},
+			{Column: "temperature", Operator: FilterLessOrEqual, Values: []interface{}{22.0}},
+		}},
+	}}), 2)
+}
+
+func TestThatFilterOnUnknownColumnFails(t *testing.T) {
+	is, db := setupTest(t)
+
+	f := Filter{Column: "latitude; DROP TABLE air_quality_observeds", Operator: FilterGreater, Values: []interface{}{0.0}}
+	_, err := getAirQualities(db, "", time.Time{}, time.Time{}, 1000, WithFilter(f))
+	is.True(err != nil) // only measurement columns should be allowed in filters
+}
+
+func TestThatObservationsAreIndexedByDeviceAndEntity(t *testing.T) {
+	is, db := setupTest(t)
+
+	migrator := db.(*myDB).impl.Migrator()
+	is.True(migrator.HasIndex(&models.AirQualityObserved{}, "idx_air_quality_observeds_device_timestamp"))
+	is.True(migrator.HasIndex(&models.AirQualityObserved{}, "idx_air_quality_observeds_entity_timestamp"))
+}
+
+func TestThatGetAirQualityObservedsSupportsAllFilterCombinations(t *testing.T) {
+	is, db := setupTest(t)
+
+	// Two entities, reported by two devices, with an observation every hour during three hours
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for hour := 0; hour < 3; hour++ {
+		timestamp := start.Add(time.Duration(hour) * time.Hour)
+		co2 := float64Ptr(400.0 + float64(hour)*400.0)
+		storeAirQuality(db, "sundsvall", "device1", 62.3908, 17.3069, models.AirQualityMeasurements{CO2: co2}, timestamp, DuplicatesIgnore)
+		storeAirQuality(db, "madrid", "device2", 40.423852, -3.712247, models.AirQualityMeasurements{CO2: co2}, timestamp, DuplicatesIgnore)
+	}
+
+	nearSundsvall := NewNearPointGeoQuery(17.3069, 62.3908, 1000)
+	highCO2 := Filter{Column: "co2", Operator: FilterGreater, Values: []interface{}{1000.0}}
+
+	testCases := []struct {
+		name     string
+		deviceId string
+		from, to time.Time
+		limit    uint64
+		options  []QueryOption
+		expected int
+	}{
+		{"no filters", "", time.Time{}, time.Time{}, 100, nil, 6},
+		{"limit", "", time.Time{}, time.Time{}, 4, nil, 4},
+		{"device", "device1", time.Time{}, time.Time{}, 100, nil, 3},
+		{"unknown device", "device3", time.Time{}, time.Time{}, 100, nil, 0},
+		{"from", "", start.Add(time.Hour), time.Time{}, 100, nil, 4},
+		{"to", "", time.Time{}, start.Add(time.Hour), 100, nil, 2},
+		{"from and to", "", start.Add(time.Hour), start.Add(2 * time.Hour), 100, nil, 2},
+		{"device and time", "device2", start.Add(time.Hour), time.Time{}, 100, nil, 2},
+		{"entity", "", time.Time{}, time.Time{}, 100, []QueryOption{WithEntityID("madrid")}, 3},
+		{"entity and device", "device1", time.Time{}, time.Time{}, 100, []QueryOption{WithEntityID("madrid")}, 0},
+		{"entity and time", "", time.Time{}, start.Add(2 * time.Hour), 100, []QueryOption{WithEntityID("sundsvall")}, 2},
+		{"geo", "", time.Time{}, time.Time{}, 100, []QueryOption{WithGeoQuery(nearSundsvall)}, 3},
+		{"geo and device", "device2", time.Time{}, time.Time{}, 100, []QueryOption{WithGeoQuery(nearSundsvall)}, 0},
+		{"filter", "", time.Time{}, time.Time{}, 100, []QueryOption{WithFilter(highCO2)}, 2},
+		{"filter and device", "device1", time.Time{}, time.Time{}, 100, []QueryOption{WithFilter(highCO2)}, 1},
+		{"all", "device1", start, start.Add(3 * time.Hour), 100, []QueryOption{WithEntityID("sundsvall"), WithGeoQuery(nearSundsvall), WithFilter(highCO2)}, 1},
+	}
+
+	for _, tc := range testCases {
+		aqos, err := getAirQualities(db, tc.deviceId, tc.from, tc.to, tc.limit, tc.options...)
+		is.NoErr(err)
+		is.Equal(len(aqos), tc.expected) // unexpected number of observations for this filter combination
+
+		for idx := 1; idx < len(aqos); idx++ {
+			is.True(!aqos[idx].Timestamp.After(aqos[idx-1].Timestamp)) // observations should be returned most recent first
+		}
+
+		if tc.deviceId != "" {
+			for _, aqo := range aqos {
+				is.Equal(aqo.DeviceId, tc.deviceId)
+			}
+		}
+	}
+}
+
+func TestThatEmbeddedMigrationsAreValidForAllDialects(t *testing.T) {
+	is := is.New(t)
+
+	for _, dialect := range []string{"postgres", "sqlite"} {
+		migrations, err := loadMigrations(dialect)
+		is.NoErr(err)
+		is.True(len(migrations) > 0)
+		is.Equal(migrations[0].version, uint64(1))
+	}
+}
+
+func TestThatRegisteredMigrationsAreLoadedWithTheEmbeddedOnes(t *testing.T) {
+	is := is.New(t)
+	defer func(registered []fs.FS) { registeredMigrations = registered }(registeredMigrations)
+
+	script := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	RegisterMigrations(fstest.MapFS{
+		"migrations/sqlite/0100_create_tests.up.sql":   script,
+		"migrations/sqlite/0100_create_tests.down.sql": script,
+	})
+
+	migrations, err := loadMigrations("sqlite")
+	is.NoErr(err)
+	is.Equal(migrations[len(migrations)-1].version, uint64(100))
+
+	_, err = loadMigrations("postgres")
+	is.True(err != nil) // the registered migrations lack the postgres dialect
+
+	RegisterMigrations(fstest.MapFS{"migrations/sqlite/0100_create_others.up.sql": script})
+	_, err = loadMigrations("sqlite")
+	is.True(err != nil) // a version must not be used by more than one migration
+}
+
+func TestThatMigrationsAreOnlyAppliedOnce(t *testing.T) {
+	is, db := setupTest(t)
+
+	migrator, err := newMigrator(db.(*myDB).impl, log.Logger)
+	is.NoErr(err)
+
+	count, err := migrator.Up()
+	is.NoErr(err)
+	is.Equal(count, 0) // all migrations should have been applied when the connection was created
+
+	status, err := migrator.Status()
+	is.NoErr(err)
+	for _, s := range status {
+		is.True(s.Applied)
+		is.True(!s.Modified)
+	}
+}
+
+func TestThatMigrationsCanBeRolledBack(t *testing.T) {
+	is, db := setupTest(t)
+	impl := db.(*myDB).impl
+
+	migrator, _ := newMigrator(impl, log.Logger)
+
+	status, _ := migrator.Status()
+	for status[len(status)-1].Version > 11 {
+		status = status[:len(status)-1]
+		is.NoErr(migrator.Down())
+	}
+
+	is.True(!impl.Migrator().HasColumn(&models.AirQualityObserved{}, "DeletedMeasurements")) // 0012 should have been rolled back
+	is.True(errors.Is(migrator.Down(), ErrIrreversible))                                     // while 0011 can not be
+
+	count, err := migrator.Up()
+	is.NoErr(err)
+	is.Equal(count, len(migrator.migrations)-len(status))
+
+	// The migrations before the irreversible one can all be rolled back
+	impl, migrator = newMigratorUpTo(t, 10)
+	for range migrator.migrations {
+		is.NoErr(migrator.Down())
+	}
+
+	is.True(!impl.Migrator().HasTable(&models.AirQualityObserved{})) // all migrations should have been rolled back
+	is.NoErr(migrator.Down())                                        // nothing left to roll back should not fail
+
+	_, err = migrator.Up()
+	is.NoErr(err)
+	is.True(impl.Migrator().HasTable(&models.AirQualityObserved{}))
+}
+
+func TestThatMigrationsRefuseASchemaThatIsAhead(t *testing.T) {
+	is, db := setupTest(t)
+	impl := db.(*myDB).impl
+
+	impl.Create(&schemaMigration{Version: 9999, Name: "from_the_future", Checksum: "abc", AppliedAt: time.Now().UTC()})
+
+	migrator, _ := newMigrator(impl, log.Logger)
+	_, err := migrator.Up()
+	is.True(errors.Is(err, ErrSchemaAhead))
+
+	status, _ := migrator.Status()
+	is.True(status[len(status)-1].Unknown)
+}
+
+func TestThatMigrationsDetectModifiedScripts(t *testing.T) {
+	is, db := setupTest(t)
+	impl := db.(*myDB).impl
+
+	impl.Model(&schemaMigration{}).Where("version = ?", 1).Update("checksum", "modified")
+
+	migrator, _ := newMigrator(impl, log.Logger)
+	_, err := migrator.Up()
+	is.True(errors.Is(err, ErrChecksumMismatch))
+}
+
+func TestThatTimescaleDBIsNotUsedWithSQLite(t *testing.T) {
+	is, db := setupTest(t)
+	is.True(!db.(*myDB).timescale)
+}
+
+func TestThatContinuousAggregatesAreOnlyUsedForWholePeriods(t *testing.T) {
+	is := is.New(t)
+
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	noOptions := newQueryOptions(nil)
+
+	is.True(canUseContinuousAggregate(AggregationPeriodHour, time.Time{}, time.Time{}, noOptions))
+	is.True(canUseContinuousAggregate(AggregationPeriodDay, start, start.AddDate(0, 1, 0), noOptions))
+	is.True(canUseContinuousAggregate(AggregationPeriodHour, start.Add(time.Hour), time.Time{}, newQueryOptions([]QueryOption{WithEntityID("e")})))
+
+	is.True(!canUseContinuousAggregate(AggregationPeriodDay, start.Add(time.Hour), time.Time{}, noOptions)) // from is not at the start of a day
+	is.True(!canUseContinuousAggregate(AggregationPeriodMinute, time.Time{}, time.Time{}, noOptions))       // minutes are not materialized
+	is.True(!canUseContinuousAggregate(AggregationPeriodNone, time.Time{}, time.Time{}, noOptions))         // neither is the whole interval
+
+	highCO2 := newQueryOptions([]QueryOption{WithFilter(Filter{Column: "co2", Operator: FilterGreater, Values: []interface{}{1000.0}})})
+	is.True(!canUseContinuousAggregate(AggregationPeriodHour, time.Time{}, time.Time{}, highCO2)) // measurement filters need the raw observations
+}
+
+func TestContinuousAggregateSQL(t *testing.T) {
+	is := is.New(t)
+
+	sql := continuousAggregateSQL("air_quality_observeds_hourly", "1 hour")
+	is.True(strings.Contains(sql, "WITH (timescaledb.continuous)"))
+	is.True(strings.Contains(sql, `time_bucket(INTERVAL '1 hour', "timestamp")`))
+	is.True(strings.Contains(sql, `SUM(CASE WHEN deleted_measurements LIKE '%,co2,%' THEN NULL ELSE "co2" END) AS "co2_sum"`))
+	is.True(strings.Contains(sql, `COUNT(CASE WHEN deleted_measurements LIKE '%,voc,%' THEN NULL ELSE "voc" END) AS "voc_count"`))
+}
+
+func TestThatOnlyTheChunksOfAMutationAreDecompressed(t *testing.T) {
+	is := is.New(t)
+
+	observedAt := time.Date(2022, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	sql, values := decompressChunksSQL(observedAt, observedAt)
+	is.True(strings.Contains(sql, "decompress_chunk("))
+	is.True(strings.Contains(sql, "range_end > ? AND range_start <= ?"))
+	is.Equal(len(values), 2)
+
+	sql, values = decompressChunksSQL(time.Time{}, observedAt)
+	is.True(!strings.Contains(sql, "range_end")) // the span is open at the start
+	is.Equal(len(values), 1)
+}
+
+func TestThatRefreshesCoverWholeBuckets(t *testing.T) {
+	is := is.New(t)
+
+	from := time.Date(2022, 3, 1, 10, 30, 0, 0, time.UTC)
+	to := time.Date(2022, 3, 2, 8, 15, 0, 0, time.UTC)
+
+	sql, values := refreshContinuousAggregateSQL(AggregationPeriodHour, from, to)
+	is.Equal(sql, "CALL refresh_continuous_aggregate('air_quality_observeds_hourly', ?::timestamptz, ?::timestamptz)")
+	is.Equal(values, []interface{}{time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC), time.Date(2022, 3, 2, 9, 0, 0, 0, time.UTC)})
+
+	_, values = refreshContinuousAggregateSQL(AggregationPeriodDay, from, to)
+	is.Equal(values, []interface{}{time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 3, 3, 0, 0, 0, 0, time.UTC)})
+
+	sql, values = refreshContinuousAggregateSQL(AggregationPeriodDay, time.Time{}, time.Time{})
+	is.Equal(sql, "CALL refresh_continuous_aggregate('air_quality_observeds_daily', NULL, NULL)")
+	is.Equal(len(values), 0)
+}
+
+func TestThatRetentionRollsUpObservationsBeforeDeletingThem(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{CO2: float64Ptr(400.0)}, start.Add(5*time.Minute), DuplicatesIgnore)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{CO2: float64Ptr(600.0)}, start.Add(25*time.Minute), DuplicatesIgnore)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{CO2: float64Ptr(500.0)}, start.Add(70*time.Minute), DuplicatesIgnore)
+
+	result, err := db.ApplyRetention(AirQualityObservedKind, start.Add(90*time.Minute), time.Hour, time.Time{}, false)
+	is.NoErr(err)
+	is.Equal(result.Cutoff, start.Add(time.Hour)) // the cutoff should be aligned to the start of an hour
+	is.Equal(result.RolledUp, int64(2))
+	is.Equal(result.AggregatesWritten, int64(1))
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(len(aqos), 1) // the observation in the current hour should be kept
+
+	// Late observations in an hour that has already been rolled up are merged into the existing aggregate
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{CO2: float64Ptr(300.0)}, start.Add(40*time.Minute), DuplicatesIgnore)
+	_, err = db.ApplyRetention(AirQualityObservedKind, start.Add(90*time.Minute), time.Hour, time.Time{}, false)
+	is.NoErr(err)
+
+	var aggregate struct {
+		PeriodStart time.Time
+		Co2Min      float64
+		Co2Max      float64
+		Co2Sum      float64
+		Co2Count    int64
+		HumidityMin *float64
+	}
+	impl := db.(*myDB).impl
+	is.NoErr(impl.Table(aggregatesTable).Take(&aggregate).Error)
+	is.True(aggregate.PeriodStart.Equal(start))
+	is.Equal(aggregate.Co2Min, 300.0)
+	is.Equal(aggregate.Co2Max, 600.0)
+	is.Equal(aggregate.Co2Sum, 1300.0)
+	is.Equal(aggregate.Co2Count, int64(3))
+	is.True(aggregate.HumidityMin == nil) // humidity was never observed
+}
+
+func TestThatAggregatedQueriesIncludeRolledUpObservations(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	store := func(offset time.Duration, value float64) {
+		storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{CO2: float64Ptr(value)}, start.Add(offset), DuplicatesIgnore)
+	}
+
+	store(10*time.Hour, 400)
+	store(11*time.Hour, 600)
+	store(14*time.Hour, 800)
+	store(26*time.Hour, 500)
+
+	// Roll up everything before noon on the first day, which leaves one raw observation that day
+	_, err := db.ApplyRetention(AirQualityObservedKind, start.Add(12*time.Hour), time.Hour, time.Time{}, false)
+	is.NoErr(err)
+
+	aggregates, err := db.GetAggregatedObservations(AirQualityObservedKind, "", start, start.AddDate(0, 0, 2), AggregationPeriodDay)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 2)
+
+	is.True(aggregates[0].PeriodStart.Equal(start))
+	is.Equal(*aggregates[0].TotalCount["co2"], 3.0) // two rolled up observations and one raw observation
+	is.Equal(*aggregates[0].Minimum["co2"], 400.0)
+	is.Equal(*aggregates[0].Maximum["co2"], 800.0)
+	is.Equal(*aggregates[0].Average["co2"], 600.0)
+	is.Equal(*aggregates[1].TotalCount["co2"], 1.0)
+
+	aggregates, err = db.GetAggregatedObservations(AirQualityObservedKind, "device1", time.Time{}, time.Time{}, AggregationPeriodNone, WithEntityID("aqo1"))
+	is.NoErr(err)
+	is.Equal(len(aggregates), 1)
+	is.True(aggregates[0].PeriodStart.Equal(start.Add(10 * time.Hour))) // the start of the first rollup
+	is.Equal(*aggregates[0].Sum["co2"], 2300.0)
+
+	highCO2 := WithFilter(Filter{Column: "co2", Operator: FilterGreater, Values: []interface{}{700.0}})
+	aggregates, _ = db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodNone, highCO2)
+	is.Equal(*aggregates[0].TotalCount["co2"], 1.0) // rollups can not be filtered on measurements
+}
+
+func TestThatRetentionDryRunDoesNotChangeAnything(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, measurements(), start.Add(time.Duration(i)*20*time.Minute), DuplicatesIgnore)
+	}
+
+	result, err := db.ApplyRetention(AirQualityObservedKind, start.Add(2*time.Hour), time.Hour, start, true)
+	is.NoErr(err)
+	is.Equal(result.RolledUp, int64(6))
+	is.Equal(result.AggregatesWritten, int64(2))
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(len(aqos), 6)
+}
+
+func TestThatRetentionDeletesExpiredAggregates(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, measurements(), start, DuplicatesIgnore)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, measurements(), start.Add(24*time.Hour), DuplicatesIgnore)
+
+	_, err := db.ApplyRetention(AirQualityObservedKind, start.AddDate(0, 0, 2), time.Hour, time.Time{}, false)
+	is.NoErr(err)
+
+	result, err := db.ApplyRetention(AirQualityObservedKind, start.AddDate(0, 0, 2), time.Hour, start.Add(12*time.Hour), false)
+	is.NoErr(err)
+	is.Equal(result.AggregatesDeleted, int64(1)) // only the first day has expired
+
+	var count int64
+	db.(*myDB).impl.Table(aggregatesTable).Count(&count)
+	is.Equal(count, int64(1))
+}
+
+func TestThatDuplicateObservationsAreHandledAccordingToPolicy(t *testing.T) {
+	is, db := setupTest(t)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	co2 := func(value float64) models.AirQualityMeasurements {
+		return models.AirQualityMeasurements{CO2: float64Ptr(value)}
+	}
+
+	_, result, err := storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, co2(400), observedAt, DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(result, StoreResultCreated)
+
+	// The same point in time in another time zone is still a duplicate
+	aqo, result, err := storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, co2(500), observedAt.In(time.FixedZone("CET", 3600)), DuplicatesIgnore)
+	is.NoErr(err)
+	is.Equal(result, StoreResultIgnored)
+	is.Equal(*aqo.CO2, 400.0) // the existing observation should be returned
+
+	_, _, err = storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, co2(500), observedAt, DuplicatesReject)
+	is.True(errors.Is(err, ErrDuplicate))
+
+	_, result, err = storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, co2(600), observedAt, DuplicatesOverwrite)
+	is.NoErr(err)
+	is.Equal(result, StoreResultOverwritten)
+
+	_, result, err = storeAirQuality(db, "aqo2", "device1", 62.39, 17.30, co2(700), observedAt, DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(result, StoreResultCreated) // another entity at the same time is not a duplicate
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100, WithEntityID("aqo1"))
+	is.Equal(len(aqos), 1)
+	is.Equal(*aqos[0].CO2, 600.0)
+}
+
+func TestThatExistingDuplicatesAreRemovedByTheMigration(t *testing.T) {
+	is := is.New(t)
+	impl, migrator := newMigratorUpTo(t, 2)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, value := range []float64{400, 500} {
+		// The deleted measurements are added by a later migration
+		is.NoErr(impl.Omit("DeletedMeasurements").Create(&models.AirQualityObserved{EntityId: "aqo1", Timestamp: observedAt, AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(value)}}).Error)
+	}
+
+	migrator.migrations, _ = loadMigrations("sqlite")
+	_, err := migrator.Up()
+	is.NoErr(err)
+
+	db := &myDB{impl: impl, log: log.Logger}
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(len(aqos), 1)
+	is.Equal(*aqos[0].CO2, 400.0) // the first of the duplicates should be kept
+}
+
+func TestThatMigrationsAddTheMissingColumnsOfABaselineTable(t *testing.T) {
+	is := is.New(t)
+	impl, migrator := newMigratorUpTo(t, 0)
+	db := &myDB{impl: impl, log: log.Logger}
+
+	// The table as it was created by AutoMigrate, before the migrations were introduced
+	is.NoErr(impl.Exec(`CREATE TABLE air_quality_observeds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT, created_at DATETIME, updated_at DATETIME, deleted_at DATETIME,
+		entity_id TEXT, device_id TEXT, co2 REAL, humidity REAL, temperature REAL,
+		latitude REAL, longitude REAL, "timestamp" DATETIME)`).Error)
+	is.NoErr(impl.Exec(`INSERT INTO air_quality_observeds (entity_id, co2, "timestamp") VALUES ('aqo1', 400, '2022-03-01 10:00:00+00:00')`).Error)
+
+	migrator.migrations, _ = loadMigrations("sqlite")
+	_, err := migrator.Up()
+	is.NoErr(err)
+
+	observedAt := time.Date(2022, 3, 1, 11, 0, 0, 0, time.UTC)
+	_, _, err = storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, models.AirQualityMeasurements{PM10: float64Ptr(12), VOC: float64Ptr(3)}, observedAt, DuplicatesReject)
+	is.NoErr(err)
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100, WithEntityID("aqo1"))
+	is.Equal(len(aqos), 2)
+	is.Equal(*aqos[0].PM10, 12.0)
+	is.Equal(*aqos[1].CO2, 400.0) // the baseline observation should have been kept
+}
+
+func TestThatBatchesOfObservationsAreStoredInOneGo(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	storeAirQuality(db, "aqo1", "device1", 62.39, 17.30, measurements(), start, DuplicatesIgnore)
+
+	batch := []models.AirQualityObserved{}
+	for idx := 0; idx < 250; idx++ {
+		batch = append(batch, models.AirQualityObserved{EntityId: "aqo1", DeviceId: "device1", Latitude: 62.39, Longitude: 17.30, Timestamp: start.Add(time.Duration(idx) * time.Minute)})
+	}
+	batch = append(batch, batch[10])
+
+	results, err := storeAirQualities(db, batch, DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(len(results), len(batch))
+	is.True(errors.Is(results[0].Err, ErrDuplicate))   // the first observation was already stored
+	is.True(errors.Is(results[250].Err, ErrDuplicate)) // and the last one is a duplicate within the batch
+	is.NoErr(results[1].Err)
+	is.Equal(results[1].Result, StoreResultCreated)
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 1000)
+	is.Equal(len(aqos), 250)
+
+	batch[0].AirQualityMeasurements = models.AirQualityMeasurements{CO2: float64Ptr(800)}
+	results, err = storeAirQualities(db, batch[:1], DuplicatesOverwrite)
+	is.NoErr(err)
+	is.Equal(results[0].Result, StoreResultOverwritten)
+
+	aqo, _ := getAirQualities(db, "", start, start.Add(time.Second), 1, WithEntityID("aqo1"))
+	is.Equal(*aqo[0].CO2, 800.0)
+}
+
+func TestThatObservationsOfEntitiesCanBeDeleted(t *testing.T) {
+	is, db := setupTest(t)
+
+	createAirQualityObserveds(db, 3)
+
+	deleted, err := db.DeleteObservations(AirQualityObservedKind, []string{"entityId0", "entityId2", "unknown"}, false)
 	is.NoErr(err)
+	is.Equal(deleted["entityId0"], int64(1))
+	is.Equal(deleted["unknown"], int64(0))
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(len(aqos), 1)
+	is.Equal(aqos[0].EntityId, "entityId1")
+
+	// Soft deleted observations can still be purged
+	deleted, err = db.DeleteObservations(AirQualityObservedKind, []string{"entityId0"}, true)
+	is.NoErr(err)
+	is.Equal(deleted["entityId0"], int64(1))
+}
+
+func TestThatObservationsOfDeviceCanBeDeletedWithinTimeSpan(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		storeAirQuality(db, "aqo1", "dev1", 62.3908, 17.3069, measurements(), start.Add(time.Duration(i)*time.Hour), DuplicatesIgnore)
+	}
+	storeAirQuality(db, "aqo2", "dev2", 62.3908, 17.3069, measurements(), start.Add(time.Hour), DuplicatesIgnore)
+
+	deleted, err := db.DeleteObservationsOfDevice("dev1", start.Add(time.Hour), start.Add(3*time.Hour), true)
+	is.NoErr(err)
+	is.Equal(deleted, int64(2))
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
 	is.Equal(len(aqos), 3)
 }
 
+func TestThatSingleMeasurementsCanBeDeleted(t *testing.T) {
+	is, db := setupTest(t)
+
+	m := models.AirQualityMeasurements{CO2: float64Ptr(400.0), Temperature: float64Ptr(12.0)}
+	aqo, _, _ := storeAirQuality(db, "aqo1", "dev1", 62.3908, 17.3069, m, time.Now().UTC(), DuplicatesIgnore)
+
+	is.NoErr(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "co2", false))
+	is.True(errors.Is(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "co2", false), ErrNotFound)) // already deleted
+	is.True(errors.Is(db.DeleteMeasurement(AirQualityObservedKind, "aqo2", aqo.ID, "temperature", false), ErrNotFound))
+	is.True(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "device_id", false) != nil)
+
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(aqos[0].CO2, nil)
+	is.Equal(*aqos[0].Temperature, 12.0)
+
+	// The observation is deleted along with its last measurement
+	is.NoErr(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "temperature", false))
+	aqos, _ = getAirQualities(db, "", time.Time{}, time.Time{}, 100)
+	is.Equal(len(aqos), 0)
+}
+
+func TestThatSoftDeletedMeasurementsAreKeptButNotRead(t *testing.T) {
+	is, db := setupTest(t)
+	impl := db.(*myDB).impl
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	m := models.AirQualityMeasurements{CO2: float64Ptr(400.0), Temperature: float64Ptr(12.0)}
+	aqo, _, _ := storeAirQuality(db, "aqo1", "dev1", 62.3908, 17.3069, m, observedAt, DuplicatesIgnore)
+
+	is.NoErr(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "co2", false))
+
+	stored := models.AirQualityObserved{}
+	impl.First(&stored, aqo.ID)
+	is.Equal(*stored.CO2, 400.0) // the value is kept when it is soft deleted
+	is.Equal(stored.DeletedMeasurements, ",co2,")
+
+	latest, _ := getAirQuality(db, "aqo1")
+	is.Equal(latest.CO2, nil)
+
+	highCO2 := WithFilter(Filter{Column: "co2", Operator: FilterGreater, Values: []interface{}{300.0}})
+	aqos, _ := getAirQualities(db, "", time.Time{}, time.Time{}, 100, highCO2)
+	is.Equal(len(aqos), 0)
+
+	aggregates, _ := db.GetAggregatedObservations(AirQualityObservedKind, "", time.Time{}, time.Time{}, AggregationPeriodHour)
+	is.Equal(aggregates[0].Maximum["co2"], nil)
+	is.Equal(*aggregates[0].TotalCount["co2"], 0.0)
+	is.Equal(*aggregates[0].Maximum["temperature"], 12.0)
+
+	// A soft deleted measurement can still be purged
+	is.NoErr(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "co2", true))
+	stored = models.AirQualityObserved{}
+	impl.First(&stored, aqo.ID)
+	is.Equal(stored.CO2, nil)
+	is.Equal(stored.DeletedMeasurements, "")
+
+	// Overwriting the observation restores it as a whole
+	is.NoErr(db.DeleteMeasurement(AirQualityObservedKind, "aqo1", aqo.ID, "temperature", false))
+	_, _, err := storeAirQuality(db, "aqo1", "dev1", 62.3908, 17.3069, m, observedAt, DuplicatesOverwrite)
+	is.NoErr(err)
+
+	latest, _ = getAirQuality(db, "aqo1")
+	is.Equal(*latest.CO2, 400.0)
+	is.Equal(*latest.Temperature, 12.0)
+}
+
+func TestSubscriptions(t *testing.T) {
+	is, db := setupTest(t)
+
+	s := models.Subscription{ID: "urn:ngsi-ld:Subscription:s1", EntityType: "AirQualityObserved", Endpoint: "http://alerts", Accept: "application/json", IsActive: true}
+	is.NoErr(db.CreateSubscription(s))
+	is.True(errors.Is(db.CreateSubscription(s), ErrSubscriptionExists))
+
+	s.IsActive = false
+	s.Q = "CO2>1000"
+	is.NoErr(db.UpdateSubscription(s))
+	is.NoErr(db.RecordNotification(s.ID, time.Now(), false))
+
+	stored, err := db.GetSubscription(s.ID)
+	is.NoErr(err)
+	is.True(!stored.IsActive)
+	is.Equal(stored.Q, "CO2>1000")
+	is.Equal(stored.TimesSent, int64(1))
+	is.True(stored.LastFailure != nil)
+	is.True(stored.LastSuccess == nil)
+
+	subscriptions, _ := db.GetSubscriptions()
+	is.Equal(len(subscriptions), 1)
+
+	is.NoErr(db.DeleteSubscription(s.ID))
+	is.True(errors.Is(db.DeleteSubscription(s.ID), ErrNotFound))
+	_, err = db.GetSubscription(s.ID)
+	is.True(errors.Is(err, ErrNotFound))
+}
+
+func TestAlerts(t *testing.T) {
+	is, db := setupTest(t)
+
+	now := time.Now().UTC()
+	a1 := &models.Alert{Rule: "co2", DeviceId: "dev1", EntityId: "aqo1", Attribute: "CO2", Threshold: 1000, BreachedAt: now.Add(-2 * time.Hour), RaisedAt: now.Add(-time.Hour), Value: 1200}
+	a2 := &models.Alert{Rule: "co2", DeviceId: "dev2", EntityId: "aqo2", Attribute: "CO2", Threshold: 1000, BreachedAt: now.Add(-time.Hour), RaisedAt: now, Value: 1100}
+	is.NoErr(db.CreateAlert(a1))
+	is.NoErr(db.CreateAlert(a2))
+	is.True(a1.ID != 0)
+
+	is.NoErr(db.ClearAlert(a1.ID, now, 700))
+	is.True(errors.Is(db.ClearAlert(a1.ID, now, 700), ErrNotFound)) // already cleared
+
+	active, err := db.GetAlerts("", time.Time{}, time.Time{}, true, 0)
+	is.NoErr(err)
+	is.Equal(len(active), 1)
+	is.Equal(active[0].ID, a2.ID)
+
+	all, _ := db.GetAlerts("", time.Time{}, time.Time{}, false, 0)
+	is.Equal(len(all), 2)
+	is.Equal(all[0].ID, a2.ID) // the most recent alert first
+	is.Equal(*all[1].ClearValue, 700.0)
+
+	ofDevice, _ := db.GetAlerts("dev1", now.Add(-90*time.Minute), now, false, 1)
+	is.Equal(len(ofDevice), 1)
+	is.True(ofDevice[0].ClearedAt != nil)
+}
+
+func TestDevices(t *testing.T) {
+	is, db := setupTest(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	learned := int64(900)
+	is.NoErr(db.SaveDevices([]models.Device{{DeviceId: "dev1", LastSeen: now.Add(-time.Hour)}, {DeviceId: "dev2", LastSeen: now}}))
+	is.NoErr(db.UpdateDeviceExpectedInterval("dev1", &learned))
+	is.NoErr(db.SaveDevices([]models.Device{{DeviceId: "dev1", LastSeen: now, LearnedInterval: &learned}}))
+	is.True(errors.Is(db.UpdateDeviceExpectedInterval("unknown", nil), ErrNotFound))
+
+	devices, err := db.GetDevices()
+	is.NoErr(err)
+	is.Equal(len(devices), 2)
+	is.True(devices[0].LastSeen.Equal(now))
+	is.Equal(*devices[0].LearnedInterval, int64(900))
+	is.True(devices[0].ExpectedInterval != nil) // saving should not reset the expected interval
+
+	for _, minutes := range []int{30, 20, 10} {
+		storeAirQuality(db, fmt.Sprintf("aqo%d", minutes), "dev1", 62.3908, 17.3069, measurements(), now.Add(-time.Duration(minutes)*time.Minute), DuplicatesIgnore)
+	}
+	storeAirQuality(db, "aqo", "dev2", 62.3908, 17.3069, measurements(), now.Add(-5*time.Minute), DuplicatesIgnore)
+
+	gaps, err := db.GetObservationGaps("dev1", now.Add(-25*time.Minute), now, 7*time.Minute)
+	is.NoErr(err)
+	is.Equal(len(gaps), 1)
+	is.Equal(gaps["dev1"], []ObservationGap{{From: now.Add(-20 * time.Minute), To: now.Add(-10 * time.Minute)}, {From: now.Add(-10 * time.Minute), To: now}})
+
+	gaps, _ = db.GetObservationGaps("", now.Add(-time.Hour), now, 15*time.Minute)
+	is.Equal(len(gaps), 2)
+	is.Equal(gaps["dev1"], []ObservationGap{{From: now.Add(-time.Hour), To: now.Add(-30 * time.Minute)}})
+	is.Equal(gaps["dev2"], []ObservationGap{{From: now.Add(-time.Hour), To: now.Add(-5 * time.Minute)}})
+}
+
 func setupTest(t *testing.T) (*is.I, Datastore) {
 	is := is.New(t)
 	db, err := NewDatabaseConnection(NewSQLiteConnector(log.Logger))
@@ -35,11 +957,95 @@ func setupTest(t *testing.T) (*is.I, Datastore) {
 	return is, db
 }
 
+//newMigratorUpTo returns a new, empty, database with the migrations up to and including a version
+//applied, and a migrator that only knows of those migrations
+func newMigratorUpTo(t *testing.T, version uint64) (*gorm.DB, *Migrator) {
+	is := is.New(t)
+
+	impl, _, err := NewSQLiteConnector(log.Logger)()
+	is.NoErr(err)
+
+	migrator, err := newMigrator(impl, log.Logger)
+	is.NoErr(err)
+
+	for len(migrator.migrations) > 0 && migrator.migrations[len(migrator.migrations)-1].version > version {
+		migrator.migrations = migrator.migrations[:len(migrator.migrations)-1]
+	}
+
+	_, err = migrator.Up()
+	is.NoErr(err)
+
+	return impl, migrator
+}
+
 func createAirQualityObserveds(db Datastore, times int) {
 	i := 0
 
 	for i < times {
-		db.StoreAirQualityObserved(fmt.Sprintf("entityId%d", i), fmt.Sprintf("entityId%d", i), 15.0, 20.0, 25.0, time.Now().UTC())
+		storeAirQuality(db, fmt.Sprintf("entityId%d", i), fmt.Sprintf("entityId%d", i), 62.3908, 17.3069, measurements(), time.Now().UTC(), DuplicatesIgnore)
 		i++
 	}
 }
+
+func createAirQualityObservedsAtPositions(db Datastore) {
+	now := time.Now().UTC()
+	storeAirQuality(db, "sundsvall-center", "device1", 62.3908, 17.3069, measurements(), now, DuplicatesIgnore)
+	storeAirQuality(db, "sundsvall-nearby", "device2", 62.3940, 17.3100, measurements(), now, DuplicatesIgnore)
+	storeAirQuality(db, "sundsvall-far", "device3", 62.4500, 17.3069, measurements(), now, DuplicatesIgnore)
+	storeAirQuality(db, "madrid", "device4", 40.423852, -3.712247, measurements(), now, DuplicatesIgnore)
+}
+
+func measurements() models.AirQualityMeasurements {
+	return models.AirQualityMeasurements{
+		CO2:         float64Ptr(15.0),
+		Humidity:    float64Ptr(20.0),
+		Temperature: float64Ptr(25.0),
+	}
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+func storeAirQuality(db Datastore, entityId, deviceId string, latitude, longitude float64, m models.AirQualityMeasurements, timestamp time.Time, onDuplicate DuplicatePolicy) (*models.AirQualityObserved, StoreResult, error) {
+	aqo := &models.AirQualityObserved{EntityId: entityId, DeviceId: deviceId, Latitude: latitude, Longitude: longitude, Timestamp: timestamp, AirQualityMeasurements: m}
+
+	stored, result, err := db.StoreObservation(AirQualityObservedKind, aqo, onDuplicate)
+	if err != nil {
+		return nil, result, err
+	}
+
+	return stored.(*models.AirQualityObserved), result, nil
+}
+
+func storeAirQualities(db Datastore, aqos []models.AirQualityObserved, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error) {
+	observations := []Observation{}
+	for idx := range aqos {
+		observations = append(observations, &aqos[idx])
+	}
+
+	return db.StoreObservations(AirQualityObservedKind, observations, onDuplicate)
+}
+
+func getAirQuality(db Datastore, entityId string) (*models.AirQualityObserved, error) {
+	observation, err := db.GetObservation(AirQualityObservedKind, entityId)
+	if err != nil {
+		return nil, err
+	}
+
+	return observation.(*models.AirQualityObserved), nil
+}
+
+func getAirQualities(db Datastore, deviceId string, from, to time.Time, limit uint64, options ...QueryOption) ([]models.AirQualityObserved, error) {
+	observations, err := db.GetObservations(AirQualityObservedKind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	aqos := []models.AirQualityObserved{}
+	for _, o := range observations {
+		aqos = append(aqos, *o.(*models.AirQualityObserved))
+	}
+
+	return aqos, nil
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+//deleteScope returns a query that soft deletes observations, or one that removes them from the
+//database, including observations that have already been soft deleted, if purge is set
+func deleteScope(tx *gorm.DB, purge bool) *gorm.DB {
+	if purge {
+		return tx.Unscoped()
+	}
+	return tx
+}
+
+//deleteEntities deletes all observations of a set of entities from the table of a model and
+//returns the number of deleted observations per entity
+func deleteEntities(tx *gorm.DB, model interface{}, entityIds []string, purge bool) (map[string]int64, error) {
+	deleted := map[string]int64{}
+
+	for _, entityId := range entityIds {
+		result := deleteScope(tx, purge).Where("entity_id = ?", entityId).Delete(model)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		deleted[entityId] += result.RowsAffected
+	}
+
+	return deleted, nil
+}
+
+//deleteAirQualityObserveds deletes all observations of a set of entities in a single transaction
+//and returns the number of deleted observations per entity
+func (db *myDB) deleteAirQualityObserveds(entityIds []string, purge bool) (map[string]int64, error) {
+	var deleted map[string]int64
+	var from, to time.Time
+	var found bool
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		var err error
+		from, to, found, err = db.observationSpan(tx.Where("entity_id IN ?", entityIds))
+		if err != nil {
+			return err
+		}
+
+		if found {
+			err = db.decompressChunks(tx, from, to)
+			if err != nil {
+				return err
+			}
+		}
+
+		deleted, err = deleteEntities(tx, &models.AirQualityObserved{}, entityIds, purge)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		db.refreshContinuousAggregates(from, to)
+	}
+
+	return deleted, nil
+}
+
+//DeleteObservationsOfDevice deletes the observations of every kind that a device has reported
+//within a time span, in a single transaction, and returns the number of deleted observations
+func (db *myDB) DeleteObservationsOfDevice(deviceId string, from, to time.Time, purge bool) (int64, error) {
+	var deleted int64
+	var first, last time.Time
+	var found bool
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		for _, kind := range observationKinds {
+			ofDevice := func(tx *gorm.DB) *gorm.DB {
+				return insertTemporalSQL(tx.Where("device_id = ?", deviceId), kind.reportedColumn(), from, to)
+			}
+
+			if kind == AirQualityObservedKind {
+				var err error
+				first, last, found, err = db.observationSpan(ofDevice(tx))
+				if err != nil {
+					return err
+				}
+
+				if found {
+					err = db.decompressChunks(tx, first, last)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			result := ofDevice(deleteScope(tx, purge)).Delete(kind.New())
+			if result.Error != nil {
+				return result.Error
+			}
+
+			deleted += result.RowsAffected
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if found {
+		db.refreshContinuousAggregates(first, last)
+	}
+
+	return deleted, nil
+}
+
+//observationSpan returns the times of the first and last observations, including soft deleted
+//ones, that match a query, and false if there are none. It is only needed to limit the chunks
+//that a TimescaleDB mutation touches, and always returns false otherwise.
+func (db *myDB) observationSpan(query *gorm.DB) (time.Time, time.Time, bool, error) {
+	if !db.timescale {
+		return time.Time{}, time.Time{}, false, nil
+	}
+
+	span := struct {
+		First sql.NullTime
+		Last  sql.NullTime
+	}{}
+
+	err := query.Unscoped().Model(&models.AirQualityObserved{}).Select(`MIN("timestamp") AS first, MAX("timestamp") AS last`).Scan(&span).Error
+	if err != nil || !span.First.Valid {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	return span.First.Time, span.Last.Time, true, nil
+}
+
+//deleteAirQualityObservedAttribute removes a single measurement from an observation. The
+//measurement is soft deleted by adding it to the deleted measurements of the observation, unless
+//purge is set, and the observation itself is deleted once it has no measurements left. It returns
+//ErrNotFound if the entity has no such observation, or if the measurement is not part of the observation.
+func (db *myDB) deleteAirQualityObservedAttribute(entityId string, id uint, column string, purge bool) error {
+	isMeasurement := false
+	for _, c := range measurementColumns {
+		isMeasurement = isMeasurement || c == column
+	}
+
+	if !isMeasurement {
+		return fmt.Errorf("%s is not a measurement", column)
+	}
+
+	var observedAt time.Time
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		aqo := models.AirQualityObserved{}
+		result := tx.Where("id = ? AND entity_id = ?", id, entityId).Limit(1).Find(&aqo)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		// Measurements that have been soft deleted can still be purged
+		found, remaining := false, 0
+		for idx, value := range measurementFields(&aqo.AirQualityMeasurements) {
+			visible := *value != nil && !isMeasurementDeleted(aqo.DeletedMeasurements, measurementColumns[idx])
+			if measurementColumns[idx] == column {
+				found = visible || (*value != nil && purge)
+			} else if visible {
+				remaining++
+			}
+		}
+
+		if !found {
+			return ErrNotFound
+		}
+
+		observedAt = aqo.Timestamp
+
+		err := db.decompressChunks(tx, observedAt, observedAt)
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"deleted_measurements": markMeasurementDeleted(aqo.DeletedMeasurements, column, !purge)}
+		if purge {
+			updates[column] = nil
+		}
+
+		err = tx.Model(&aqo).Updates(updates).Error
+		if err != nil {
+			return err
+		}
+
+		if remaining == 0 {
+			return deleteScope(tx, purge).Delete(&aqo).Error
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	db.refreshContinuousAggregates(observedAt, observedAt)
+
+	return nil
+}
+
+//airQualityObserveds selects the observations with the values of their soft deleted measurements
+//replaced by NULL. The selection is named like the observations table, so that it can be queried
+//and filtered as if it was the table itself.
+func (db *myDB) airQualityObserveds() *gorm.DB {
+	columns := []string{"id", "created_at", "updated_at", "deleted_at", "entity_id", "device_id", "latitude", "longitude", `"timestamp"`, "deleted_measurements"}
+	for _, column := range measurementColumns {
+		columns = append(columns, fmt.Sprintf(`%s AS "%s"`, measurementSQL(column), column))
+	}
+
+	values := db.impl.Unscoped().Table(observationsTable).Select(strings.Join(columns, ", "))
+
+	return db.impl.Model(&models.AirQualityObserved{}).Table("(?) AS "+observationsTable, values)
+}
+
+//measurementSQL returns an expression for the value of a measurement column, which is NULL if the
+//measurement has been soft deleted
+func measurementSQL(column string) string {
+	return fmt.Sprintf(`CASE WHEN deleted_measurements LIKE '%%,%s,%%' THEN NULL ELSE "%s" END`, column, column)
+}
+
+//isMeasurementDeleted returns true if a column is listed in the deleted measurements of an
+//observation, which are stored as a comma separated list that starts and ends with a comma
+func isMeasurementDeleted(deleted, column string) bool {
+	return strings.Contains(deleted, ","+column+",")
+}
+
+//markMeasurementDeleted adds a column to, or removes it from, the deleted measurements of an observation
+func markMeasurementDeleted(deleted, column string, isDeleted bool) string {
+	deleted = strings.Replace(deleted, ","+column+",", ",", 1)
+
+	if isDeleted {
+		if deleted == "" {
+			deleted = ","
+		}
+		deleted += column + ","
+	}
+
+	if deleted == "," {
+		return ""
+	}
+
+	return deleted
+}
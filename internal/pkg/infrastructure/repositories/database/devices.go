@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm/clause"
+)
+
+//GetDevices returns all devices that have reported observations
+func (db *myDB) GetDevices() ([]models.Device, error) {
+	devices := []models.Device{}
+
+	err := db.impl.Order("device_id").Find(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+//SaveDevices stores the last seen time and the learned interval of a number of devices, but
+//leaves the expected intervals of existing devices as they are
+func (db *myDB) SaveDevices(devices []models.Device) error {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	for idx := range devices {
+		devices[idx].LastSeen = devices[idx].LastSeen.UTC()
+	}
+
+	return db.impl.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_seen", "learned_interval", "updated_at"}),
+	}).CreateInBatches(&devices, batchSize).Error
+}
+
+//UpdateDeviceExpectedInterval sets, or removes if interval is nil, the expected reporting
+//interval of a device, or returns ErrNotFound
+func (db *myDB) UpdateDeviceExpectedInterval(deviceId string, interval *int64) error {
+	result := db.impl.Model(&models.Device{}).Where("device_id = ?", deviceId).Updates(map[string]interface{}{
+		"expected_interval": interval,
+		"updated_at":        time.Now().UTC(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//ObservationGap is a period within which a device did not report any observations
+type ObservationGap struct {
+	From time.Time
+	To   time.Time
+}
+
+//GetObservationGaps returns the periods longer than minGap between from, the observations of
+//any kind and to, keyed on device and in chronological order. Only the devices, or the single
+//device, that reported observations within the time span are included. The gaps are found by
+//the database, so that the observations themselves never have to be loaded.
+func (db *myDB) GetObservationGaps(deviceId string, from, to time.Time, minGap time.Duration) (map[string][]ObservationGap, error) {
+	gaps := map[string][]ObservationGap{}
+
+	unions := []string{}
+	queries := []interface{}{}
+
+	for _, kind := range observationKinds {
+		column := kind.reportedColumn()
+		query := insertTemporalSQL(db.impl.Model(kind.New()).Select("device_id, "+column+` AS "timestamp"`).Where("device_id <> ''"), column, from, to)
+
+		if deviceId != "" {
+			query = query.Where("device_id = ?", deviceId)
+		}
+
+		unions = append(unions, "?")
+		queries = append(queries, query)
+	}
+
+	window := `OVER (PARTITION BY device_id ORDER BY "timestamp")`
+	intervals := db.impl.Table("("+strings.Join(unions, " UNION ALL ")+") AS observations", queries...).
+		Select(`device_id, "timestamp", LAG("timestamp") ` + window + ` AS previous_at, LEAD("timestamp") ` + window + ` AS next_at`)
+
+	selects := `device_id, "timestamp", previous_at, next_at`
+	seconds := `EXTRACT(EPOCH FROM ("timestamp" - previous_at))`
+
+	if db.impl.Dialector.Name() != "postgres" {
+		format := func(column string) string {
+			return fmt.Sprintf(`strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', %s) AS %s`, column, column)
+		}
+
+		selects = strings.Join([]string{"device_id", format(`"timestamp"`), format("previous_at"), format("next_at")}, ", ")
+		seconds = `(julianday("timestamp") - julianday(previous_at)) * 86400`
+	}
+
+	// Only the first and last observation of every device, and the ones that end a gap, are returned
+	rows, err := db.impl.Table("(?) AS intervals", intervals).Select(selects).
+		Where("previous_at IS NULL OR next_at IS NULL OR "+seconds+" > ?", minGap.Seconds()).
+		Order(`device_id, "timestamp"`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addGap := func(deviceId string, start, end time.Time) {
+		if end.Sub(start) > minGap {
+			gaps[deviceId] = append(gaps[deviceId], ObservationGap{From: start, To: end})
+		}
+	}
+
+	for rows.Next() {
+		var device, timestamp string
+		var previous, next sql.NullString
+
+		err = rows.Scan(&device, &timestamp, &previous, &next)
+		if err != nil {
+			return nil, err
+		}
+
+		observedAt, err := parseTimestamp(timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := gaps[device]; !ok {
+			gaps[device] = []ObservationGap{}
+		}
+
+		start := from
+		if previous.Valid {
+			start, err = parseTimestamp(previous.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+		addGap(device, start, observedAt)
+
+		if !next.Valid {
+			addGap(device, observedAt, to)
+		}
+	}
+
+	return gaps, rows.Err()
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//duplicateKey identifies an observation by the columns that no two observations may share, e.g.
+//the entity and the time of the observation
+type duplicateKey struct {
+	//Columns are the columns of the unique index that a duplicate conflicts on
+	Columns []string
+	//EntityId and ObservedAt describe the observation in the ErrDuplicate of a rejected duplicate
+	EntityId   string
+	ObservedAt time.Time
+}
+
+//storeWithDuplicatePolicy creates an observation, unless a stored observation has the same values
+//in the columns of the key. The stored observation is then loaded into existing and handled
+//according to onDuplicate: it is kept when duplicates are ignored, and replaced by observation
+//when they are overwritten. A deleted observation is always replaced, and reported as created.
+//Both observation and existing are pointers to models that embed gorm.Model. If replace is not
+//nil, it is called within the transaction that replaces the stored observation.
+func storeWithDuplicatePolicy(tx *gorm.DB, observation, existing interface{}, key duplicateKey, onDuplicate DuplicatePolicy, replace func(tx *gorm.DB) error) (StoreResult, error) {
+	conflictColumns := []clause.Column{}
+	keyFields := []interface{}{}
+	for _, column := range key.Columns {
+		conflictColumns = append(conflictColumns, clause.Column{Name: column})
+		keyFields = append(keyFields, column)
+	}
+
+	result := tx.Clauses(clause.OnConflict{Columns: conflictColumns, DoNothing: true}).Create(observation)
+	if result.Error != nil {
+		return StoreResultCreated, result.Error
+	}
+
+	if result.RowsAffected == 1 {
+		return StoreResultCreated, nil
+	}
+
+	err := tx.Unscoped().Where(observation, keyFields...).Take(existing).Error
+	if err != nil {
+		return StoreResultCreated, err
+	}
+
+	stored := embeddedModel(existing)
+	storeResult := StoreResultOverwritten
+
+	if stored.DeletedAt.Valid {
+		storeResult = StoreResultCreated
+	} else if onDuplicate == DuplicatesIgnore {
+		return StoreResultIgnored, nil
+	} else if onDuplicate != DuplicatesOverwrite {
+		return StoreResultCreated, fmt.Errorf("%w (%s at %s)", ErrDuplicate, key.EntityId, key.ObservedAt.Format(time.RFC3339))
+	}
+
+	replacement := embeddedModel(observation)
+	replacement.ID = stored.ID
+	replacement.CreatedAt = stored.CreatedAt
+
+	if replace == nil {
+		return storeResult, tx.Unscoped().Save(observation).Error
+	}
+
+	return storeResult, tx.Transaction(func(tx *gorm.DB) error {
+		err := replace(tx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Save(observation).Error
+	})
+}
+
+//embeddedModel returns the gorm.Model that is embedded in the model that value points to
+func embeddedModel(value interface{}) *gorm.Model {
+	return reflect.ValueOf(value).Elem().FieldByName("Model").Addr().Interface().(*gorm.Model)
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	//FilterAnd combines the terms of a Filter so that all of them have to match
+	FilterAnd string = ";"
+	//FilterOr combines the terms of a Filter so that at least one of them has to match
+	FilterOr string = "|"
+
+	FilterEqual          string = "=="
+	FilterNotEqual       string = "!="
+	FilterGreater        string = ">"
+	FilterGreaterOrEqual string = ">="
+	FilterLess           string = "<"
+	FilterLessOrEqual    string = "<="
+
+	//deviceColumn is the only non measurement column that may be used in a Filter of every kind of
+	//observations, while other text columns are listed by the kinds that have them
+	deviceColumn string = "device_id"
+)
+
+//Filter is a node in the expression tree of an attribute query. A node either combines the
+//Filters in Terms using a logical operator, or compares the value of a single column.
+type Filter struct {
+	Logical string
+	Terms   []Filter
+
+	//Attribute is the name of the compared attribute as it appeared in the query, while
+	//Column is the stored column it maps to. An empty Column refers to an attribute that
+	//is not stored, and such a comparison never matches.
+	Attribute string
+	Column    string
+	Operator  string
+	//Values holds a single value, a list of values to match against or, if IsRange is
+	//set, the lower and upper bounds of a range. An empty Operator and no values only
+	//requires the column to have a value.
+	Values  []interface{}
+	IsRange bool
+}
+
+//Walk calls fn for every comparison in the expression tree
+func (f *Filter) Walk(fn func(*Filter) error) error {
+	if f.Logical == "" {
+		return fn(f)
+	}
+
+	for idx := range f.Terms {
+		err := f.Terms[idx].Walk(fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//WithFilter restricts a query to observations that match the supplied Filter
+func WithFilter(f Filter) QueryOption {
+	return func(qo *queryOptions) {
+		qo.filter = &f
+	}
+}
+
+//sql translates the filter into a parameterized condition, that may compare the device and the
+//given measurement and text columns
+func (f Filter) sql(columns, textColumns []string) (string, []interface{}, error) {
+	if f.Logical != "" {
+		if f.Logical != FilterAnd && f.Logical != FilterOr {
+			return "", nil, fmt.Errorf("logical operator %s is not supported", f.Logical)
+		}
+
+		conditions := []string{}
+		args := []interface{}{}
+
+		for _, term := range f.Terms {
+			condition, termArgs, err := term.sql(columns, textColumns)
+			if err != nil {
+				return "", nil, err
+			}
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, termArgs...)
+		}
+
+		operator := " AND "
+		if f.Logical == FilterOr {
+			operator = " OR "
+		}
+
+		return strings.Join(conditions, operator), args, nil
+	}
+
+	if f.Column == "" {
+		return "1 = 0", nil, nil
+	}
+
+	if !isFilterableColumn(f.Column, columns, textColumns) {
+		return "", nil, fmt.Errorf("column %s can not be used in a filter", f.Column)
+	}
+
+	column := fmt.Sprintf(`"%s"`, f.Column)
+
+	if f.Operator == "" {
+		return column + " IS NOT NULL", nil, nil
+	}
+
+	if len(f.Values) == 0 {
+		return "", nil, fmt.Errorf("missing value to compare %s with", f.Column)
+	}
+
+	// Comparing a measurement with a text value, or a reference with a number, can never match
+	for _, v := range f.Values {
+		_, isText := v.(string)
+		if isText != isTextColumn(f.Column, textColumns) {
+			return "1 = 0", nil, nil
+		}
+	}
+
+	if f.IsRange {
+		if len(f.Values) != 2 {
+			return "", nil, fmt.Errorf("a range requires exactly two values")
+		}
+
+		switch f.Operator {
+		case FilterEqual:
+			return column + " BETWEEN ? AND ?", f.Values, nil
+		case FilterNotEqual:
+			return column + " NOT BETWEEN ? AND ?", f.Values, nil
+		default:
+			return "", nil, fmt.Errorf("ranges can not be used with the operator %s", f.Operator)
+		}
+	}
+
+	if len(f.Values) > 1 {
+		switch f.Operator {
+		case FilterEqual:
+			return column + " IN ?", []interface{}{f.Values}, nil
+		case FilterNotEqual:
+			return column + " NOT IN ?", []interface{}{f.Values}, nil
+		default:
+			return "", nil, fmt.Errorf("lists of values can not be used with the operator %s", f.Operator)
+		}
+	}
+
+	switch f.Operator {
+	case FilterEqual:
+		return column + " = ?", f.Values, nil
+	case FilterNotEqual:
+		return column + " <> ?", f.Values, nil
+	case FilterGreater, FilterGreaterOrEqual, FilterLess, FilterLessOrEqual:
+		return column + " " + f.Operator + " ?", f.Values, nil
+	default:
+		return "", nil, fmt.Errorf("operator %s is not supported", f.Operator)
+	}
+}
+
+func isFilterableColumn(column string, columns, textColumns []string) bool {
+	return isTextColumn(column, textColumns) || contains(columns, column)
+}
+
+//isTextColumn returns true for the device column and the given text columns
+func isTextColumn(column string, textColumns []string) bool {
+	return column == deviceColumn || contains(textColumns, column)
+}
+
+func contains(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
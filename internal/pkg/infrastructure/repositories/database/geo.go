@@ -0,0 +1,223 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	//GeoRelationNear matches entities within a maximum distance from a Point
+	GeoRelationNear string = "near"
+	//GeoRelationWithin matches entities that are located inside a Polygon
+	GeoRelationWithin string = "within"
+	//GeoRelationIntersects matches entities that intersect a Point or a Polygon
+	GeoRelationIntersects string = "intersects"
+
+	//GeometryPoint is the GeoJSON type name for a single position
+	GeometryPoint string = "Point"
+	//GeometryPolygon is the GeoJSON type name for a polygon
+	GeometryPolygon string = "Polygon"
+
+	earthRadiusInMeters float64 = 6371008.8
+	metersPerDegree     float64 = earthRadiusInMeters * math.Pi / 180.0
+)
+
+//GeoQuery describes a geospatial restriction that should be applied to a query
+type GeoQuery struct {
+	Relation string
+	Geometry string
+	//Coordinates holds a single [longitude, latitude] position for a Point, or the
+	//positions of the exterior ring of a Polygon
+	Coordinates [][2]float64
+	//MaxDistance is the maximum distance in meters from a Point for the near relation
+	MaxDistance float64
+}
+
+//NewNearPointGeoQuery creates a GeoQuery that matches everything within maxDistance meters from a position
+func NewNearPointGeoQuery(longitude, latitude, maxDistance float64) GeoQuery {
+	return GeoQuery{
+		Relation:    GeoRelationNear,
+		Geometry:    GeometryPoint,
+		Coordinates: [][2]float64{{longitude, latitude}},
+		MaxDistance: maxDistance,
+	}
+}
+
+//Validate checks that the combination of relation, geometry and coordinates is supported
+func (gq GeoQuery) Validate() error {
+	switch gq.Geometry {
+	case GeometryPoint:
+		if len(gq.Coordinates) != 1 {
+			return fmt.Errorf("a Point geometry requires exactly one position, but %d were supplied", len(gq.Coordinates))
+		}
+	case GeometryPolygon:
+		if len(gq.Coordinates) < 4 {
+			return errors.New("a Polygon geometry requires a linear ring of at least four positions")
+		}
+		if gq.Coordinates[0] != gq.Coordinates[len(gq.Coordinates)-1] {
+			return errors.New("the first and last positions of a Polygon must be identical")
+		}
+	default:
+		return fmt.Errorf("geometry type %s is not supported", gq.Geometry)
+	}
+
+	for _, position := range gq.Coordinates {
+		if position[0] < -180.0 || position[0] > 180.0 || position[1] < -90.0 || position[1] > 90.0 {
+			return fmt.Errorf("position %v is outside the valid WGS84 range", position)
+		}
+	}
+
+	switch gq.Relation {
+	case GeoRelationNear:
+		if gq.Geometry != GeometryPoint {
+			return errors.New("the geospatial relationship near is only defined for the geometry type Point")
+		}
+		if gq.MaxDistance < 0 {
+			return errors.New("distance value must be non negative")
+		}
+	case GeoRelationWithin:
+		if gq.Geometry != GeometryPolygon {
+			return errors.New("the geospatial relationship within is only defined for the geometry type Polygon")
+		}
+	case GeoRelationIntersects:
+	default:
+		return fmt.Errorf("the geospatial relationship %s is not supported", gq.Relation)
+	}
+
+	return nil
+}
+
+//wkt returns the well known text representation of the geometry
+func (gq GeoQuery) wkt() string {
+	positions := []string{}
+	for _, p := range gq.Coordinates {
+		positions = append(positions, fmt.Sprintf("%f %f", p[0], p[1]))
+	}
+
+	if gq.Geometry == GeometryPoint {
+		return fmt.Sprintf("POINT(%s)", positions[0])
+	}
+
+	return fmt.Sprintf("POLYGON((%s))", strings.Join(positions, ","))
+}
+
+//boundingBox returns the minimum and maximum latitude and longitude that may match the query
+func (gq GeoQuery) boundingBox() (minLat, maxLat, minLon, maxLon float64) {
+	minLat, maxLat = 90.0, -90.0
+	minLon, maxLon = 180.0, -180.0
+
+	for _, p := range gq.Coordinates {
+		minLon, maxLon = math.Min(minLon, p[0]), math.Max(maxLon, p[0])
+		minLat, maxLat = math.Min(minLat, p[1]), math.Max(maxLat, p[1])
+	}
+
+	if gq.Relation == GeoRelationNear {
+		latDelta := gq.MaxDistance / metersPerDegree
+		minLat, maxLat = math.Max(minLat-latDelta, -90.0), math.Min(maxLat+latDelta, 90.0)
+
+		cosLat := math.Cos(gq.Coordinates[0][1] * math.Pi / 180.0)
+		if cosLat < 0.01 || minLat <= -90.0 || maxLat >= 90.0 {
+			// Too close to a pole to make any useful assumptions about longitude
+			minLon, maxLon = -180.0, 180.0
+		} else {
+			lonDelta := latDelta / cosLat
+			minLon, maxLon = math.Max(minLon-lonDelta, -180.0), math.Min(maxLon+lonDelta, 180.0)
+		}
+	}
+
+	return
+}
+
+//insertGeoSQL adds the conditions needed to restrict a query to the supplied GeoQuery,
+//using PostGIS on PostgreSQL and the functions registered by the SQLite connector otherwise
+func insertGeoSQL(db *gorm.DB, gq GeoQuery) *gorm.DB {
+	if db.Dialector.Name() == "postgres" {
+		const location string = "ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)"
+
+		switch gq.Relation {
+		case GeoRelationNear:
+			return db.Where(
+				"ST_DWithin("+location+"::geography, ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography, ?)",
+				gq.Coordinates[0][0], gq.Coordinates[0][1], gq.MaxDistance,
+			)
+		case GeoRelationWithin:
+			return db.Where("ST_Within("+location+", ST_GeomFromText(?, 4326))", gq.wkt())
+		default:
+			return db.Where("ST_Intersects("+location+", ST_GeomFromText(?, 4326))", gq.wkt())
+		}
+	}
+
+	minLat, maxLat, minLon, maxLon := gq.boundingBox()
+	db = db.Where("latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?", minLat, maxLat, minLon, maxLon)
+
+	switch gq.Relation {
+	case GeoRelationNear:
+		return db.Where("haversine(latitude, longitude, ?, ?) <= ?", gq.Coordinates[0][1], gq.Coordinates[0][0], gq.MaxDistance)
+	case GeoRelationWithin:
+		ring, _ := json.Marshal(gq.Coordinates)
+		return db.Where("point_in_polygon(longitude, latitude, ?, 0) = 1", string(ring))
+	default:
+		if gq.Geometry == GeometryPoint {
+			return db.Where("latitude = ? AND longitude = ?", gq.Coordinates[0][1], gq.Coordinates[0][0])
+		}
+		ring, _ := json.Marshal(gq.Coordinates)
+		return db.Where("point_in_polygon(longitude, latitude, ?, 1) = 1", string(ring))
+	}
+}
+
+//haversine returns the great circle distance in meters between two positions
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const toRadians float64 = math.Pi / 180.0
+
+	dLat := (lat2 - lat1) * toRadians
+	dLon := (lon2 - lon1) * toRadians
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusInMeters * math.Asin(math.Min(1.0, math.Sqrt(a)))
+}
+
+//pointInPolygon uses ray casting to determine if a position is inside a polygon ring that
+//has been encoded as a JSON array of [longitude, latitude] positions. Positions on the
+//boundary of the polygon are only considered inside if inclusive is non zero.
+func pointInPolygon(lon, lat float64, encodedRing string, inclusive int64) (bool, error) {
+	ring := [][2]float64{}
+	if err := json.Unmarshal([]byte(encodedRing), &ring); err != nil {
+		return false, err
+	}
+
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+
+		if isOnSegment(lon, lat, xi, yi, xj, yj) {
+			return inclusive != 0, nil
+		}
+
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+
+	return inside, nil
+}
+
+func isOnSegment(x, y, x1, y1, x2, y2 float64) bool {
+	const epsilon float64 = 1e-12
+
+	cross := (x-x1)*(y2-y1) - (y-y1)*(x2-x1)
+	if math.Abs(cross) > epsilon {
+		return false
+	}
+
+	return x >= math.Min(x1, x2)-epsilon && x <= math.Max(x1, x2)+epsilon &&
+		y >= math.Min(y1, y2)-epsilon && y <= math.Max(y1, y2)+epsilon
+}
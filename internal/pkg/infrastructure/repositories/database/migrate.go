@@ -0,0 +1,391 @@
+package database
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+//ErrSchemaAhead is returned when the database contains migrations that are unknown to this binary
+var ErrSchemaAhead = errors.New("the database schema is ahead of this binary")
+
+//ErrChecksumMismatch is returned when an applied migration differs from the one embedded in this binary
+var ErrChecksumMismatch = errors.New("checksum mismatch for applied migration")
+
+//ErrIrreversible is returned when rolling back a migration whose down script has no statements
+var ErrIrreversible = errors.New("the migration can not be rolled back")
+
+//migrationSteps holds the parts of migrations, per dialect and version, that can not be expressed
+//in the SQL of the dialect. A step runs before the script of its migration, in the same transaction.
+var migrationSteps = map[string]map[uint64]func(tx *gorm.DB) error{
+	"sqlite": {
+		11: addMissingSQLiteColumns("air_quality_observeds", "REAL",
+			"co2", "humidity", "temperature", "pm10", "pm25", "pm1", "no2", "no", "o3", "so2", "co", "benzene", "voc"),
+	},
+}
+
+//addMissingSQLiteColumns returns a migration step that adds the columns that a table lacks, since
+//SQLite does not support ADD COLUMN IF NOT EXISTS
+func addMissingSQLiteColumns(table, columnType string, columns ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, column := range columns {
+			var count int64
+			err := tx.Raw("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count).Error
+			if err != nil {
+				return err
+			}
+
+			if count == 0 {
+				err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN "%s" %s`, table, column, columnType)).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+type migration struct {
+	version  uint64
+	name     string
+	up       string
+	down     string
+	checksum string
+}
+
+//schemaMigration is a row in the schema_migrations table
+type schemaMigration struct {
+	Version   uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+//MigrationStatus describes a migration that is either embedded in the binary, applied to the
+//database, or both
+type MigrationStatus struct {
+	Version   uint64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	//Unknown is set for applied migrations that are not embedded in this binary
+	Unknown bool
+	//Modified is set for applied migrations whose checksum differs from the embedded migration
+	Modified bool
+}
+
+//Migrator applies the numbered schema migrations that are embedded in the binary. Every
+//migration consists of an up and a down script, per database dialect.
+type Migrator struct {
+	db         *gorm.DB
+	migrations []migration
+	log        zerolog.Logger
+}
+
+//NewMigrator connects to the database and prepares the schema_migrations table
+func NewMigrator(connect ConnectorFunc) (*Migrator, error) {
+	db, log, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return newMigrator(db, log)
+}
+
+func newMigrator(db *gorm.DB, log zerolog.Logger) (*Migrator, error) {
+	migrations, err := loadMigrations(db.Dialector.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the schema_migrations table: %w", err)
+	}
+
+	return &Migrator{db: db, migrations: migrations, log: log}, nil
+}
+
+//registeredMigrations holds the migrations of the tables that are provided by other packages
+var registeredMigrations = []fs.FS{}
+
+//RegisterMigrations adds the migrations of a package that provides a table of its own, such as the
+//observations of an entity type. The files must be laid out like the embedded migrations, in a
+//migrations directory per dialect, and their versions must not be used by any other migration.
+func RegisterMigrations(files fs.FS) {
+	registeredMigrations = append(registeredMigrations, files)
+}
+
+//loadMigrations reads the embedded and registered migrations for a dialect, ordered by version
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+
+	migrationsByVersion := map[uint64]*migration{}
+
+	for _, files := range append([]fs.FS{migrationFiles}, registeredMigrations...) {
+		entries, err := fs.ReadDir(files, dir)
+		if err != nil {
+			return nil, fmt.Errorf("no migrations found for database dialect %s", dialect)
+		}
+
+		for _, entry := range entries {
+			match := migrationFileName.FindStringSubmatch(entry.Name())
+			if match == nil {
+				return nil, fmt.Errorf("unexpected file %s among the migrations", entry.Name())
+			}
+
+			version, _ := strconv.ParseUint(match[1], 10, 64)
+
+			contents, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			m, ok := migrationsByVersion[version]
+			if !ok {
+				m = &migration{version: version, name: match[2]}
+				migrationsByVersion[version] = m
+			} else if m.name != match[2] {
+				return nil, fmt.Errorf("conflicting names for migration %d", version)
+			}
+
+			if match[3] == "up" {
+				if m.up != "" {
+					return nil, fmt.Errorf("migration %d has more than one up script", version)
+				}
+				m.up = string(contents)
+				sum := sha256.Sum256(contents)
+				m.checksum = hex.EncodeToString(sum[:])
+			} else {
+				if m.down != "" {
+					return nil, fmt.Errorf("migration %d has more than one down script", version)
+				}
+				m.down = string(contents)
+			}
+		}
+	}
+
+	migrations := []migration{}
+	for _, m := range migrationsByVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d must have both an up and a down script", m.version)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+func (m *Migrator) applied() ([]schemaMigration, error) {
+	applied := []schemaMigration{}
+	err := m.db.Order("version").Find(&applied).Error
+	return applied, err
+}
+
+//verify makes sure that every applied migration is known to, and unchanged in, this binary
+func (m *Migrator) verify(applied []schemaMigration) error {
+	known := map[uint64]migration{}
+	for _, mig := range m.migrations {
+		known[mig.version] = mig
+	}
+
+	for _, a := range applied {
+		mig, ok := known[a.Version]
+		if !ok {
+			return fmt.Errorf("%w: migration %d (%s) is not known", ErrSchemaAhead, a.Version, a.Name)
+		}
+
+		if mig.checksum != a.Checksum {
+			return fmt.Errorf("%w %d (%s)", ErrChecksumMismatch, a.Version, a.Name)
+		}
+	}
+
+	return nil
+}
+
+//Up applies all pending migrations in order and returns the number of applied migrations
+func (m *Migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.verify(applied)
+	if err != nil {
+		return 0, err
+	}
+
+	isApplied := map[uint64]bool{}
+	for _, a := range applied {
+		isApplied[a.Version] = true
+	}
+
+	count := 0
+
+	for _, mig := range m.migrations {
+		if isApplied[mig.version] {
+			continue
+		}
+
+		m.log.Info().Uint64("version", mig.version).Str("name", mig.name).Msg("applying migration")
+
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			if step, ok := migrationSteps[m.db.Dialector.Name()][mig.version]; ok {
+				err := step(tx)
+				if err != nil {
+					return err
+				}
+			}
+
+			if hasStatements(mig.up) {
+				err := tx.Exec(mig.up).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			return tx.Create(&schemaMigration{
+				Version:   mig.version,
+				Name:      mig.name,
+				Checksum:  mig.checksum,
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to apply migration %d (%s): %w", mig.version, mig.name, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+//hasStatements returns false if a script is empty, or only contains comments
+func hasStatements(script string) bool {
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Down rolls back the most recently applied migration. It is not an error if there is nothing to roll
+//back, but it is if the migration has a down script without any statements, i.e. is irreversible.
+func (m *Migrator) Down() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	err = m.verify(applied)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		return nil
+	}
+
+	latest := applied[len(applied)-1]
+
+	for _, mig := range m.migrations {
+		if mig.version != latest.Version {
+			continue
+		}
+
+		if !hasStatements(mig.down) {
+			return fmt.Errorf("%w: migration %d (%s)", ErrIrreversible, mig.version, mig.name)
+		}
+
+		m.log.Info().Uint64("version", mig.version).Str("name", mig.name).Msg("rolling back migration")
+
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec(mig.down).Error
+			if err != nil {
+				return err
+			}
+
+			return tx.Delete(&schemaMigration{}, mig.version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("failed to roll back migration %d (%s): %w", mig.version, mig.name, err)
+		}
+	}
+
+	return nil
+}
+
+//Status returns the state of every embedded migration, followed by any applied migrations that
+//are not known to this binary
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedByVersion := map[uint64]schemaMigration{}
+	for _, a := range applied {
+		appliedByVersion[a.Version] = a
+	}
+
+	status := []MigrationStatus{}
+
+	for _, mig := range m.migrations {
+		s := MigrationStatus{Version: mig.version, Name: mig.name}
+
+		if a, ok := appliedByVersion[mig.version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.AppliedAt
+			s.Modified = a.Checksum != mig.checksum
+			delete(appliedByVersion, mig.version)
+		}
+
+		status = append(status, s)
+	}
+
+	for _, a := range applied {
+		if _, ok := appliedByVersion[a.Version]; ok {
+			status = append(status, MigrationStatus{
+				Version: a.Version, Name: a.Name, Applied: true, AppliedAt: a.AppliedAt, Unknown: true,
+			})
+		}
+	}
+
+	return status, nil
+}
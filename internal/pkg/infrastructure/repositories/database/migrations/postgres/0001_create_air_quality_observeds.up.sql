@@ -0,0 +1,29 @@
+-- The table may already exist in databases that were created by GORM AutoMigrate
+CREATE TABLE IF NOT EXISTS air_quality_observeds (
+    id          BIGSERIAL PRIMARY KEY,
+    created_at  TIMESTAMPTZ,
+    updated_at  TIMESTAMPTZ,
+    deleted_at  TIMESTAMPTZ,
+    entity_id   TEXT,
+    device_id   TEXT,
+    latitude    DOUBLE PRECISION,
+    longitude   DOUBLE PRECISION,
+    "timestamp" TIMESTAMPTZ,
+    co2         DOUBLE PRECISION,
+    humidity    DOUBLE PRECISION,
+    temperature DOUBLE PRECISION,
+    pm10        DOUBLE PRECISION,
+    pm25        DOUBLE PRECISION,
+    pm1         DOUBLE PRECISION,
+    no2         DOUBLE PRECISION,
+    "no"        DOUBLE PRECISION,
+    o3          DOUBLE PRECISION,
+    so2         DOUBLE PRECISION,
+    co          DOUBLE PRECISION,
+    benzene     DOUBLE PRECISION,
+    voc         DOUBLE PRECISION
+);
+
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_deleted_at ON air_quality_observeds (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_device_timestamp ON air_quality_observeds (device_id, "timestamp" DESC);
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_entity_timestamp ON air_quality_observeds (entity_id, "timestamp" DESC);
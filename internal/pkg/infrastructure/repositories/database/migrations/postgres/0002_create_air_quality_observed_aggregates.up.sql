@@ -0,0 +1,66 @@
+-- Observations that are older than the raw TTL of a retention policy are rolled up into
+-- this table, with the minimum, maximum, sum and count of every measurement per period
+CREATE TABLE air_quality_observed_aggregates (
+    id           BIGSERIAL PRIMARY KEY,
+    entity_id    TEXT NOT NULL,
+    device_id    TEXT NOT NULL DEFAULT '',
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end   TIMESTAMPTZ NOT NULL,
+    latitude     DOUBLE PRECISION,
+    longitude    DOUBLE PRECISION,
+    co2_min DOUBLE PRECISION,
+    co2_max DOUBLE PRECISION,
+    co2_sum DOUBLE PRECISION,
+    co2_count BIGINT NOT NULL DEFAULT 0,
+    humidity_min DOUBLE PRECISION,
+    humidity_max DOUBLE PRECISION,
+    humidity_sum DOUBLE PRECISION,
+    humidity_count BIGINT NOT NULL DEFAULT 0,
+    temperature_min DOUBLE PRECISION,
+    temperature_max DOUBLE PRECISION,
+    temperature_sum DOUBLE PRECISION,
+    temperature_count BIGINT NOT NULL DEFAULT 0,
+    pm10_min DOUBLE PRECISION,
+    pm10_max DOUBLE PRECISION,
+    pm10_sum DOUBLE PRECISION,
+    pm10_count BIGINT NOT NULL DEFAULT 0,
+    pm25_min DOUBLE PRECISION,
+    pm25_max DOUBLE PRECISION,
+    pm25_sum DOUBLE PRECISION,
+    pm25_count BIGINT NOT NULL DEFAULT 0,
+    pm1_min DOUBLE PRECISION,
+    pm1_max DOUBLE PRECISION,
+    pm1_sum DOUBLE PRECISION,
+    pm1_count BIGINT NOT NULL DEFAULT 0,
+    no2_min DOUBLE PRECISION,
+    no2_max DOUBLE PRECISION,
+    no2_sum DOUBLE PRECISION,
+    no2_count BIGINT NOT NULL DEFAULT 0,
+    no_min DOUBLE PRECISION,
+    no_max DOUBLE PRECISION,
+    no_sum DOUBLE PRECISION,
+    no_count BIGINT NOT NULL DEFAULT 0,
+    o3_min DOUBLE PRECISION,
+    o3_max DOUBLE PRECISION,
+    o3_sum DOUBLE PRECISION,
+    o3_count BIGINT NOT NULL DEFAULT 0,
+    so2_min DOUBLE PRECISION,
+    so2_max DOUBLE PRECISION,
+    so2_sum DOUBLE PRECISION,
+    so2_count BIGINT NOT NULL DEFAULT 0,
+    co_min DOUBLE PRECISION,
+    co_max DOUBLE PRECISION,
+    co_sum DOUBLE PRECISION,
+    co_count BIGINT NOT NULL DEFAULT 0,
+    benzene_min DOUBLE PRECISION,
+    benzene_max DOUBLE PRECISION,
+    benzene_sum DOUBLE PRECISION,
+    benzene_count BIGINT NOT NULL DEFAULT 0,
+    voc_min DOUBLE PRECISION,
+    voc_max DOUBLE PRECISION,
+    voc_sum DOUBLE PRECISION,
+    voc_count BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX idx_air_quality_observed_aggregates_period ON air_quality_observed_aggregates (entity_id, device_id, period_start);
+CREATE INDEX idx_air_quality_observed_aggregates_period_end ON air_quality_observed_aggregates (period_end);
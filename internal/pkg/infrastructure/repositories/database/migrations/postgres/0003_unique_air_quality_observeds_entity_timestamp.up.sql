@@ -0,0 +1,8 @@
+-- An entity can only have one observation per point in time. Keep the first of any
+-- duplicates that were stored before this constraint existed.
+DELETE FROM air_quality_observeds a
+    USING air_quality_observeds b
+    WHERE a.entity_id = b.entity_id AND a."timestamp" = b."timestamp" AND a.id > b.id;
+
+DROP INDEX IF EXISTS idx_air_quality_observeds_entity_timestamp;
+CREATE UNIQUE INDEX idx_air_quality_observeds_entity_timestamp ON air_quality_observeds (entity_id, "timestamp");
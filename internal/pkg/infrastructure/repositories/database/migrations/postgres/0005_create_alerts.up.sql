@@ -0,0 +1,21 @@
+-- Alerts that have been raised by the alert rules. An alert is active until it is cleared.
+CREATE TABLE alerts (
+    id          BIGSERIAL PRIMARY KEY,
+    rule        TEXT NOT NULL,
+    device_id   TEXT NOT NULL DEFAULT '',
+    entity_id   TEXT NOT NULL DEFAULT '',
+    attribute   TEXT NOT NULL,
+    direction   TEXT NOT NULL,
+    threshold   DOUBLE PRECISION NOT NULL,
+    severity    TEXT NOT NULL DEFAULT '',
+    latitude    DOUBLE PRECISION,
+    longitude   DOUBLE PRECISION,
+    breached_at TIMESTAMPTZ NOT NULL,
+    raised_at   TIMESTAMPTZ NOT NULL,
+    value       DOUBLE PRECISION NOT NULL,
+    cleared_at  TIMESTAMPTZ,
+    clear_value DOUBLE PRECISION
+);
+
+CREATE INDEX idx_alerts_device_raised_at ON alerts (device_id, raised_at DESC);
+CREATE INDEX idx_alerts_active ON alerts (raised_at DESC) WHERE cleared_at IS NULL;
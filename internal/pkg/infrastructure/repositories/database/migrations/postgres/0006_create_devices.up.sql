@@ -0,0 +1,11 @@
+-- The latest time that every device has reported an observation. Reporting intervals are stored
+-- in seconds. The expected interval is configured, while the learned one is derived from the
+-- intervals between recent observations.
+CREATE TABLE devices (
+    device_id         TEXT PRIMARY KEY,
+    created_at        TIMESTAMPTZ NOT NULL,
+    updated_at        TIMESTAMPTZ NOT NULL,
+    last_seen         TIMESTAMPTZ NOT NULL,
+    expected_interval BIGINT,
+    learned_interval  BIGINT
+);
@@ -0,0 +1,3 @@
+-- This migration can not be rolled back. The columns are either part of the table that is created
+-- by 0001, or of a table that was created before the migrations were introduced, and neither are
+-- this migration's to drop.
@@ -0,0 +1,16 @@
+-- Databases that were created by GORM AutoMigrate before the migrations were introduced already
+-- have an air_quality_observeds table, which 0001 left as it was. Add the columns that the
+-- measurements have gained since then, and that such a table lacks.
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS co2 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS humidity DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS temperature DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS pm10 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS pm25 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS pm1 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS no2 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS "no" DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS o3 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS so2 DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS co DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS benzene DOUBLE PRECISION;
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS voc DOUBLE PRECISION;
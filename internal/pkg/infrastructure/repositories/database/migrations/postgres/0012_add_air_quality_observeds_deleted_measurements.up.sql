@@ -0,0 +1,2 @@
+-- Measurements are soft deleted one by one by listing their columns here, as in ',co2,pm10,'
+ALTER TABLE air_quality_observeds ADD COLUMN IF NOT EXISTS deleted_measurements TEXT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS air_quality_observeds;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS air_quality_observeds (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME,
+    updated_at  DATETIME,
+    deleted_at  DATETIME,
+    entity_id   TEXT,
+    device_id   TEXT,
+    latitude    REAL,
+    longitude   REAL,
+    "timestamp" DATETIME,
+    co2         REAL,
+    humidity    REAL,
+    temperature REAL,
+    pm10        REAL,
+    pm25        REAL,
+    pm1         REAL,
+    no2         REAL,
+    "no"        REAL,
+    o3          REAL,
+    so2         REAL,
+    co          REAL,
+    benzene     REAL,
+    voc         REAL
+);
+
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_deleted_at ON air_quality_observeds (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_device_timestamp ON air_quality_observeds (device_id, "timestamp" DESC);
+CREATE INDEX IF NOT EXISTS idx_air_quality_observeds_entity_timestamp ON air_quality_observeds (entity_id, "timestamp" DESC);
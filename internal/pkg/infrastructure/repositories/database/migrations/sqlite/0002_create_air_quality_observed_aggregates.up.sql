@@ -0,0 +1,66 @@
+-- Observations that are older than the raw TTL of a retention policy are rolled up into
+-- this table, with the minimum, maximum, sum and count of every measurement per period
+CREATE TABLE air_quality_observed_aggregates (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity_id    TEXT NOT NULL,
+    device_id    TEXT NOT NULL DEFAULT '',
+    period_start DATETIME NOT NULL,
+    period_end   DATETIME NOT NULL,
+    latitude     REAL,
+    longitude    REAL,
+    co2_min REAL,
+    co2_max REAL,
+    co2_sum REAL,
+    co2_count INTEGER NOT NULL DEFAULT 0,
+    humidity_min REAL,
+    humidity_max REAL,
+    humidity_sum REAL,
+    humidity_count INTEGER NOT NULL DEFAULT 0,
+    temperature_min REAL,
+    temperature_max REAL,
+    temperature_sum REAL,
+    temperature_count INTEGER NOT NULL DEFAULT 0,
+    pm10_min REAL,
+    pm10_max REAL,
+    pm10_sum REAL,
+    pm10_count INTEGER NOT NULL DEFAULT 0,
+    pm25_min REAL,
+    pm25_max REAL,
+    pm25_sum REAL,
+    pm25_count INTEGER NOT NULL DEFAULT 0,
+    pm1_min REAL,
+    pm1_max REAL,
+    pm1_sum REAL,
+    pm1_count INTEGER NOT NULL DEFAULT 0,
+    no2_min REAL,
+    no2_max REAL,
+    no2_sum REAL,
+    no2_count INTEGER NOT NULL DEFAULT 0,
+    no_min REAL,
+    no_max REAL,
+    no_sum REAL,
+    no_count INTEGER NOT NULL DEFAULT 0,
+    o3_min REAL,
+    o3_max REAL,
+    o3_sum REAL,
+    o3_count INTEGER NOT NULL DEFAULT 0,
+    so2_min REAL,
+    so2_max REAL,
+    so2_sum REAL,
+    so2_count INTEGER NOT NULL DEFAULT 0,
+    co_min REAL,
+    co_max REAL,
+    co_sum REAL,
+    co_count INTEGER NOT NULL DEFAULT 0,
+    benzene_min REAL,
+    benzene_max REAL,
+    benzene_sum REAL,
+    benzene_count INTEGER NOT NULL DEFAULT 0,
+    voc_min REAL,
+    voc_max REAL,
+    voc_sum REAL,
+    voc_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX idx_air_quality_observed_aggregates_period ON air_quality_observed_aggregates (entity_id, device_id, period_start);
+CREATE INDEX idx_air_quality_observed_aggregates_period_end ON air_quality_observed_aggregates (period_end);
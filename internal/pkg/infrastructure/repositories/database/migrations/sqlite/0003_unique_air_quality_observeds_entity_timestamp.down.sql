@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_air_quality_observeds_entity_timestamp;
+CREATE INDEX idx_air_quality_observeds_entity_timestamp ON air_quality_observeds (entity_id, "timestamp" DESC);
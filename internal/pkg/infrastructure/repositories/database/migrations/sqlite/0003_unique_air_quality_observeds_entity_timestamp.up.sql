@@ -0,0 +1,7 @@
+-- An entity can only have one observation per point in time. Keep the first of any
+-- duplicates that were stored before this constraint existed.
+DELETE FROM air_quality_observeds
+    WHERE id NOT IN (SELECT MIN(id) FROM air_quality_observeds GROUP BY entity_id, "timestamp");
+
+DROP INDEX IF EXISTS idx_air_quality_observeds_entity_timestamp;
+CREATE UNIQUE INDEX idx_air_quality_observeds_entity_timestamp ON air_quality_observeds (entity_id, "timestamp");
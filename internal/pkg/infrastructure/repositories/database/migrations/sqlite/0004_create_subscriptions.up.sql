@@ -0,0 +1,24 @@
+-- NGSI-LD subscriptions to new observations. Lists of attribute names are stored comma
+-- separated, and filter holds the JSON encoded filter that the q expression was parsed into.
+CREATE TABLE subscriptions (
+    id                      TEXT PRIMARY KEY,
+    created_at              DATETIME NOT NULL,
+    updated_at              DATETIME NOT NULL,
+    description             TEXT NOT NULL DEFAULT '',
+    entity_type             TEXT NOT NULL,
+    entity_id               TEXT NOT NULL DEFAULT '',
+    watched_attributes      TEXT NOT NULL DEFAULT '',
+    q                       TEXT NOT NULL DEFAULT '',
+    filter                  TEXT NOT NULL DEFAULT '',
+    notification_attributes TEXT NOT NULL DEFAULT '',
+    endpoint                TEXT NOT NULL,
+    accept                  TEXT NOT NULL DEFAULT 'application/json',
+    throttling              INTEGER NOT NULL DEFAULT 0,
+    is_active               BOOLEAN NOT NULL DEFAULT TRUE,
+    times_sent              INTEGER NOT NULL DEFAULT 0,
+    last_notification       DATETIME,
+    last_success            DATETIME,
+    last_failure            DATETIME
+);
+
+CREATE INDEX idx_subscriptions_entity_type ON subscriptions (entity_type);
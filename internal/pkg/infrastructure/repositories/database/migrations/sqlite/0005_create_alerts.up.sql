@@ -0,0 +1,21 @@
+-- Alerts that have been raised by the alert rules. An alert is active until it is cleared.
+CREATE TABLE alerts (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    rule        TEXT NOT NULL,
+    device_id   TEXT NOT NULL DEFAULT '',
+    entity_id   TEXT NOT NULL DEFAULT '',
+    attribute   TEXT NOT NULL,
+    direction   TEXT NOT NULL,
+    threshold   REAL NOT NULL,
+    severity    TEXT NOT NULL DEFAULT '',
+    latitude    REAL,
+    longitude   REAL,
+    breached_at DATETIME NOT NULL,
+    raised_at   DATETIME NOT NULL,
+    value       REAL NOT NULL,
+    cleared_at  DATETIME,
+    clear_value REAL
+);
+
+CREATE INDEX idx_alerts_device_raised_at ON alerts (device_id, raised_at DESC);
+CREATE INDEX idx_alerts_active ON alerts (raised_at DESC) WHERE cleared_at IS NULL;
@@ -0,0 +1,4 @@
+-- Databases that were created by GORM AutoMigrate before the migrations were introduced already
+-- have an air_quality_observeds table, which 0001 left as it was. The columns that the
+-- measurements have gained since then, and that such a table lacks, are added by the migration
+-- step of this version in migrate.go, since SQLite does not support ADD COLUMN IF NOT EXISTS.
@@ -0,0 +1 @@
+ALTER TABLE air_quality_observeds DROP COLUMN deleted_measurements;
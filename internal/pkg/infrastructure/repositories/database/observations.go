@@ -0,0 +1,265 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+//Observation is a stored observation of an entity. Observations are pointers to models that
+//embed gorm.Model, and are stored in the table of the model.
+type Observation interface {
+	//Key returns the entity and the point in time that identify the observation, since an entity
+	//can only have one observation per point in time
+	Key() (entityId string, observedAt time.Time)
+	//Source returns the device that reported the observation, and when it was reported
+	Source() (deviceId string, reportedAt time.Time)
+	//Position returns the latitude and longitude of the observation
+	Position() (latitude, longitude float64)
+	//Attributes returns the measurements keyed on their NGSI-LD attribute names
+	Attributes() map[string]*float64
+}
+
+//ObservationKind describes how the observations of an entity type are stored and queried. The
+//schema of the table is managed by the migrations, and times are stored in UTC.
+type ObservationKind struct {
+	//Name is the name of the entity type that the observations are made of
+	Name string
+	//New returns an empty observation of the kind
+	New func() Observation
+	//Columns lists the columns of the measurements, which can be filtered and aggregated
+	Columns []string
+	//TextColumns lists the columns, besides the device, that filters compare with text values
+	TextColumns []string
+	//TimeColumn holds the point in time that is part of the Key of an observation
+	TimeColumn string
+	//EndTimeColumn is set for observations that are made over an interval, from TimeColumn to
+	//EndTimeColumn. The intervals are reported when they end, and are matched by the time spans
+	//of queries that they overlap.
+	EndTimeColumn string
+}
+
+//AirQualityObservedKind holds the air quality observations. Its table is a hypertable when
+//TimescaleDB is available, and it is the only kind that supports retention policies and deletes
+//of single measurements.
+var AirQualityObservedKind = &ObservationKind{
+	Name:       "AirQualityObserved",
+	New:        func() Observation { return &models.AirQualityObserved{} },
+	Columns:    measurementColumns,
+	TimeColumn: "timestamp",
+}
+
+//observationKinds lists every kind of observations, so that they count towards the liveness of
+//the reporting devices and are deleted along with the other observations of a device
+var observationKinds = []*ObservationKind{}
+
+func init() {
+	RegisterObservationKind(AirQualityObservedKind)
+}
+
+//RegisterObservationKind makes a kind of observations known to the Datastore. It panics if a kind
+//with the same name has already been registered.
+func RegisterObservationKind(kind *ObservationKind) {
+	if _, ok := LookupObservationKind(kind.Name); ok {
+		panic(fmt.Sprintf("observations of %s have already been registered", kind.Name))
+	}
+
+	observationKinds = append(observationKinds, kind)
+}
+
+//LookupObservationKind returns the registered kind of observations with the given name
+func LookupObservationKind(name string) (*ObservationKind, bool) {
+	for _, kind := range observationKinds {
+		if kind.Name == name {
+			return kind, true
+		}
+	}
+
+	return nil, false
+}
+
+//reportedColumn returns the quoted column that holds the time an observation was reported at
+func (k *ObservationKind) reportedColumn() string {
+	if k.EndTimeColumn != "" {
+		return `"` + k.EndTimeColumn + `"`
+	}
+	return `"` + k.TimeColumn + `"`
+}
+
+//check makes sure that an observation is stored in the table of the kind
+func (k *ObservationKind) check(observation Observation) error {
+	if reflect.TypeOf(observation) != reflect.TypeOf(k.New()) {
+		return fmt.Errorf("%T is not an observation of %s", observation, k.Name)
+	}
+	return nil
+}
+
+//newSlice returns a pointer to an empty slice of the model of the kind, that queries can be scanned into
+func (k *ObservationKind) newSlice() interface{} {
+	return reflect.New(reflect.SliceOf(reflect.TypeOf(k.New()).Elem())).Interface()
+}
+
+//observationsOf returns pointers to the observations in a slice that was created by newSlice
+func observationsOf(slice interface{}) []Observation {
+	values := reflect.ValueOf(slice).Elem()
+
+	observations := make([]Observation, values.Len())
+	for idx := range observations {
+		observations[idx] = values.Index(idx).Addr().Interface().(Observation)
+	}
+
+	return observations
+}
+
+//observations selects the stored observations of a kind
+func (db *myDB) observations(kind *ObservationKind) *gorm.DB {
+	if kind == AirQualityObservedKind {
+		return db.airQualityObserveds()
+	}
+	return db.impl.Model(kind.New())
+}
+
+//StoreObservation stores an observation, unless the entity already has an observation at the
+//same point in time. Duplicates are handled according to onDuplicate, and the observation that
+//is stored afterwards is returned.
+func (db *myDB) StoreObservation(kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error) {
+	err := kind.check(observation)
+	if err != nil {
+		return nil, StoreResultCreated, err
+	}
+
+	if kind == AirQualityObservedKind {
+		return db.storeAirQualityObserved(observation.(*models.AirQualityObserved), onDuplicate)
+	}
+
+	return storeObservation(db.impl, kind, observation, onDuplicate)
+}
+
+//storeObservation stores an observation using tx, so that it can also be part of a batch
+func storeObservation(tx *gorm.DB, kind *ObservationKind, observation Observation, onDuplicate DuplicatePolicy) (Observation, StoreResult, error) {
+	entityId, observedAt := observation.Key()
+
+	existing := kind.New()
+	key := duplicateKey{Columns: []string{"entity_id", kind.TimeColumn}, EntityId: entityId, ObservedAt: observedAt}
+
+	result, err := storeWithDuplicatePolicy(tx, observation, existing, key, onDuplicate, nil)
+	if err != nil {
+		return nil, StoreResultCreated, err
+	}
+
+	if result == StoreResultIgnored {
+		return existing, result, nil
+	}
+
+	return observation, result, nil
+}
+
+//StoreObservations stores a batch of observations in a single transaction and returns the outcome
+//of every observation, in the same order
+func (db *myDB) StoreObservations(kind *ObservationKind, observations []Observation, onDuplicate DuplicatePolicy) ([]BatchStoreResult, error) {
+	for _, o := range observations {
+		err := kind.check(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if kind == AirQualityObservedKind {
+		aqos := []models.AirQualityObserved{}
+		for _, o := range observations {
+			aqos = append(aqos, *o.(*models.AirQualityObserved))
+		}
+		return db.storeAirQualityObserveds(aqos, onDuplicate)
+	}
+
+	return db.storeInBatch(len(observations), func(tx *gorm.DB, idx int) (StoreResult, error) {
+		_, result, err := storeObservation(tx, kind, observations[idx], onDuplicate)
+		return result, err
+	})
+}
+
+//GetObservation returns the most recent observation of an entity
+func (db *myDB) GetObservation(kind *ObservationKind, entityId string) (Observation, error) {
+	observation := kind.New()
+
+	result := db.observations(kind).Where("entity_id = ?", entityId).Order(`"` + kind.TimeColumn + `" DESC`).Limit(1).Find(observation)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
+	return observation, nil
+}
+
+//GetObservations returns the observations, optionally of a single device, that were made within a
+//time span and match the options, the most recent first
+func (db *myDB) GetObservations(kind *ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...QueryOption) ([]Observation, error) {
+	qo := newQueryOptions(options)
+
+	gorm, err := applyQueryFilters(db.observations(kind).Order(`"`+kind.TimeColumn+`" DESC`), kind, deviceId, from, to, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	gorm, err = db.limitPerEntity(gorm, kind, qo)
+	if err != nil {
+		return nil, err
+	}
+
+	observations := kind.newSlice()
+
+	result := gorm.Limit(int(limit)).Find(observations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return observationsOf(observations), nil
+}
+
+//DeleteObservations deletes all observations of a set of entities in a single transaction and
+//returns the number of deleted observations per entity
+func (db *myDB) DeleteObservations(kind *ObservationKind, entityIds []string, purge bool) (map[string]int64, error) {
+	if kind == AirQualityObservedKind {
+		return db.deleteAirQualityObserveds(entityIds, purge)
+	}
+
+	var deleted map[string]int64
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		var err error
+		deleted, err = deleteEntities(tx, kind.New(), entityIds, purge)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+//DeleteMeasurement removes a single measurement from an observation, which is only supported
+//for air quality observations
+func (db *myDB) DeleteMeasurement(kind *ObservationKind, entityId string, id uint, column string, purge bool) error {
+	if kind != AirQualityObservedKind {
+		return fmt.Errorf("measurements can not be deleted from observations of %s", kind.Name)
+	}
+
+	return db.deleteAirQualityObservedAttribute(entityId, id, column, purge)
+}
+
+//ApplyRetention applies a retention policy to the observations of a kind, which is only
+//supported for air quality observations
+func (db *myDB) ApplyRetention(kind *ObservationKind, rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error) {
+	if kind != AirQualityObservedKind {
+		return RetentionResult{}, fmt.Errorf("retention is not supported for observations of %s", kind.Name)
+	}
+
+	return db.applyAirQualityObservedRetention(rawBefore, interval, aggregatesBefore, dryRun)
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+)
+
+const aggregatesTable string = "air_quality_observed_aggregates"
+
+//RetentionResult describes the rows that were, or in a dry run would have been, affected by
+//applying a retention policy
+type RetentionResult struct {
+	//Cutoff is the time before which raw observations are rolled up and deleted
+	Cutoff time.Time
+	//RolledUp is the number of raw observations that were rolled up into aggregates and deleted
+	RolledUp int64
+	//AggregatesWritten is the number of aggregate rows that were created or updated
+	AggregatesWritten int64
+	//AggregatesDeleted is the number of aggregate rows that were deleted because they expired
+	AggregatesDeleted int64
+}
+
+//bucketSQL returns an expression for the start of the fixed size bucket, in seconds since the
+//unix epoch, that an observation belongs to, and a function that converts such an expression
+//into a timestamp
+func bucketSQL(dialect string, interval time.Duration) (string, func(string) string) {
+	seconds := int64(interval.Seconds())
+
+	if dialect == "postgres" {
+		return fmt.Sprintf(`floor(extract(epoch from "timestamp") / %d) * %d`, seconds, seconds),
+			func(epoch string) string { return fmt.Sprintf("to_timestamp(%s)", epoch) }
+	}
+
+	// Use the same format as the sqlite driver uses for time parameters, so that text comparisons work
+	return fmt.Sprintf(`(CAST(strftime('%%s', "timestamp") AS INTEGER) / %d) * %d`, seconds, seconds),
+		func(epoch string) string {
+			return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:%%S+00:00', %s, 'unixepoch')", epoch)
+		}
+}
+
+//rollupSQL creates an upsert that rolls up all observations before a cutoff into the aggregates
+//table. Rows that already exist for a period, e.g. because late observations arrived after a
+//previous rollup, are merged with the new statistics.
+func rollupSQL(dialect string, interval time.Duration) string {
+	bucket, toTimestamp := bucketSQL(dialect, interval)
+	start := toTimestamp(bucket)
+	end := toTimestamp(fmt.Sprintf("%s + %d", bucket, int64(interval.Seconds())))
+
+	least, greatest := "MIN", "MAX"
+	if dialect == "postgres" {
+		least, greatest = "LEAST", "GREATEST"
+	}
+
+	columns := []string{"entity_id", "device_id", "period_start", "period_end", "latitude", "longitude"}
+	selects := []string{"entity_id", "device_id", start, end, "AVG(latitude)", "AVG(longitude)"}
+	updates := []string{}
+
+	for _, column := range measurementColumns {
+		columns = append(columns,
+			fmt.Sprintf(`"%s_min"`, column), fmt.Sprintf(`"%s_max"`, column),
+			fmt.Sprintf(`"%s_sum"`, column), fmt.Sprintf(`"%s_count"`, column),
+		)
+		value := measurementSQL(column)
+		selects = append(selects,
+			fmt.Sprintf(`MIN(%s)`, value), fmt.Sprintf(`MAX(%s)`, value),
+			fmt.Sprintf(`SUM(%s)`, value), fmt.Sprintf(`COUNT(%s)`, value),
+		)
+
+		existing := func(fn string) string { return fmt.Sprintf(`%s."%s_%s"`, aggregatesTable, column, fn) }
+		excluded := func(fn string) string { return fmt.Sprintf(`excluded."%s_%s"`, column, fn) }
+
+		updates = append(updates,
+			fmt.Sprintf(`"%s_min" = %s(COALESCE(%s, %s), COALESCE(%s, %s))`, column, least, existing("min"), excluded("min"), excluded("min"), existing("min")),
+			fmt.Sprintf(`"%s_max" = %s(COALESCE(%s, %s), COALESCE(%s, %s))`, column, greatest, existing("max"), excluded("max"), excluded("max"), existing("max")),
+			fmt.Sprintf(`"%s_sum" = CASE WHEN %s IS NULL THEN %s WHEN %s IS NULL THEN %s ELSE %s + %s END`,
+				column, existing("sum"), excluded("sum"), excluded("sum"), existing("sum"), existing("sum"), excluded("sum")),
+			fmt.Sprintf(`"%s_count" = %s + %s`, column, existing("count"), excluded("count")),
+		)
+	}
+
+	return fmt.Sprintf(
+		`INSERT INTO %s (%s)
+		SELECT %s FROM %s WHERE "timestamp" < ? AND deleted_at IS NULL
+		GROUP BY entity_id, device_id, %s
+		ON CONFLICT (entity_id, device_id, period_start) DO UPDATE SET %s`,
+		aggregatesTable, strings.Join(columns, ", "),
+		strings.Join(selects, ", "), observationsTable,
+		bucket, strings.Join(updates, ", "),
+	)
+}
+
+//applyAirQualityObservedRetention rolls up all raw observations before rawBefore into aggregates
+//of the given interval and deletes them, and deletes all aggregates that end before aggregatesBefore.
+//The raw cutoff is aligned to the start of an interval, so that no period is rolled up while it
+//still has raw observations. A zero aggregatesBefore keeps the aggregates forever. In a dry run
+//nothing is changed, and the result describes what would have been done.
+func (db *myDB) applyAirQualityObservedRetention(rawBefore time.Time, interval time.Duration, aggregatesBefore time.Time, dryRun bool) (RetentionResult, error) {
+	if interval < time.Second {
+		return RetentionResult{}, fmt.Errorf("downsample interval must be at least one second")
+	}
+
+	seconds := int64(interval.Seconds())
+	result := RetentionResult{Cutoff: time.Unix(rawBefore.Unix()/seconds*seconds, 0).UTC()}
+
+	if dryRun {
+		return result, db.retentionDryRun(interval, aggregatesBefore, &result)
+	}
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		rollup := tx.Exec(rollupSQL(db.impl.Dialector.Name(), interval), result.Cutoff)
+		if rollup.Error != nil {
+			return fmt.Errorf("failed to roll up observations: %w", rollup.Error)
+		}
+		result.AggregatesWritten = rollup.RowsAffected
+
+		first, last, found, err := db.observationSpan(tx.Where(`"timestamp" < ?`, result.Cutoff))
+		if err != nil {
+			return err
+		}
+
+		if found {
+			err = db.decompressChunks(tx, first, last)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Soft deleted observations are not part of the aggregates, but are removed as well
+		deleted := tx.Unscoped().Where(`"timestamp" < ?`, result.Cutoff).Delete(&models.AirQualityObserved{})
+		if deleted.Error != nil {
+			return fmt.Errorf("failed to delete rolled up observations: %w", deleted.Error)
+		}
+		result.RolledUp = deleted.RowsAffected
+
+		if !aggregatesBefore.IsZero() {
+			expired := tx.Exec("DELETE FROM "+aggregatesTable+" WHERE period_end <= ?", aggregatesBefore.UTC())
+			if expired.Error != nil {
+				return fmt.Errorf("failed to delete expired aggregates: %w", expired.Error)
+			}
+			result.AggregatesDeleted = expired.RowsAffected
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+func (db *myDB) retentionDryRun(interval time.Duration, aggregatesBefore time.Time, result *RetentionResult) error {
+	bucket, _ := bucketSQL(db.impl.Dialector.Name(), interval)
+
+	err := db.impl.Table(observationsTable).Unscoped().Where(`"timestamp" < ?`, result.Cutoff).Count(&result.RolledUp).Error
+	if err != nil {
+		return err
+	}
+
+	buckets := db.impl.Table(observationsTable).Select("1").Where(`"timestamp" < ? AND deleted_at IS NULL`, result.Cutoff).Group("entity_id, device_id, " + bucket)
+	err = db.impl.Table("(?) AS buckets", buckets).Count(&result.AggregatesWritten).Error
+	if err != nil {
+		return err
+	}
+
+	if !aggregatesBefore.IsZero() {
+		return db.impl.Table(aggregatesTable).Where("period_end <= ?", aggregatesBefore.UTC()).Count(&result.AggregatesDeleted).Error
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//ErrSubscriptionExists is returned when a subscription is created with the id of an existing one
+var ErrSubscriptionExists = errors.New("a subscription with this id already exists")
+
+//CreateSubscription stores a new subscription
+func (db *myDB) CreateSubscription(subscription models.Subscription) error {
+	result := db.impl.Clauses(clause.OnConflict{DoNothing: true}).Create(&subscription)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w (%s)", ErrSubscriptionExists, subscription.ID)
+	}
+
+	return nil
+}
+
+//GetSubscription returns the subscription with the given id, or ErrNotFound
+func (db *myDB) GetSubscription(id string) (*models.Subscription, error) {
+	subscription := &models.Subscription{}
+
+	result := db.impl.Where("id = ?", id).Limit(1).Find(subscription)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
+	return subscription, nil
+}
+
+//GetSubscriptions returns all subscriptions, the oldest first
+func (db *myDB) GetSubscriptions() ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+
+	err := db.impl.Order("created_at, id").Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+//UpdateSubscription replaces the settings of an existing subscription, but leaves its
+//notification statistics as they are
+func (db *myDB) UpdateSubscription(subscription models.Subscription) error {
+	result := db.impl.Model(&models.Subscription{}).Where("id = ?", subscription.ID).
+		Select("description", "entity_type", "entity_id", "watched_attributes", "q", "filter",
+			"notification_attributes", "endpoint", "accept", "throttling", "is_active", "updated_at").
+		Updates(&subscription)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//DeleteSubscription deletes a subscription, or returns ErrNotFound
+func (db *myDB) DeleteSubscription(id string) error {
+	result := db.impl.Where("id = ?", id).Delete(&models.Subscription{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//RecordNotification updates the statistics of a subscription after a notification has been
+//delivered, or has finally failed to be delivered
+func (db *myDB) RecordNotification(id string, notifiedAt time.Time, success bool) error {
+	notifiedAt = notifiedAt.UTC()
+
+	updates := map[string]interface{}{
+		"times_sent":        gorm.Expr("times_sent + 1"),
+		"last_notification": notifiedAt,
+	}
+
+	if success {
+		updates["last_success"] = notifiedAt
+	} else {
+		updates["last_failure"] = notifiedAt
+	}
+
+	return db.impl.Model(&models.Subscription{}).Where("id = ?", id).UpdateColumns(updates).Error
+}
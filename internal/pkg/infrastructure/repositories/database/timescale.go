@@ -0,0 +1,294 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+const observationsTable string = "air_quality_observeds"
+
+//continuousAggregates maps the aggregation periods that are materialized by TimescaleDB
+//to the names of their continuous aggregates
+var continuousAggregates = map[AggregationPeriod]string{
+	AggregationPeriodHour: observationsTable + "_hourly",
+	AggregationPeriodDay:  observationsTable + "_daily",
+}
+
+var continuousAggregateBuckets = map[AggregationPeriod]string{
+	AggregationPeriodHour: "1 hour",
+	AggregationPeriodDay:  "1 day",
+}
+
+//timescaleStep is a part of the TimescaleDB setup. The statements are skipped if the exists
+//query returns true.
+type timescaleStep struct {
+	description string
+	exists      string
+	statements  []string
+}
+
+//setupTimescaleDB turns the observations table into a hypertable with a compression policy,
+//and creates continuous aggregates for hourly and daily statistics, if the timescaledb
+//extension is installed. Every step checks the current state first, so that this can run
+//on every start. It returns true if TimescaleDB is available and has been set up.
+func setupTimescaleDB(db *gorm.DB, log zerolog.Logger) bool {
+	if db.Dialector.Name() != "postgres" {
+		return false
+	}
+
+	var installed bool
+	err := db.Raw("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&installed).Error
+	if err != nil || !installed {
+		log.Info().Msg("timescaledb extension not found, using a plain observations table")
+		return false
+	}
+
+	compressAfter := getEnv("DIWISE_TIMESCALEDB_COMPRESS_AFTER", "7 days")
+
+	steps := []timescaleStep{
+		{
+			description: "create hypertable",
+			exists:      "SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = '" + observationsTable + "')",
+			statements: []string{
+				// Unique constraints on a hypertable must include the partitioning column
+				"ALTER TABLE " + observationsTable + " DROP CONSTRAINT IF EXISTS " + observationsTable + "_pkey",
+				"ALTER TABLE " + observationsTable + ` ADD PRIMARY KEY (id, "timestamp")`,
+				"SELECT create_hypertable('" + observationsTable + "', 'timestamp', migrate_data => true)",
+			},
+		},
+		{
+			description: "enable compression",
+			exists:      "SELECT EXISTS (SELECT 1 FROM timescaledb_information.compression_settings WHERE hypertable_name = '" + observationsTable + "')",
+			statements: []string{
+				"ALTER TABLE " + observationsTable + ` SET (timescaledb.compress, timescaledb.compress_segmentby = 'entity_id', timescaledb.compress_orderby = '"timestamp" DESC')`,
+			},
+		},
+		{
+			description: "add compression policy",
+			statements: []string{
+				fmt.Sprintf("SELECT add_compression_policy('%s', INTERVAL '%s', if_not_exists => true)", observationsTable, compressAfter),
+			},
+		},
+	}
+
+	for _, period := range []AggregationPeriod{AggregationPeriodHour, AggregationPeriodDay} {
+		view := continuousAggregates[period]
+		bucket := continuousAggregateBuckets[period]
+
+		steps = append(steps,
+			timescaleStep{
+				// Aggregates that were created before measurements could be deleted one by one are replaced
+				description: "create continuous aggregate " + view,
+				exists: "SELECT EXISTS (SELECT 1 FROM timescaledb_information.continuous_aggregates WHERE view_name = '" + view + "'" +
+					" AND view_definition LIKE '%deleted_measurements%')",
+				statements: []string{
+					"DROP MATERIALIZED VIEW IF EXISTS " + view,
+					continuousAggregateSQL(view, bucket),
+					// The view is created without data, so the existing observations are materialized separately
+					"CALL refresh_continuous_aggregate('" + view + "', NULL, NULL)",
+				},
+			},
+			timescaleStep{
+				description: "enable real-time aggregation for " + view,
+				exists:      "SELECT EXISTS (SELECT 1 FROM timescaledb_information.continuous_aggregates WHERE view_name = '" + view + "' AND NOT materialized_only)",
+				statements: []string{
+					"ALTER MATERIALIZED VIEW " + view + " SET (timescaledb.materialized_only = false)",
+				},
+			},
+			timescaleStep{
+				// Without a start offset the policy refreshes every invalidated period, however old
+				description: "add refresh policy for " + view,
+				exists: "SELECT EXISTS (SELECT 1 FROM timescaledb_information.jobs WHERE proc_name = 'policy_refresh_continuous_aggregate'" +
+					" AND hypertable_name = (SELECT materialization_hypertable_name FROM timescaledb_information.continuous_aggregates WHERE view_name = '" + view + "')" +
+					" AND config->>'start_offset' IS NULL)",
+				statements: []string{
+					"SELECT remove_continuous_aggregate_policy('" + view + "', if_exists => true)",
+					fmt.Sprintf(
+						"SELECT add_continuous_aggregate_policy('%s', start_offset => NULL, end_offset => INTERVAL '%s', schedule_interval => INTERVAL '%s')",
+						view, bucket, bucket,
+					),
+				},
+			},
+		)
+	}
+
+	for _, step := range steps {
+		if step.exists != "" {
+			var exists bool
+			err = db.Raw(step.exists).Scan(&exists).Error
+			if err != nil {
+				log.Error().Err(err).Msgf("failed to check timescaledb state before step: %s", step.description)
+				return false
+			}
+			if exists {
+				continue
+			}
+		}
+
+		for _, statement := range step.statements {
+			err = db.Exec(statement).Error
+			if err != nil {
+				log.Error().Err(err).Msgf("timescaledb setup failed: %s", step.description)
+				return false
+			}
+		}
+
+		log.Info().Msgf("timescaledb setup: %s", step.description)
+	}
+
+	return true
+}
+
+//decompressChunks decompresses the chunks that hold observations within a time span, since
+//compressed chunks can not be updated or deleted from. A zero from or to leaves the span open.
+//The compression policy compresses the chunks again once they are old enough.
+func (db *myDB) decompressChunks(tx *gorm.DB, from, to time.Time) error {
+	if !db.timescale {
+		return nil
+	}
+
+	statement, values := decompressChunksSQL(from, to)
+	return tx.Exec(statement, values...).Error
+}
+
+func decompressChunksSQL(from, to time.Time) (string, []interface{}) {
+	statement := "SELECT decompress_chunk(format('%I.%I', chunk_schema, chunk_name)::regclass, if_compressed => true)" +
+		" FROM timescaledb_information.chunks WHERE hypertable_name = '" + observationsTable + "' AND is_compressed"
+	values := []interface{}{}
+
+	if !from.IsZero() {
+		statement += " AND range_end > ?"
+		values = append(values, from.UTC())
+	}
+
+	if !to.IsZero() {
+		statement += " AND range_start <= ?"
+		values = append(values, to.UTC())
+	}
+
+	return statement, values
+}
+
+//refreshContinuousAggregates materializes the aggregates of a time span again after observations
+//within it have been changed or deleted. A zero from or to leaves the span open. It must not be
+//called within a transaction. A failed refresh is only logged, since the refresh policy will
+//eventually catch up.
+func (db *myDB) refreshContinuousAggregates(from, to time.Time) {
+	if !db.timescale {
+		return
+	}
+
+	for _, period := range []AggregationPeriod{AggregationPeriodHour, AggregationPeriodDay} {
+		statement, values := refreshContinuousAggregateSQL(period, from, to)
+
+		err := db.impl.Exec(statement, values...).Error
+		if err != nil {
+			db.log.Error().Err(err).Msgf("failed to refresh the continuous aggregate %s", continuousAggregates[period])
+		}
+	}
+}
+
+//refreshContinuousAggregateSQL refreshes the buckets of a continuous aggregate that overlap a time span
+func refreshContinuousAggregateSQL(period AggregationPeriod, from, to time.Time) (string, []interface{}) {
+	window := []string{"NULL", "NULL"}
+	values := []interface{}{}
+
+	if !from.IsZero() {
+		window[0] = "?::timestamptz"
+		values = append(values, bucketStart(period, from))
+	}
+
+	if !to.IsZero() {
+		window[1] = "?::timestamptz"
+		values = append(values, period.periodEnd(bucketStart(period, to)))
+	}
+
+	return fmt.Sprintf("CALL refresh_continuous_aggregate('%s', %s, %s)", continuousAggregates[period], window[0], window[1]), values
+}
+
+//bucketStart returns the start of the hourly or daily bucket that a point in time belongs to
+func bucketStart(period AggregationPeriod, t time.Time) time.Time {
+	if period == AggregationPeriodHour {
+		return t.UTC().Truncate(time.Hour)
+	}
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+//continuousAggregateSQL creates a continuous aggregate that holds the minimum, maximum, sum and
+//count of every measurement, that has not been deleted, per entity, device and bucket
+func continuousAggregateSQL(view, bucket string) string {
+	columns := []string{}
+	for _, column := range measurementColumns {
+		for _, fn := range []string{"MIN", "MAX", "SUM", "COUNT"} {
+			columns = append(columns, fmt.Sprintf(`%s(%s) AS "%s_%s"`, fn, measurementSQL(column), column, strings.ToLower(fn)))
+		}
+	}
+
+	return fmt.Sprintf(
+		`CREATE MATERIALIZED VIEW %s WITH (timescaledb.continuous) AS
+		SELECT entity_id, device_id, time_bucket(INTERVAL '%s', "timestamp") AS period_start, %s
+		FROM %s WHERE deleted_at IS NULL
+		GROUP BY entity_id, device_id, time_bucket(INTERVAL '%s', "timestamp")
+		WITH NO DATA`,
+		view, bucket, strings.Join(columns, ", "), observationsTable, bucket,
+	)
+}
+
+//canUseContinuousAggregate returns true if an aggregation query can be answered by one of the
+//continuous aggregates, i.e. if it does not filter on anything but entity, device and whole periods
+func canUseContinuousAggregate(period AggregationPeriod, from, to time.Time, qo *queryOptions) bool {
+	if _, ok := continuousAggregates[period]; !ok {
+		return false
+	}
+
+	if qo.geoQuery != nil || qo.filter != nil {
+		return false
+	}
+
+	isAligned := func(t time.Time) bool {
+		if t.IsZero() {
+			return true
+		}
+
+		if period == AggregationPeriodHour {
+			return t.Truncate(time.Hour).Equal(t)
+		}
+		return t.Truncate(24 * time.Hour).Equal(t)
+	}
+
+	return isAligned(from) && isAligned(to)
+}
+
+//continuousAggregateQuery selects the aggregates from a continuous aggregate, combining the
+//rows of entities that have been reported by more than one device during a period
+func (db *myDB) continuousAggregateQuery(period AggregationPeriod, deviceId string, from, to time.Time, qo *queryOptions) *gorm.DB {
+	selects := []string{"entity_id", "period_start"}
+
+	for _, column := range measurementColumns {
+		selects = append(selects,
+			fmt.Sprintf(`SUM("%s_sum") / NULLIF(SUM("%s_count"), 0)`, column, column),
+			fmt.Sprintf(`MIN("%s_min")`, column),
+			fmt.Sprintf(`MAX("%s_max")`, column),
+			fmt.Sprintf(`SUM("%s_sum")`, column),
+			fmt.Sprintf(`SUM("%s_count")`, column),
+		)
+	}
+
+	query := db.impl.Table(continuousAggregates[period]).Select(strings.Join(selects, ", "))
+
+	if deviceId != "" {
+		query = query.Where("device_id = ?", deviceId)
+	}
+
+	if qo.entityId != "" {
+		query = query.Where("entity_id = ?", qo.entityId)
+	}
+
+	query = insertTemporalSQL(query, "period_start", from, to)
+
+	return query.Group("entity_id, period_start").Order("entity_id, period_start")
+}
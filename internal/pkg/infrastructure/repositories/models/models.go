@@ -6,14 +6,140 @@ import (
 	"gorm.io/gorm"
 )
 
+//AirQualityObserved is a single observation of an entity. The schema, including the indexes
+//on (device_id, timestamp DESC) and (entity_id, timestamp DESC), is managed by the migrations
+//in the database package.
 type AirQualityObserved struct {
 	gorm.Model
-	EntityId    string
-	DeviceId    string
-	CO2         float64
-	Humidity    float64
-	Temperature float64
-	Latitude    float64
-	Longitude   float64
-	Timestamp   time.Time
+	EntityId  string
+	DeviceId  string
+	Latitude  float64
+	Longitude float64
+	Timestamp time.Time
+	AirQualityMeasurements
+
+	//DeletedMeasurements lists the columns of the measurements that have been soft deleted from
+	//the observation. Their values are kept, but are NULL when the observation is read.
+	DeletedMeasurements string
+
+	//AirQualityIndex and AirQualityLevel are derived from the measurements when an
+	//observation is read and are not stored
+	AirQualityIndex *float64 `gorm:"-"`
+	AirQualityLevel string   `gorm:"-"`
+}
+
+//Key returns the entity and the time of the observation
+func (aqo *AirQualityObserved) Key() (string, time.Time) {
+	return aqo.EntityId, aqo.Timestamp
+}
+
+//Source returns the device that made the observation, and the time of the observation
+func (aqo *AirQualityObserved) Source() (string, time.Time) {
+	return aqo.DeviceId, aqo.Timestamp
+}
+
+//Position returns the latitude and longitude of the observation
+func (aqo *AirQualityObserved) Position() (float64, float64) {
+	return aqo.Latitude, aqo.Longitude
+}
+
+//AirQualityMeasurements contains the values that can be observed by an air quality sensor,
+//as defined by the FIWARE AirQualityObserved data model. Values that were not part of an
+//observation are nil and stored as NULL.
+type AirQualityMeasurements struct {
+	CO2         *float64
+	Humidity    *float64
+	Temperature *float64
+	PM10        *float64
+	PM25        *float64
+	PM1         *float64
+	NO2         *float64
+	NO          *float64
+	O3          *float64
+	SO2         *float64
+	CO          *float64
+	Benzene     *float64
+	VOC         *float64
+}
+
+//Attributes returns the measurements keyed on their NGSI-LD attribute names
+func (m AirQualityMeasurements) Attributes() map[string]*float64 {
+	return map[string]*float64{
+		"CO2":                           m.CO2,
+		"relativeHumidity":              m.Humidity,
+		"temperature":                   m.Temperature,
+		"PM10":                          m.PM10,
+		"PM2.5":                         m.PM25,
+		"PM1":                           m.PM1,
+		"NO2":                           m.NO2,
+		"NO":                            m.NO,
+		"O3":                            m.O3,
+		"SO2":                           m.SO2,
+		"CO":                            m.CO,
+		"C6H6":                          m.Benzene,
+		"volatileOrganicCompoundsTotal": m.VOC,
+	}
+}
+
+//Subscription is an NGSI-LD subscription to new observations of an entity type. The lists of
+//attribute names are stored comma separated, and Filter holds the JSON encoded database filter
+//that Q was parsed into. Throttling is the minimum number of seconds between two notifications.
+type Subscription struct {
+	ID                     string `gorm:"primaryKey"`
+	CreatedAt              time.Time
+	UpdatedAt              time.Time
+	Description            string
+	EntityType             string
+	EntityID               string
+	WatchedAttributes      string
+	Q                      string
+	Filter                 string
+	NotificationAttributes string
+	Endpoint               string
+	Accept                 string
+	Throttling             int64
+	IsActive               bool
+
+	//TimesSent and the times of the latest notifications are updated for every delivery attempt
+	TimesSent        int64
+	LastNotification *time.Time
+	LastSuccess      *time.Time
+	LastFailure      *time.Time
+}
+
+//Alert is raised when the observations of a device have breached the threshold of an alert
+//rule for long enough, and is cleared when they have returned past the clear threshold of the
+//rule. An alert is active until ClearedAt has been set.
+type Alert struct {
+	ID        uint `gorm:"primaryKey"`
+	Rule      string
+	DeviceId  string
+	EntityId  string
+	Attribute string
+	Direction string
+	Threshold float64
+	Severity  string
+	Latitude  float64
+	Longitude float64
+
+	//BreachedAt is the time of the first observation that breached the threshold, and
+	//RaisedAt the time of the observation that raised the alert with Value
+	BreachedAt time.Time
+	RaisedAt   time.Time
+	Value      float64
+
+	ClearedAt  *time.Time
+	ClearValue *float64
+}
+
+//Device holds the latest time that a device reported an observation, and its reporting
+//intervals in seconds. ExpectedInterval is configured, and takes precedence over the interval
+//that has been learned from the observations of the device.
+type Device struct {
+	DeviceId         string `gorm:"primaryKey"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	LastSeen         time.Time
+	ExpectedInterval *int64
+	LearnedInterval  *int64
 }
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/go-chi/chi/v5"
+)
+
+//requireAdminToken returns a middleware that only lets requests through if they carry the admin
+//token as a bearer token. Every request is refused if the token is empty.
+func requireAdminToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasAdminToken(r, token) {
+				ngsierrors.ReportUnauthorizedRequest(w, "a valid admin token is required")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//requireAdminTokenToPurge returns a middleware for the public delete routes, which lets soft
+//deletes through, but only lets requests that set the purge parameter through if they carry the
+//admin token. Invalid purge parameters are left for the handler to report.
+func requireAdminTokenToPurge(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			purge, err := purgeRequested(r)
+			if err == nil && purge && !hasAdminToken(r, token) {
+				ngsierrors.ReportUnauthorizedRequest(w, "a valid admin token is required to purge observations")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//hasAdminToken returns true if a request carries the admin token as a bearer token, which is
+//never the case if the token is empty
+func hasAdminToken(r *http.Request, token string) bool {
+	authorization := r.Header.Get("Authorization")
+	bearer := strings.TrimPrefix(authorization, "Bearer ")
+
+	return token != "" && bearer != authorization && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+//deleteDeviceObservationsResponse reports the number of observations that were deleted
+type deleteDeviceObservationsResponse struct {
+	DeviceID string `json:"deviceId"`
+	Deleted  int64  `json:"deleted"`
+	Purged   bool   `json:"purged"`
+}
+
+//NewDeleteDeviceObservationsHandler deletes the observations that a device has reported within
+//the time span given by the from and to parameters, e.g. after the device has been found to be
+//faulty. The observations are soft deleted, unless the purge parameter is set to true.
+func NewDeleteDeviceObservationsHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceId")
+
+		from, err := parseTimeParameter(r.URL.Query().Get("from"), "from")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		to, err := parseTimeParameter(r.URL.Query().Get("to"), "to")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if !from.Before(to) {
+			ngsierrors.ReportNewBadRequestData(w, "from must be before to")
+			return
+		}
+
+		purge, err := purgeRequested(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		deleted, err := app.DeleteObservationsOfDevice(deviceID, from.UTC(), to.UTC(), purge)
+		if err != nil {
+			reportInternalError(w, "failed to delete observations: "+err.Error())
+			return
+		}
+
+		writeAdminResponse(w, deleteDeviceObservationsResponse{DeviceID: deviceID, Deleted: deleted, Purged: purge})
+	})
+}
+
+//deviceStatusJSON is the liveness of a device. The interval is given in seconds.
+type deviceStatusJSON struct {
+	DeviceID       string `json:"deviceId"`
+	LastSeen       string `json:"lastSeen"`
+	Interval       int64  `json:"interval"`
+	IntervalSource string `json:"intervalSource"`
+	Stale          bool   `json:"stale"`
+}
+
+type reportingGapJSON struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Duration int64  `json:"duration"`
+}
+
+type deviceGapsJSON struct {
+	DeviceID string             `json:"deviceId"`
+	Interval int64              `json:"interval"`
+	Gaps     []reportingGapJSON `json:"gaps"`
+}
+
+//NewQueryDevicesHandler returns the liveness of all devices, i.e. when they last reported an
+//observation, how often they are expected to report and whether they have stopped reporting.
+//Only stale devices are returned if the stale parameter is set to true.
+func NewQueryDevicesHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		staleOnly := false
+		if value := r.URL.Query().Get("stale"); value != "" {
+			var err error
+			staleOnly, err = strconv.ParseBool(value)
+			if err != nil {
+				ngsierrors.ReportNewBadRequestData(w, "stale must be true or false")
+				return
+			}
+		}
+
+		statuses, err := app.RetrieveDeviceStatuses()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve devices: "+err.Error())
+			return
+		}
+
+		response := []deviceStatusJSON{}
+		for _, s := range statuses {
+			if staleOnly && !s.Stale {
+				continue
+			}
+
+			response = append(response, deviceStatusJSON{
+				DeviceID:       s.DeviceId,
+				LastSeen:       s.LastSeen.UTC().Format(time.RFC3339),
+				Interval:       int64(s.Interval.Seconds()),
+				IntervalSource: s.IntervalSource,
+				Stale:          s.Stale,
+			})
+		}
+
+		writeAdminResponse(w, response)
+	})
+}
+
+//NewUpdateDeviceHandler configures the interval, in seconds, that a device is expected to report
+//observations with. An interval of 0, or null, makes the device use its learned interval.
+func NewUpdateDeviceHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "deviceId")
+
+		update := struct {
+			ExpectedInterval *int64 `json:"expectedInterval"`
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("unable to decode request payload: %s", err.Error()))
+			return
+		}
+
+		interval := time.Duration(0)
+		if update.ExpectedInterval != nil {
+			if *update.ExpectedInterval < 0 {
+				ngsierrors.ReportNewBadRequestData(w, "expectedInterval must not be negative")
+				return
+			}
+			interval = time.Duration(*update.ExpectedInterval) * time.Second
+		}
+
+		err = app.UpdateExpectedReportingInterval(deviceID, interval)
+		if err != nil {
+			if errors.Is(err, application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("device %s has not reported any observations", deviceID))
+			} else {
+				reportInternalError(w, "failed to update device: "+err.Error())
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//NewQueryReportingGapsHandler returns the periods, within the time span given by the from and
+//to parameters, in which devices missed too many reports. The gaps can be limited to a single
+//device with the deviceId parameter.
+func NewQueryReportingGapsHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		from, err := parseTimeParameter(params.Get("from"), "from")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		to, err := parseTimeParameter(params.Get("to"), "to")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if !from.Before(to) {
+			ngsierrors.ReportNewBadRequestData(w, "from must be before to")
+			return
+		}
+
+		deviceID := strings.TrimPrefix(params.Get("deviceId"), fiware.DeviceIDPrefix)
+
+		devices, err := app.RetrieveReportingGaps(deviceID, from.UTC(), to.UTC())
+		if err != nil {
+			if errors.Is(err, application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("device %s has not reported any observations", deviceID))
+			} else {
+				reportInternalError(w, "failed to retrieve reporting gaps: "+err.Error())
+			}
+			return
+		}
+
+		response := []deviceGapsJSON{}
+		for _, d := range devices {
+			gaps := []reportingGapJSON{}
+			for _, g := range d.Gaps {
+				gaps = append(gaps, reportingGapJSON{
+					From:     g.From.UTC().Format(time.RFC3339),
+					To:       g.To.UTC().Format(time.RFC3339),
+					Duration: int64(g.To.Sub(g.From).Seconds()),
+				})
+			}
+
+			response = append(response, deviceGapsJSON{DeviceID: d.DeviceId, Interval: int64(d.Interval.Seconds()), Gaps: gaps})
+		}
+
+		writeAdminResponse(w, response)
+	})
+}
+
+func writeAdminResponse(w http.ResponseWriter, response interface{}) {
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		reportInternalError(w, "failed to encode response")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/context"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//NewQueryAlertsHandler returns the alerts that have been raised, as NGSI-LD Alert entities with
+//the most recent first. Only active alerts are returned, unless the status parameter is set to
+//all. The alerts can be limited to a device, a time span from and/or to when they were raised,
+//and a maximum number of alerts.
+func NewQueryAlertsHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		activeOnly := true
+		switch params.Get("status") {
+		case "", "active":
+		case "all":
+			activeOnly = false
+		default:
+			ngsierrors.ReportNewBadRequestData(w, "status must be active or all")
+			return
+		}
+
+		var err error
+		from, to := time.Time{}, time.Time{}
+
+		if params.Get("from") != "" {
+			from, err = parseTimeParameter(params.Get("from"), "from")
+			if err != nil {
+				ngsierrors.ReportNewBadRequestData(w, err.Error())
+				return
+			}
+		}
+
+		if params.Get("to") != "" {
+			to, err = parseTimeParameter(params.Get("to"), "to")
+			if err != nil {
+				ngsierrors.ReportNewBadRequestData(w, err.Error())
+				return
+			}
+		}
+
+		limit, err := parseUintParameter(params.Get("limit"), "limit")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		deviceID := strings.TrimPrefix(params.Get("deviceId"), fiware.DeviceIDPrefix)
+
+		alerts, err := app.RetrieveAlerts(deviceID, from.UTC(), to.UTC(), activeOnly, limit)
+		if err != nil {
+			reportInternalError(w, "failed to retrieve alerts: "+err.Error())
+			return
+		}
+
+		bytes, err := json.Marshal(context.NewAlerts(alerts))
+		if err != nil {
+			reportInternalError(w, "failed to encode response")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
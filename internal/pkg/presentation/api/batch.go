@@ -0,0 +1,230 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//maxBatchSize is the maximum number of entities in a single batch operation
+const maxBatchSize int = 1000
+
+//batchEntityStorer is implemented by context sources that can store a batch of entities of a
+//type in a single transaction
+type batchEntityStorer interface {
+	StoreEntities(typeName string, entities []json.RawMessage, upsert bool) ([]error, error)
+}
+
+//batchEntityDeleter is implemented by context sources that can delete a batch of entities
+type batchEntityDeleter interface {
+	DeleteEntities(entityIDs []string, purge bool) ([]error, error)
+}
+
+//batchOperationResult reports the outcome of a batch operation per entity
+type batchOperationResult struct {
+	Success []string           `json:"success"`
+	Errors  []batchEntityError `json:"errors"`
+}
+
+type batchEntityError struct {
+	EntityID string         `json:"entityId"`
+	Error    problemDetails `json:"error"`
+}
+
+func (result *batchOperationResult) add(entityID string, err error) {
+	if err == nil {
+		result.Success = append(result.Success, entityID)
+		return
+	}
+
+	problem := problemDetails{
+		Type:   "https://uri.etsi.org/ngsi-ld/errors/BadRequestData",
+		Title:  "Bad Request Data",
+		Detail: err.Error(),
+	}
+
+	if errors.Is(err, application.ErrAlreadyExists) {
+		problem.Type, problem.Title = "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists", "Already Exists"
+	} else if errors.Is(err, application.ErrNotFound) {
+		problem.Type, problem.Title = "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound", "Resource Not Found"
+	}
+
+	result.Errors = append(result.Errors, batchEntityError{EntityID: entityID, Error: problem})
+}
+
+//writeResponse responds with successStatusCode if all entities succeeded, and with the result
+//and 207 Multi-Status otherwise. A successful 201 Created holds only the array of created ids,
+//while the body is left out when successStatusCode is 204 No Content.
+func (result batchOperationResult) writeResponse(w http.ResponseWriter, successStatusCode int) {
+	statusCode := successStatusCode
+	var response interface{} = result
+
+	if len(result.Errors) > 0 {
+		statusCode = http.StatusMultiStatus
+	} else if statusCode == http.StatusNoContent {
+		w.WriteHeader(statusCode)
+		return
+	} else if statusCode == http.StatusCreated {
+		response = result.Success
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		reportInternalError(w, "failed to encode response")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
+
+//NewBatchCreateEntitiesHandler creates, or upserts, an array of entities. The entities of each
+//type are stored in a single transaction, and the outcome is reported per entity unless a
+//whole upsert succeeded.
+func NewBatchCreateEntitiesHandler(ctxReg ngsi.ContextRegistry, upsert bool) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entities := []json.RawMessage{}
+		err := json.NewDecoder(r.Body).Decode(&entities)
+		if err != nil || len(entities) == 0 || len(entities) > maxBatchSize {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("the request payload must be an array of 1 to %d entities", maxBatchSize))
+			return
+		}
+
+		entityIDs := make([]string, len(entities))
+		errs := make([]error, len(entities))
+		indicesPerType := map[string][]int{}
+		typeNames := []string{}
+
+		for idx, entity := range entities {
+			base := types.BaseEntity{}
+			err = json.Unmarshal(entity, &base)
+			if err == nil && (base.ID == "" || base.Type == "") {
+				err = errors.New("entities must have an id and a type")
+			}
+			if err != nil {
+				errs[idx] = err
+				continue
+			}
+
+			entityIDs[idx] = base.ID
+			if _, ok := indicesPerType[base.Type]; !ok {
+				typeNames = append(typeNames, base.Type)
+			}
+			indicesPerType[base.Type] = append(indicesPerType[base.Type], idx)
+		}
+
+		for _, typeName := range typeNames {
+			indices := indicesPerType[typeName]
+
+			var storer batchEntityStorer
+			if contextSources := ctxReg.GetContextSourcesForEntityType(typeName); len(contextSources) > 0 {
+				storer, _ = contextSources[0].(batchEntityStorer)
+			}
+
+			if storer == nil {
+				for _, idx := range indices {
+					errs[idx] = fmt.Errorf("batch operations are not supported for entities of type %s", typeName)
+				}
+				continue
+			}
+
+			batch := []json.RawMessage{}
+			for _, idx := range indices {
+				batch = append(batch, entities[idx])
+			}
+
+			batchErrs, err := storer.StoreEntities(typeName, batch, upsert)
+			if err != nil {
+				reportInternalError(w, "failed to store entities: "+err.Error())
+				return
+			}
+
+			for i, idx := range indices {
+				errs[idx] = batchErrs[i]
+			}
+		}
+
+		result := batchOperationResult{Success: []string{}, Errors: []batchEntityError{}}
+		for idx := range entities {
+			result.add(entityIDs[idx], errs[idx])
+		}
+
+		if upsert {
+			result.writeResponse(w, http.StatusNoContent)
+		} else {
+			result.writeResponse(w, http.StatusCreated)
+		}
+	})
+}
+
+//NewBatchDeleteEntitiesHandler deletes all observations of an array of entity IDs
+func NewBatchDeleteEntitiesHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		purge, err := purgeRequested(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		entityIDs := []string{}
+		err = json.NewDecoder(r.Body).Decode(&entityIDs)
+		if err != nil || len(entityIDs) == 0 || len(entityIDs) > maxBatchSize {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("the request payload must be an array of 1 to %d entity ids", maxBatchSize))
+			return
+		}
+
+		errs := make([]error, len(entityIDs))
+		indicesPerDeleter := map[batchEntityDeleter][]int{}
+		deleters := []batchEntityDeleter{}
+
+		for idx, entityID := range entityIDs {
+			var deleter batchEntityDeleter
+			if contextSources := ctxReg.GetContextSourcesForEntity(entityID); len(contextSources) > 0 {
+				deleter, _ = contextSources[0].(batchEntityDeleter)
+			}
+
+			if deleter == nil {
+				errs[idx] = fmt.Errorf("%w: no context source provides entities with id %s", application.ErrNotFound, entityID)
+				continue
+			}
+
+			if _, ok := indicesPerDeleter[deleter]; !ok {
+				deleters = append(deleters, deleter)
+			}
+			indicesPerDeleter[deleter] = append(indicesPerDeleter[deleter], idx)
+		}
+
+		for _, deleter := range deleters {
+			indices := indicesPerDeleter[deleter]
+
+			batch := []string{}
+			for _, idx := range indices {
+				batch = append(batch, entityIDs[idx])
+			}
+
+			batchErrs, err := deleter.DeleteEntities(batch, purge)
+			if err != nil {
+				reportInternalError(w, "failed to delete entities: "+err.Error())
+				return
+			}
+
+			for i, idx := range indices {
+				errs[idx] = batchErrs[i]
+			}
+		}
+
+		result := batchOperationResult{Success: []string{}, Errors: []batchEntityError{}}
+		for idx, entityID := range entityIDs {
+			result.add(entityID, errs[idx])
+		}
+
+		result.writeResponse(w, http.StatusNoContent)
+	})
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+	"github.com/go-chi/chi/v5"
+)
+
+//entityStorer is implemented by context sources that can report whether a created entity was
+//new, or a duplicate that was ignored or overwrote an existing observation
+type entityStorer interface {
+	StoreEntity(typeName, entityID string, req ngsi.Request) (database.StoreResult, error)
+}
+
+//NewCreateEntityHandler creates an entity. Unlike the handler in the ngsi-ld library it reports
+//duplicate observations as 200 OK when they are ignored, 204 No Content when they overwrite the
+//existing observation, and as an AlreadyExists problem when they are rejected. Only invalid
+//entities are reported as bad requests, while failures to store them are internal errors.
+func NewCreateEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := newRequestWrapper(r)
+
+		entity := &types.BaseEntity{}
+		err := request.DecodeBodyInto(entity)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("unable to decode request payload: %s", err.Error()))
+			return
+		}
+
+		contextSources := ctxReg.GetContextSourcesForEntityType(entity.Type)
+		if len(contextSources) == 0 {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("no context sources found matching the provided type %s", entity.Type))
+			return
+		}
+
+		result := database.StoreResultCreated
+
+		if storer, ok := contextSources[0].(entityStorer); ok {
+			result, err = storer.StoreEntity(entity.Type, entity.ID, request)
+		} else {
+			err = contextSources[0].CreateEntity(entity.Type, entity.ID, request)
+		}
+
+		if err != nil {
+			if errors.Is(err, application.ErrAlreadyExists) {
+				reportAlreadyExists(w, err.Error())
+				return
+			}
+
+			if errors.Is(err, entities.ErrInvalidEntity) {
+				ngsierrors.ReportNewBadRequestData(w, "unable to create entity: "+err.Error())
+				return
+			}
+
+			reportInternalError(w, "failed to create entity: "+err.Error())
+			return
+		}
+
+		switch result {
+		case database.StoreResultIgnored:
+			w.WriteHeader(http.StatusOK)
+		case database.StoreResultOverwritten:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Add("Location", "/ngsi-ld/v1/entities/"+entity.ID)
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+}
+
+//NewRetrieveEntityHandler retrieves the current state of an entity by its ID. Unlike the
+//handler in the ngsi-ld library it reports unknown entities as a ResourceNotFound problem.
+func NewRetrieveEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entityId")
+
+		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		if len(contextSources) == 0 {
+			reportResourceNotFound(w, fmt.Sprintf("no context source provides entities with id %s", entityID))
+			return
+		}
+
+		entity, err := contextSources[0].RetrieveEntity(entityID, newRequestWrapper(r))
+		if err != nil {
+			if errors.Is(err, application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("entity %s does not exist", entityID))
+				return
+			}
+
+			reportInternalError(w, "failed to retrieve entity: "+err.Error())
+			return
+		}
+
+		responseContentType := "application/ld+json;charset=utf-8"
+		var response interface{} = entity
+
+		if acceptsGeoJSON(r) {
+			if spatialEntity, ok := entity.(geojson.SpatialEntity); ok {
+				response, err = spatialEntity.ToGeoJSONFeature("location", r.URL.Query().Get("options") == "keyValues")
+				if err != nil {
+					reportInternalError(w, "failed to convert entity to GeoJSON: "+err.Error())
+					return
+				}
+				responseContentType = geojson.ContentTypeWithCharset
+			}
+		}
+
+		bytes, err := json.Marshal(response)
+		if err != nil {
+			reportInternalError(w, "failed to encode response")
+			return
+		}
+
+		w.Header().Add("Content-Type", responseContentType)
+		w.Write(bytes)
+	})
+}
+
+//NewUpdateEntityAttributesHandler handles PATCH requests for entity attributes and reports
+//unknown entities as a ResourceNotFound problem. Like creates, only invalid fragments are
+//reported as bad requests.
+func NewUpdateEntityAttributesHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entityId")
+
+		contextSources := ctxReg.GetContextSourcesForEntity(entityID)
+		if len(contextSources) == 0 {
+			reportResourceNotFound(w, fmt.Sprintf("no context source provides entities with id %s", entityID))
+			return
+		}
+
+		err := contextSources[0].UpdateEntityAttributes(entityID, newRequestWrapper(r))
+		if err != nil {
+			if errors.Is(err, application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("entity %s does not exist", entityID))
+				return
+			}
+
+			if errors.Is(err, application.ErrAlreadyExists) {
+				reportAlreadyExists(w, err.Error())
+				return
+			}
+
+			if errors.Is(err, entities.ErrInvalidEntity) {
+				ngsierrors.ReportNewBadRequestData(w, "unable to update entity attributes: "+err.Error())
+				return
+			}
+
+			reportInternalError(w, "failed to update entity attributes: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//NewDeleteEntityHandler deletes all observations of an entity. The observations are soft
+//deleted, unless the purge parameter is set to true.
+func NewDeleteEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entityId")
+
+		purge, err := purgeRequested(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		var deleter batchEntityDeleter
+		if contextSources := ctxReg.GetContextSourcesForEntity(entityID); len(contextSources) > 0 {
+			deleter, _ = contextSources[0].(batchEntityDeleter)
+		}
+
+		if deleter == nil {
+			reportResourceNotFound(w, fmt.Sprintf("no context source provides entities with id %s", entityID))
+			return
+		}
+
+		errs, err := deleter.DeleteEntities([]string{entityID}, purge)
+		if err != nil {
+			reportInternalError(w, "failed to delete entity: "+err.Error())
+			return
+		}
+
+		if errs[0] != nil {
+			if errors.Is(errs[0], application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("entity %s does not exist", entityID))
+				return
+			}
+
+			ngsierrors.ReportNewBadRequestData(w, "unable to delete entity: "+errs[0].Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//purgeRequested returns true if the request asks for deleted observations to be removed from
+//the database, instead of being soft deleted
+func purgeRequested(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("purge")
+	if value == "" {
+		return false, nil
+	}
+
+	purge, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for the purge parameter", value)
+	}
+
+	return purge, nil
+}
+
+func acceptsGeoJSON(r *http.Request) bool {
+	for _, acceptableType := range r.Header["Accept"] {
+		if strings.HasPrefix(acceptableType, geojson.ContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+//requestWrapper implements the ngsi.Request interface for handlers that are not part of
+//the ngsi-ld library
+type requestWrapper struct {
+	request *http.Request
+	body    []byte
+}
+
+func newRequestWrapper(r *http.Request) ngsi.Request {
+	rw := &requestWrapper{request: r}
+
+	if r.Body != nil {
+		rw.body, _ = ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(rw.body))
+	}
+
+	return rw
+}
+
+func (rw *requestWrapper) Request() *http.Request {
+	return rw.request
+}
+
+func (rw *requestWrapper) BodyReader() io.Reader {
+	return bytes.NewReader(rw.body)
+}
+
+func (rw *requestWrapper) DecodeBodyInto(v interface{}) error {
+	return json.NewDecoder(rw.BodyReader()).Decode(v)
+}
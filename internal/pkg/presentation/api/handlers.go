@@ -2,10 +2,13 @@ package api
 
 import (
 	"compress/flate"
+	"expvar"
 	"net/http"
 
 	"github.com/diwise/api-environment/internal/pkg/application"
 	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/context"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/geoquery"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/qfilter"
 	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -14,13 +17,44 @@ import (
 )
 
 func createContextRegistry(app application.EnvironmentApp, log zerolog.Logger) ngsi.ContextRegistry {
-	contextRegistry := ngsi.NewContextRegistry()
+	contextRegistry := uniqueSourcesRegistry{ngsi.NewContextRegistry()}
 	ctxSource := context.CreateSource(app, log)
 	contextRegistry.Register(ctxSource)
 	return contextRegistry
 }
 
-func RegisterHandlers(r chi.Router, app application.EnvironmentApp, log zerolog.Logger) error {
+//uniqueSourcesRegistry returns every context source that matches a query once, even if the
+//source provides more than one of the queried types. Every source is asked for all the types in
+//the query, so a source that is returned twice would return its entities twice.
+type uniqueSourcesRegistry struct {
+	ngsi.ContextRegistry
+}
+
+func (r uniqueSourcesRegistry) GetContextSourcesForQuery(query ngsi.Query) []ngsi.ContextSource {
+	sources := []ngsi.ContextSource{}
+
+	for _, src := range r.ContextRegistry.GetContextSourcesForQuery(query) {
+		if !containsSource(sources, src) {
+			sources = append(sources, src)
+		}
+	}
+
+	return sources
+}
+
+func containsSource(sources []ngsi.ContextSource, source ngsi.ContextSource) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+//RegisterHandlers registers the API. The /admin routes, and deletes that purge observations from
+//the database, require adminToken as a bearer token, and are refused if it is empty.
+func RegisterHandlers(r chi.Router, app application.EnvironmentApp, adminToken string, log zerolog.Logger) error {
 	r.Use(cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowCredentials: true,
@@ -38,8 +72,45 @@ func RegisterHandlers(r chi.Router, app application.EnvironmentApp, log zerolog.
 
 	ctxReg := createContextRegistry(app, log)
 
-	r.Post("/ngsi-ld/v1/entities", ngsi.NewCreateEntityHandler(ctxReg))
-	r.Get("/ngsi-ld/v1/entities", ngsi.NewQueryEntitiesHandler(ctxReg))
+	r.Post("/ngsi-ld/v1/entities", NewCreateEntityHandler(ctxReg))
+	r.With(geoquery.Middleware, qfilter.Middleware).Get("/ngsi-ld/v1/entities", ngsi.NewQueryEntitiesHandler(ctxReg))
+	r.Get("/ngsi-ld/v1/entities/{entityId}", NewRetrieveEntityHandler(ctxReg))
+	r.With(requireAdminTokenToPurge(adminToken)).Delete("/ngsi-ld/v1/entities/{entityId}", NewDeleteEntityHandler(ctxReg))
+	r.Patch("/ngsi-ld/v1/entities/{entityId}/attrs", NewUpdateEntityAttributesHandler(ctxReg))
+	r.Patch("/ngsi-ld/v1/entities/{entityId}/attrs/", NewUpdateEntityAttributesHandler(ctxReg))
+
+	r.Post("/ngsi-ld/v1/entityOperations/create", NewBatchCreateEntitiesHandler(ctxReg, false))
+	r.Post("/ngsi-ld/v1/entityOperations/upsert", NewBatchCreateEntitiesHandler(ctxReg, true))
+	r.With(requireAdminTokenToPurge(adminToken)).Post("/ngsi-ld/v1/entityOperations/delete", NewBatchDeleteEntitiesHandler(ctxReg))
+
+	r.Get("/ngsi-ld/v1/temporal/entities", NewQueryTemporalEntitiesHandler(ctxReg))
+	r.Get("/ngsi-ld/v1/temporal/entities/{entityId}", NewRetrieveTemporalEntityHandler(ctxReg))
+	r.With(requireAdminTokenToPurge(adminToken)).Delete("/ngsi-ld/v1/temporal/entities/{entityId}/attrs/{attrId}/{instanceId}", NewDeleteAttributeInstanceHandler(ctxReg))
+
+	r.Post("/ngsi-ld/v1/subscriptions", NewCreateSubscriptionHandler(app))
+	r.Get("/ngsi-ld/v1/subscriptions", NewQuerySubscriptionsHandler(app))
+	r.Get("/ngsi-ld/v1/subscriptions/{subscriptionId}", NewRetrieveSubscriptionHandler(app))
+	r.Patch("/ngsi-ld/v1/subscriptions/{subscriptionId}", NewUpdateSubscriptionHandler(app))
+	r.Delete("/ngsi-ld/v1/subscriptions/{subscriptionId}", NewDeleteSubscriptionHandler(app))
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(requireAdminToken(adminToken))
+
+		r.Get("/devices", NewQueryDevicesHandler(app))
+		r.Get("/devices/gaps", NewQueryReportingGapsHandler(app))
+		r.Patch("/devices/{deviceId}", NewUpdateDeviceHandler(app))
+		r.Delete("/devices/{deviceId}/observations", NewDeleteDeviceObservationsHandler(app))
+	})
+
+	r.Get("/alerts", NewQueryAlertsHandler(app))
+
+	r.Get("/noise/indicators", NewQueryNoiseIndicatorsHandler(app))
 
 	return nil
 }
+
+//RegisterMetricsHandlers exposes the runtime, notification, alert, liveness and retention
+//metrics. They are meant for an internal listener and must not be registered on the public API.
+func RegisterMetricsHandlers(r chi.Router) {
+	r.Handle("/debug/vars", expvar.Handler())
+}
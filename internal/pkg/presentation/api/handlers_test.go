@@ -0,0 +1,859 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/airqualityobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/indoorenvironmentobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/noiselevelobserved"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/waterqualityobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/weatherobserved"
+	"github.com/go-chi/chi/v5"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog/log"
+)
+
+func TestCreateEntityReportsHowDuplicatesWereHandled(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	body := `{
+		"id": "urn:ngsi-ld:AirQualityObserved:aqo1",
+		"type": "AirQualityObserved",
+		"dateObserved": {"type": "Property", "value": "2022-03-01T10:00:00Z"},
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [17.3069, 62.3908]}}
+	}`
+
+	testCases := []struct {
+		result     database.StoreResult
+		err        error
+		statusCode int
+	}{
+		{database.StoreResultCreated, nil, http.StatusCreated},
+		{database.StoreResultIgnored, nil, http.StatusOK},
+		{database.StoreResultOverwritten, nil, http.StatusNoContent},
+		{database.StoreResultCreated, application.ErrAlreadyExists, http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		app.StoreObservationFunc = func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return tc.result, tc.err
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		is.Equal(w.Code, tc.statusCode)
+	}
+
+	is.Equal(app.StoreObservationCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(app.StoreObservationCalls()[0].Observation.(*models.AirQualityObserved).EntityId, "aqo1")
+}
+
+func TestCreateEntityReportsOnlyInvalidEntitiesAsBadRequests(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.StoreObservationFunc = func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+		return database.StoreResultCreated, errors.New("connection refused")
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(`{
+		"id": "urn:ngsi-ld:AirQualityObserved:aqo1",
+		"type": "AirQualityObserved",
+		"dateObserved": {"type": "Property", "value": "2022-03-01T10:00:00Z"},
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [17.3069, 62.3908]}}
+	}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusInternalServerError)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/ngsi-ld/v1/entities", strings.NewReader(`{
+		"id": "urn:ngsi-ld:AirQualityObserved:aqo1",
+		"type": "AirQualityObserved",
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [17.3069, 62.3908]}}
+	}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // dateObserved is missing
+	is.Equal(len(app.StoreObservationCalls()), 1)
+}
+
+func TestBatchCreateReportsResultsPerEntity(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.StoreObservationsFunc = func(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+		results := make([]database.BatchStoreResult, len(observations))
+		results[1].Err = application.ErrAlreadyExists
+		return results, nil
+	}
+
+	entity := func(id, dateObserved string) string {
+		return `{"id": "urn:ngsi-ld:AirQualityObserved:` + id + `", "type": "AirQualityObserved",
+			"dateObserved": {"type": "Property", "value": "` + dateObserved + `"},
+			"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [17.3069, 62.3908]}}}`
+	}
+	body := "[" + entity("aqo1", "2022-03-01T10:00:00Z") + "," + entity("aqo1", "2022-03-01T10:00:00Z") + "," + entity("aqo2", "yesterday") + "]"
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/upsert", strings.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusMultiStatus)
+	is.Equal(len(app.StoreObservationsCalls()), 1)
+	is.Equal(len(app.StoreObservationsCalls()[0].Observations), 2) // the entity with an invalid date should not be stored
+	is.True(app.StoreObservationsCalls()[0].Upsert)
+
+	result := batchOperationResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	is.Equal(result.Success, []string{"urn:ngsi-ld:AirQualityObserved:aqo1"})
+	is.Equal(len(result.Errors), 2)
+	is.True(strings.HasSuffix(result.Errors[0].Error.Type, "AlreadyExists"))
+	is.Equal(result.Errors[1].EntityID, "urn:ngsi-ld:AirQualityObserved:aqo2")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(`{"not": "an array"}`))
+	router.ServeHTTP(w, req)
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestSuccessfulBatchOperationsReturnNoContent(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.StoreObservationsFunc = func(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+		return make([]database.BatchStoreResult, len(observations)), nil
+	}
+	app.DeleteObservationsFunc = func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+		return make([]error, len(entityIds)), nil
+	}
+
+	body := `[{"id": "urn:ngsi-ld:AirQualityObserved:aqo1", "type": "AirQualityObserved",
+		"dateObserved": {"type": "Property", "value": "2022-03-01T10:00:00Z"},
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [17.3069, 62.3908]}}}]`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/upsert", strings.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.Equal(w.Body.Len(), 0)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(body))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	createdIDs := []string{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &createdIDs)) // a successful create returns the array of created ids
+	is.Equal(createdIDs, []string{"urn:ngsi-ld:AirQualityObserved:aqo1"})
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(`["urn:ngsi-ld:AirQualityObserved:aqo1"]`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.Equal(w.Body.Len(), 0)
+}
+
+func TestBatchDeleteReportsUnknownEntities(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.DeleteObservationsFunc = func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+		return []error{nil, application.ErrNotFound}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(
+		`["urn:ngsi-ld:AirQualityObserved:aqo1", "urn:ngsi-ld:AirQualityObserved:unknown", "urn:ngsi-ld:Beach:b1"]`,
+	))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusMultiStatus)
+	is.Equal(app.DeleteObservationsCalls()[0].EntityIds, []string{"aqo1", "unknown"})
+
+	result := batchOperationResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	is.Equal(result.Success, []string{"urn:ngsi-ld:AirQualityObserved:aqo1"})
+	is.Equal(len(result.Errors), 2)
+	is.True(strings.HasSuffix(result.Errors[1].Error.Type, "ResourceNotFound")) // no context source provides beaches
+}
+
+func TestDeleteEntity(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.DeleteObservationsFunc = func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+		if entityIds[0] != "aqo1" {
+			return []error{application.ErrNotFound}, nil
+		}
+		return []error{nil}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := newAdminRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1?purge=true", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.True(app.DeleteObservationsCalls()[0].Purge)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:unknown", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+	is.True(!app.DeleteObservationsCalls()[1].Purge)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1?purge=maybe", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestRetrieveEntity(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.RetrieveObservationCalls()[0].EntityId, "aqo1")
+	is.True(strings.Contains(w.Body.String(), `"id":"urn:ngsi-ld:AirQualityObserved:aqo1"`))
+}
+
+func TestRetrieveUnknownEntityReturnsNotFound(t *testing.T) {
+	is, _, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:unknown", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+	is.True(strings.Contains(w.Body.String(), "ResourceNotFound"))
+}
+
+func TestRetrieveEntityOfUnsupportedTypeReturnsNotFound(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:Beach:b1", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+	is.Equal(len(app.RetrieveObservationCalls()), 0)
+}
+
+func TestUpdateEntityAttributes(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs", strings.NewReader(`{"temperature":{"type":"Property","value":13.5}}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.Equal(len(app.UpdateObservationCalls()), 1)
+}
+
+func TestUpdateEntityAttributesReportsOnlyInvalidFragmentsAsBadRequests(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs", strings.NewReader(`{"temperature":{"type":"Property","value":13.5,"observedAt":"yesterday"}}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	app.UpdateObservationFunc = func(kind *database.ObservationKind, entityId string, update application.ObservationUpdate) error {
+		return errors.New("connection refused")
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs", strings.NewReader(`{"temperature":{"type":"Property","value":13.5}}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusInternalServerError)
+}
+
+func TestUpdateAttributesOfUnknownEntityReturnsNotFound(t *testing.T) {
+	is, _, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:unknown/attrs/", strings.NewReader(`{"temperature":{"type":"Property","value":13.5}}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestQueryTemporalEntities(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved&timerel=between&timeAt=2022-03-01T00:00:00Z&endTimeAt=2022-03-02T00:00:00Z&lastN=5", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	call := app.RetrieveObservationsCalls()[0]
+	is.Equal(call.Kind, database.AirQualityObservedKind)
+	is.Equal(call.From, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC))
+	is.Equal(call.To, time.Date(2022, 3, 2, 0, 0, 0, 0, time.UTC))
+	is.True(strings.Contains(w.Body.String(), `"observedAt"`))
+}
+
+func TestTruncatedTemporalQueriesArePaginated(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		observations := []database.Observation{}
+		if kind == weatherobserved.Kind {
+			for _, observedAt := range []time.Time{now.Add(-30 * time.Second), now.Add(-2 * time.Minute)} {
+				if !observedAt.Before(from) {
+					observations = append(observations, &weatherobserved.Observation{EntityId: "wo1", Latitude: 62.3908, Longitude: 17.3069, Timestamp: observedAt})
+				}
+			}
+			return observations, nil
+		}
+
+		for _, observedAt := range []time.Time{now, now.Add(-time.Minute)} {
+			if !observedAt.Before(from) {
+				observations = append(observations, &models.AirQualityObserved{EntityId: "aqo1", Latitude: 62.3908, Longitude: 17.3069, Timestamp: observedAt})
+			}
+		}
+		return observations, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved,WeatherObserved&limit=1", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusPartialContent)
+	is.Equal(w.Header().Get("Content-Range"), "date-time 2022-03-01T12:00:00Z-2022-03-01T12:00:00Z/*")
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:AirQualityObserved:aqo1"`))
+	is.True(!strings.Contains(w.Body.String(), `"urn:ngsi-ld:WeatherObserved:wo1"`)) // the weather is older than the range of the air quality
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved&limit=100000", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // the limit should be capped
+}
+
+func TestQueryTemporalEntitiesWithInvalidTimerelFails(t *testing.T) {
+	is, _, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved&timerel=between&timeAt=2022-03-01T00:00:00Z", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // between requires endTimeAt
+}
+
+func TestQueryTemporalEntitiesWithAggregation(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved&aggrMethods=avg,max&aggrPeriodDuration=PT1H", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Period, database.AggregationPeriodHour)
+	is.True(strings.Contains(w.Body.String(), `"avg"`))
+	is.True(strings.Contains(w.Body.String(), `"max"`))
+	is.True(!strings.Contains(w.Body.String(), `"min"`)) // min was not requested
+}
+
+func TestQueryTemporalEntitiesWithUnsupportedAggregationFails(t *testing.T) {
+	is, _, router := testSetup(t)
+
+	for _, params := range []string{"aggrMethods=stddev", "aggrMethods=avg&aggrPeriodDuration=PT15M", "aggrPeriodDuration=PT1H"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=AirQualityObserved&"+params, nil)
+		router.ServeHTTP(w, req)
+
+		is.Equal(w.Code, http.StatusBadRequest) // unsupported aggregation should be a bad request
+	}
+}
+
+func TestQueryTemporalWeatherObserveds(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		windSpeed := 4.2
+		return []database.Observation{
+			&weatherobserved.Observation{EntityId: "wo1", Latitude: 62.3908, Longitude: 17.3069, Timestamp: from, Measurements: weatherobserved.Measurements{WindSpeed: &windSpeed}},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=WeatherObserved&timerel=after&timeAt=2022-03-01T00:00:00Z", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(app.RetrieveObservationsCalls()), 1)
+	is.Equal(app.RetrieveObservationsCalls()[0].Kind, weatherobserved.Kind) // only weather should be queried
+	is.Equal(app.RetrieveObservationsCalls()[0].From, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC))
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:WeatherObserved:wo1"`))
+	is.True(strings.Contains(w.Body.String(), `"windSpeed"`))
+	is.True(strings.Contains(w.Body.String(), `"observedAt": "2022-03-01T00:00:00Z"`))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities?type=WeatherObserved&aggrMethods=avg&aggrPeriodDuration=PT1H", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // aggregation is not supported for weather
+}
+
+func TestQueryWeatherAndAirQualityInOneQuery(t *testing.T) {
+	is, app, router := testSetup(t)
+	retrieveAirQuality := app.RetrieveObservationsFunc
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		if kind == weatherobserved.Kind {
+			return []database.Observation{&weatherobserved.Observation{EntityId: "wo1", Latitude: 62.3908, Longitude: 17.3069, Timestamp: time.Now().UTC()}}, nil
+		}
+		return retrieveAirQuality(kind, deviceId, from, to, limit, options...)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved,WeatherObserved", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(app.RetrieveObservationsCalls()), 2) // the context source should only be asked once
+	is.Equal(app.RetrieveObservationsCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(app.RetrieveObservationsCalls()[1].Kind, weatherobserved.Kind)
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:AirQualityObserved:aqo1`))
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:WeatherObserved:wo1"`))
+}
+
+func TestQueryAggregatedIndoorEnvironmentOfBuilding(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveAggregatedObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+		start := time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)
+		co2, count := 950.0, 4.0
+		return []database.ObservationAggregate{
+			{
+				EntityId:    "room1",
+				PeriodStart: start,
+				PeriodEnd:   start.Add(time.Hour),
+				Maximum:     map[string]*float64{"co2": &co2},
+				TotalCount:  map[string]*float64{"co2": &count},
+			},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", `/ngsi-ld/v1/temporal/entities?type=IndoorEnvironmentObserved&q=refPointOfInterest=="urn:ngsi-ld:PointOfInterest:school1"&aggrMethods=max&aggrPeriodDuration=PT1H`, nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Kind, indoorenvironmentobserved.Kind)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Period, database.AggregationPeriodHour)
+	is.Equal(len(app.RetrieveAggregatedObservationsCalls()[0].Options), 1) // expected a point of interest filter
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:IndoorEnvironmentObserved:room1"`))
+	is.True(strings.Contains(w.Body.String(), `"co2"`))
+	is.True(strings.Contains(w.Body.String(), `"2022-03-01T09:00:00Z"`))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", `/ngsi-ld/v1/temporal/entities?type=WeatherObserved&q=refPointOfInterest=="urn:ngsi-ld:PointOfInterest:school1"`, nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // weather observations are not made within buildings
+}
+
+func TestRetrieveTemporalEntity(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:aqo1?attrs=temperature", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(app.RetrieveObservationsCalls()[0].Options), 2) // expected an entity id option and a limit per entity
+	is.True(strings.Contains(w.Body.String(), `"temperature"`))
+}
+
+func TestRetrieveUnknownTemporalEntityReturnsNotFound(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		return []database.Observation{}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:unknown", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestDeleteAttributeInstance(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.DeleteMeasurementFunc = func(kind *database.ObservationKind, entityId string, instanceId uint, column string, purge bool) error {
+		if instanceId != 17 {
+			return application.ErrNotFound
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs/temperature/urn:ngsi-ld:instance:17", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.Equal(app.DeleteMeasurementCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(app.DeleteMeasurementCalls()[0].EntityId, "aqo1")
+	is.Equal(app.DeleteMeasurementCalls()[0].Column, "temperature")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs/temperature/urn:ngsi-ld:instance:18", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs/location/urn:ngsi-ld:instance:17", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // location instances can not be deleted
+}
+
+func TestDeleteDeviceObservations(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.DeleteObservationsOfDeviceFunc = func(deviceId string, from, to time.Time, purge bool) (int64, error) {
+		return 12, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := newAdminRequest("DELETE", "/admin/devices/dev1/observations?from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.DeleteObservationsOfDeviceCalls()[0].DeviceId, "dev1")
+	is.True(strings.Contains(w.Body.String(), `"deleted":12`))
+
+	w = httptest.NewRecorder()
+	req, _ = newAdminRequest("DELETE", "/admin/devices/dev1/observations?from=2022-03-01T00:00:00Z", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // a time span is required
+}
+
+func TestCreateSubscription(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.CreateSubscriptionFunc = func(subscription application.Subscription) (string, error) {
+		return "urn:ngsi-ld:Subscription:s1", nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/subscriptions", strings.NewReader(`{
+		"type": "Subscription",
+		"entities": [{"type": "AirQualityObserved"}],
+		"watchedAttributes": ["CO2"],
+		"q": "CO2>1000",
+		"throttling": 60,
+		"notification": {"endpoint": {"uri": "http://alerts/notify"}}
+	}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+	is.Equal(w.Header().Get("Location"), "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:s1")
+
+	subscription := app.CreateSubscriptionCalls()[0].Subscription
+	is.Equal(subscription.EntityType, "AirQualityObserved")
+	is.Equal(subscription.Filter.Attribute, "CO2")
+	is.Equal(subscription.Throttling, time.Minute)
+	is.True(subscription.IsActive)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/ngsi-ld/v1/subscriptions", strings.NewReader(`{
+		"type": "Subscription",
+		"entities": [{"type": "AirQualityObserved"}],
+		"q": "CO2~=1000",
+		"notification": {"endpoint": {"uri": "http://alerts/notify"}}
+	}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest) // pattern matching is not supported
+}
+
+func TestUpdateSubscription(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveSubscriptionFunc = func(id string) (*application.Subscription, error) {
+		if id != "urn:ngsi-ld:Subscription:s1" {
+			return nil, application.ErrNotFound
+		}
+		return &application.Subscription{ID: id, EntityType: "AirQualityObserved", Endpoint: "http://alerts/notify", IsActive: true}, nil
+	}
+	app.UpdateSubscriptionFunc = func(subscription application.Subscription) error {
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:s1", strings.NewReader(`{"isActive": false}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	updated := app.UpdateSubscriptionCalls()[0].Subscription
+	is.True(!updated.IsActive)
+	is.Equal(updated.Endpoint, "http://alerts/notify") // attributes that are not part of the fragment should be kept
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:unknown", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestQueryAlerts(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveAlertsFunc = func(deviceId string, from, to time.Time, activeOnly bool, limit uint64) ([]models.Alert, error) {
+		raisedAt := time.Date(2022, 3, 1, 8, 16, 0, 0, time.UTC)
+		return []models.Alert{{ID: 3, Rule: "co2", DeviceId: "dev1", EntityId: "aqo1", Attribute: "CO2", Direction: "above", Threshold: 1000, Severity: "high", BreachedAt: raisedAt.Add(-10 * time.Minute), RaisedAt: raisedAt, Value: 1200}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/alerts?deviceId=urn:ngsi-ld:Device:dev1&status=all&limit=10", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	call := app.RetrieveAlertsCalls()[0]
+	is.Equal(call.DeviceId, "dev1")
+	is.True(!call.ActiveOnly)
+	is.Equal(call.Limit, uint64(10))
+
+	body := w.Body.String()
+	is.True(strings.Contains(body, `"id":"urn:ngsi-ld:Alert:3"`))
+	is.True(strings.Contains(body, `"alertSource":{"type":"Relationship","object":"urn:ngsi-ld:Device:dev1"}`))
+	is.True(strings.Contains(body, `"dateIssued":{"type":"Property","value":{"@type":"DateTime","@value":"2022-03-01T08:16:00Z"}}`))
+	is.True(!strings.Contains(body, `"validTo"`)) // the alert is still active
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/alerts?status=cleared", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestQueryReportingGaps(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveReportingGapsFunc = func(deviceId string, from, to time.Time) ([]application.DeviceGaps, error) {
+		return []application.DeviceGaps{{DeviceId: "dev1", Interval: 15 * time.Minute, Gaps: []application.ReportingGap{{From: from, To: from.Add(2 * time.Hour)}}}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := newAdminRequest("GET", "/admin/devices/gaps?from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z&deviceId=dev1", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.RetrieveReportingGapsCalls()[0].DeviceId, "dev1")
+	is.Equal(w.Body.String(), `[{"deviceId":"dev1","interval":900,"gaps":[{"from":"2022-03-01T00:00:00Z","to":"2022-03-01T02:00:00Z","duration":7200}]}]`)
+
+	w = httptest.NewRecorder()
+	req, _ = newAdminRequest("GET", "/admin/devices/gaps?from=2022-03-02T00:00:00Z&to=2022-03-01T00:00:00Z", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestUpdateDevice(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.UpdateExpectedReportingIntervalFunc = func(deviceId string, interval time.Duration) error {
+		if deviceId != "dev1" {
+			return application.ErrNotFound
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := newAdminRequest("PATCH", "/admin/devices/dev1", strings.NewReader(`{"expectedInterval": 600}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.Equal(app.UpdateExpectedReportingIntervalCalls()[0].Interval, 10*time.Minute)
+
+	w = httptest.NewRecorder()
+	req, _ = newAdminRequest("PATCH", "/admin/devices/dev2", strings.NewReader(`{"expectedInterval": null}`))
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+}
+
+func TestQueryNoiseIndicators(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		interval := func(fromHour int, laeq float64) database.Observation {
+			start := from.Add(time.Duration(fromHour) * time.Hour)
+			return &noiselevelobserved.Observation{EntityId: "nlo1", DeviceId: "dev1", DateObservedFrom: start, DateObservedTo: start.Add(time.Hour), Measurements: noiselevelobserved.Measurements{LAeq: &laeq}}
+		}
+		return []database.Observation{interval(10, 61.234), interval(23, 52.0)}, nil
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/noise/indicators?from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z&deviceId=urn:ngsi-ld:Device:dev1&timezone=UTC", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(app.RetrieveObservationsCalls()[0].Kind, noiselevelobserved.Kind)
+	is.Equal(app.RetrieveObservationsCalls()[0].DeviceId, "dev1")
+	is.Equal(w.Body.String(), `[{"entityId":"urn:ngsi-ld:NoiseLevelObserved:nlo1","deviceId":"dev1","from":"2022-03-01T00:00:00Z","to":"2022-03-02T00:00:00Z","Lday":61.2,"Lnight":52}]`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/noise/indicators?from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z&timezone=Nowhere/Special", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
+
+func TestMetricsAreNotExposedOnThePublicAPI(t *testing.T) {
+	is, _, router := testSetup(t)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/debug/vars", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNotFound)
+
+	metrics := chi.NewRouter()
+	RegisterMetricsHandlers(metrics)
+
+	w = httptest.NewRecorder()
+	metrics.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `"retention"`))
+}
+
+func TestAdminEndpointsRequireTheAdminToken(t *testing.T) {
+	is, app, router := testSetup(t)
+
+	for _, authorization := range []string{"", "Bearer wrong-token", testAdminToken} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/admin/devices/dev1/observations?from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z", nil)
+		req.Header.Set("Authorization", authorization)
+		router.ServeHTTP(w, req)
+
+		is.Equal(w.Code, http.StatusUnauthorized)
+	}
+
+	is.Equal(len(app.DeleteObservationsOfDeviceCalls()), 0)
+
+	w := httptest.NewRecorder()
+	req, _ := newAdminRequest("GET", "/admin/devices", nil)
+	router = chi.NewRouter()
+	RegisterHandlers(router, app, "", log.Logger)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusUnauthorized) // the admin endpoints are disabled without a token
+}
+
+func TestPurgingRequiresTheAdminToken(t *testing.T) {
+	is, app, router := testSetup(t)
+	app.DeleteObservationsFunc = func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+		return make([]error, len(entityIds)), nil
+	}
+
+	requests := []struct {
+		method string
+		url    string
+		body   string
+	}{
+		{"DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1?purge=true", ""},
+		{"POST", "/ngsi-ld/v1/entityOperations/delete?purge=true", `["urn:ngsi-ld:AirQualityObserved:aqo1"]`},
+		{"DELETE", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs/temperature/urn:ngsi-ld:instance:17?purge=true", ""},
+	}
+
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(r.method, r.url, strings.NewReader(r.body))
+		req.Header.Set("Authorization", "Bearer wrong-token")
+		router.ServeHTTP(w, req)
+
+		is.Equal(w.Code, http.StatusUnauthorized)
+	}
+
+	is.Equal(len(app.DeleteObservationsCalls()), 0)
+	is.Equal(len(app.DeleteMeasurementCalls()), 0)
+
+	// Soft deletes do not require the token
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1?purge=false", nil)
+	router.ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+	is.True(!app.DeleteObservationsCalls()[0].Purge)
+}
+
+const testAdminToken string = "s3cret"
+
+func newAdminRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	return req, err
+}
+
+func testSetup(t *testing.T) (*is.I, *application.EnvironmentAppMock, *chi.Mux) {
+	is := is.New(t)
+
+	temperature := 12.0
+
+	app := &application.EnvironmentAppMock{
+		RetrieveObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+			return []database.Observation{
+				&models.AirQualityObserved{
+					EntityId:               "aqo1",
+					Latitude:               62.3908,
+					Longitude:              17.3069,
+					Timestamp:              time.Now().UTC(),
+					AirQualityMeasurements: models.AirQualityMeasurements{Temperature: &temperature},
+				},
+			}, nil
+		},
+		RetrieveAggregatedObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+			start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+			count := 2.0
+			return []database.ObservationAggregate{
+				{
+					EntityId:    "aqo1",
+					PeriodStart: start,
+					PeriodEnd:   start.Add(time.Hour),
+					Average:     map[string]*float64{"temperature": &temperature},
+					Minimum:     map[string]*float64{"temperature": &temperature},
+					Maximum:     map[string]*float64{"temperature": &temperature},
+					Sum:         map[string]*float64{"temperature": &temperature},
+					TotalCount:  map[string]*float64{"temperature": &count},
+				},
+			}, nil
+		},
+		UpdateObservationFunc: func(kind *database.ObservationKind, entityId string, update application.ObservationUpdate) error {
+			if entityId != "aqo1" {
+				return application.ErrNotFound
+			}
+			return nil
+		},
+		RetrieveObservationFunc: func(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+			if entityId != "aqo1" {
+				return nil, application.ErrNotFound
+			}
+			return &models.AirQualityObserved{
+				EntityId:               entityId,
+				Latitude:               62.3908,
+				Longitude:              17.3069,
+				Timestamp:              time.Now().UTC(),
+				AirQualityMeasurements: models.AirQualityMeasurements{Temperature: &temperature},
+			}, nil
+		},
+	}
+
+	router := chi.NewRouter()
+	RegisterHandlers(router, app, testAdminToken, log.Logger)
+
+	return is, app, router
+}
@@ -0,0 +1,136 @@
+package context
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	AlertIDPrefix string = "urn:ngsi-ld:Alert:"
+	AlertTypeName string = "Alert"
+)
+
+//alert is an NGSI-LD Alert, as defined by the FIWARE smart data model, that is raised when the
+//observations of a device break an alert rule. The alert is valid until it has been cleared.
+type alert struct {
+	types.BaseEntity
+	Category    types.TextProperty              `json:"category"`
+	SubCategory types.TextProperty              `json:"subCategory"`
+	Severity    types.TextProperty              `json:"severity"`
+	Description types.TextProperty              `json:"description"`
+	DateIssued  types.DateTimeProperty          `json:"dateIssued"`
+	ValidFrom   types.DateTimeProperty          `json:"validFrom"`
+	ValidTo     *types.DateTimeProperty         `json:"validTo,omitempty"`
+	AlertSource types.SingleObjectRelationship  `json:"alertSource"`
+	Location    *geojson.GeoJSONProperty        `json:"location,omitempty"`
+	Data        alertDataProperty               `json:"data"`
+	RefDevice   *types.SingleObjectRelationship `json:"refDevice,omitempty"`
+}
+
+type alertDataProperty struct {
+	types.Property
+	Value alertData `json:"value"`
+}
+
+//alertData holds the details of the rule that was broken, and the values that raised and
+//cleared the alert
+type alertData struct {
+	Rule       string   `json:"rule"`
+	Attribute  string   `json:"attribute"`
+	Direction  string   `json:"direction"`
+	Threshold  float64  `json:"threshold"`
+	Value      float64  `json:"value"`
+	ClearValue *float64 `json:"clearValue,omitempty"`
+}
+
+//newAlert converts a stored alert into an NGSI-LD entity
+func newAlert(a models.Alert) *alert {
+	// The device that made the observations is the source of the alert, if it is known
+	source := fiware.AirQualityObservedIDPrefix + a.EntityId
+	if a.DeviceId != "" {
+		source = fiware.DeviceIDPrefix + a.DeviceId
+	}
+
+	e := &alert{
+		BaseEntity: types.BaseEntity{
+			ID:   AlertIDPrefix + strconv.FormatUint(uint64(a.ID), 10),
+			Type: AlertTypeName,
+			Context: []string{
+				"https://schema.lab.fiware.org/ld/context",
+				"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+			},
+		},
+		Category:    *types.NewTextProperty("environment"),
+		SubCategory: *types.NewTextProperty("airPollution"),
+		Severity:    *types.NewTextProperty(a.Severity),
+		Description: *types.NewTextProperty(fmt.Sprintf("%s has been %s %g", a.Attribute, a.Direction, a.Threshold)),
+		DateIssued:  *types.CreateDateTimeProperty(a.RaisedAt.UTC().Format(time.RFC3339)),
+		ValidFrom:   *types.CreateDateTimeProperty(a.BreachedAt.UTC().Format(time.RFC3339)),
+		AlertSource: *types.NewSingleObjectRelationship(source),
+		Location:    geojson.CreateGeoJSONPropertyFromWGS84(a.Longitude, a.Latitude),
+		Data: alertDataProperty{
+			Property: types.Property{Type: "Property"},
+			Value: alertData{
+				Rule:       a.Rule,
+				Attribute:  a.Attribute,
+				Direction:  a.Direction,
+				Threshold:  a.Threshold,
+				Value:      a.Value,
+				ClearValue: a.ClearValue,
+			},
+		},
+	}
+
+	if a.DeviceId != "" {
+		e.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + a.DeviceId)
+	}
+
+	if a.ClearedAt != nil {
+		e.ValidTo = types.CreateDateTimeProperty(a.ClearedAt.UTC().Format(time.RFC3339))
+	}
+
+	return e
+}
+
+//NewAlerts converts stored alerts into NGSI-LD entities
+func NewAlerts(alerts []models.Alert) []interface{} {
+	result := []interface{}{}
+	for _, a := range alerts {
+		result = append(result, newAlert(a))
+	}
+	return result
+}
+
+//NotificationEntity converts a stored observation, or alert, into the NGSI-LD entity that is
+//sent to subscribers, keyed on the attribute names
+func NotificationEntity(source interface{}) (map[string]interface{}, error) {
+	entity, ok := entities.Registered().Encode(source)
+	if !ok {
+		a, isAlert := source.(models.Alert)
+		if !isAlert {
+			return nil, fmt.Errorf("unable to create a notification entity from %T", source)
+		}
+		entity = newAlert(a)
+	}
+
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
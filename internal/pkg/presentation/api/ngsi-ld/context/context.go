@@ -1,85 +1,232 @@
 package context
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/geoquery"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/qfilter"
 	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
-	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
 	"github.com/rs/zerolog"
 )
 
 type contextSource struct {
-	app application.EnvironmentApp
-	log zerolog.Logger
+	app   application.EnvironmentApp
+	log   zerolog.Logger
+	types *entities.Registry
 }
 
-//CreateSource instantiates and returns a Fiware ContextSource that wraps the provided application interface
+//CreateSource instantiates and returns a Fiware ContextSource that wraps the provided application
+//interface. It provides the entity types of every entity type package that has been imported.
 func CreateSource(app application.EnvironmentApp, log zerolog.Logger) ngsi.ContextSource {
 	return &contextSource{
-		app: app,
-		log: log,
+		app:   app,
+		log:   log,
+		types: entities.Registered(),
 	}
 }
 
 func (cs contextSource) CreateEntity(typeName, entityID string, req ngsi.Request) error {
-	if typeName != fiware.AirQualityObservedTypeName {
+	_, err := cs.StoreEntity(typeName, entityID, req)
+	return err
+}
+
+//StoreEntity creates an entity like CreateEntity, and reports whether the entity was new, or a
+//duplicate of an existing observation that was ignored or overwritten
+func (cs contextSource) StoreEntity(typeName, entityID string, req ngsi.Request) (database.StoreResult, error) {
+	t, ok := cs.types.Type(typeName)
+	if !ok {
 		errorMessage := fmt.Sprintf("entity type %s not supported", typeName)
 		cs.log.Error().Msg(errorMessage)
-		return errors.New(errorMessage)
+		return database.StoreResultCreated, fmt.Errorf("%w: %s", entities.ErrInvalidEntity, errorMessage)
 	}
 
-	aqo := &fiware.AirQualityObserved{}
-	err := req.DecodeBodyInto(aqo)
+	body, err := ioutil.ReadAll(req.BodyReader())
 	if err != nil {
-		return err
+		return database.StoreResultCreated, err
 	}
 
-	dateObserved, err := time.Parse(time.RFC3339, aqo.DateObserved.Value)
+	entity, err := t.Decode(body)
 	if err != nil {
-		return err
+		return database.StoreResultCreated, entities.InvalidEntity(err)
 	}
 
-	entity := strings.TrimPrefix(aqo.ID, fiware.AirQualityObservedIDPrefix)
+	err = t.Validate(entity)
+	if err != nil {
+		return database.StoreResultCreated, entities.InvalidEntity(err)
+	}
 
-	refDevice := ""
-	if aqo.RefDevice != nil {
-		refDevice = strings.TrimPrefix(aqo.RefDevice.Object, fiware.DeviceIDPrefix)
+	return t.Repository(cs.app).Store(entity)
+}
+
+//StoreEntities creates a batch of entities of the same type in a single transaction and returns
+//an error, or nil, for each of them. Duplicates overwrite the existing observations if upsert is set.
+func (cs contextSource) StoreEntities(typeName string, batch []json.RawMessage, upsert bool) ([]error, error) {
+	errs := make([]error, len(batch))
+
+	t, ok := cs.types.Type(typeName)
+	if !ok {
+		for idx := range errs {
+			errs[idx] = fmt.Errorf("%w: entity type %s not supported", entities.ErrInvalidEntity, typeName)
+		}
+		return errs, nil
 	}
 
-	co2 := 0.0
-	if aqo.CO2 != nil {
-		co2 = aqo.CO2.Value
+	decoded := []ngsi.Entity{}
+	decodedIdx := []int{}
+
+	for idx, body := range batch {
+		entity, err := t.Decode(body)
+		if err == nil {
+			err = t.Validate(entity)
+		}
+
+		if err != nil {
+			errs[idx] = entities.InvalidEntity(err)
+			continue
+		}
+
+		decoded = append(decoded, entity)
+		decodedIdx = append(decodedIdx, idx)
 	}
 
-	humidity := 0.0
-	if aqo.RelativeHumidity != nil {
-		humidity = aqo.RelativeHumidity.Value
+	if len(decoded) == 0 {
+		return errs, nil
 	}
 
-	temp := 0.0
-	if aqo.Temperature != nil {
-		temp = aqo.Temperature.Value
+	stored, err := t.Repository(cs.app).StoreBatch(decoded, upsert)
+	if err != nil {
+		return nil, err
 	}
 
-	err = cs.app.StoreAirQualityObserved(entity, refDevice, co2, humidity, temp, dateObserved)
+	for idx, err := range stored {
+		errs[decodedIdx[idx]] = err
+	}
 
-	return err
+	return errs, nil
 }
 
-func (cs contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
-	var err error
+//DeleteEntities deletes all observations of a batch of entities, which may be of different types,
+//and returns an error, or nil, for each of them. The observations are removed from the database
+//if purge is set.
+func (cs contextSource) DeleteEntities(entityIDs []string, purge bool) ([]error, error) {
+	errs := make([]error, len(entityIDs))
+	indicesPerType := map[string][]int{}
+	types := []entities.EntityType{}
+
+	for idx, entityID := range entityIDs {
+		t, ok := cs.types.TypeFromID(entityID)
+		if !ok {
+			errs[idx] = fmt.Errorf("%w: entity %s", application.ErrNotFound, entityID)
+			continue
+		}
+
+		if _, ok := indicesPerType[t.Name()]; !ok {
+			types = append(types, t)
+		}
+		indicesPerType[t.Name()] = append(indicesPerType[t.Name()], idx)
+	}
+
+	for _, t := range types {
+		indices := indicesPerType[t.Name()]
+
+		ids := []string{}
+		for _, idx := range indices {
+			ids = append(ids, strings.TrimPrefix(entityIDs[idx], t.IDPrefix()))
+		}
 
+		deleted, err := t.Repository(cs.app).Delete(ids, purge)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, idx := range indices {
+			errs[idx] = deleted[i]
+		}
+	}
+
+	return errs, nil
+}
+
+//DeleteAttributeInstance deletes a single instance of an attribute, as identified by the
+//instanceId in the temporal representation of the entity
+func (cs contextSource) DeleteAttributeInstance(entityID, attributeName, instanceID string, purge bool) error {
+	t, ok := cs.types.TypeFromID(entityID)
+	if !ok {
+		return fmt.Errorf("%w: entity %s", application.ErrNotFound, entityID)
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(instanceID, InstanceIDPrefix), 10, 32)
+	if err != nil || !strings.HasPrefix(instanceID, InstanceIDPrefix) {
+		return fmt.Errorf("%w: instance %s does not exist", application.ErrNotFound, instanceID)
+	}
+
+	return t.Repository(cs.app).DeleteAttributeInstance(strings.TrimPrefix(entityID, t.IDPrefix()), attributeName, uint(id), purge)
+}
+
+func (cs contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
 	if query == nil {
 		return errors.New("GetEntities: query may not be nil")
 	}
 
+	for _, t := range cs.queriedTypes(query) {
+		err := cs.getEntities(t, query, callback)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//queriedTypes returns the provided entity types that a query asks for. A query without any
+//types asks for the types that provide at least one of the requested attributes.
+func (cs contextSource) queriedTypes(query ngsi.Query) []entities.EntityType {
+	types := []entities.EntityType{}
+
+	for _, typeName := range query.EntityTypes() {
+		if t, ok := cs.types.Type(typeName); ok {
+			types = append(types, t)
+		}
+	}
+
+	if len(types) > 0 {
+		return types
+	}
+
+	for _, t := range cs.types.Types() {
+		for _, attributeName := range query.EntityAttributes() {
+			if providesAttribute(t, attributeName) {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+
+	return types
+}
+
+//getQueryParameters returns the device, time span and options that are common to the queries
+//of all entity types. The q filter is resolved using the stored columns of the queried type.
+func getQueryParameters(query ngsi.Query, columns map[string]string) (string, time.Time, time.Time, []database.QueryOption, error) {
+	options := []database.QueryOption{}
+
+	filter := getAttributeFilter(query, columns)
+
 	deviceId := ""
-	if query.HasDeviceReference() {
+	if filter != nil {
+		// The filter takes care of any refDevice comparisons in the query
+		options = append(options, database.WithFilter(*filter))
+	} else if query.HasDeviceReference() {
 		deviceId = strings.TrimPrefix(query.Device(), fiware.DeviceIDPrefix)
 	}
 
@@ -89,18 +236,31 @@ func (cs contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitie
 		from, to = query.Temporal().TimeSpan()
 	}
 
-	limit := query.PaginationLimit()
+	geoQuery, err := getGeoQuery(query)
+	if err != nil {
+		return "", from, to, nil, err
+	}
 
-	aqos, err := cs.app.RetrieveAirQualityObserveds(deviceId, from, to, limit)
+	if geoQuery != nil {
+		options = append(options, database.WithGeoQuery(*geoQuery))
+	}
+
+	return deviceId, from, to, options, nil
+}
+
+func (cs contextSource) getEntities(t entities.EntityType, query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
+	deviceId, from, to, options, err := getQueryParameters(query, t.AttributeColumns())
 	if err != nil {
 		return err
 	}
 
-	for _, a := range aqos {
-		entity := fiware.NewAirQualityObserved(a.EntityId, a.Latitude, a.Longitude, a.Timestamp.Format(time.RFC3339)).WithCO2(a.CO2).WithRelativeHumidity(a.Humidity).WithTemperature(a.Temperature)
-		if a.DeviceId != "" {
-			entity.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + a.DeviceId)
-		}
+	observations, err := t.Repository(cs.app).Query(deviceId, from, to, query.PaginationLimit(), options...)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range observations {
+		entity, _ := t.Encode(o.Value)
 
 		err = callback(entity)
 		if err != nil {
@@ -112,29 +272,142 @@ func (cs contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitie
 }
 
 func (cs contextSource) GetProvidedTypeFromID(entityID string) (string, error) {
-	if cs.ProvidesEntitiesWithMatchingID(entityID) {
-		return fiware.AirQualityObservedTypeName, nil
+	t, ok := cs.types.TypeFromID(entityID)
+	if !ok {
+		return "", errors.New("no entities found with matching type")
 	}
 
-	return "", errors.New("no entities found with matching type")
+	return t.Name(), nil
 }
 
 func (cs contextSource) ProvidesAttribute(attributeName string) bool {
+	for _, t := range cs.types.Types() {
+		if providesAttribute(t, attributeName) {
+			return true
+		}
+	}
+
 	return false
 }
 
+//providesAttribute returns true if entities of a type may have an attribute
+func providesAttribute(t entities.EntityType, attributeName string) bool {
+	return attributeName == "location" || t.ProvidesAttribute(attributeName)
+}
+
 func (cs contextSource) ProvidesEntitiesWithMatchingID(entityID string) bool {
-	return strings.HasPrefix(entityID, fiware.AirQualityObservedIDPrefix)
+	_, err := cs.GetProvidedTypeFromID(entityID)
+	return err == nil
 }
 
 func (cs contextSource) ProvidesType(typeName string) bool {
-	return typeName == fiware.AirQualityObservedTypeName
+	_, ok := cs.types.Type(typeName)
+	return ok
 }
 
 func (cs contextSource) RetrieveEntity(entityID string, request ngsi.Request) (ngsi.Entity, error) {
-	return nil, errors.New("retrieve entity not implemented")
+	t, ok := cs.types.TypeFromID(entityID)
+	if !ok {
+		return nil, fmt.Errorf("failed to retrieve entity %s: %w", entityID, application.ErrNotFound)
+	}
+
+	observation, err := t.Repository(cs.app).Retrieve(strings.TrimPrefix(entityID, t.IDPrefix()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve entity %s: %w", entityID, err)
+	}
+
+	entity, _ := t.Encode(observation)
+
+	return entity, nil
+}
+
+//getGeoQuery returns the geo-query that has been parsed by the geoquery middleware, or converts
+//the more limited geo-query support of the ngsi-ld library if the middleware has not been used
+func getGeoQuery(query ngsi.Query) (*database.GeoQuery, error) {
+	if query.Request() != nil {
+		if gq, ok := geoquery.FromContext(query.Request().Context()); ok {
+			return gq, nil
+		}
+	}
+
+	if !query.IsGeoQuery() {
+		return nil, nil
+	}
+
+	gq := query.Geo()
+
+	if gq.GeoRel == ngsi.GeoSpatialRelationNearPoint {
+		lon, lat, err := gq.Point()
+		if err != nil {
+			return nil, err
+		}
+		distance, _ := gq.Distance()
+		nearQuery := database.NewNearPointGeoQuery(lon, lat, float64(distance))
+		return &nearQuery, nil
+	}
+
+	lon0, lat0, lon1, lat1, err := gq.Rectangle()
+	if err != nil {
+		return nil, err
+	}
+
+	return &database.GeoQuery{
+		Relation: database.GeoRelationWithin,
+		Geometry: database.GeometryPolygon,
+		Coordinates: [][2]float64{
+			{lon0, lat0}, {lon1, lat0}, {lon1, lat1}, {lon0, lat1}, {lon0, lat0},
+		},
+	}, nil
 }
 
+//getAttributeFilter returns the filter that has been parsed from the q parameter by the qfilter
+//middleware, with the attribute names in the query resolved to their stored columns
+func getAttributeFilter(query ngsi.Query, columns map[string]string) *database.Filter {
+	if query.Request() == nil {
+		return nil
+	}
+
+	filter, ok := qfilter.FromContext(query.Request().Context())
+	if !ok {
+		return nil
+	}
+
+	filter.Walk(func(comparison *database.Filter) error {
+		comparison.Column = ""
+
+		for name, column := range columns {
+			if strings.EqualFold(name, comparison.Attribute) {
+				comparison.Column = column
+			}
+		}
+
+		// References are stored without their URN prefixes
+		prefixes := map[string]string{
+			"refDevice":          fiware.DeviceIDPrefix,
+			"refPointOfInterest": fiware.PointOfInterestIDPrefix,
+		}
+
+		if prefix, ok := prefixes[comparison.Attribute]; ok {
+			for idx, v := range comparison.Values {
+				if reference, ok := v.(string); ok {
+					comparison.Values[idx] = strings.TrimPrefix(reference, prefix)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return filter
+}
+
+//UpdateEntityAttributes appends a new observation to an entity, based on the attributes in
+//the request fragment and the latest known state of the entity
 func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request) error {
-	return errors.New("UpdateEntityAttributes is not supported by this service")
+	t, ok := cs.types.TypeFromID(entityID)
+	if !ok {
+		return fmt.Errorf("entity %s is not provided by this service", entityID)
+	}
+
+	return t.Repository(cs.app).UpdateAttributes(strings.TrimPrefix(entityID, t.IDPrefix()), req)
 }
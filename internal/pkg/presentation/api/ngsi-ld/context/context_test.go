@@ -2,16 +2,31 @@ package context
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
 	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	_ "github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/airqualityobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/indoorenvironmentobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/noiselevelobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/waterqualityobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/weatherobserved"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/geoquery"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/qfilter"
 	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
 	"github.com/matryer/is"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 )
 
 func TestStoreAirQualityObserved(t *testing.T) {
@@ -23,7 +38,90 @@ func TestStoreAirQualityObserved(t *testing.T) {
 	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
 
 	is.Equal(w.Code, http.StatusCreated)
-	is.Equal(len(app.StoreAirQualityObservedCalls()), 1)
+
+	stored := storedObservationsOf(app, database.AirQualityObservedKind)
+	is.Equal(len(stored), 1)
+	is.Equal(stored[0].(*models.AirQualityObserved).Latitude, 40.423852777777775)
+	is.Equal(stored[0].(*models.AirQualityObserved).Longitude, -3.712247222222222)
+}
+
+func TestStoreAirQualityObservedWithPollutants(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(aqoWithPollutantsJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	measurements := storedObservationsOf(app, database.AirQualityObservedKind)[0].(*models.AirQualityObserved).AirQualityMeasurements
+	is.Equal(*measurements.PM10, 19.0)
+	is.Equal(*measurements.PM25, 9.0)
+	is.Equal(*measurements.NO2, 22.0)
+	is.Equal(*measurements.O3, 45.0)
+	is.Equal(*measurements.CO, 0.4)
+	is.Equal(*measurements.Benzene, 1.2)
+	is.True(measurements.CO2 == nil) // CO2 was not part of the entity and should be nil
+}
+
+func TestThatUnobservedAttributesAreOmitted(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		return []database.Observation{
+			&models.AirQualityObserved{
+				EntityId:               "entityId",
+				Timestamp:              time.Now().UTC(),
+				AirQualityMeasurements: models.AirQualityMeasurements{Temperature: float64Ptr(12.0)},
+			},
+		}, nil
+	}
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `"temperature"`))
+	is.True(!strings.Contains(w.Body.String(), `"CO2"`))              // CO2 was never observed
+	is.True(!strings.Contains(w.Body.String(), `"relativeHumidity"`)) // humidity was never observed
+}
+
+func TestThatAirQualityIndexIsIncludedInEntities(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		return []database.Observation{
+			&models.AirQualityObserved{
+				EntityId:               "entityId",
+				Timestamp:              time.Now().UTC(),
+				AirQualityMeasurements: models.AirQualityMeasurements{NO2: float64Ptr(150.0)},
+				AirQualityIndex:        float64Ptr(63.0),
+				AirQualityLevel:        "medium",
+			},
+		}, nil
+	}
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.True(strings.Contains(w.Body.String(), `"airQualityIndex"`))
+	is.True(strings.Contains(w.Body.String(), `"medium"`))
+}
+
+func TestStoreAirQualityObservedWithoutLocationFails(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(aqoWithoutLocationJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.Equal(len(app.StoreObservationCalls()), 0)
 }
 
 func TestRetrieveAirQualityObserveds(t *testing.T) {
@@ -35,27 +133,571 @@ func TestRetrieveAirQualityObserveds(t *testing.T) {
 	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
 
 	is.Equal(w.Code, http.StatusOK)
-	is.Equal(len(app.RetrieveAirQualityObservedsCalls()), 1)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 1)
+	is.True(strings.Contains(w.Body.String(), "17.3069")) // response should contain the stored longitude
+	is.True(strings.Contains(w.Body.String(), "62.3908")) // response should contain the stored latitude
+	is.True(strings.Contains(w.Body.String(), `"PM2.5"`)) // response should contain the stored pollutants
+}
+
+func TestRetrieveAirQualityObservedsNearPoint(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&georel=near%3BmaxDistance==500&geometry=Point&coordinates=[-3.712247,40.423852]", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	geoquery.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 1)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)[0].Options), 1) // expected a geo query option
+}
+
+func TestRetrieveAirQualityObservedsIntersectingPolygon(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&georel=intersects&geometry=Polygon&coordinates=[[[17.30,62.38],[17.32,62.38],[17.32,62.40],[17.30,62.38]]]", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	geoquery.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)[0].Options), 1) // expected a geo query option
+}
+
+func TestRetrieveAirQualityObservedsWithAttributeFilter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&q="+url.QueryEscape(`refDevice=="urn:ngsi-ld:Device:dev1";co2>1000`), nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	qfilter.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(queriesOf(app, database.AirQualityObservedKind)[0].DeviceId, "")    // refDevice should be handled by the filter
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)[0].Options), 1) // expected a filter option
+}
+
+func TestRetrieveAirQualityObservedsByAttributeName(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?attrs=PM2.5", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 1) // the context source should provide PM2.5
+}
+
+func TestStoreWaterQualityObserved(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(wqoJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	stored := storedObservationsOf(app, waterqualityobserved.Kind)
+	is.Equal(len(stored), 1)
+
+	wqo := stored[0].(*waterqualityobserved.Observation)
+	is.Equal(wqo.EntityId, "wqo1")
+	is.Equal(wqo.DeviceId, "dev1")
+	is.Equal(wqo.Latitude, 62.3908)
+	is.Equal(wqo.Longitude, 17.3069)
+	is.Equal(*wqo.Temperature, 8.5)
+	is.Equal(*wqo.PH, 7.2)
+	is.Equal(*wqo.DissolvedOxygen, 10.4)
+	is.True(wqo.Turbidity == nil) // turbidity was not part of the entity and should be nil
+	is.Equal(len(storedObservationsOf(app, database.AirQualityObservedKind)), 0)
+}
+
+func TestRetrieveWaterQualityObserveds(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=WaterQualityObserved", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, waterqualityobserved.Kind)), 1)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 0)
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:WaterQualityObserved:wqo1"`))
+	is.True(strings.Contains(w.Body.String(), `"pH"`))                      // response should contain the stored pH
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:Device:dev1"`)) // response should contain the device
+	is.True(!strings.Contains(w.Body.String(), `"turbidity"`))              // turbidity was never observed
+}
+
+func TestRetrieveWaterQualityObservedsWithAttributeFilter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=WaterQualityObserved&q="+url.QueryEscape(`pH>7;O2<12`), nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	qfilter.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, waterqualityobserved.Kind)[0].Options), 1) // expected a filter option
+}
+
+func TestRetrieveWaterQualityObservedsByAttributeName(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?attrs=pH", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, waterqualityobserved.Kind)), 1)
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 0) // pH is only provided by water quality observations
+}
+
+func TestRetrieveWaterQualityObservedByID(t *testing.T) {
+	is, app, ctxReg := testSetup(t)
+
+	source := ctxReg.GetContextSourcesForEntity("urn:ngsi-ld:WaterQualityObserved:wqo1")
+	is.Equal(len(source), 1)
+
+	entity, err := source[0].RetrieveEntity("urn:ngsi-ld:WaterQualityObserved:wqo1", nil)
+	is.NoErr(err)
+	is.Equal(app.RetrieveObservationCalls()[0].Kind, waterqualityobserved.Kind)
+	is.Equal(app.RetrieveObservationCalls()[0].EntityId, "wqo1")
+
+	b, _ := json.Marshal(entity)
+	wqo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &wqo))
+	is.Equal(wqo["id"], "urn:ngsi-ld:WaterQualityObserved:wqo1")
+}
+
+func TestStoreEntitiesStoresBatchOfWaterQualityObserveds(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	app.StoreObservationsFunc = func(kind *database.ObservationKind, observations []database.Observation, upsert bool) ([]database.BatchStoreResult, error) {
+		return make([]database.BatchStoreResult, len(observations)), nil
+	}
+
+	batch := []json.RawMessage{
+		json.RawMessage(wqoJson),
+		json.RawMessage(strings.Replace(wqoJson, "urn:ngsi-ld:WaterQualityObserved:wqo1", "urn:ngsi-ld:Device:wqo2", 1)),
+	}
+
+	errs, err := CreateSource(app, log.Logger).(*contextSource).StoreEntities("WaterQualityObserved", batch, true)
+	is.NoErr(err)
+	is.Equal(len(errs), 2)
+	is.NoErr(errs[0])
+	is.True(errors.Is(errs[1], entities.ErrInvalidEntity)) // the id of the second entity has the wrong prefix
+
+	is.Equal(len(app.StoreObservationsCalls()), 1)
+	call := app.StoreObservationsCalls()[0]
+	is.Equal(call.Kind, waterqualityobserved.Kind)
+	is.True(call.Upsert)
+	is.Equal(len(call.Observations), 1)
+	is.Equal(call.Observations[0].(*waterqualityobserved.Observation).EntityId, "wqo1")
+	is.Equal(*call.Observations[0].(*waterqualityobserved.Observation).PH, 7.2)
+}
+
+func TestDeleteEntitiesDeletesEachTypeFromItsOwnRepository(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	app.DeleteObservationsFunc = func(kind *database.ObservationKind, entityIds []string, purge bool) ([]error, error) {
+		if kind == database.AirQualityObservedKind {
+			return []error{fmt.Errorf("%w: entity %s", application.ErrNotFound, entityIds[0])}, nil
+		}
+		return make([]error, len(entityIds)), nil
+	}
+
+	entityIDs := []string{
+		"urn:ngsi-ld:WaterQualityObserved:wqo1",
+		"urn:ngsi-ld:AirQualityObserved:aqo1",
+		"urn:ngsi-ld:WaterQualityObserved:wqo2",
+		"urn:ngsi-ld:Device:dev1",
+	}
+
+	errs, err := CreateSource(app, log.Logger).(*contextSource).DeleteEntities(entityIDs, true)
+	is.NoErr(err)
+	is.Equal(len(errs), 4)
+	is.NoErr(errs[0])
+	is.True(errors.Is(errs[1], application.ErrNotFound))
+	is.NoErr(errs[2])
+	is.True(errors.Is(errs[3], application.ErrNotFound)) // devices are not provided by the context source
+
+	deleted := map[*database.ObservationKind][]string{}
+	for _, call := range app.DeleteObservationsCalls() {
+		is.True(call.Purge)
+		deleted[call.Kind] = append(deleted[call.Kind], call.EntityIds...)
+	}
+	is.Equal(len(app.DeleteObservationsCalls()), 2) // one call for each type
+	is.Equal(deleted[waterqualityobserved.Kind], []string{"wqo1", "wqo2"})
+	is.Equal(deleted[database.AirQualityObservedKind], []string{"aqo1"})
+}
+
+func TestAttributeInstancesOfWaterQualityObservedsCanNotBeDeleted(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	err := CreateSource(app, log.Logger).(*contextSource).DeleteAttributeInstance("urn:ngsi-ld:WaterQualityObserved:wqo1", "pH", InstanceIDPrefix+"17", false)
+	is.True(errors.Is(err, entities.ErrInvalidAttribute))
+}
+
+func TestStoreNoiseLevelObserved(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(nloJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	stored := storedObservationsOf(app, noiselevelobserved.Kind)
+	is.Equal(len(stored), 1)
+
+	nlo := stored[0].(*noiselevelobserved.Observation)
+	is.Equal(nlo.EntityId, "nlo1")
+	is.Equal(nlo.DeviceId, "dev1")
+	is.Equal(nlo.DateObservedFrom, time.Date(2022, 3, 21, 8, 0, 0, 0, time.UTC))
+	is.Equal(nlo.DateObservedTo, time.Date(2022, 3, 21, 8, 15, 0, 0, time.UTC))
+	is.Equal(*nlo.LAeq, 64.2)
+	is.Equal(*nlo.LAmax, 81.5)
+	is.True(nlo.LA90 == nil) // LA90 was not part of the entity and should be nil
+}
+
+func TestStoreNoiseLevelObservedWithoutIntervalFails(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(strings.Replace(nloJson, "dateObservedTo", "dateObserved", 1))))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+	is.Equal(len(app.StoreObservationCalls()), 0)
+}
+
+func TestRetrieveNoiseLevelObservedsOfDeviceWithinTimeWindow(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=NoiseLevelObserved&q="+url.QueryEscape(`refDevice=="urn:ngsi-ld:Device:dev1"`)+"&timerel=between&timeAt=2022-03-21T00:00:00Z&endTimeAt=2022-03-22T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewQueryEntitiesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, noiselevelobserved.Kind)), 1)
+
+	query := queriesOf(app, noiselevelobserved.Kind)[0]
+	is.Equal(query.DeviceId, "dev1")
+	is.Equal(query.From, time.Date(2022, 3, 21, 0, 0, 0, 0, time.UTC))
+	is.Equal(query.To, time.Date(2022, 3, 22, 0, 0, 0, 0, time.UTC))
+
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:NoiseLevelObserved:nlo1"`))
+	is.True(strings.Contains(w.Body.String(), `"dateObservedFrom"`))
+	is.True(strings.Contains(w.Body.String(), `"LAeq"`))
+	is.True(!strings.Contains(w.Body.String(), `"LA90"`)) // LA90 was never observed
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 0)
+}
+
+func TestStoreWeatherObserved(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(woJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	stored := storedObservationsOf(app, weatherobserved.Kind)
+	is.Equal(len(stored), 1)
+
+	wo := stored[0].(*weatherobserved.Observation)
+	is.Equal(wo.EntityId, "wo1")
+	is.Equal(wo.Latitude, 62.3908)
+	is.Equal(*wo.Temperature, -3.5)
+	is.Equal(*wo.Humidity, 0.82)
+	is.Equal(*wo.Pressure, 1013.2)
+	is.Equal(*wo.WindSpeed, 6.1)
+	is.Equal(*wo.WindDirection, 225.0)
+	is.Equal(*wo.Precipitation, 0.4)
+	is.True(wo.SolarRadiation == nil) // solar radiation was not part of the entity and should be nil
+}
+
+func TestRetrieveWeatherObservedsNearPoint(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=WeatherObserved&georel=near%3BmaxDistance==500&geometry=Point&coordinates=[17.3069,62.3908]", nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	geoquery.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, weatherobserved.Kind)), 1)
+	is.Equal(len(queriesOf(app, weatherobserved.Kind)[0].Options), 1) // expected a geo query option
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:WeatherObserved:wo1"`))
+	is.True(strings.Contains(w.Body.String(), "62.3908")) // response should contain the stored latitude
+	is.True(strings.Contains(w.Body.String(), `"windSpeed"`))
+}
+
+func TestStoreIndoorEnvironmentObserved(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/ngsi-ld/v1/entities", bytes.NewBuffer([]byte(ieoJson)))
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	ngsi.NewCreateEntityHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusCreated)
+
+	stored := storedObservationsOf(app, indoorenvironmentobserved.Kind)
+	is.Equal(len(stored), 1)
+
+	ieo := stored[0].(*indoorenvironmentobserved.Observation)
+	is.Equal(ieo.EntityId, "room1")
+	is.Equal(ieo.DeviceId, "dev1")
+	is.Equal(ieo.PointOfInterestId, "school1") // the building should be stored without its prefix
+	is.Equal(*ieo.CO2, 1120.0)
+	is.Equal(*ieo.Humidity, 0.38)
+	is.Equal(*ieo.PeopleCount, 24.0)
+	is.True(ieo.Illuminance == nil) // illuminance was not part of the entity and should be nil
+}
+
+func TestRetrieveIndoorEnvironmentObservedsOfBuilding(t *testing.T) {
+	q := url.QueryEscape(`refPointOfInterest=="urn:ngsi-ld:PointOfInterest:school1";co2>1000`)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=IndoorEnvironmentObserved&q="+q, nil)
+	w := httptest.NewRecorder()
+
+	is, app, ctxReg := testSetup(t)
+
+	qfilter.Middleware(ngsi.NewQueryEntitiesHandler(ctxReg)).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(queriesOf(app, indoorenvironmentobserved.Kind)), 1)
+	is.Equal(len(queriesOf(app, indoorenvironmentobserved.Kind)[0].Options), 1) // expected a filter option
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:IndoorEnvironmentObserved:room1"`))
+	is.True(strings.Contains(w.Body.String(), `"urn:ngsi-ld:PointOfInterest:school1"`)) // response should refer to the building
+	is.True(strings.Contains(w.Body.String(), `"peopleCount"`))
+	is.Equal(len(queriesOf(app, database.AirQualityObservedKind)), 0)
+}
+
+func TestUpdateEntityAttributesUsesObservedAtFromFragment(t *testing.T) {
+	is, app, ctxReg := testSetup(t)
+
+	req, _ := http.NewRequest("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:AirQualityObserved:aqo1/attrs/", bytes.NewBuffer([]byte(aqoFragmentJson)))
+	w := httptest.NewRecorder()
+
+	ngsi.NewUpdateEntityAttributesHandler(ctxReg).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusNoContent)
+
+	call := app.UpdateObservationCalls()[0]
+	is.Equal(call.Kind, database.AirQualityObservedKind)
+	is.Equal(call.EntityId, "aqo1")
+
+	latest := &models.AirQualityObserved{
+		EntityId: "aqo1", DeviceId: "dev1", Latitude: 62.3908, Longitude: 17.3069,
+		AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(640.0), Temperature: float64Ptr(21.0)},
+	}
+
+	updated, err := call.Update(latest)
+	is.NoErr(err)
+
+	aqo := updated.(*models.AirQualityObserved)
+	is.Equal(*aqo.CO2, 812.0)
+	is.Equal(*aqo.Temperature, 21.0) // temperature was not part of the fragment and should be carried over
+	is.Equal(aqo.DeviceId, "dev1")   // and so was refDevice
+	is.Equal(aqo.Timestamp, time.Date(2022, 3, 21, 8, 15, 0, 0, time.UTC))
+}
+
+func TestGetTemporalEntitiesGroupsObservationsPerEntity(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	now := time.Now().UTC()
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		return []database.Observation{
+			&models.AirQualityObserved{EntityId: "aqo1", Timestamp: now, AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(600.0)}},
+			&models.AirQualityObserved{EntityId: "aqo2", Timestamp: now.Add(-time.Minute), AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(500.0)}},
+			&models.AirQualityObserved{Model: gorm.Model{ID: 7}, EntityId: "aqo1", Timestamp: now.Add(-2 * time.Minute), AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(450.0), Temperature: float64Ptr(21.0)}},
+			&models.AirQualityObserved{EntityId: "aqo1", Timestamp: now.Add(-3 * time.Minute), AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(400.0)}},
+		}, nil
+	}
+
+	source := CreateSource(app, log.Logger).(TemporalContextSource)
+
+	entities := []temporalEntity{}
+	truncated, err := source.GetTemporalEntities(TemporalQuery{LastN: 2, Attributes: []string{"CO2", "temperature"}}, func(e ngsi.Entity) error {
+		entities = append(entities, e.(temporalEntity))
+		return nil
+	})
+
+	is.NoErr(err)
+	is.True(truncated == nil)
+	is.Equal(len(entities), 2)
+	is.Equal(entities[0]["id"], "urn:ngsi-ld:AirQualityObserved:aqo1")
+
+	co2 := entities[0]["CO2"].([]interface{})
+	is.Equal(len(co2), 2) // only the lastN instances should be returned
+	is.Equal(co2[0].(map[string]interface{})["value"], 450.0)
+	is.Equal(co2[0].(map[string]interface{})["instanceId"], "urn:ngsi-ld:instance:7")
+	is.Equal(co2[1].(map[string]interface{})["value"], 600.0)
+	is.Equal(len(entities[0]["temperature"].([]interface{})), 1)
+	is.True(entities[0]["location"] == nil) // location was not among the requested attributes
+}
+
+func TestGetTemporalEntitiesAreLimitedPerEntity(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	now := time.Now().UTC()
+	app.RetrieveObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+		aqo := func(entityId string, minutes int) database.Observation {
+			return &models.AirQualityObserved{EntityId: entityId, Timestamp: now.Add(time.Duration(-minutes) * time.Minute), AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(400.0)}}
+		}
+		return []database.Observation{aqo("busy", 0), aqo("quiet", 1), aqo("busy", 2), aqo("busy", 4), aqo("quiet", 5)}, nil
+	}
+
+	source := CreateSource(app, log.Logger).(TemporalContextSource)
+
+	entities := []temporalEntity{}
+	truncated, err := source.GetTemporalEntities(TemporalQuery{Limit: 2}, func(e ngsi.Entity) error {
+		entities = append(entities, e.(temporalEntity))
+		return nil
+	})
+
+	is.NoErr(err)
+	is.Equal(queriesOf(app, database.AirQualityObservedKind)[0].Limit, uint64(0)) // the limit should apply per entity
+	is.Equal(truncated.From, now.Add(-2*time.Minute))                             // the oldest instance that was kept of the busy entity
+	is.Equal(truncated.To, now)
+
+	is.Equal(len(entities), 2)
+	is.Equal(len(entities[0]["CO2"].([]interface{})), 2)
+	is.Equal(len(entities[1]["CO2"].([]interface{})), 1) // the quiet entity is restricted to the same range
+
+	_, err = source.GetTemporalEntities(TemporalQuery{Limit: MaxTemporalLimit + 1}, func(e ngsi.Entity) error { return nil })
+	is.True(errors.Is(err, ErrUnsupportedTemporalQuery))
+}
+
+func TestGetTemporalEntitiesWithAggregationMethods(t *testing.T) {
+	is, app, _ := testSetup(t)
+
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	app.RetrieveAggregatedObservationsFunc = func(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+		aggregate := func(day int, co2 float64) database.ObservationAggregate {
+			return database.ObservationAggregate{
+				EntityId:    "aqo1",
+				PeriodStart: start.AddDate(0, 0, day),
+				PeriodEnd:   start.AddDate(0, 0, day+1),
+				Average:     map[string]*float64{"co2": float64Ptr(co2), "temperature": nil},
+				Maximum:     map[string]*float64{"co2": float64Ptr(co2 + 100), "temperature": nil},
+				TotalCount:  map[string]*float64{"co2": float64Ptr(24.0), "temperature": float64Ptr(0.0)},
+			}
+		}
+		return []database.ObservationAggregate{aggregate(0, 400.0), aggregate(1, 450.0)}, nil
+	}
+
+	source := CreateSource(app, log.Logger).(TemporalContextSource)
+
+	entities := []temporalEntity{}
+	query := TemporalQuery{AggregationMethods: []string{"avg", "max"}, AggregationPeriod: database.AggregationPeriodDay}
+	_, err := source.GetTemporalEntities(query, func(e ngsi.Entity) error {
+		entities = append(entities, e.(temporalEntity))
+		return nil
+	})
+
+	is.NoErr(err)
+	is.Equal(len(entities), 1)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Kind, database.AirQualityObservedKind)
+	is.Equal(app.RetrieveAggregatedObservationsCalls()[0].Period, database.AggregationPeriodDay)
+
+	co2 := entities[0]["CO2"].(map[string]interface{})
+	is.Equal(co2["type"], "Property")
+	is.Equal(len(co2["avg"].([]interface{})), 2)
+	is.Equal(co2["avg"].([]interface{})[1], []interface{}{450.0, "2022-03-02T00:00:00Z", "2022-03-03T00:00:00Z"})
+	is.Equal(co2["max"].([]interface{})[0].([]interface{})[0], 500.0)
+	is.True(entities[0]["temperature"] == nil) // temperature was never observed
 }
 
 func testSetup(t *testing.T) (*is.I, *application.EnvironmentAppMock, ngsi.ContextRegistry) {
 	is := is.New(t)
 
+	observations := map[*database.ObservationKind][]database.Observation{
+		database.AirQualityObservedKind: {
+			&models.AirQualityObserved{
+				EntityId:  "entityId",
+				DeviceId:  "deviceId",
+				Latitude:  62.3908,
+				Longitude: 17.3069,
+				Timestamp: time.Now().UTC(),
+				AirQualityMeasurements: models.AirQualityMeasurements{
+					CO2:         float64Ptr(20.0),
+					Humidity:    float64Ptr(30.0),
+					Temperature: float64Ptr(40.0),
+					PM25:        float64Ptr(7.5),
+				},
+			},
+		},
+		waterqualityobserved.Kind: {
+			&waterqualityobserved.Observation{
+				EntityId:  "wqo1",
+				DeviceId:  "dev1",
+				Latitude:  62.3908,
+				Longitude: 17.3069,
+				Timestamp: time.Now().UTC(),
+				Measurements: waterqualityobserved.Measurements{
+					Temperature: float64Ptr(8.5),
+					PH:          float64Ptr(7.2),
+				},
+			},
+		},
+		noiselevelobserved.Kind: {
+			&noiselevelobserved.Observation{
+				EntityId:         "nlo1",
+				DeviceId:         "dev1",
+				Latitude:         62.3908,
+				Longitude:        17.3069,
+				DateObservedFrom: time.Date(2022, 3, 21, 8, 0, 0, 0, time.UTC),
+				DateObservedTo:   time.Date(2022, 3, 21, 8, 15, 0, 0, time.UTC),
+				Measurements:     noiselevelobserved.Measurements{LAeq: float64Ptr(64.2)},
+			},
+		},
+		weatherobserved.Kind: {
+			&weatherobserved.Observation{
+				EntityId:     "wo1",
+				Latitude:     62.3908,
+				Longitude:    17.3069,
+				Timestamp:    time.Now().UTC(),
+				Measurements: weatherobserved.Measurements{Temperature: float64Ptr(-3.5), WindSpeed: float64Ptr(6.1)},
+			},
+		},
+		indoorenvironmentobserved.Kind: {
+			&indoorenvironmentobserved.Observation{
+				EntityId:          "room1",
+				DeviceId:          "dev1",
+				PointOfInterestId: "school1",
+				Latitude:          62.3908,
+				Longitude:         17.3069,
+				Timestamp:         time.Now().UTC(),
+				Measurements:      indoorenvironmentobserved.Measurements{CO2: float64Ptr(1120.0), PeopleCount: float64Ptr(24.0)},
+			},
+		},
+	}
+
 	app := &application.EnvironmentAppMock{
-		StoreAirQualityObservedFunc: func(entityId, deviceId string, co2, humidity, temperature float64, timestamp time.Time) error {
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+		UpdateObservationFunc: func(kind *database.ObservationKind, entityId string, update application.ObservationUpdate) error {
 			return nil
 		},
-		RetrieveAirQualityObservedsFunc: func(deviceId string, from, to time.Time, limit uint64) ([]models.AirQualityObserved, error) {
-			return []models.AirQualityObserved{
-				{
-					EntityId:    "entityId",
-					DeviceId:    "deviceId",
-					CO2:         20.0,
-					Humidity:    30.0,
-					Temperature: 40.0,
-					Timestamp:   time.Now().UTC(),
-				},
-			}, nil
+		RetrieveObservationFunc: func(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+			if len(observations[kind]) == 0 {
+				return nil, application.ErrNotFound
+			}
+			return observations[kind][0], nil
+		},
+		RetrieveObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+			return observations[kind], nil
 		},
 	}
 
@@ -66,6 +708,41 @@ func testSetup(t *testing.T) (*is.I, *application.EnvironmentAppMock, ngsi.Conte
 	return is, app, ctxReg
 }
 
+//query holds the arguments of a call to RetrieveObservations
+type query struct {
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	Limit    uint64
+	Options  []database.QueryOption
+}
+
+//queriesOf returns the queries that were made for observations of a kind
+func queriesOf(app *application.EnvironmentAppMock, kind *database.ObservationKind) []query {
+	queries := []query{}
+	for _, call := range app.RetrieveObservationsCalls() {
+		if call.Kind == kind {
+			queries = append(queries, query{DeviceId: call.DeviceId, From: call.From, To: call.To, Limit: call.Limit, Options: call.Options})
+		}
+	}
+	return queries
+}
+
+//storedObservationsOf returns the observations of a kind that were stored one at a time
+func storedObservationsOf(app *application.EnvironmentAppMock, kind *database.ObservationKind) []database.Observation {
+	stored := []database.Observation{}
+	for _, call := range app.StoreObservationCalls() {
+		if call.Kind == kind {
+			stored = append(stored, call.Observation)
+		}
+	}
+	return stored
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
 const aqoJson string = `{
     "id": "urn:ngsi-ld:AirQualityObserved:Madrid-AmbientObserved-28079004-2016-03-15T11:00:00",
     "type": "AirQualityObserved",
@@ -98,3 +775,182 @@ const aqoJson string = `{
         "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
     ]
 }`
+
+const aqoWithoutLocationJson string = `{
+    "id": "urn:ngsi-ld:AirQualityObserved:Madrid-AmbientObserved-28079004-2016-03-15T11:00:00",
+    "type": "AirQualityObserved",
+    "dateObserved": {
+		"type": "Property",
+		"value": "2016-03-15T11:00:00Z"
+    },
+    "temperature": {
+        "type": "Property",
+        "value": 12.2
+    },
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const aqoWithPollutantsJson string = `{
+    "id": "urn:ngsi-ld:AirQualityObserved:Madrid-AmbientObserved-28079004-2016-03-15T11:00:00",
+    "type": "AirQualityObserved",
+    "dateObserved": {
+		"type": "Property",
+		"value": "2016-03-15T11:00:00Z"
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [-3.712247222222222, 40.423852777777775]
+        }
+    },
+    "PM10": {"type": "Property", "value": 19, "unitCode": "GQ"},
+    "PM2.5": {"type": "Property", "value": 9, "unitCode": "GQ"},
+    "NO2": {"type": "Property", "value": 22, "unitCode": "GQ"},
+    "O3": {"type": "Property", "value": 45, "unitCode": "GQ"},
+    "CO": {"type": "Property", "value": 0.4, "unitCode": "GP"},
+    "C6H6": {"type": "Property", "value": 1.2, "unitCode": "GQ"},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const aqoFragmentJson string = `{
+    "CO2": {
+        "type": "Property",
+        "value": 812,
+        "observedAt": "2022-03-21T08:15:00Z"
+    },
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const wqoJson string = `{
+    "id": "urn:ngsi-ld:WaterQualityObserved:wqo1",
+    "type": "WaterQualityObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:15:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {
+        "type": "Relationship",
+        "object": "urn:ngsi-ld:Device:dev1"
+    },
+    "temperature": {"type": "Property", "value": 8.5},
+    "pH": {"type": "Property", "value": 7.2},
+    "O2": {"type": "Property", "value": 10.4},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const nloJson string = `{
+    "id": "urn:ngsi-ld:NoiseLevelObserved:nlo1",
+    "type": "NoiseLevelObserved",
+    "dateObservedFrom": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:00:00Z"
+        }
+    },
+    "dateObservedTo": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:15:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {
+        "type": "Relationship",
+        "object": "urn:ngsi-ld:Device:dev1"
+    },
+    "LAeq": {"type": "Property", "value": 64.2},
+    "LAmax": {"type": "Property", "value": 81.5},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const woJson string = `{
+    "id": "urn:ngsi-ld:WeatherObserved:wo1",
+    "type": "WeatherObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:00:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "temperature": {"type": "Property", "value": -3.5},
+    "relativeHumidity": {"type": "Property", "value": 0.82},
+    "atmosphericPressure": {"type": "Property", "value": 1013.2},
+    "windSpeed": {"type": "Property", "value": 6.1},
+    "windDirection": {"type": "Property", "value": 225},
+    "precipitation": {"type": "Property", "value": 0.4},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
+
+const ieoJson string = `{
+    "id": "urn:ngsi-ld:IndoorEnvironmentObserved:room1",
+    "type": "IndoorEnvironmentObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T09:30:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {"type": "Relationship", "object": "urn:ngsi-ld:Device:dev1"},
+    "refPointOfInterest": {"type": "Relationship", "object": "urn:ngsi-ld:PointOfInterest:school1"},
+    "co2": {"type": "Property", "value": 1120},
+    "temperature": {"type": "Property", "value": 21.4},
+    "relativeHumidity": {"type": "Property", "value": 0.38},
+    "peopleCount": {"type": "Property", "value": 24},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
@@ -0,0 +1,351 @@
+package context
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//TemporalQuery contains the parameters of a query against the NGSI-LD temporal API
+type TemporalQuery struct {
+	EntityID   string
+	Device     string
+	From       time.Time
+	To         time.Time
+	LastN      uint64
+	Attributes []string
+	//Limit is the largest number of instances that are returned per entity. It defaults to
+	//ngsi.QueryDefaultPaginationLimit, and must not exceed MaxTemporalLimit.
+	Limit uint64
+	//EntityType is the type of the queried entities. It is derived from the EntityID if empty.
+	EntityType string
+	//PointOfInterest restricts the query to the indoor environment observations within a building,
+	//or any other point of interest
+	PointOfInterest string
+	//AggregationMethods requests aggregated values instead of the individual attribute instances
+	AggregationMethods []string
+	AggregationPeriod  database.AggregationPeriod
+}
+
+//MaxTemporalLimit is the largest number of instances per entity that a temporal query may request
+const MaxTemporalLimit uint64 = 10000
+
+//TemporalRange is the time interval of the instances that were returned by a temporal query that
+//matched more instances than its limit. Every instance within the range was returned, and the next
+//page of older instances is requested with timerel=before and timeAt set to From.
+type TemporalRange struct {
+	From time.Time
+	To   time.Time
+}
+
+//InstanceIDPrefix is the prefix of the instanceId of every attribute instance, followed by the
+//id of the stored observation that the instance is part of
+const InstanceIDPrefix string = "urn:ngsi-ld:instance:"
+
+//TemporalContextSource is implemented by context sources that can provide the temporal
+//evolution of their entities
+type TemporalContextSource interface {
+	ngsi.ContextSource
+	GetTemporalEntities(query TemporalQuery, callback ngsi.QueryEntitiesCallback) (*TemporalRange, error)
+}
+
+//temporalEntity is the temporal representation of an entity, where every attribute
+//is represented by an array of attribute instances
+type temporalEntity map[string]interface{}
+
+//attributes that are part of every entity and should not be represented as instances
+var nonTemporalAttributes = map[string]bool{
+	"id": true, "type": true, "@context": true, "dateObserved": true, "dateObservedFrom": true, "dateObservedTo": true,
+}
+
+//ErrUnsupportedTemporalQuery is returned when a temporal query is not supported for the queried entity type
+var ErrUnsupportedTemporalQuery = errors.New("unsupported temporal query")
+
+//GetTemporalEntities passes the temporal representation of the matching entities to the callback.
+//If any entity has more instances than the limit, the instances of every entity are restricted to
+//the range that was returned in full for all of them, and the range is returned.
+func (cs contextSource) GetTemporalEntities(query TemporalQuery, callback ngsi.QueryEntitiesCallback) (*TemporalRange, error) {
+	typeName := query.EntityType
+	if typeName == "" {
+		typeName = fiware.AirQualityObservedTypeName
+
+		if query.EntityID != "" {
+			if t, err := cs.GetProvidedTypeFromID(query.EntityID); err == nil {
+				typeName = t
+			}
+		}
+	}
+
+	t, ok := cs.types.Type(typeName)
+	if !ok {
+		return nil, fmt.Errorf("%w: entities of type %s are not provided", ErrUnsupportedTemporalQuery, typeName)
+	}
+
+	options := []database.QueryOption{}
+
+	if query.EntityID != "" {
+		options = append(options, database.WithEntityID(strings.TrimPrefix(query.EntityID, t.IDPrefix())))
+	}
+
+	if query.PointOfInterest != "" {
+		column, ok := t.AttributeColumns()["refPointOfInterest"]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s has no point of interest", ErrUnsupportedTemporalQuery, typeName)
+		}
+
+		options = append(options, database.WithFilter(database.Filter{
+			Attribute: "refPointOfInterest",
+			Column:    column,
+			Operator:  database.FilterEqual,
+			Values:    []interface{}{strings.TrimPrefix(query.PointOfInterest, fiware.PointOfInterestIDPrefix)},
+		}))
+	}
+
+	if len(query.AggregationMethods) > 0 {
+		return nil, cs.getAggregatedTemporalEntities(t, query, options, callback)
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = ngsi.QueryDefaultPaginationLimit
+	}
+
+	if limit > MaxTemporalLimit {
+		return nil, fmt.Errorf("%w: the limit must not exceed %d", ErrUnsupportedTemporalQuery, MaxTemporalLimit)
+	}
+
+	// One more observation than the limit is queried per entity, to tell if any entity was truncated
+	options = append(options, database.WithLimitPerEntity(limit+1))
+
+	observations, err := t.Repository(cs.app).Query(query.Device, query.From, query.To, 0, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	observations, truncated := limitObservations(observations, limit)
+
+	temporalEntities := []temporalEntity{}
+	entitiesByID := map[string]temporalEntity{}
+
+	// Observations are returned with the most recent first, so the entities will be
+	// ordered with the most recently observed entity first
+	for _, o := range observations {
+		if _, ok := entitiesByID[o.EntityId]; !ok {
+			entity := temporalEntity{
+				"id":       t.IDPrefix() + o.EntityId,
+				"type":     typeName,
+				"@context": entities.DefaultContext,
+			}
+			entitiesByID[o.EntityId] = entity
+			temporalEntities = append(temporalEntities, entity)
+		}
+	}
+
+	// ... while we iterate backwards to add the attribute instances in chronological order
+	for idx := len(observations) - 1; idx >= 0; idx-- {
+		o := observations[idx]
+
+		entity, _ := t.Encode(o.Value)
+
+		err = entitiesByID[o.EntityId].addInstances(entity, fmt.Sprintf("%s%d", InstanceIDPrefix, o.ID), o.ObservedAt, query.Attributes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entity := range temporalEntities {
+		entity.truncate(query.LastN)
+
+		err = callback(entity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return truncated, nil
+}
+
+//limitObservations keeps at most limit observations of every entity. The observations are ordered
+//with the most recent first. If any entity has more observations than the limit, the observations
+//of every entity are restricted to the range that all of them cover in full, which is returned.
+func limitObservations(observations []entities.Observation, limit uint64) ([]entities.Observation, *TemporalRange) {
+	counts := map[string]uint64{}
+	oldest := map[string]time.Time{}
+	var truncated *TemporalRange
+
+	for _, o := range observations {
+		counts[o.EntityId]++
+
+		if counts[o.EntityId] <= limit {
+			oldest[o.EntityId] = o.ObservedAt
+			continue
+		}
+
+		// The range starts with the oldest observation that was kept of a truncated entity
+		if truncated == nil {
+			truncated = &TemporalRange{From: oldest[o.EntityId], To: observations[0].ObservedAt}
+		} else if oldest[o.EntityId].After(truncated.From) {
+			truncated.From = oldest[o.EntityId]
+		}
+	}
+
+	if truncated == nil {
+		return observations, nil
+	}
+
+	kept := []entities.Observation{}
+	for _, o := range observations {
+		if !o.ObservedAt.Before(truncated.From) {
+			kept = append(kept, o)
+		}
+	}
+
+	return kept, truncated
+}
+
+//getAggregatedTemporalEntities returns the aggregated temporal representation of the matching
+//entities, where every requested aggregation method of an attribute holds an array of
+//[value, startAt, endAt] triples in chronological order
+func (cs contextSource) getAggregatedTemporalEntities(t entities.EntityType, query TemporalQuery, options []database.QueryOption, callback ngsi.QueryEntitiesCallback) error {
+	aggregator, ok := t.Repository(cs.app).(entities.Aggregator)
+	if !ok {
+		return fmt.Errorf("%w: aggregation is not supported for %s", ErrUnsupportedTemporalQuery, t.Name())
+	}
+
+	aggregates, err := aggregator.Aggregate(query.Device, query.From, query.To, query.AggregationPeriod, options...)
+	if err != nil {
+		return err
+	}
+
+	temporalEntities := []temporalEntity{}
+	entitiesByID := map[string]temporalEntity{}
+
+	for _, a := range aggregates {
+		entity, ok := entitiesByID[a.EntityId]
+		if !ok {
+			entity = temporalEntity{
+				"id":       t.IDPrefix() + a.EntityId,
+				"type":     t.Name(),
+				"@context": entities.DefaultContext,
+			}
+			entitiesByID[a.EntityId] = entity
+			temporalEntities = append(temporalEntities, entity)
+		}
+
+		entity.addAggregates(a, query.AggregationMethods, query.Attributes)
+	}
+
+	for _, entity := range temporalEntities {
+		entity.truncate(query.LastN)
+
+		err = callback(entity)
+		if err != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+//addAggregates appends the values of the requested aggregation methods for every observed attribute
+func (te temporalEntity) addAggregates(a entities.Aggregate, methods, attributes []string) {
+	startAt := a.PeriodStart.UTC().Format(time.RFC3339)
+	endAt := a.PeriodEnd.UTC().Format(time.RFC3339)
+
+	for name, count := range a.Values[entities.AggregationMethodTotalCount] {
+		if count == nil || *count == 0 || !isRequestedAttribute(name, attributes) {
+			continue
+		}
+
+		attribute, ok := te[name].(map[string]interface{})
+		if !ok {
+			attribute = map[string]interface{}{"type": "Property"}
+			te[name] = attribute
+		}
+
+		for _, method := range methods {
+			if value := a.Values[method][name]; value != nil {
+				aggregated, _ := attribute[method].([]interface{})
+				attribute[method] = append(aggregated, []interface{}{*value, startAt, endAt})
+			}
+		}
+	}
+}
+
+//addInstances appends the attributes of an entity as new attribute instances observed at a
+//certain time, optionally restricted to a set of attribute names
+func (te temporalEntity) addInstances(entity interface{}, instanceID string, observedAt time.Time, attributes []string) error {
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]json.RawMessage{}
+	err = json.Unmarshal(b, &properties)
+	if err != nil {
+		return err
+	}
+
+	for name, raw := range properties {
+		if nonTemporalAttributes[name] || !isRequestedAttribute(name, attributes) {
+			continue
+		}
+
+		instance := map[string]interface{}{}
+		err = json.Unmarshal(raw, &instance)
+		if err != nil {
+			return err
+		}
+		instance["observedAt"] = observedAt.UTC().Format(time.RFC3339)
+		instance["instanceId"] = instanceID
+
+		instances, _ := te[name].([]interface{})
+		te[name] = append(instances, instance)
+	}
+
+	return nil
+}
+
+//truncate keeps only the lastN most recent instances, or aggregated values, of every attribute
+func (te temporalEntity) truncate(lastN uint64) {
+	if lastN == 0 {
+		return
+	}
+
+	truncate := func(values map[string]interface{}) {
+		for name, value := range values {
+			if instances, ok := value.([]interface{}); ok && uint64(len(instances)) > lastN {
+				values[name] = instances[uint64(len(instances))-lastN:]
+			}
+		}
+	}
+
+	truncate(te)
+
+	for _, value := range te {
+		if aggregated, ok := value.(map[string]interface{}); ok {
+			truncate(aggregated)
+		}
+	}
+}
+
+func isRequestedAttribute(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+
+	for _, attr := range attributes {
+		if attr == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,537 @@
+package airqualityobserved
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	TypeName string = fiware.AirQualityObservedTypeName
+	IDPrefix string = fiware.AirQualityObservedIDPrefix
+)
+
+const (
+	unitCodeMicrogramPerCubicMetre string = "GQ"
+	unitCodeMilligramPerCubicMetre string = "GP"
+)
+
+//airQualityObserved extends the fiware AirQualityObserved with the pollutants that are defined
+//by the smart data model, but are not (yet) supported by the ngsi-ld library
+type airQualityObserved struct {
+	fiware.AirQualityObserved
+	pollutants
+
+	AirQualityIndex *types.NumberProperty `json:"airQualityIndex,omitempty"`
+	AirQualityLevel *types.TextProperty   `json:"airQualityLevel,omitempty"`
+}
+
+type pollutants struct {
+	PM10    *types.NumberProperty `json:"PM10,omitempty"`
+	PM25    *types.NumberProperty `json:"PM2.5,omitempty"`
+	PM1     *types.NumberProperty `json:"PM1,omitempty"`
+	NO2     *types.NumberProperty `json:"NO2,omitempty"`
+	NO      *types.NumberProperty `json:"NO,omitempty"`
+	O3      *types.NumberProperty `json:"O3,omitempty"`
+	SO2     *types.NumberProperty `json:"SO2,omitempty"`
+	CO      *types.NumberProperty `json:"CO,omitempty"`
+	Benzene *types.NumberProperty `json:"C6H6,omitempty"`
+	VOC     *types.NumberProperty `json:"volatileOrganicCompoundsTotal,omitempty"`
+}
+
+//properties returns the pollutant properties keyed on their attribute names
+func (p pollutants) properties() map[string]*types.NumberProperty {
+	return map[string]*types.NumberProperty{
+		"PM10":                          p.PM10,
+		"PM2.5":                         p.PM25,
+		"PM1":                           p.PM1,
+		"NO2":                           p.NO2,
+		"NO":                            p.NO,
+		"O3":                            p.O3,
+		"SO2":                           p.SO2,
+		"CO":                            p.CO,
+		"C6H6":                          p.Benzene,
+		"volatileOrganicCompoundsTotal": p.VOC,
+	}
+}
+
+//newAirQualityObserved converts a stored observation into an NGSI-LD entity, leaving out
+//any attributes that were not part of the observation
+func newAirQualityObserved(a *models.AirQualityObserved) *airQualityObserved {
+	aqo := &airQualityObserved{
+		AirQualityObserved: *fiware.NewAirQualityObserved(a.EntityId, a.Latitude, a.Longitude, a.Timestamp.Format(time.RFC3339)),
+	}
+
+	if a.DeviceId != "" {
+		aqo.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + a.DeviceId)
+	}
+
+	if a.CO2 != nil {
+		aqo.AirQualityObserved = *aqo.AirQualityObserved.WithCO2(*a.CO2)
+	}
+
+	if a.Humidity != nil {
+		aqo.AirQualityObserved = *aqo.AirQualityObserved.WithRelativeHumidity(*a.Humidity)
+	}
+
+	if a.Temperature != nil {
+		aqo.AirQualityObserved = *aqo.AirQualityObserved.WithTemperature(*a.Temperature)
+	}
+
+	optionals := []struct {
+		value *float64
+		with  func(airQualityObserved, float64) *airQualityObserved
+	}{
+		{a.PM10, airQualityObserved.WithPM10},
+		{a.PM25, airQualityObserved.WithPM25},
+		{a.PM1, airQualityObserved.WithPM1},
+		{a.NO2, airQualityObserved.WithNO2},
+		{a.NO, airQualityObserved.WithNO},
+		{a.O3, airQualityObserved.WithO3},
+		{a.SO2, airQualityObserved.WithSO2},
+		{a.CO, airQualityObserved.WithCO},
+		{a.Benzene, airQualityObserved.WithBenzene},
+		{a.VOC, airQualityObserved.WithVOC},
+	}
+
+	for _, o := range optionals {
+		if o.value != nil {
+			aqo = o.with(*aqo, *o.value)
+		}
+	}
+
+	if a.AirQualityIndex != nil {
+		aqo.AirQualityIndex = types.NewNumberProperty(*a.AirQualityIndex)
+		aqo.AirQualityLevel = types.NewTextProperty(a.AirQualityLevel)
+	}
+
+	return aqo
+}
+
+//observation converts a created entity into an observation that can be stored
+func (aqo airQualityObserved) observation() (*models.AirQualityObserved, error) {
+	dateObserved, err := time.Parse(time.RFC3339, aqo.DateObserved.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	latitude, longitude, err := entities.PositionFromLocation(aqo.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	refDevice := ""
+	if aqo.RefDevice != nil {
+		refDevice = strings.TrimPrefix(aqo.RefDevice.Object, fiware.DeviceIDPrefix)
+	}
+
+	return &models.AirQualityObserved{
+		EntityId:               strings.TrimPrefix(aqo.ID, IDPrefix),
+		DeviceId:               refDevice,
+		Latitude:               latitude,
+		Longitude:              longitude,
+		Timestamp:              dateObserved,
+		AirQualityMeasurements: aqo.measurements(),
+	}, nil
+}
+
+//measurements extracts the observed values from the entity. Attributes that are
+//missing from the entity are returned as nil.
+func (aqo airQualityObserved) measurements() models.AirQualityMeasurements {
+	return models.AirQualityMeasurements{
+		CO2:         entities.NumberValue(aqo.CO2),
+		Humidity:    entities.NumberValue(aqo.RelativeHumidity),
+		Temperature: entities.NumberValue(aqo.Temperature),
+		PM10:        entities.NumberValue(aqo.PM10),
+		PM25:        entities.NumberValue(aqo.PM25),
+		PM1:         entities.NumberValue(aqo.PM1),
+		NO2:         entities.NumberValue(aqo.NO2),
+		NO:          entities.NumberValue(aqo.NO),
+		O3:          entities.NumberValue(aqo.O3),
+		SO2:         entities.NumberValue(aqo.SO2),
+		CO:          entities.NumberValue(aqo.CO),
+		Benzene:     entities.NumberValue(aqo.Benzene),
+		VOC:         entities.NumberValue(aqo.VOC),
+	}
+}
+
+//attributeColumns maps the attributes that can be used in queries to their stored columns
+var attributeColumns = map[string]string{
+	"refDevice":                     "device_id",
+	"CO2":                           "co2",
+	"relativeHumidity":              "humidity",
+	"temperature":                   "temperature",
+	"PM10":                          "pm10",
+	"PM2.5":                         "pm25",
+	"PM1":                           "pm1",
+	"NO2":                           "no2",
+	"NO":                            "no",
+	"O3":                            "o3",
+	"SO2":                           "so2",
+	"CO":                            "co",
+	"C6H6":                          "benzene",
+	"volatileOrganicCompoundsTotal": "voc",
+}
+
+func (aqo *airQualityObserved) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, &aqo.AirQualityObserved)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &aqo.pollutants)
+}
+
+func (aqo airQualityObserved) ToGeoJSONFeature(propertyName string, simplified bool) (geojson.GeoJSONFeature, error) {
+	g, err := aqo.AirQualityObserved.ToGeoJSONFeature(propertyName, simplified)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, p := range aqo.pollutants.properties() {
+		if p == nil {
+			continue
+		}
+
+		if simplified {
+			g.SetProperty(name, p.Value)
+		} else {
+			g.SetProperty(name, p)
+		}
+	}
+
+	if aqo.AirQualityIndex != nil {
+		if simplified {
+			g.SetProperty("airQualityIndex", aqo.AirQualityIndex.Value)
+			g.SetProperty("airQualityLevel", aqo.AirQualityLevel.Value)
+		} else {
+			g.SetProperty("airQualityIndex", aqo.AirQualityIndex)
+			g.SetProperty("airQualityLevel", aqo.AirQualityLevel)
+		}
+	}
+
+	return g, nil
+}
+
+func (aqo airQualityObserved) WithPM10(value float64) *airQualityObserved {
+	aqo.PM10 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithPM25(value float64) *airQualityObserved {
+	aqo.PM25 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithPM1(value float64) *airQualityObserved {
+	aqo.PM1 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithNO2(value float64) *airQualityObserved {
+	aqo.NO2 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithNO(value float64) *airQualityObserved {
+	aqo.NO = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithO3(value float64) *airQualityObserved {
+	aqo.O3 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithSO2(value float64) *airQualityObserved {
+	aqo.SO2 = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithCO(value float64) *airQualityObserved {
+	aqo.CO = types.NewNumberPropertyWithUnitCode(value, unitCodeMilligramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithBenzene(value float64) *airQualityObserved {
+	aqo.Benzene = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+func (aqo airQualityObserved) WithVOC(value float64) *airQualityObserved {
+	aqo.VOC = types.NewNumberPropertyWithUnitCode(value, unitCodeMicrogramPerCubicMetre)
+	return &aqo
+}
+
+//New returns the AirQualityObserved entity type, which is the only type that supports partial
+//updates and deletes of single attribute instances
+func New() entities.EntityType {
+	return entityType{}
+}
+
+func init() {
+	entities.Register(New())
+}
+
+type entityType struct{}
+
+func (entityType) Name() string {
+	return TypeName
+}
+
+func (entityType) IDPrefix() string {
+	return IDPrefix
+}
+
+func (entityType) AttributeColumns() map[string]string {
+	return attributeColumns
+}
+
+func (entityType) ProvidesAttribute(attributeName string) bool {
+	_, ok := attributeColumns[attributeName]
+	return ok || attributeName == "dateObserved" || attributeName == "airQualityIndex" || attributeName == "airQualityLevel"
+}
+
+func (entityType) Decode(body []byte) (ngsi.Entity, error) {
+	aqo := &airQualityObserved{}
+	err := json.Unmarshal(body, aqo)
+	return aqo, err
+}
+
+func (entityType) Validate(entity ngsi.Entity) error {
+	aqo := entity.(*airQualityObserved)
+
+	err := entities.ValidateID(aqo.ID, IDPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = aqo.observation()
+	return err
+}
+
+func (entityType) Repository(app application.EnvironmentApp) entities.Repository {
+	return repository{app: app}
+}
+
+func (entityType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	switch a := observation.(type) {
+	case *models.AirQualityObserved:
+		return newAirQualityObserved(a), true
+	case latestAirQualityObserved:
+		aqo := newAirQualityObserved(a.AirQualityObserved)
+		aqo.ID = IDPrefix + a.EntityId
+		return aqo, true
+	default:
+		return nil, false
+	}
+}
+
+//latestAirQualityObserved is the most recent observation of an entity. The ids of air quality
+//entities include the time of the observation when they are queried, but not when the latest
+//observation is retrieved.
+type latestAirQualityObserved struct {
+	*models.AirQualityObserved
+}
+
+type repository struct {
+	app application.EnvironmentApp
+}
+
+func (r repository) Store(entity ngsi.Entity) (database.StoreResult, error) {
+	o, err := entity.(*airQualityObserved).observation()
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	return r.app.StoreObservation(database.AirQualityObservedKind, o)
+}
+
+func (r repository) StoreBatch(batch []ngsi.Entity, upsert bool) ([]error, error) {
+	observations := []database.Observation{}
+	for _, entity := range batch {
+		o, err := entity.(*airQualityObserved).observation()
+		if err != nil {
+			return nil, err
+		}
+		observations = append(observations, o)
+	}
+
+	return entities.BatchErrors(r.app.StoreObservations(database.AirQualityObservedKind, observations, upsert))
+}
+
+func (r repository) Delete(entityIds []string, purge bool) ([]error, error) {
+	return r.app.DeleteObservations(database.AirQualityObservedKind, entityIds, purge)
+}
+
+func (r repository) DeleteAttributeInstance(entityId, attributeName string, instanceId uint, purge bool) error {
+	column, ok := attributeColumns[attributeName]
+	if !ok {
+		return fmt.Errorf("%w: %s is not an attribute with deletable instances", entities.ErrInvalidAttribute, attributeName)
+	}
+
+	return r.app.DeleteMeasurement(database.AirQualityObservedKind, entityId, instanceId, column, purge)
+}
+
+//UpdateAttributes appends a new observation to an entity. Attributes that are missing from the
+//request fragment are carried over from the latest known state of the entity.
+func (r repository) UpdateAttributes(entityId string, req ngsi.Request) error {
+	fragment := &airQualityObserved{}
+	err := req.DecodeBodyInto(fragment)
+	if err != nil {
+		return entities.InvalidEntity(err)
+	}
+
+	timestamp, err := getObservationTime(fragment, req)
+	if err != nil {
+		return entities.InvalidEntity(err)
+	}
+
+	var deviceId *string
+	if fragment.RefDevice != nil {
+		d := strings.TrimPrefix(fragment.RefDevice.Object, fiware.DeviceIDPrefix)
+		deviceId = &d
+	}
+
+	var latitude, longitude *float64
+	if fragment.Location.Value != nil {
+		lat, lon, err := entities.PositionFromLocation(fragment.Location)
+		if err != nil {
+			return entities.InvalidEntity(err)
+		}
+		latitude, longitude = &lat, &lon
+	}
+
+	return r.app.UpdateObservation(database.AirQualityObservedKind, entityId, func(o database.Observation) (database.Observation, error) {
+		latest := o.(*models.AirQualityObserved)
+
+		update := &models.AirQualityObserved{
+			EntityId:               entityId,
+			DeviceId:               latest.DeviceId,
+			Latitude:               latest.Latitude,
+			Longitude:              latest.Longitude,
+			Timestamp:              timestamp,
+			AirQualityMeasurements: mergeMeasurements(latest.AirQualityMeasurements, fragment.measurements()),
+		}
+
+		if deviceId != nil {
+			update.DeviceId = *deviceId
+		}
+
+		if latitude != nil && longitude != nil {
+			update.Latitude, update.Longitude = *latitude, *longitude
+		}
+
+		return update, nil
+	})
+}
+
+//mergeMeasurements returns the current measurements, overwritten by any non nil values in update
+func mergeMeasurements(current, update models.AirQualityMeasurements) models.AirQualityMeasurements {
+	merge := func(c, u *float64) *float64 {
+		if u != nil {
+			return u
+		}
+		return c
+	}
+
+	return models.AirQualityMeasurements{
+		CO2:         merge(current.CO2, update.CO2),
+		Humidity:    merge(current.Humidity, update.Humidity),
+		Temperature: merge(current.Temperature, update.Temperature),
+		PM10:        merge(current.PM10, update.PM10),
+		PM25:        merge(current.PM25, update.PM25),
+		PM1:         merge(current.PM1, update.PM1),
+		NO2:         merge(current.NO2, update.NO2),
+		NO:          merge(current.NO, update.NO),
+		O3:          merge(current.O3, update.O3),
+		SO2:         merge(current.SO2, update.SO2),
+		CO:          merge(current.CO, update.CO),
+		Benzene:     merge(current.Benzene, update.Benzene),
+		VOC:         merge(current.VOC, update.VOC),
+	}
+}
+
+func (r repository) Retrieve(entityId string) (interface{}, error) {
+	aqo, err := r.app.RetrieveObservation(database.AirQualityObservedKind, entityId)
+	if err != nil {
+		return nil, err
+	}
+
+	return latestAirQualityObserved{aqo.(*models.AirQualityObserved)}, nil
+}
+
+func (r repository) Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]entities.Observation, error) {
+	aqos, err := r.app.RetrieveObservations(database.AirQualityObservedKind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	observations := []entities.Observation{}
+	for _, o := range aqos {
+		a := o.(*models.AirQualityObserved)
+		observations = append(observations, entities.Observation{ID: a.ID, EntityId: a.EntityId, ObservedAt: a.Timestamp, Value: a})
+	}
+
+	return observations, nil
+}
+
+func (r repository) Aggregate(deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]entities.Aggregate, error) {
+	aggregates, err := r.app.RetrieveAggregatedObservations(database.AirQualityObservedKind, deviceId, from, to, period, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return entities.AggregatesByAttribute(aggregates, attributeColumns), nil
+}
+
+//getObservationTime returns the dateObserved of an entity fragment if present, or the most recent
+//observedAt of its attributes. The current time is used if neither is available.
+func getObservationTime(fragment *airQualityObserved, req ngsi.Request) (time.Time, error) {
+	if fragment.DateObserved.Value != "" {
+		return time.Parse(time.RFC3339, fragment.DateObserved.Value)
+	}
+
+	attributes := map[string]json.RawMessage{}
+	err := req.DecodeBodyInto(&attributes)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	observedAt := time.Time{}
+
+	for _, attr := range attributes {
+		property := struct {
+			ObservedAt string `json:"observedAt"`
+		}{}
+
+		if json.Unmarshal(attr, &property) != nil || property.ObservedAt == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, property.ObservedAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse observedAt: %s", err.Error())
+		}
+
+		if t.After(observedAt) {
+			observedAt = t
+		}
+	}
+
+	if observedAt.IsZero() {
+		observedAt = time.Now().UTC()
+	}
+
+	return observedAt, nil
+}
@@ -0,0 +1,144 @@
+package airqualityobserved
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/matryer/is"
+)
+
+func TestStoreAirQualityObserved(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+	}
+
+	aqot := New()
+	entity, err := aqot.Decode([]byte(aqoJson))
+	is.NoErr(err)
+	is.NoErr(aqot.Validate(entity))
+
+	_, err = aqot.Repository(app).Store(entity)
+	is.NoErr(err)
+
+	is.Equal(len(app.StoreObservationCalls()), 1)
+	call := app.StoreObservationCalls()[0]
+	is.Equal(call.Kind, database.AirQualityObservedKind)
+
+	aqo := call.Observation.(*models.AirQualityObserved)
+	is.Equal(aqo.EntityId, "aqo1")
+	is.Equal(aqo.DeviceId, "dev1")
+	is.Equal(*aqo.CO2, 812.0)
+	is.Equal(*aqo.PM25, 7.5)
+	is.Equal(aqo.Temperature, nil) // temperature was not observed
+}
+
+func TestValidateAirQualityObservedWithTheWrongIDPrefix(t *testing.T) {
+	is := is.New(t)
+
+	aqot := New()
+	entity, err := aqot.Decode([]byte(strings.Replace(aqoJson, IDPrefix, "urn:ngsi-ld:WeatherObserved:", 1)))
+	is.NoErr(err)
+
+	err = aqot.Validate(entity)
+	is.True(errors.Is(err, entities.ErrInvalidEntity))
+}
+
+func TestThatRetrievedAirQualityObservedsAreEncodedWithTheEntityID(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		RetrieveObservationFunc: func(kind *database.ObservationKind, entityId string) (database.Observation, error) {
+			return &models.AirQualityObserved{EntityId: entityId, Timestamp: time.Date(2022, 3, 21, 8, 15, 0, 0, time.UTC)}, nil
+		},
+	}
+
+	latest, err := New().Repository(app).Retrieve("aqo1")
+	is.NoErr(err)
+	is.Equal(app.RetrieveObservationCalls()[0].Kind, database.AirQualityObservedKind)
+
+	entity, ok := New().Encode(latest)
+	is.True(ok)
+
+	b, _ := json.Marshal(entity)
+	aqo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &aqo))
+	is.Equal(aqo["id"], "urn:ngsi-ld:AirQualityObserved:aqo1")
+
+	_, ok = New().Encode(models.AirQualityObserved{})
+	is.True(!ok) // only pointers to stored observations should be encoded
+}
+
+func TestAggregateAirQualityObserveds(t *testing.T) {
+	is := is.New(t)
+	average, count := 7.5, 4.0
+	app := &application.EnvironmentAppMock{
+		RetrieveAggregatedObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+			return []database.ObservationAggregate{
+				{
+					EntityId:   "aqo1",
+					Average:    map[string]*float64{"pm25": &average},
+					TotalCount: map[string]*float64{"pm25": &count},
+				},
+			}, nil
+		},
+	}
+
+	aggregator, ok := New().Repository(app).(entities.Aggregator)
+	is.True(ok) // air quality observations should support aggregation
+
+	aggregates, err := aggregator.Aggregate("", time.Time{}, time.Time{}, database.AggregationPeriodHour)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 1)
+	is.Equal(*aggregates[0].Values[entities.AggregationMethodAverage]["PM2.5"], 7.5) // columns should be mapped to attributes
+	is.Equal(*aggregates[0].Values[entities.AggregationMethodTotalCount]["PM2.5"], 4.0)
+	is.True(aggregates[0].Values[entities.AggregationMethodAverage]["CO2"] == nil)
+}
+
+func TestMergeMeasurementsKeepsTheMeasurementsThatWereNotUpdated(t *testing.T) {
+	is := is.New(t)
+
+	co2, temperature, updatedCO2 := 640.0, 21.0, 812.0
+	merged := mergeMeasurements(
+		models.AirQualityMeasurements{CO2: &co2, Temperature: &temperature},
+		models.AirQualityMeasurements{CO2: &updatedCO2},
+	)
+
+	is.Equal(*merged.CO2, 812.0)
+	is.Equal(*merged.Temperature, 21.0)
+	is.True(merged.PM10 == nil)
+}
+
+const aqoJson string = `{
+    "id": "urn:ngsi-ld:AirQualityObserved:aqo1",
+    "type": "AirQualityObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": "2022-03-21T08:15:00Z"
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {
+        "type": "Relationship",
+        "object": "urn:ngsi-ld:Device:dev1"
+    },
+    "CO2": {"type": "Property", "value": 812},
+    "PM2.5": {"type": "Property", "value": 7.5},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
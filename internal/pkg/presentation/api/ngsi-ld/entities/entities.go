@@ -0,0 +1,224 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//DefaultContext is the @context of the entities of every provided type
+var DefaultContext = []string{
+	"https://schema.lab.fiware.org/ld/context",
+	"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+}
+
+//EntityType is implemented by every entity type that is provided by the context source. A created
+//entity is decoded, validated and then stored in the repository of its type, while stored
+//observations are encoded into entities when they are queried or sent to subscribers.
+type EntityType interface {
+	//Name is the NGSI-LD type name, and every entity id of the type starts with IDPrefix
+	Name() string
+	IDPrefix() string
+
+	//AttributeColumns maps the attributes that can be used in queries to their stored columns,
+	//while ProvidesAttribute returns true for every attribute that an entity of the type may have
+	AttributeColumns() map[string]string
+	ProvidesAttribute(attributeName string) bool
+
+	//Decode decodes the body of a create request into an entity of the type, which is checked by
+	//Validate before it is stored. Validate, and Store of the repository, are only ever passed
+	//entities that have been returned by Decode of the same type.
+	Decode(body []byte) (ngsi.Entity, error)
+	Validate(entity ngsi.Entity) error
+	Repository(app application.EnvironmentApp) Repository
+
+	//Encode converts a stored observation into an entity, and returns false if the observation
+	//is not one of this type
+	Encode(observation interface{}) (ngsi.Entity, bool)
+}
+
+//Repository stores and retrieves the observations of an entity type. Entity ids are passed
+//without the id prefix of the type.
+type Repository interface {
+	//Store stores a decoded and validated entity as a new observation
+	Store(entity ngsi.Entity) (database.StoreResult, error)
+	//StoreBatch stores a batch of decoded and validated entities in a single transaction and
+	//returns an error, or nil, for each of them. Duplicates overwrite the existing observations
+	//if upsert is set.
+	StoreBatch(entities []ngsi.Entity, upsert bool) ([]error, error)
+	//Delete deletes all observations of a set of entities and returns an error, or nil, for each
+	//of them. The observations are removed from the database if purge is set.
+	Delete(entityIds []string, purge bool) ([]error, error)
+	//DeleteAttributeInstance deletes a single instance of an attribute, as identified by the id
+	//of the observation that it is part of. It returns ErrInvalidAttribute if instances of the
+	//attribute can not be deleted on their own.
+	DeleteAttributeInstance(entityId, attributeName string, instanceId uint, purge bool) error
+	//UpdateAttributes appends a new observation to an entity, based on the attributes in the
+	//request fragment and the latest known state of the entity
+	UpdateAttributes(entityId string, req ngsi.Request) error
+	//Retrieve returns the most recent observation of an entity
+	Retrieve(entityId string) (interface{}, error)
+	//Query returns the observations, optionally of a single device, that were made within a time
+	//span and match the options, the most recent first
+	Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]Observation, error)
+}
+
+//Aggregator is implemented by the repositories of the entity types that support aggregated
+//temporal queries
+type Aggregator interface {
+	//Aggregate returns the aggregated measurements of the matching observations, ordered by
+	//entity and then chronologically
+	Aggregate(deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]Aggregate, error)
+}
+
+//Observation is a stored observation of any entity type. ObservedAt is the time that the
+//attributes of the observation are observed at in the temporal representation of the entity.
+type Observation struct {
+	ID         uint
+	EntityId   string
+	ObservedAt time.Time
+	Value      interface{}
+}
+
+//The aggregation methods that are supported by aggregated temporal queries
+const (
+	AggregationMethodAverage    string = "avg"
+	AggregationMethodMinimum    string = "min"
+	AggregationMethodMaximum    string = "max"
+	AggregationMethodSum        string = "sum"
+	AggregationMethodTotalCount string = "totalCount"
+)
+
+//Aggregate holds the aggregated values of the attributes of an entity during a period, keyed
+//on aggregation method (avg, min, max, sum or totalCount) and then on attribute name
+type Aggregate struct {
+	EntityId    string
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Values      map[string]map[string]*float64
+}
+
+//AggregatesByAttribute converts the aggregates of stored observations, which are keyed on column,
+//into aggregates that are keyed on the attribute names in attributeColumns
+func AggregatesByAttribute(aggregates []database.ObservationAggregate, attributeColumns map[string]string) []Aggregate {
+	byAttribute := func(values map[string]*float64) map[string]*float64 {
+		attributes := map[string]*float64{}
+		for attributeName, column := range attributeColumns {
+			if value, ok := values[column]; ok {
+				attributes[attributeName] = value
+			}
+		}
+		return attributes
+	}
+
+	result := []Aggregate{}
+	for _, a := range aggregates {
+		result = append(result, Aggregate{
+			EntityId:    a.EntityId,
+			PeriodStart: a.PeriodStart,
+			PeriodEnd:   a.PeriodEnd,
+			Values: map[string]map[string]*float64{
+				AggregationMethodAverage:    byAttribute(a.Average),
+				AggregationMethodMinimum:    byAttribute(a.Minimum),
+				AggregationMethodMaximum:    byAttribute(a.Maximum),
+				AggregationMethodSum:        byAttribute(a.Sum),
+				AggregationMethodTotalCount: byAttribute(a.TotalCount),
+			},
+		})
+	}
+
+	return result
+}
+
+//ErrInvalidEntity is returned when a created entity can not be stored as an observation of its type
+var ErrInvalidEntity = errors.New("invalid entity")
+
+//InvalidEntity wraps an error that is caused by the content of a request in ErrInvalidEntity,
+//unless it already is one, so that it can be told apart from failures to store the entity
+func InvalidEntity(err error) error {
+	if err == nil || errors.Is(err, ErrInvalidEntity) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrInvalidEntity, err.Error())
+}
+
+//ErrInvalidAttribute is returned when an operation refers to an attribute that does not support it
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+//BatchErrors returns the error, or nil, of every observation in the results of a batch store
+func BatchErrors(results []database.BatchStoreResult, err error) ([]error, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(results))
+	for idx, result := range results {
+		errs[idx] = result.Err
+	}
+
+	return errs, nil
+}
+
+//WholeObservations is embedded in the repositories of entity types whose observations can only
+//be stored and deleted as a whole. Partial updates and deletes of attribute instances are
+//rejected as invalid requests.
+type WholeObservations struct {
+	TypeName string
+}
+
+func (w WholeObservations) DeleteAttributeInstance(entityId, attributeName string, instanceId uint, purge bool) error {
+	return fmt.Errorf("%w: instances of %s can not be deleted from %s entities", ErrInvalidAttribute, attributeName, w.TypeName)
+}
+
+func (w WholeObservations) UpdateAttributes(entityId string, req ngsi.Request) error {
+	return fmt.Errorf("%w: attributes of %s entities can not be updated", ErrInvalidEntity, w.TypeName)
+}
+
+//ValidateID makes sure that the id of an entity has the prefix of its type, followed by an id
+func ValidateID(entityID, prefix string) error {
+	if !strings.HasPrefix(entityID, prefix) || len(entityID) == len(prefix) {
+		return fmt.Errorf("%w: the id %s does not start with %s", ErrInvalidEntity, entityID, prefix)
+	}
+
+	return nil
+}
+
+//PositionFromLocation extracts latitude and longitude from a location that is expected to be a Point
+func PositionFromLocation(location geojson.GeoJSONProperty) (float64, float64, error) {
+	if location.Value == nil {
+		return 0, 0, errors.New("location is missing or could not be parsed")
+	}
+
+	if location.GeoPropertyType() != "Point" {
+		return 0, 0, fmt.Errorf("location must be a Point, not a %s", location.GeoPropertyType())
+	}
+
+	point := location.GetAsPoint()
+
+	return point.Latitude(), point.Longitude(), nil
+}
+
+//NumberProperty returns a property holding a measured value, or nil if it was not measured
+func NumberProperty(value *float64) *types.NumberProperty {
+	if value == nil {
+		return nil
+	}
+	return types.NewNumberProperty(*value)
+}
+
+//NumberValue returns the value of a property, or nil if the property is missing
+func NumberValue(p *types.NumberProperty) *float64 {
+	if p == nil {
+		return nil
+	}
+	v := p.Value
+	return &v
+}
@@ -0,0 +1,273 @@
+package indoorenvironmentobserved
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	IDPrefix string = "urn:ngsi-ld:IndoorEnvironmentObserved:"
+	TypeName string = "IndoorEnvironmentObserved"
+)
+
+//indoorEnvironmentObserved is an NGSI-LD IndoorEnvironmentObserved, as defined by the FIWARE smart
+//data model, where refPointOfInterest refers to the building, floor or room of the observation
+type indoorEnvironmentObserved struct {
+	types.BaseEntity
+	DateObserved        types.DateTimeProperty          `json:"dateObserved"`
+	Location            geojson.GeoJSONProperty         `json:"location"`
+	RefDevice           *types.SingleObjectRelationship `json:"refDevice,omitempty"`
+	RefPointOfInterest  *types.SingleObjectRelationship `json:"refPointOfInterest,omitempty"`
+	CO2                 *types.NumberProperty           `json:"co2,omitempty"`
+	Temperature         *types.NumberProperty           `json:"temperature,omitempty"`
+	RelativeHumidity    *types.NumberProperty           `json:"relativeHumidity,omitempty"`
+	Illuminance         *types.NumberProperty           `json:"illuminance,omitempty"`
+	AtmosphericPressure *types.NumberProperty           `json:"atmosphericPressure,omitempty"`
+	PeopleCount         *types.NumberProperty           `json:"peopleCount,omitempty"`
+}
+
+//indoorEnvironmentObservedFields is declared as a type of its own, so that the DTO does not
+//inherit the UnmarshalJSON method of indoorEnvironmentObserved
+type indoorEnvironmentObservedFields indoorEnvironmentObserved
+
+type indoorEnvironmentObservedDTO struct {
+	indoorEnvironmentObservedFields
+	Location json.RawMessage `json:"location"`
+}
+
+//attributeColumns maps the attributes that can be used in queries to their stored columns
+var attributeColumns = map[string]string{
+	"refDevice":           "device_id",
+	"refPointOfInterest":  "point_of_interest_id",
+	"co2":                 "co2",
+	"temperature":         "temperature",
+	"relativeHumidity":    "humidity",
+	"illuminance":         "illuminance",
+	"atmosphericPressure": "pressure",
+	"peopleCount":         "people_count",
+}
+
+//New returns the IndoorEnvironmentObserved entity type
+func New() entities.EntityType {
+	return entityType{}
+}
+
+//go:embed migrations
+var migrations embed.FS
+
+func init() {
+	database.RegisterMigrations(migrations)
+	database.RegisterObservationKind(Kind)
+	entities.Register(New())
+}
+
+type entityType struct{}
+
+func (entityType) Name() string {
+	return TypeName
+}
+
+func (entityType) IDPrefix() string {
+	return IDPrefix
+}
+
+func (entityType) AttributeColumns() map[string]string {
+	return attributeColumns
+}
+
+func (entityType) ProvidesAttribute(attributeName string) bool {
+	_, ok := attributeColumns[attributeName]
+	return ok || attributeName == "dateObserved"
+}
+
+func (entityType) Decode(body []byte) (ngsi.Entity, error) {
+	ieo := &indoorEnvironmentObserved{}
+	err := json.Unmarshal(body, ieo)
+	return ieo, err
+}
+
+func (entityType) Validate(entity ngsi.Entity) error {
+	ieo := entity.(*indoorEnvironmentObserved)
+
+	err := entities.ValidateID(ieo.ID, IDPrefix)
+	if err != nil {
+		return err
+	}
+
+	o, err := ieo.observation()
+	if err != nil {
+		return err
+	}
+
+	return entities.InvalidEntity(o.validate())
+}
+
+func (entityType) Repository(app application.EnvironmentApp) entities.Repository {
+	return repository{app: app, WholeObservations: entities.WholeObservations{TypeName: TypeName}}
+}
+
+func (entityType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	i, ok := observation.(*Observation)
+	if !ok {
+		return nil, false
+	}
+
+	return newIndoorEnvironmentObserved(i), true
+}
+
+type repository struct {
+	app application.EnvironmentApp
+	entities.WholeObservations
+}
+
+func (r repository) Store(entity ngsi.Entity) (database.StoreResult, error) {
+	o, err := entity.(*indoorEnvironmentObserved).observation()
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	return r.app.StoreObservation(Kind, o)
+}
+
+func (r repository) StoreBatch(batch []ngsi.Entity, upsert bool) ([]error, error) {
+	observations := []database.Observation{}
+	for _, entity := range batch {
+		o, err := entity.(*indoorEnvironmentObserved).observation()
+		if err != nil {
+			return nil, err
+		}
+		observations = append(observations, o)
+	}
+
+	return entities.BatchErrors(r.app.StoreObservations(Kind, observations, upsert))
+}
+
+func (r repository) Delete(entityIds []string, purge bool) ([]error, error) {
+	return r.app.DeleteObservations(Kind, entityIds, purge)
+}
+
+func (r repository) Retrieve(entityId string) (interface{}, error) {
+	return r.app.RetrieveObservation(Kind, entityId)
+}
+
+func (r repository) Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]entities.Observation, error) {
+	ieos, err := r.app.RetrieveObservations(Kind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	observations := []entities.Observation{}
+	for _, o := range ieos {
+		i := o.(*Observation)
+		observations = append(observations, entities.Observation{ID: i.ID, EntityId: i.EntityId, ObservedAt: i.Timestamp, Value: i})
+	}
+
+	return observations, nil
+}
+
+func (r repository) Aggregate(deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]entities.Aggregate, error) {
+	aggregates, err := r.app.RetrieveAggregatedObservations(Kind, deviceId, from, to, period, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return entities.AggregatesByAttribute(aggregates, attributeColumns), nil
+}
+
+//newIndoorEnvironmentObserved converts a stored observation into an NGSI-LD entity, leaving out
+//any attributes that were not part of the observation
+func newIndoorEnvironmentObserved(i *Observation) *indoorEnvironmentObserved {
+	ieo := &indoorEnvironmentObserved{
+		BaseEntity: types.BaseEntity{
+			ID:      IDPrefix + i.EntityId,
+			Type:    TypeName,
+			Context: entities.DefaultContext,
+		},
+		DateObserved: *types.CreateDateTimeProperty(i.Timestamp.UTC().Format(time.RFC3339)),
+		Location:     *geojson.CreateGeoJSONPropertyFromWGS84(i.Longitude, i.Latitude),
+	}
+
+	if i.DeviceId != "" {
+		ieo.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + i.DeviceId)
+	}
+
+	if i.PointOfInterestId != "" {
+		ieo.RefPointOfInterest = types.NewSingleObjectRelationship(fiware.PointOfInterestIDPrefix + i.PointOfInterestId)
+	}
+
+	ieo.CO2 = entities.NumberProperty(i.CO2)
+	ieo.Temperature = entities.NumberProperty(i.Temperature)
+	ieo.RelativeHumidity = entities.NumberProperty(i.Humidity)
+	ieo.Illuminance = entities.NumberProperty(i.Illuminance)
+	ieo.AtmosphericPressure = entities.NumberProperty(i.Pressure)
+	ieo.PeopleCount = entities.NumberProperty(i.PeopleCount)
+
+	return ieo
+}
+
+//observation converts a created entity into an observation that can be stored
+func (ieo indoorEnvironmentObserved) observation() (*Observation, error) {
+	dateObserved, err := time.Parse(time.RFC3339, ieo.DateObserved.Value.Value)
+	if err != nil {
+		return nil, errors.New("dateObserved is missing or could not be parsed")
+	}
+
+	latitude, longitude, err := entities.PositionFromLocation(ieo.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	refDevice := ""
+	if ieo.RefDevice != nil {
+		refDevice = strings.TrimPrefix(ieo.RefDevice.Object, fiware.DeviceIDPrefix)
+	}
+
+	refPointOfInterest := ""
+	if ieo.RefPointOfInterest != nil {
+		refPointOfInterest = strings.TrimPrefix(ieo.RefPointOfInterest.Object, fiware.PointOfInterestIDPrefix)
+	}
+
+	return &Observation{
+		EntityId:          strings.TrimPrefix(ieo.ID, IDPrefix),
+		DeviceId:          refDevice,
+		PointOfInterestId: refPointOfInterest,
+		Latitude:          latitude,
+		Longitude:         longitude,
+		Timestamp:         dateObserved.UTC(),
+		Measurements: Measurements{
+			CO2:         entities.NumberValue(ieo.CO2),
+			Temperature: entities.NumberValue(ieo.Temperature),
+			Humidity:    entities.NumberValue(ieo.RelativeHumidity),
+			Illuminance: entities.NumberValue(ieo.Illuminance),
+			Pressure:    entities.NumberValue(ieo.AtmosphericPressure),
+			PeopleCount: entities.NumberValue(ieo.PeopleCount),
+		},
+	}, nil
+}
+
+func (ieo *indoorEnvironmentObserved) UnmarshalJSON(data []byte) error {
+	dto := &indoorEnvironmentObservedDTO{}
+	err := json.Unmarshal(data, dto)
+	if err != nil {
+		return err
+	}
+
+	*ieo = indoorEnvironmentObserved(dto.indoorEnvironmentObservedFields)
+
+	if len(dto.Location) > 0 {
+		ieo.Location = *geojson.CreateGeoJSONPropertyFromJSON(dto.Location)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package indoorenvironmentobserved
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog/log"
+)
+
+func TestStoreIndoorEnvironmentObserved(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+	}
+
+	ieot := New()
+	entity, err := ieot.Decode([]byte(ieoJson))
+	is.NoErr(err)
+	is.NoErr(ieot.Validate(entity))
+
+	_, err = ieot.Repository(app).Store(entity)
+	is.NoErr(err)
+
+	is.Equal(len(app.StoreObservationCalls()), 1)
+	call := app.StoreObservationCalls()[0]
+	is.Equal(call.Kind, Kind)
+
+	ieo := call.Observation.(*Observation)
+	is.Equal(ieo.EntityId, "room1")
+	is.Equal(ieo.PointOfInterestId, "school1")
+	is.Equal(*ieo.PeopleCount, 24.0)
+	is.Equal(ieo.Illuminance, nil) // illuminance was not observed
+}
+
+func TestValidateIndoorEnvironmentObservedWithImpossibleMeasurements(t *testing.T) {
+	is := is.New(t)
+
+	ieot := New()
+	for _, measurement := range []string{`"peopleCount": {"type": "Property", "value": 2.5}`, `"peopleCount": {"type": "Property", "value": 24}, "illuminance": {"type": "Property", "value": -1}`} {
+		entity, err := ieot.Decode([]byte(strings.Replace(ieoJson, `"peopleCount": {"type": "Property", "value": 24}`, measurement, 1)))
+		is.NoErr(err)
+
+		err = ieot.Validate(entity)
+		is.True(errors.Is(err, entities.ErrInvalidEntity))
+	}
+}
+
+func TestEncodeIndoorEnvironmentObservedInBuilding(t *testing.T) {
+	is := is.New(t)
+
+	co2 := 1120.0
+	entity, ok := New().Encode(&Observation{
+		EntityId:          "room1",
+		PointOfInterestId: "school1",
+		Timestamp:         time.Date(2022, 3, 21, 9, 30, 0, 0, time.UTC),
+		Measurements:      Measurements{CO2: &co2},
+	})
+	is.True(ok)
+
+	b, _ := json.Marshal(entity)
+	ieo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &ieo))
+	is.Equal(ieo["id"], "urn:ngsi-ld:IndoorEnvironmentObserved:room1")
+	is.Equal(ieo["refPointOfInterest"].(map[string]interface{})["object"], "urn:ngsi-ld:PointOfInterest:school1")
+	is.Equal(ieo["co2"].(map[string]interface{})["value"], 1120.0)
+}
+
+func TestAggregateIndoorEnvironmentObserveds(t *testing.T) {
+	is := is.New(t)
+	average, count := 21.4, 4.0
+	app := &application.EnvironmentAppMock{
+		RetrieveAggregatedObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, period database.AggregationPeriod, options ...database.QueryOption) ([]database.ObservationAggregate, error) {
+			return []database.ObservationAggregate{
+				{
+					EntityId:   "room1",
+					Average:    map[string]*float64{"temperature": &average},
+					TotalCount: map[string]*float64{"temperature": &count},
+				},
+			}, nil
+		},
+	}
+
+	aggregator, ok := New().Repository(app).(entities.Aggregator)
+	is.True(ok) // indoor environment observations should support aggregation
+
+	aggregates, err := aggregator.Aggregate("", time.Time{}, time.Time{}, database.AggregationPeriodHour)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 1)
+	is.Equal(*aggregates[0].Values[entities.AggregationMethodAverage]["temperature"], 21.4)
+	is.Equal(*aggregates[0].Values[entities.AggregationMethodTotalCount]["temperature"], 4.0)
+}
+
+func TestThatIndoorEnvironmentObservedsCanBeQueriedByBuilding(t *testing.T) {
+	is := is.New(t)
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(log.Logger))
+	is.NoErr(err)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	indoor := func(entityId, deviceId, pointOfInterestId string, co2, people float64, timestamp time.Time) *Observation {
+		return &Observation{
+			EntityId: entityId, DeviceId: deviceId, PointOfInterestId: pointOfInterestId, Latitude: 62.39, Longitude: 17.30, Timestamp: timestamp,
+			Measurements: Measurements{CO2: float64Ptr(co2), PeopleCount: float64Ptr(people)},
+		}
+	}
+
+	db.StoreObservation(Kind, indoor("room1", "dev1", "school1", 600, 20, observedAt), database.DuplicatesReject)
+	db.StoreObservation(Kind, indoor("room1", "dev1", "school1", 1000, 24, observedAt.Add(30*time.Minute)), database.DuplicatesReject)
+	db.StoreObservation(Kind, indoor("room2", "dev2", "school1", 450, 0, observedAt), database.DuplicatesReject)
+	db.StoreObservation(Kind, indoor("office1", "dev3", "townhall", 500, 3, observedAt), database.DuplicatesReject)
+
+	latest, err := db.GetObservation(Kind, "room1")
+	is.NoErr(err)
+	ieo := latest.(*Observation)
+	is.Equal(*ieo.CO2, 1000.0)
+	is.Equal(*ieo.PeopleCount, 24.0)
+	is.Equal(ieo.PointOfInterestId, "school1")
+
+	inSchool := database.WithFilter(database.Filter{Column: "point_of_interest_id", Operator: database.FilterEqual, Values: []interface{}{"school1"}})
+
+	ieos, err := db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, inSchool)
+	is.NoErr(err)
+	is.Equal(len(ieos), 3)
+
+	aggregates, err := db.GetAggregatedObservations(Kind, "", time.Time{}, time.Time{}, database.AggregationPeriodHour, inSchool)
+	is.NoErr(err)
+	is.Equal(len(aggregates), 2) // one hour of observations for each room in the school
+	is.Equal(aggregates[0].EntityId, "room1")
+	is.Equal(*aggregates[0].Average["co2"], 800.0)
+	is.Equal(*aggregates[0].Maximum["people_count"], 24.0)
+	is.Equal(*aggregates[0].TotalCount["co2"], 2.0)
+	is.True(aggregates[0].Average["temperature"] == nil)
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+const ieoJson string = `{
+    "id": "urn:ngsi-ld:IndoorEnvironmentObserved:room1",
+    "type": "IndoorEnvironmentObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T09:30:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {"type": "Relationship", "object": "urn:ngsi-ld:Device:dev1"},
+    "refPointOfInterest": {"type": "Relationship", "object": "urn:ngsi-ld:PointOfInterest:school1"},
+    "co2": {"type": "Property", "value": 1120},
+    "temperature": {"type": "Property", "value": 21.4},
+    "relativeHumidity": {"type": "Property", "value": 0.38},
+    "peopleCount": {"type": "Property", "value": 24},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
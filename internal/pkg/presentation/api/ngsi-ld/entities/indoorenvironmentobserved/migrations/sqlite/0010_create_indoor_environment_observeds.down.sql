@@ -0,0 +1 @@
+DROP TABLE IF EXISTS indoor_environment_observeds;
@@ -0,0 +1,26 @@
+-- Observations of the indoor environment of rooms and other places within buildings. The building,
+-- or other point of interest, of an observation is stored without its URN prefix. An entity can
+-- only have one observation per point in time.
+CREATE TABLE indoor_environment_observeds (
+    id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at           DATETIME,
+    updated_at           DATETIME,
+    deleted_at           DATETIME,
+    entity_id            TEXT NOT NULL,
+    device_id            TEXT NOT NULL DEFAULT '',
+    point_of_interest_id TEXT NOT NULL DEFAULT '',
+    latitude             REAL,
+    longitude            REAL,
+    "timestamp"          DATETIME NOT NULL,
+    co2                  REAL,
+    temperature          REAL,
+    humidity             REAL,
+    illuminance          REAL,
+    pressure             REAL,
+    people_count         INTEGER
+);
+
+CREATE INDEX idx_indoor_environment_observeds_deleted_at ON indoor_environment_observeds (deleted_at);
+CREATE INDEX idx_indoor_environment_observeds_device_timestamp ON indoor_environment_observeds (device_id, "timestamp" DESC);
+CREATE INDEX idx_indoor_environment_observeds_poi_timestamp ON indoor_environment_observeds (point_of_interest_id, "timestamp" DESC);
+CREATE UNIQUE INDEX idx_indoor_environment_observeds_entity_timestamp ON indoor_environment_observeds (entity_id, "timestamp");
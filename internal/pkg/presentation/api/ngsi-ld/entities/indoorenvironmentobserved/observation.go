@@ -0,0 +1,105 @@
+package indoorenvironmentobserved
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"gorm.io/gorm"
+)
+
+//Observation is a single observation of the indoor environment of a room, or any other place
+//within a building. PointOfInterestId refers to the building, floor or room that the observation
+//was made in. The schema of its table is created by the migrations of this package.
+type Observation struct {
+	gorm.Model
+	EntityId          string
+	DeviceId          string
+	PointOfInterestId string
+	Latitude          float64
+	Longitude         float64
+	Timestamp         time.Time
+	Measurements
+}
+
+func (Observation) TableName() string {
+	return "indoor_environment_observeds"
+}
+
+func (o *Observation) Key() (string, time.Time) {
+	return o.EntityId, o.Timestamp
+}
+
+func (o *Observation) Source() (string, time.Time) {
+	return o.DeviceId, o.Timestamp
+}
+
+func (o *Observation) Position() (float64, float64) {
+	return o.Latitude, o.Longitude
+}
+
+//Measurements contains the values that can be observed by an indoor environment sensor, as
+//defined by the FIWARE IndoorEnvironmentObserved data model. Values that were not part of an
+//observation are nil and stored as NULL.
+type Measurements struct {
+	//CO2 is measured in ppm
+	CO2         *float64
+	Temperature *float64
+	//Humidity is the relative humidity, as a fraction between 0 and 1
+	Humidity *float64
+	//Illuminance is measured in lux
+	Illuminance *float64
+	//Pressure is the atmospheric pressure in hPa
+	Pressure *float64
+	//PeopleCount is the number of people that were present, and is always a whole number
+	PeopleCount *float64
+}
+
+//Attributes returns the measurements keyed on their NGSI-LD attribute names
+func (m Measurements) Attributes() map[string]*float64 {
+	return map[string]*float64{
+		"co2":                 m.CO2,
+		"temperature":         m.Temperature,
+		"relativeHumidity":    m.Humidity,
+		"illuminance":         m.Illuminance,
+		"atmosphericPressure": m.Pressure,
+		"peopleCount":         m.PeopleCount,
+	}
+}
+
+//validate makes sure that the measurements are physically possible
+func (m Measurements) validate() error {
+	if m.Humidity != nil && (*m.Humidity < 0 || *m.Humidity > 1) {
+		return fmt.Errorf("relativeHumidity %f is outside the valid range [0, 1]", *m.Humidity)
+	}
+
+	if m.PeopleCount != nil && *m.PeopleCount != math.Trunc(*m.PeopleCount) {
+		return fmt.Errorf("peopleCount %f is not a whole number", *m.PeopleCount)
+	}
+
+	nonNegative := map[string]*float64{
+		"co2":                 m.CO2,
+		"illuminance":         m.Illuminance,
+		"atmosphericPressure": m.Pressure,
+		"peopleCount":         m.PeopleCount,
+	}
+
+	for name, value := range nonNegative {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+//Kind describes how indoor environment observations are stored and queried. Queries can also be
+//filtered on the point of interest that the observations were made in.
+var Kind = &database.ObservationKind{
+	Name:        TypeName,
+	New:         func() database.Observation { return &Observation{} },
+	Columns:     []string{"co2", "temperature", "humidity", "illuminance", "pressure", "people_count"},
+	TextColumns: []string{"point_of_interest_id"},
+	TimeColumn:  "timestamp",
+}
@@ -0,0 +1,153 @@
+package noiselevelobserved
+
+import (
+	"math"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+)
+
+//NoiseIndicators are the long term noise levels of an entity, as defined by the EU Environmental
+//Noise Directive, that have been computed from the LAeq of the observed intervals. A level is nil
+//if no interval overlapped its period of the day.
+type NoiseIndicators struct {
+	EntityId string
+	DeviceId string
+	From     time.Time
+	To       time.Time
+	//Lday is the level during the day, between 07:00 and 19:00
+	Lday *float64
+	//Levening is the level during the evening, between 19:00 and 23:00
+	Levening *float64
+	//Lnight is the level during the night, between 23:00 and 07:00
+	Lnight *float64
+	//Lden is the day-evening-night level, in which the evening and night are penalised by 5 and
+	//10 dB. It is only computed if all three periods have been observed.
+	Lden *float64
+}
+
+type noisePeriod int
+
+const (
+	noisePeriodDay noisePeriod = iota
+	noisePeriodEvening
+	noisePeriodNight
+)
+
+//RetrieveNoiseIndicators computes Lday, Levening, Lnight and Lden, per entity and optionally of a
+//single device, from the intervals that were observed between from and to. The periods of the
+//day are determined in the given location.
+func RetrieveNoiseIndicators(app application.EnvironmentApp, deviceId string, from, to time.Time, location *time.Location) ([]NoiseIndicators, error) {
+	observations, err := app.RetrieveObservations(Kind, deviceId, from, to, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	type accumulator struct {
+		deviceId string
+		energy   [3]float64
+		seconds  [3]float64
+	}
+
+	entityIds := []string{}
+	accumulators := map[string]*accumulator{}
+
+	for _, o := range observations {
+		nlo := o.(*Observation)
+		if nlo.LAeq == nil {
+			continue
+		}
+
+		acc, ok := accumulators[nlo.EntityId]
+		if !ok {
+			acc = &accumulator{deviceId: nlo.DeviceId}
+			accumulators[nlo.EntityId] = acc
+			entityIds = append(entityIds, nlo.EntityId)
+		}
+
+		start, end := clampInterval(nlo.DateObservedFrom, nlo.DateObservedTo, from, to)
+
+		// Intervals that span more than one period contribute to each of them
+		for start.Before(end) {
+			boundary, period := nextNoisePeriodBoundary(start.In(location))
+			if boundary.After(end) {
+				boundary = end
+			}
+
+			seconds := boundary.Sub(start).Seconds()
+			acc.energy[period] += math.Pow(10, *nlo.LAeq/10) * seconds
+			acc.seconds[period] += seconds
+
+			start = boundary
+		}
+	}
+
+	indicators := []NoiseIndicators{}
+
+	for _, entityId := range entityIds {
+		acc := accumulators[entityId]
+
+		levels := [3]*float64{}
+		for period := range levels {
+			if acc.seconds[period] > 0 {
+				level := 10 * math.Log10(acc.energy[period]/acc.seconds[period])
+				levels[period] = &level
+			}
+		}
+
+		indicators = append(indicators, NoiseIndicators{
+			EntityId: entityId,
+			DeviceId: acc.deviceId,
+			From:     from,
+			To:       to,
+			Lday:     levels[noisePeriodDay],
+			Levening: levels[noisePeriodEvening],
+			Lnight:   levels[noisePeriodNight],
+			Lden:     lden(levels[noisePeriodDay], levels[noisePeriodEvening], levels[noisePeriodNight]),
+		})
+	}
+
+	return indicators, nil
+}
+
+//lden combines the levels of the periods of the day into the day-evening-night level
+func lden(day, evening, night *float64) *float64 {
+	if day == nil || evening == nil || night == nil {
+		return nil
+	}
+
+	level := 10 * math.Log10((12*math.Pow(10, *day/10)+4*math.Pow(10, (*evening+5)/10)+8*math.Pow(10, (*night+10)/10))/24)
+	return &level
+}
+
+//nextNoisePeriodBoundary returns the period of the day that t is in, and the time at which
+//that period ends
+func nextNoisePeriodBoundary(t time.Time) (time.Time, noisePeriod) {
+	at := func(day, hour int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+day, hour, 0, 0, 0, t.Location())
+	}
+
+	switch hour := t.Hour(); {
+	case hour < 7:
+		return at(0, 7), noisePeriodNight
+	case hour < 19:
+		return at(0, 19), noisePeriodDay
+	case hour < 23:
+		return at(0, 23), noisePeriodEvening
+	default:
+		return at(1, 7), noisePeriodNight
+	}
+}
+
+//clampInterval limits an interval to a time window, in which a zero from or to is unbounded
+func clampInterval(start, end, from, to time.Time) (time.Time, time.Time) {
+	if !from.IsZero() && start.Before(from) {
+		start = from
+	}
+
+	if !to.IsZero() && end.After(to) {
+		end = to
+	}
+
+	return start, end
+}
@@ -0,0 +1,21 @@
+-- Noise levels that were observed over an interval, e.g. by stations along arterial roads. An
+-- entity can only have one observation per interval start.
+CREATE TABLE noise_level_observeds (
+    id                 BIGSERIAL PRIMARY KEY,
+    created_at         TIMESTAMPTZ,
+    updated_at         TIMESTAMPTZ,
+    deleted_at         TIMESTAMPTZ,
+    entity_id          TEXT NOT NULL,
+    device_id          TEXT NOT NULL DEFAULT '',
+    latitude           DOUBLE PRECISION,
+    longitude          DOUBLE PRECISION,
+    date_observed_from TIMESTAMPTZ NOT NULL,
+    date_observed_to   TIMESTAMPTZ NOT NULL,
+    laeq               DOUBLE PRECISION,
+    lamax              DOUBLE PRECISION,
+    la90               DOUBLE PRECISION
+);
+
+CREATE INDEX idx_noise_level_observeds_deleted_at ON noise_level_observeds (deleted_at);
+CREATE INDEX idx_noise_level_observeds_device_from ON noise_level_observeds (device_id, date_observed_from DESC);
+CREATE UNIQUE INDEX idx_noise_level_observeds_entity_from ON noise_level_observeds (entity_id, date_observed_from);
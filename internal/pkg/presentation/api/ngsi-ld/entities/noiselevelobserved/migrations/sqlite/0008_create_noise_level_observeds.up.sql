@@ -0,0 +1,21 @@
+-- Noise levels that were observed over an interval, e.g. by stations along arterial roads. An
+-- entity can only have one observation per interval start.
+CREATE TABLE noise_level_observeds (
+    id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at         DATETIME,
+    updated_at         DATETIME,
+    deleted_at         DATETIME,
+    entity_id          TEXT NOT NULL,
+    device_id          TEXT NOT NULL DEFAULT '',
+    latitude           REAL,
+    longitude          REAL,
+    date_observed_from DATETIME NOT NULL,
+    date_observed_to   DATETIME NOT NULL,
+    laeq               REAL,
+    lamax              REAL,
+    la90               REAL
+);
+
+CREATE INDEX idx_noise_level_observeds_deleted_at ON noise_level_observeds (deleted_at);
+CREATE INDEX idx_noise_level_observeds_device_from ON noise_level_observeds (device_id, date_observed_from DESC);
+CREATE UNIQUE INDEX idx_noise_level_observeds_entity_from ON noise_level_observeds (entity_id, date_observed_from);
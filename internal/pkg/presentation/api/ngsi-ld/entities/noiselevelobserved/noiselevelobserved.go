@@ -0,0 +1,250 @@
+package noiselevelobserved
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/geojson"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	IDPrefix string = "urn:ngsi-ld:NoiseLevelObserved:"
+	TypeName string = "NoiseLevelObserved"
+)
+
+//noiseLevelObserved is an NGSI-LD NoiseLevelObserved, as defined by the FIWARE smart data model,
+//that holds the sound levels of the interval from dateObservedFrom to dateObservedTo
+type noiseLevelObserved struct {
+	types.BaseEntity
+	DateObservedFrom types.DateTimeProperty          `json:"dateObservedFrom"`
+	DateObservedTo   types.DateTimeProperty          `json:"dateObservedTo"`
+	Location         geojson.GeoJSONProperty         `json:"location"`
+	RefDevice        *types.SingleObjectRelationship `json:"refDevice,omitempty"`
+	LAeq             *types.NumberProperty           `json:"LAeq,omitempty"`
+	LAmax            *types.NumberProperty           `json:"LAmax,omitempty"`
+	LA90             *types.NumberProperty           `json:"LA90,omitempty"`
+}
+
+//noiseLevelObservedDTO decodes the location of an entity, which can not be decoded directly into
+//a GeoJSONProperty. The embedded fields are declared as a type of their own, so that the DTO does
+//not inherit the UnmarshalJSON method of noiseLevelObserved.
+type noiseLevelObservedFields noiseLevelObserved
+
+type noiseLevelObservedDTO struct {
+	noiseLevelObservedFields
+	Location json.RawMessage `json:"location"`
+}
+
+//attributeColumns maps the attributes that can be used in queries to their stored columns
+var attributeColumns = map[string]string{
+	"refDevice": "device_id",
+	"LAeq":      "laeq",
+	"LAmax":     "lamax",
+	"LA90":      "la90",
+}
+
+//New returns the NoiseLevelObserved entity type
+func New() entities.EntityType {
+	return entityType{}
+}
+
+//go:embed migrations
+var migrations embed.FS
+
+func init() {
+	database.RegisterMigrations(migrations)
+	database.RegisterObservationKind(Kind)
+	entities.Register(New())
+}
+
+type entityType struct{}
+
+func (entityType) Name() string {
+	return TypeName
+}
+
+func (entityType) IDPrefix() string {
+	return IDPrefix
+}
+
+func (entityType) AttributeColumns() map[string]string {
+	return attributeColumns
+}
+
+func (entityType) ProvidesAttribute(attributeName string) bool {
+	_, ok := attributeColumns[attributeName]
+	return ok || attributeName == "dateObservedFrom" || attributeName == "dateObservedTo"
+}
+
+func (entityType) Decode(body []byte) (ngsi.Entity, error) {
+	nlo := &noiseLevelObserved{}
+	err := json.Unmarshal(body, nlo)
+	return nlo, err
+}
+
+func (entityType) Validate(entity ngsi.Entity) error {
+	nlo := entity.(*noiseLevelObserved)
+
+	err := entities.ValidateID(nlo.ID, IDPrefix)
+	if err != nil {
+		return err
+	}
+
+	o, err := nlo.observation()
+	if err != nil {
+		return err
+	}
+
+	return entities.InvalidEntity(o.validate())
+}
+
+func (entityType) Repository(app application.EnvironmentApp) entities.Repository {
+	return repository{app: app, WholeObservations: entities.WholeObservations{TypeName: TypeName}}
+}
+
+func (entityType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	n, ok := observation.(*Observation)
+	if !ok {
+		return nil, false
+	}
+
+	return newNoiseLevelObserved(n), true
+}
+
+type repository struct {
+	app application.EnvironmentApp
+	entities.WholeObservations
+}
+
+func (r repository) Store(entity ngsi.Entity) (database.StoreResult, error) {
+	o, err := entity.(*noiseLevelObserved).observation()
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	return r.app.StoreObservation(Kind, o)
+}
+
+func (r repository) StoreBatch(batch []ngsi.Entity, upsert bool) ([]error, error) {
+	observations := []database.Observation{}
+	for _, entity := range batch {
+		o, err := entity.(*noiseLevelObserved).observation()
+		if err != nil {
+			return nil, err
+		}
+		observations = append(observations, o)
+	}
+
+	return entities.BatchErrors(r.app.StoreObservations(Kind, observations, upsert))
+}
+
+func (r repository) Delete(entityIds []string, purge bool) ([]error, error) {
+	return r.app.DeleteObservations(Kind, entityIds, purge)
+}
+
+func (r repository) Retrieve(entityId string) (interface{}, error) {
+	return r.app.RetrieveObservation(Kind, entityId)
+}
+
+func (r repository) Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]entities.Observation, error) {
+	nlos, err := r.app.RetrieveObservations(Kind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The levels of an interval are observed at the start of the interval
+	observations := []entities.Observation{}
+	for _, o := range nlos {
+		n := o.(*Observation)
+		observations = append(observations, entities.Observation{ID: n.ID, EntityId: n.EntityId, ObservedAt: n.DateObservedFrom, Value: n})
+	}
+
+	return observations, nil
+}
+
+//newNoiseLevelObserved converts a stored observation into an NGSI-LD entity, leaving out any
+//attributes that were not part of the observation
+func newNoiseLevelObserved(n *Observation) *noiseLevelObserved {
+	nlo := &noiseLevelObserved{
+		BaseEntity: types.BaseEntity{
+			ID:      IDPrefix + n.EntityId,
+			Type:    TypeName,
+			Context: entities.DefaultContext,
+		},
+		DateObservedFrom: *types.CreateDateTimeProperty(n.DateObservedFrom.UTC().Format(time.RFC3339)),
+		DateObservedTo:   *types.CreateDateTimeProperty(n.DateObservedTo.UTC().Format(time.RFC3339)),
+		Location:         *geojson.CreateGeoJSONPropertyFromWGS84(n.Longitude, n.Latitude),
+	}
+
+	if n.DeviceId != "" {
+		nlo.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + n.DeviceId)
+	}
+
+	nlo.LAeq = entities.NumberProperty(n.LAeq)
+	nlo.LAmax = entities.NumberProperty(n.LAmax)
+	nlo.LA90 = entities.NumberProperty(n.LA90)
+
+	return nlo
+}
+
+//observation converts a created entity into an observation that can be stored
+func (nlo noiseLevelObserved) observation() (*Observation, error) {
+	observedFrom, err := time.Parse(time.RFC3339, nlo.DateObservedFrom.Value.Value)
+	if err != nil {
+		return nil, errors.New("dateObservedFrom is missing or could not be parsed")
+	}
+
+	observedTo, err := time.Parse(time.RFC3339, nlo.DateObservedTo.Value.Value)
+	if err != nil {
+		return nil, errors.New("dateObservedTo is missing or could not be parsed")
+	}
+
+	latitude, longitude, err := entities.PositionFromLocation(nlo.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	refDevice := ""
+	if nlo.RefDevice != nil {
+		refDevice = strings.TrimPrefix(nlo.RefDevice.Object, fiware.DeviceIDPrefix)
+	}
+
+	return &Observation{
+		EntityId:         strings.TrimPrefix(nlo.ID, IDPrefix),
+		DeviceId:         refDevice,
+		Latitude:         latitude,
+		Longitude:        longitude,
+		DateObservedFrom: observedFrom.UTC(),
+		DateObservedTo:   observedTo.UTC(),
+		Measurements: Measurements{
+			LAeq:  entities.NumberValue(nlo.LAeq),
+			LAmax: entities.NumberValue(nlo.LAmax),
+			LA90:  entities.NumberValue(nlo.LA90),
+		},
+	}, nil
+}
+
+func (nlo *noiseLevelObserved) UnmarshalJSON(data []byte) error {
+	dto := &noiseLevelObservedDTO{}
+	err := json.Unmarshal(data, dto)
+	if err != nil {
+		return err
+	}
+
+	*nlo = noiseLevelObserved(dto.noiseLevelObservedFields)
+
+	if len(dto.Location) > 0 {
+		nlo.Location = *geojson.CreateGeoJSONPropertyFromJSON(dto.Location)
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package noiselevelobserved
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog/log"
+)
+
+func TestStoreNoiseLevelObserved(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+	}
+
+	nlot := New()
+	entity, err := nlot.Decode([]byte(nloJson))
+	is.NoErr(err)
+	is.NoErr(nlot.Validate(entity))
+
+	_, err = nlot.Repository(app).Store(entity)
+	is.NoErr(err)
+
+	is.Equal(len(app.StoreObservationCalls()), 1)
+	call := app.StoreObservationCalls()[0]
+	is.Equal(call.Kind, Kind)
+
+	nlo := call.Observation.(*Observation)
+	is.Equal(nlo.EntityId, "nlo1")
+	is.Equal(*nlo.LAeq, 64.2)
+	is.Equal(nlo.LA90, nil) // LA90 was not observed
+	is.Equal(nlo.DateObservedTo.Sub(nlo.DateObservedFrom), 15*time.Minute)
+}
+
+func TestValidateNoiseLevelObservedWithoutAnInterval(t *testing.T) {
+	is := is.New(t)
+
+	nlot := New()
+	entity, err := nlot.Decode([]byte(`{"id": "urn:ngsi-ld:NoiseLevelObserved:nlo1", "type": "NoiseLevelObserved"}`))
+	is.NoErr(err)
+
+	err = nlot.Validate(entity)
+	is.True(err != nil) // the interval of the observation is required
+}
+
+func TestValidateNoiseLevelObservedThatEndsBeforeItStarts(t *testing.T) {
+	is := is.New(t)
+
+	nlot := New()
+	entity, err := nlot.Decode([]byte(strings.Replace(nloJson, "2022-03-21T08:15:00Z", "2022-03-21T07:45:00Z", 1)))
+	is.NoErr(err)
+
+	err = nlot.Validate(entity)
+	is.True(errors.Is(err, entities.ErrInvalidEntity))
+}
+
+func TestEncodeNoiseLevelObserved(t *testing.T) {
+	is := is.New(t)
+
+	laeq := 64.2
+	from := time.Date(2022, 3, 21, 8, 0, 0, 0, time.UTC)
+	entity, ok := New().Encode(&Observation{
+		EntityId:         "nlo1",
+		DeviceId:         "dev1",
+		DateObservedFrom: from,
+		DateObservedTo:   from.Add(15 * time.Minute),
+		Measurements:     Measurements{LAeq: &laeq},
+	})
+	is.True(ok)
+
+	b, _ := json.Marshal(entity)
+	nlo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &nlo))
+	is.Equal(nlo["id"], "urn:ngsi-ld:NoiseLevelObserved:nlo1")
+	is.Equal(nlo["refDevice"].(map[string]interface{})["object"], "urn:ngsi-ld:Device:dev1")
+	is.Equal(nlo["LAeq"].(map[string]interface{})["value"], 64.2)
+
+	_, ok = New().Encode(&models.AirQualityObserved{})
+	is.True(!ok) // observations of other types should not be encoded
+}
+
+func TestNoiseIndicatorsAreComputedFromStoredIntervals(t *testing.T) {
+	is := is.New(t)
+
+	day := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	interval := func(entityId string, fromHour, toHour int, laeq float64) *Observation {
+		return &Observation{
+			EntityId:         entityId,
+			DeviceId:         "dev-" + entityId,
+			DateObservedFrom: day.Add(time.Duration(fromHour) * time.Hour),
+			DateObservedTo:   day.Add(time.Duration(toHour) * time.Hour),
+			Measurements:     Measurements{LAeq: float64Ptr(laeq)},
+		}
+	}
+
+	app := &application.EnvironmentAppMock{
+		RetrieveObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+			return []database.Observation{
+				interval("nlo1", 10, 11, 60.0),
+				interval("nlo1", 19, 20, 55.0),
+				interval("nlo1", 23, 24, 50.0),
+				interval("nlo2", 18, 20, 60.0), // spans the day and the evening
+				interval("nlo2", 30, 32, 90.0), // outside of the requested window
+				&Observation{EntityId: "nlo3", DateObservedFrom: day, DateObservedTo: day.Add(time.Hour)}, // no LAeq
+			}, nil
+		},
+	}
+
+	indicators, err := RetrieveNoiseIndicators(app, "", day, day.Add(24*time.Hour), time.UTC)
+	is.NoErr(err)
+	is.Equal(len(indicators), 2)
+	is.Equal(app.RetrieveObservationsCalls()[0].Kind, Kind)
+
+	round := func(v *float64) float64 { return math.Round(*v*100) / 100 }
+
+	is.Equal(indicators[0].EntityId, "nlo1")
+	is.Equal(round(indicators[0].Lday), 60.0)
+	is.Equal(round(indicators[0].Levening), 55.0)
+	is.Equal(round(indicators[0].Lnight), 50.0)
+	is.Equal(round(indicators[0].Lden), 60.0) // the penalties of evening and night make all periods equal
+
+	is.Equal(indicators[1].DeviceId, "dev-nlo2")
+	is.Equal(round(indicators[1].Lday), 60.0)
+	is.Equal(round(indicators[1].Levening), 60.0)
+	is.True(indicators[1].Lnight == nil)
+	is.True(indicators[1].Lden == nil) // Lden requires all periods of the day
+}
+
+func TestThatNoiseLevelObservedsAreStoredInTheirOwnTable(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	nlo := func(entityId, deviceId string, laeq float64, from, to time.Time) *Observation {
+		return &Observation{
+			EntityId: entityId, DeviceId: deviceId, Latitude: 62.39, Longitude: 17.30,
+			DateObservedFrom: from, DateObservedTo: to,
+			Measurements: Measurements{LAeq: float64Ptr(laeq), LAmax: float64Ptr(laeq + 15)},
+		}
+	}
+
+	for i, value := range []float64{55.0, 62.0, 58.0} {
+		from := start.Add(time.Duration(i) * time.Hour)
+		_, result, err := db.StoreObservation(Kind, nlo("nlo1", "dev1", value, from, from.Add(time.Hour)), database.DuplicatesReject)
+		is.NoErr(err)
+		is.Equal(result, database.StoreResultCreated)
+	}
+
+	_, _, err := db.StoreObservation(Kind, nlo("nlo1", "dev1", 70.0, start, start.Add(30*time.Minute)), database.DuplicatesReject)
+	is.True(errors.Is(err, database.ErrDuplicate)) // an interval that starts at the same time is a duplicate
+
+	db.StoreObservation(Kind, nlo("nlo2", "dev2", 45.0, start, start.Add(time.Hour)), database.DuplicatesReject)
+
+	latest, err := db.GetObservation(Kind, "nlo1")
+	is.NoErr(err)
+	is.Equal(*latest.(*Observation).LAeq, 58.0) // the most recent interval should be returned
+	is.True(latest.(*Observation).DateObservedTo.Equal(start.Add(3 * time.Hour)))
+	is.True(latest.(*Observation).LA90 == nil)
+
+	// Intervals that overlap the window are included, even if they start before it
+	nlos, err := db.GetObservations(Kind, "dev1", start.Add(90*time.Minute), start.Add(150*time.Minute), 100)
+	is.NoErr(err)
+	is.Equal(len(nlos), 2)
+	is.Equal(*nlos[0].(*Observation).LAeq, 58.0)
+
+	nlos, err = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, database.WithFilter(database.Filter{Column: "laeq", Operator: database.FilterGreater, Values: []interface{}{56.0}}))
+	is.NoErr(err)
+	is.Equal(len(nlos), 2)
+
+	nlos, err = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 0, database.WithLimitPerEntity(1))
+	is.NoErr(err)
+	is.Equal(len(nlos), 2) // the most recent interval of every entity
+	is.Equal(*nlos[0].(*Observation).LAeq, 58.0)
+
+	gaps, err := db.GetObservationGaps("dev2", start, start.Add(2*time.Hour), 0)
+	is.NoErr(err)
+	is.True(gaps["dev2"][0].To.Equal(start.Add(time.Hour))) // intervals are reported when they end
+}
+
+func TestThatObservationGapsSpanNoiseLevelsAndAirQuality(t *testing.T) {
+	is, db := setupTest(t)
+
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+
+	for _, hours := range []int{1, 2, 4, 6} {
+		aqo := &models.AirQualityObserved{EntityId: "aqo1", DeviceId: "dev1", Timestamp: at(hours), AirQualityMeasurements: models.AirQualityMeasurements{CO2: float64Ptr(400)}}
+		db.StoreObservation(database.AirQualityObservedKind, aqo, database.DuplicatesIgnore)
+	}
+	db.StoreObservation(Kind, &Observation{EntityId: "nlo1", DeviceId: "dev1", DateObservedFrom: at(8), DateObservedTo: at(9), Measurements: Measurements{LAeq: float64Ptr(50.0)}}, database.DuplicatesIgnore)
+
+	gaps, err := db.GetObservationGaps("dev1", start, at(12), 90*time.Minute)
+	is.NoErr(err)
+	is.Equal(gaps["dev1"], []database.ObservationGap{
+		{From: at(2), To: at(4)},
+		{From: at(4), To: at(6)},
+		{From: at(6), To: at(9)}, // intervals of noise levels are reported when they end
+		{From: at(9), To: at(12)},
+	})
+
+	gaps, _ = db.GetObservationGaps("dev2", start, at(12), time.Hour)
+	is.Equal(len(gaps), 0)
+}
+
+func setupTest(t *testing.T) (*is.I, database.Datastore) {
+	is := is.New(t)
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(log.Logger))
+	is.NoErr(err)
+
+	return is, db
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+const nloJson string = `{
+    "id": "urn:ngsi-ld:NoiseLevelObserved:nlo1",
+    "type": "NoiseLevelObserved",
+    "dateObservedFrom": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:00:00Z"
+        }
+    },
+    "dateObservedTo": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:15:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {
+        "type": "Relationship",
+        "object": "urn:ngsi-ld:Device:dev1"
+    },
+    "LAeq": {"type": "Property", "value": 64.2},
+    "LAmax": {"type": "Property", "value": 81.5},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
@@ -0,0 +1,81 @@
+package noiselevelobserved
+
+import (
+	"errors"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"gorm.io/gorm"
+)
+
+//Observation is a set of noise levels that were observed at a location over the interval from
+//DateObservedFrom to DateObservedTo. The schema of its table is created by the migrations of
+//this package.
+type Observation struct {
+	gorm.Model
+	EntityId         string
+	DeviceId         string
+	Latitude         float64
+	Longitude        float64
+	DateObservedFrom time.Time
+	DateObservedTo   time.Time
+	Measurements
+}
+
+func (Observation) TableName() string {
+	return "noise_level_observeds"
+}
+
+//Key returns the start of the interval, since an interval duplicates any other interval of the
+//same entity that starts at the same time
+func (o *Observation) Key() (string, time.Time) {
+	return o.EntityId, o.DateObservedFrom
+}
+
+//Source returns the end of the interval, which is when the levels are reported by the device
+func (o *Observation) Source() (string, time.Time) {
+	return o.DeviceId, o.DateObservedTo
+}
+
+func (o *Observation) Position() (float64, float64) {
+	return o.Latitude, o.Longitude
+}
+
+//validate makes sure that the interval starts before it ends
+func (o *Observation) validate() error {
+	if !o.DateObservedFrom.Before(o.DateObservedTo) {
+		return errors.New("dateObservedFrom must be before dateObservedTo")
+	}
+	return nil
+}
+
+//Measurements contains the A-weighted sound levels, in dB, as defined by the FIWARE
+//NoiseLevelObserved data model. Values that were not part of an observation are nil and stored
+//as NULL.
+type Measurements struct {
+	//LAeq is the equivalent continuous sound level over the interval
+	LAeq *float64 `gorm:"column:laeq"`
+	//LAmax is the maximum sound level during the interval
+	LAmax *float64 `gorm:"column:lamax"`
+	//LA90 is the sound level that was exceeded during 90 percent of the interval
+	LA90 *float64 `gorm:"column:la90"`
+}
+
+//Attributes returns the measurements keyed on their NGSI-LD attribute names
+func (m Measurements) Attributes() map[string]*float64 {
+	return map[string]*float64{
+		"LAeq":  m.LAeq,
+		"LAmax": m.LAmax,
+		"LA90":  m.LA90,
+	}
+}
+
+//Kind describes how noise level observations are stored and queried. Queries match the intervals
+//that overlap their time spans.
+var Kind = &database.ObservationKind{
+	Name:          TypeName,
+	New:           func() database.Observation { return &Observation{} },
+	Columns:       []string{"laeq", "lamax", "la90"},
+	TimeColumn:    "date_observed_from",
+	EndTimeColumn: "date_observed_to",
+}
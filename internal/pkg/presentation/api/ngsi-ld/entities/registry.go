@@ -0,0 +1,98 @@
+package entities
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Registry holds the entity types that are provided by a context source, in the order in which
+//they were registered
+type Registry struct {
+	types []EntityType
+}
+
+//NewRegistry creates a registry of entity types, and fails if two of the types share a name or
+//if the id prefix of one type is a prefix of the id prefix of another
+func NewRegistry(types ...EntityType) (*Registry, error) {
+	r := &Registry{}
+
+	for _, t := range types {
+		err := r.add(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Registry) add(t EntityType) error {
+	for _, registered := range r.types {
+		if t.Name() == registered.Name() {
+			return fmt.Errorf("entity type %s is already registered", t.Name())
+		}
+
+		if strings.HasPrefix(t.IDPrefix(), registered.IDPrefix()) || strings.HasPrefix(registered.IDPrefix(), t.IDPrefix()) {
+			return fmt.Errorf("the id prefix of %s overlaps the id prefix of %s", t.Name(), registered.Name())
+		}
+	}
+
+	r.types = append(r.types, t)
+	return nil
+}
+
+//registered holds the entity types that have registered themselves with Register
+var registered = &Registry{}
+
+//Register adds an entity type to the registry that is returned by Registered. Every entity type
+//package registers its type when it is initialized, so that importing the package is enough to
+//provide the type. It panics if the type overlaps a type that has already been registered.
+func Register(t EntityType) {
+	err := registered.add(t)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+//Registered returns the registry of the entity types that have registered themselves
+func Registered() *Registry {
+	return registered
+}
+
+//Types returns the registered entity types
+func (r *Registry) Types() []EntityType {
+	return r.types
+}
+
+//Type returns the entity type with a certain name
+func (r *Registry) Type(typeName string) (EntityType, bool) {
+	for _, t := range r.types {
+		if t.Name() == typeName {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+//TypeFromID returns the entity type with an id prefix that matches the id of an entity
+func (r *Registry) TypeFromID(entityID string) (EntityType, bool) {
+	for _, t := range r.types {
+		if strings.HasPrefix(entityID, t.IDPrefix()) {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+//Encode converts a stored observation of any registered type into its entity
+func (r *Registry) Encode(observation interface{}) (interface{}, bool) {
+	for _, t := range r.types {
+		if entity, ok := t.Encode(observation); ok {
+			return entity, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,75 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/matryer/is"
+)
+
+func TestRegistryFindsTypeFromID(t *testing.T) {
+	is := is.New(t)
+
+	r, err := NewRegistry(testType{"A", "urn:ngsi-ld:A:"}, testType{"B", "urn:ngsi-ld:B:"})
+	is.NoErr(err)
+
+	b, ok := r.TypeFromID("urn:ngsi-ld:B:b1")
+	is.True(ok)
+	is.Equal(b.Name(), "B")
+
+	_, ok = r.TypeFromID("urn:ngsi-ld:C:c1")
+	is.True(!ok) // no type is registered with a matching id prefix
+}
+
+func TestRegistryRejectsOverlappingTypes(t *testing.T) {
+	is := is.New(t)
+
+	_, err := NewRegistry(testType{"A", "urn:ngsi-ld:A:"}, testType{"A", "urn:ngsi-ld:Other:"})
+	is.True(err != nil) // duplicate type names should be rejected
+
+	_, err = NewRegistry(testType{"A", "urn:ngsi-ld:A:"}, testType{"AB", "urn:ngsi-ld:A:B:"})
+	is.True(err != nil) // the id prefix of AB starts with the id prefix of A
+}
+
+func TestRegistryEncodesObservationsOfAnyType(t *testing.T) {
+	is := is.New(t)
+
+	r, _ := NewRegistry(testType{"A", "urn:ngsi-ld:A:"}, testType{"B", "urn:ngsi-ld:B:"})
+
+	entity, ok := r.Encode("B")
+	is.True(ok)
+	is.Equal(entity, "urn:ngsi-ld:B:")
+
+	_, ok = r.Encode(42)
+	is.True(!ok) // no type encodes an int
+}
+
+func TestValidateID(t *testing.T) {
+	is := is.New(t)
+
+	is.NoErr(ValidateID("urn:ngsi-ld:A:a1", "urn:ngsi-ld:A:"))
+	is.True(ValidateID("urn:ngsi-ld:A:", "urn:ngsi-ld:A:") != nil)   // the id is missing
+	is.True(ValidateID("urn:ngsi-ld:B:b1", "urn:ngsi-ld:A:") != nil) // the prefix of another type
+}
+
+//testType encodes observations that are equal to its name into its id prefix
+type testType struct {
+	name     string
+	idPrefix string
+}
+
+func (t testType) Name() string                                     { return t.name }
+func (t testType) IDPrefix() string                                 { return t.idPrefix }
+func (t testType) AttributeColumns() map[string]string              { return nil }
+func (t testType) ProvidesAttribute(string) bool                    { return false }
+func (t testType) Decode([]byte) (ngsi.Entity, error)               { return nil, nil }
+func (t testType) Validate(ngsi.Entity) error                       { return nil }
+func (t testType) Repository(application.EnvironmentApp) Repository { return nil }
+
+func (t testType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	if name, ok := observation.(string); ok && name == t.name {
+		return t.idPrefix, true
+	}
+	return nil, false
+}
@@ -0,0 +1,22 @@
+-- Observations of water quality, e.g. by buoys in lakes and harbours. An entity can only have
+-- one observation per point in time.
+CREATE TABLE water_quality_observeds (
+    id               BIGSERIAL PRIMARY KEY,
+    created_at       TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ,
+    deleted_at       TIMESTAMPTZ,
+    entity_id        TEXT NOT NULL,
+    device_id        TEXT NOT NULL DEFAULT '',
+    latitude         DOUBLE PRECISION,
+    longitude        DOUBLE PRECISION,
+    "timestamp"      TIMESTAMPTZ NOT NULL,
+    temperature      DOUBLE PRECISION,
+    ph               DOUBLE PRECISION,
+    conductivity     DOUBLE PRECISION,
+    turbidity        DOUBLE PRECISION,
+    dissolved_oxygen DOUBLE PRECISION
+);
+
+CREATE INDEX idx_water_quality_observeds_deleted_at ON water_quality_observeds (deleted_at);
+CREATE INDEX idx_water_quality_observeds_device_timestamp ON water_quality_observeds (device_id, "timestamp" DESC);
+CREATE UNIQUE INDEX idx_water_quality_observeds_entity_timestamp ON water_quality_observeds (entity_id, "timestamp");
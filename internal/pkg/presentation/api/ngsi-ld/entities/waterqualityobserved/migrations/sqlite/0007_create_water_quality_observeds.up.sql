@@ -0,0 +1,22 @@
+-- Observations of water quality, e.g. by buoys in lakes and harbours. An entity can only have
+-- one observation per point in time.
+CREATE TABLE water_quality_observeds (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at       DATETIME,
+    updated_at       DATETIME,
+    deleted_at       DATETIME,
+    entity_id        TEXT NOT NULL,
+    device_id        TEXT NOT NULL DEFAULT '',
+    latitude         REAL,
+    longitude        REAL,
+    "timestamp"      DATETIME NOT NULL,
+    temperature      REAL,
+    ph               REAL,
+    conductivity     REAL,
+    turbidity        REAL,
+    dissolved_oxygen REAL
+);
+
+CREATE INDEX idx_water_quality_observeds_deleted_at ON water_quality_observeds (deleted_at);
+CREATE INDEX idx_water_quality_observeds_device_timestamp ON water_quality_observeds (device_id, "timestamp" DESC);
+CREATE UNIQUE INDEX idx_water_quality_observeds_entity_timestamp ON water_quality_observeds (entity_id, "timestamp");
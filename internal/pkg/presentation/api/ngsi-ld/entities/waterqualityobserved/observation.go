@@ -0,0 +1,88 @@
+package waterqualityobserved
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"gorm.io/gorm"
+)
+
+//Observation is a single observation of the water quality at a location, such as a lake or a
+//harbour. The schema of its table is created by the migrations of this package.
+type Observation struct {
+	gorm.Model
+	EntityId  string
+	DeviceId  string
+	Latitude  float64
+	Longitude float64
+	Timestamp time.Time
+	Measurements
+}
+
+func (Observation) TableName() string {
+	return "water_quality_observeds"
+}
+
+func (o *Observation) Key() (string, time.Time) {
+	return o.EntityId, o.Timestamp
+}
+
+func (o *Observation) Source() (string, time.Time) {
+	return o.DeviceId, o.Timestamp
+}
+
+func (o *Observation) Position() (float64, float64) {
+	return o.Latitude, o.Longitude
+}
+
+//Measurements contains the values that can be observed by a water quality sensor, as defined by
+//the FIWARE WaterQualityObserved data model. Values that were not part of an observation are nil
+//and stored as NULL.
+type Measurements struct {
+	Temperature     *float64
+	PH              *float64
+	Conductivity    *float64
+	Turbidity       *float64
+	DissolvedOxygen *float64
+}
+
+//Attributes returns the measurements keyed on their NGSI-LD attribute names
+func (m Measurements) Attributes() map[string]*float64 {
+	return map[string]*float64{
+		"temperature":  m.Temperature,
+		"pH":           m.PH,
+		"conductivity": m.Conductivity,
+		"turbidity":    m.Turbidity,
+		"O2":           m.DissolvedOxygen,
+	}
+}
+
+//validate makes sure that the measurements are physically possible
+func (m Measurements) validate() error {
+	if m.PH != nil && (*m.PH < 0 || *m.PH > 14) {
+		return fmt.Errorf("pH %f is outside the valid range [0, 14]", *m.PH)
+	}
+
+	nonNegative := map[string]*float64{
+		"conductivity": m.Conductivity,
+		"turbidity":    m.Turbidity,
+		"O2":           m.DissolvedOxygen,
+	}
+
+	for name, value := range nonNegative {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+//Kind describes how water quality observations are stored and queried
+var Kind = &database.ObservationKind{
+	Name:       TypeName,
+	New:        func() database.Observation { return &Observation{} },
+	Columns:    []string{"temperature", "ph", "conductivity", "turbidity", "dissolved_oxygen"},
+	TimeColumn: "timestamp",
+}
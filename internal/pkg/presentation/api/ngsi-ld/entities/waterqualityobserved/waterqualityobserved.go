@@ -0,0 +1,227 @@
+package waterqualityobserved
+
+import (
+	"embed"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	TypeName string = fiware.WaterQualityObservedTypeName
+	IDPrefix string = fiware.WaterQualityObservedIDPrefix
+)
+
+//waterQualityObserved extends the fiware WaterQualityObserved with the measurements that are
+//defined by the smart data model, but are not (yet) supported by the ngsi-ld library
+type waterQualityObserved struct {
+	fiware.WaterQualityObserved
+	waterQualityMeasurements
+}
+
+type waterQualityMeasurements struct {
+	PH           *types.NumberProperty `json:"pH,omitempty"`
+	Conductivity *types.NumberProperty `json:"conductivity,omitempty"`
+	Turbidity    *types.NumberProperty `json:"turbidity,omitempty"`
+	O2           *types.NumberProperty `json:"O2,omitempty"`
+}
+
+//attributeColumns maps the attributes that can be used in queries to their stored columns
+var attributeColumns = map[string]string{
+	"refDevice":    "device_id",
+	"temperature":  "temperature",
+	"pH":           "ph",
+	"conductivity": "conductivity",
+	"turbidity":    "turbidity",
+	"O2":           "dissolved_oxygen",
+}
+
+//New returns the WaterQualityObserved entity type
+func New() entities.EntityType {
+	return entityType{}
+}
+
+//go:embed migrations
+var migrations embed.FS
+
+func init() {
+	database.RegisterMigrations(migrations)
+	database.RegisterObservationKind(Kind)
+	entities.Register(New())
+}
+
+type entityType struct{}
+
+func (entityType) Name() string {
+	return TypeName
+}
+
+func (entityType) IDPrefix() string {
+	return IDPrefix
+}
+
+func (entityType) AttributeColumns() map[string]string {
+	return attributeColumns
+}
+
+func (entityType) ProvidesAttribute(attributeName string) bool {
+	_, ok := attributeColumns[attributeName]
+	return ok || attributeName == "dateObserved"
+}
+
+func (entityType) Decode(body []byte) (ngsi.Entity, error) {
+	wqo := &waterQualityObserved{}
+	err := json.Unmarshal(body, wqo)
+	return wqo, err
+}
+
+func (entityType) Validate(entity ngsi.Entity) error {
+	wqo := entity.(*waterQualityObserved)
+
+	err := entities.ValidateID(wqo.ID, IDPrefix)
+	if err != nil {
+		return err
+	}
+
+	o, err := wqo.observation()
+	if err != nil {
+		return err
+	}
+
+	return entities.InvalidEntity(o.validate())
+}
+
+func (entityType) Repository(app application.EnvironmentApp) entities.Repository {
+	return repository{app: app, WholeObservations: entities.WholeObservations{TypeName: TypeName}}
+}
+
+func (entityType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	w, ok := observation.(*Observation)
+	if !ok {
+		return nil, false
+	}
+
+	return newWaterQualityObserved(w), true
+}
+
+type repository struct {
+	app application.EnvironmentApp
+	entities.WholeObservations
+}
+
+func (r repository) Store(entity ngsi.Entity) (database.StoreResult, error) {
+	o, err := entity.(*waterQualityObserved).observation()
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	return r.app.StoreObservation(Kind, o)
+}
+
+func (r repository) StoreBatch(batch []ngsi.Entity, upsert bool) ([]error, error) {
+	observations := []database.Observation{}
+	for _, entity := range batch {
+		o, err := entity.(*waterQualityObserved).observation()
+		if err != nil {
+			return nil, err
+		}
+		observations = append(observations, o)
+	}
+
+	return entities.BatchErrors(r.app.StoreObservations(Kind, observations, upsert))
+}
+
+func (r repository) Delete(entityIds []string, purge bool) ([]error, error) {
+	return r.app.DeleteObservations(Kind, entityIds, purge)
+}
+
+func (r repository) Retrieve(entityId string) (interface{}, error) {
+	return r.app.RetrieveObservation(Kind, entityId)
+}
+
+func (r repository) Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]entities.Observation, error) {
+	wqos, err := r.app.RetrieveObservations(Kind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	observations := []entities.Observation{}
+	for _, o := range wqos {
+		w := o.(*Observation)
+		observations = append(observations, entities.Observation{ID: w.ID, EntityId: w.EntityId, ObservedAt: w.Timestamp, Value: w})
+	}
+
+	return observations, nil
+}
+
+//newWaterQualityObserved converts a stored observation into an NGSI-LD entity, leaving out
+//any attributes that were not part of the observation
+func newWaterQualityObserved(w *Observation) *waterQualityObserved {
+	wqo := &waterQualityObserved{
+		WaterQualityObserved: *fiware.NewWaterQualityObserved(w.EntityId, w.Latitude, w.Longitude, w.Timestamp.UTC().Format(time.RFC3339)),
+	}
+
+	wqo.ID = IDPrefix + w.EntityId
+	wqo.RefDevice = nil
+
+	if w.DeviceId != "" {
+		wqo.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + w.DeviceId)
+	}
+
+	wqo.Temperature = entities.NumberProperty(w.Temperature)
+	wqo.PH = entities.NumberProperty(w.PH)
+	wqo.Conductivity = entities.NumberProperty(w.Conductivity)
+	wqo.Turbidity = entities.NumberProperty(w.Turbidity)
+	wqo.O2 = entities.NumberProperty(w.DissolvedOxygen)
+
+	return wqo
+}
+
+//observation converts a created entity into an observation that can be stored
+func (wqo waterQualityObserved) observation() (*Observation, error) {
+	dateObserved, err := time.Parse(time.RFC3339, wqo.DateObserved.Value.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	latitude, longitude, err := entities.PositionFromLocation(wqo.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	refDevice := ""
+	if wqo.RefDevice != nil {
+		refDevice = strings.TrimPrefix(wqo.RefDevice.Object, fiware.DeviceIDPrefix)
+	}
+
+	return &Observation{
+		EntityId:  strings.TrimPrefix(wqo.ID, IDPrefix),
+		DeviceId:  refDevice,
+		Latitude:  latitude,
+		Longitude: longitude,
+		Timestamp: dateObserved.UTC(),
+		Measurements: Measurements{
+			Temperature:     entities.NumberValue(wqo.Temperature),
+			PH:              entities.NumberValue(wqo.PH),
+			Conductivity:    entities.NumberValue(wqo.Conductivity),
+			Turbidity:       entities.NumberValue(wqo.Turbidity),
+			DissolvedOxygen: entities.NumberValue(wqo.O2),
+		},
+	}, nil
+}
+
+func (wqo *waterQualityObserved) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, &wqo.WaterQualityObserved)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &wqo.waterQualityMeasurements)
+}
@@ -0,0 +1,220 @@
+package waterqualityobserved
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog/log"
+)
+
+func TestStoreWaterQualityObserved(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+	}
+
+	wqot := New()
+	entity, err := wqot.Decode([]byte(wqoJson))
+	is.NoErr(err)
+	is.NoErr(wqot.Validate(entity))
+
+	_, err = wqot.Repository(app).Store(entity)
+	is.NoErr(err)
+
+	is.Equal(len(app.StoreObservationCalls()), 1)
+	call := app.StoreObservationCalls()[0]
+	is.Equal(call.Kind, Kind)
+
+	wqo := call.Observation.(*Observation)
+	is.Equal(wqo.EntityId, "wqo1")
+	is.Equal(wqo.DeviceId, "dev1")
+	is.Equal(*wqo.PH, 7.2)
+	is.Equal(*wqo.DissolvedOxygen, 10.4)
+	is.Equal(wqo.Turbidity, nil) // turbidity was not observed
+}
+
+func TestValidateWaterQualityObservedWithImpossibleMeasurements(t *testing.T) {
+	is := is.New(t)
+
+	wqot := New()
+	for _, measurement := range []string{`"pH": {"type": "Property", "value": 14.5}`, `"turbidity": {"type": "Property", "value": -1}`} {
+		entity, err := wqot.Decode([]byte(strings.Replace(wqoJson, `"pH": {"type": "Property", "value": 7.2}`, measurement, 1)))
+		is.NoErr(err)
+
+		err = wqot.Validate(entity)
+		is.True(errors.Is(err, entities.ErrInvalidEntity))
+	}
+}
+
+func TestValidateWaterQualityObservedWithTheWrongIDPrefix(t *testing.T) {
+	is := is.New(t)
+
+	wqot := New()
+	entity, err := wqot.Decode([]byte(strings.Replace(wqoJson, IDPrefix, "urn:ngsi-ld:WeatherObserved:", 1)))
+	is.NoErr(err)
+
+	err = wqot.Validate(entity)
+	is.True(errors.Is(err, entities.ErrInvalidEntity))
+}
+
+func TestQueryWaterQualityObserveds(t *testing.T) {
+	is := is.New(t)
+	observedAt := time.Date(2022, 3, 21, 8, 15, 0, 0, time.UTC)
+	app := &application.EnvironmentAppMock{
+		RetrieveObservationsFunc: func(kind *database.ObservationKind, deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]database.Observation, error) {
+			return []database.Observation{&Observation{EntityId: "wqo1", Timestamp: observedAt}}, nil
+		},
+	}
+
+	observations, err := New().Repository(app).Query("dev1", time.Time{}, time.Time{}, 10)
+	is.NoErr(err)
+	is.Equal(len(observations), 1)
+	is.Equal(observations[0].EntityId, "wqo1")
+	is.Equal(observations[0].ObservedAt, observedAt)
+
+	entity, ok := New().Encode(observations[0].Value)
+	is.True(ok)
+
+	b, _ := json.Marshal(entity)
+	wqo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &wqo))
+	is.Equal(wqo["id"], "urn:ngsi-ld:WaterQualityObserved:wqo1")
+}
+
+func TestThatWaterQualityObservedsAreStoredInTheirOwnTable(t *testing.T) {
+	is, db := setupTest(t)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	wqo := func(entityId, deviceId string, latitude, longitude float64, ph float64, timestamp time.Time) *Observation {
+		return &Observation{
+			EntityId: entityId, DeviceId: deviceId, Latitude: latitude, Longitude: longitude, Timestamp: timestamp,
+			Measurements: Measurements{PH: float64Ptr(ph), Temperature: float64Ptr(8.0)},
+		}
+	}
+
+	_, result, err := db.StoreObservation(Kind, wqo("wqo1", "dev1", 62.39, 17.30, 6.5, observedAt), database.DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(result, database.StoreResultCreated)
+
+	_, _, err = db.StoreObservation(Kind, wqo("wqo1", "dev1", 62.39, 17.30, 6.8, observedAt), database.DuplicatesReject)
+	is.True(errors.Is(err, database.ErrDuplicate))
+
+	_, result, err = db.StoreObservation(Kind, wqo("wqo1", "dev1", 62.39, 17.30, 7.5, observedAt.Add(time.Hour)), database.DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(result, database.StoreResultCreated)
+
+	db.StoreObservation(Kind, wqo("wqo2", "dev2", 40.42, -3.71, 8.0, observedAt), database.DuplicatesReject)
+
+	latest, err := db.GetObservation(Kind, "wqo1")
+	is.NoErr(err)
+	is.Equal(*latest.(*Observation).PH, 7.5) // the most recent observation should be returned
+	is.True(latest.(*Observation).Conductivity == nil)
+
+	_, err = db.GetObservation(Kind, "unknown")
+	is.True(errors.Is(err, database.ErrNotFound))
+
+	wqos, err := db.GetObservations(Kind, "dev1", time.Time{}, time.Time{}, 100)
+	is.NoErr(err)
+	is.Equal(len(wqos), 2)
+
+	wqos, err = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, database.WithFilter(database.Filter{Column: "ph", Operator: database.FilterGreater, Values: []interface{}{7.0}}))
+	is.NoErr(err)
+	is.Equal(len(wqos), 2)
+
+	wqos, _ = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, database.WithGeoQuery(database.NewNearPointGeoQuery(17.30, 62.39, 1000)))
+	is.Equal(len(wqos), 2)
+
+	_, err = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, database.WithFilter(database.Filter{Column: "co2", Operator: database.FilterGreater, Values: []interface{}{0.0}}))
+	is.True(err != nil) // co2 is not a water quality measurement
+
+	gaps, _ := db.GetObservationGaps("dev2", observedAt.Add(-time.Minute), observedAt.Add(time.Minute), 0)
+	is.Equal(len(gaps["dev2"]), 2) // water quality observations should count towards liveness
+}
+
+func TestThatBatchesOfWaterQualityObservedsCanBeStoredAndDeleted(t *testing.T) {
+	is, db := setupTest(t)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	wqo := func(entityId string, minutes int, ph float64) database.Observation {
+		return &Observation{
+			EntityId: entityId, DeviceId: "dev1", Latitude: 62.39, Longitude: 17.30,
+			Timestamp:    observedAt.Add(time.Duration(minutes) * time.Minute),
+			Measurements: Measurements{PH: float64Ptr(ph)},
+		}
+	}
+
+	batch := []database.Observation{wqo("wqo1", 0, 6.5), wqo("wqo1", 10, 6.8), wqo("wqo2", 0, 7.1), wqo("wqo1", 0, 7.0)}
+
+	results, err := db.StoreObservations(Kind, batch, database.DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(len(results), len(batch))
+	is.NoErr(results[0].Err)
+	is.True(errors.Is(results[3].Err, database.ErrDuplicate)) // a duplicate within the batch
+
+	results, err = db.StoreObservations(Kind, batch[3:], database.DuplicatesOverwrite)
+	is.NoErr(err)
+	is.Equal(results[0].Result, database.StoreResultOverwritten)
+
+	wqos, _ := db.GetObservations(Kind, "dev1", time.Time{}, time.Time{}, 100)
+	is.Equal(len(wqos), 3)
+
+	deleted, err := db.DeleteObservations(Kind, []string{"wqo1", "unknown"}, false)
+	is.NoErr(err)
+	is.Equal(deleted["wqo1"], int64(2))
+	is.Equal(deleted["unknown"], int64(0))
+
+	wqos, _ = db.GetObservations(Kind, "dev1", time.Time{}, time.Time{}, 100)
+	is.Equal(len(wqos), 1)
+	is.Equal(wqos[0].(*Observation).EntityId, "wqo2")
+}
+
+func setupTest(t *testing.T) (*is.I, database.Datastore) {
+	is := is.New(t)
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(log.Logger))
+	is.NoErr(err)
+
+	return is, db
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+const wqoJson string = `{
+    "id": "urn:ngsi-ld:WaterQualityObserved:wqo1",
+    "type": "WaterQualityObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:15:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "refDevice": {
+        "type": "Relationship",
+        "object": "urn:ngsi-ld:Device:dev1"
+    },
+    "temperature": {"type": "Property", "value": 8.5},
+    "pH": {"type": "Property", "value": 7.2},
+    "O2": {"type": "Property", "value": 10.4},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
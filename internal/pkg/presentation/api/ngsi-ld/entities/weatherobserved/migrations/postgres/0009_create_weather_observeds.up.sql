@@ -0,0 +1,23 @@
+-- Observations of weather stations. An entity can only have one observation per point in time.
+CREATE TABLE weather_observeds (
+    id              BIGSERIAL PRIMARY KEY,
+    created_at      TIMESTAMPTZ,
+    updated_at      TIMESTAMPTZ,
+    deleted_at      TIMESTAMPTZ,
+    entity_id       TEXT NOT NULL,
+    device_id       TEXT NOT NULL DEFAULT '',
+    latitude        DOUBLE PRECISION,
+    longitude       DOUBLE PRECISION,
+    "timestamp"     TIMESTAMPTZ NOT NULL,
+    temperature     DOUBLE PRECISION,
+    humidity        DOUBLE PRECISION,
+    pressure        DOUBLE PRECISION,
+    wind_speed      DOUBLE PRECISION,
+    wind_direction  DOUBLE PRECISION,
+    precipitation   DOUBLE PRECISION,
+    solar_radiation DOUBLE PRECISION
+);
+
+CREATE INDEX idx_weather_observeds_deleted_at ON weather_observeds (deleted_at);
+CREATE INDEX idx_weather_observeds_device_timestamp ON weather_observeds (device_id, "timestamp" DESC);
+CREATE UNIQUE INDEX idx_weather_observeds_entity_timestamp ON weather_observeds (entity_id, "timestamp");
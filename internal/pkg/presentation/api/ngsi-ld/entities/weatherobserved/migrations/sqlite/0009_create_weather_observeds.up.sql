@@ -0,0 +1,23 @@
+-- Observations of weather stations. An entity can only have one observation per point in time.
+CREATE TABLE weather_observeds (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at      DATETIME,
+    updated_at      DATETIME,
+    deleted_at      DATETIME,
+    entity_id       TEXT NOT NULL,
+    device_id       TEXT NOT NULL DEFAULT '',
+    latitude        REAL,
+    longitude       REAL,
+    "timestamp"     DATETIME NOT NULL,
+    temperature     REAL,
+    humidity        REAL,
+    pressure        REAL,
+    wind_speed      REAL,
+    wind_direction  REAL,
+    precipitation   REAL,
+    solar_radiation REAL
+);
+
+CREATE INDEX idx_weather_observeds_deleted_at ON weather_observeds (deleted_at);
+CREATE INDEX idx_weather_observeds_device_timestamp ON weather_observeds (device_id, "timestamp" DESC);
+CREATE UNIQUE INDEX idx_weather_observeds_entity_timestamp ON weather_observeds (entity_id, "timestamp");
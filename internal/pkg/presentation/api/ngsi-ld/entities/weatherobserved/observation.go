@@ -0,0 +1,103 @@
+package weatherobserved
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"gorm.io/gorm"
+)
+
+//Observation is a single observation of the weather conditions at a location. The schema of its
+//table is created by the migrations of this package.
+type Observation struct {
+	gorm.Model
+	EntityId  string
+	DeviceId  string
+	Latitude  float64
+	Longitude float64
+	Timestamp time.Time
+	Measurements
+}
+
+func (Observation) TableName() string {
+	return "weather_observeds"
+}
+
+func (o *Observation) Key() (string, time.Time) {
+	return o.EntityId, o.Timestamp
+}
+
+func (o *Observation) Source() (string, time.Time) {
+	return o.DeviceId, o.Timestamp
+}
+
+func (o *Observation) Position() (float64, float64) {
+	return o.Latitude, o.Longitude
+}
+
+//Measurements contains the values that can be observed by a weather station, as defined by the
+//FIWARE WeatherObserved data model. Values that were not part of an observation are nil and
+//stored as NULL.
+type Measurements struct {
+	Temperature *float64
+	//Humidity is the relative humidity, as a fraction between 0 and 1
+	Humidity *float64
+	//Pressure is the atmospheric pressure in hPa
+	Pressure *float64
+	//WindSpeed is measured in m/s
+	WindSpeed *float64
+	//WindDirection is the direction the wind is blowing from, in degrees clockwise from north
+	WindDirection *float64
+	//Precipitation is measured in l/m²
+	Precipitation *float64
+	//SolarRadiation is measured in W/m²
+	SolarRadiation *float64
+}
+
+//Attributes returns the measurements keyed on their NGSI-LD attribute names
+func (m Measurements) Attributes() map[string]*float64 {
+	return map[string]*float64{
+		"temperature":         m.Temperature,
+		"relativeHumidity":    m.Humidity,
+		"atmosphericPressure": m.Pressure,
+		"windSpeed":           m.WindSpeed,
+		"windDirection":       m.WindDirection,
+		"precipitation":       m.Precipitation,
+		"solarRadiation":      m.SolarRadiation,
+	}
+}
+
+//validate makes sure that the measurements are physically possible
+func (m Measurements) validate() error {
+	if m.Humidity != nil && (*m.Humidity < 0 || *m.Humidity > 1) {
+		return fmt.Errorf("relativeHumidity %f is outside the valid range [0, 1]", *m.Humidity)
+	}
+
+	if m.WindDirection != nil && (*m.WindDirection < 0 || *m.WindDirection > 360) {
+		return fmt.Errorf("windDirection %f is outside the valid range [0, 360]", *m.WindDirection)
+	}
+
+	nonNegative := map[string]*float64{
+		"atmosphericPressure": m.Pressure,
+		"windSpeed":           m.WindSpeed,
+		"precipitation":       m.Precipitation,
+		"solarRadiation":      m.SolarRadiation,
+	}
+
+	for name, value := range nonNegative {
+		if value != nil && *value < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+//Kind describes how weather observations are stored and queried
+var Kind = &database.ObservationKind{
+	Name:       TypeName,
+	New:        func() database.Observation { return &Observation{} },
+	Columns:    []string{"temperature", "humidity", "pressure", "wind_speed", "wind_direction", "precipitation", "solar_radiation"},
+	TimeColumn: "timestamp",
+}
@@ -0,0 +1,235 @@
+package weatherobserved
+
+import (
+	"embed"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+const (
+	TypeName string = fiware.WeatherObservedTypeName
+	IDPrefix string = fiware.WeatherObservedIDPrefix
+)
+
+//weatherObserved extends the fiware WeatherObserved with the measurements that are defined by
+//the smart data model, but are not (yet) supported by the ngsi-ld library
+type weatherObserved struct {
+	fiware.WeatherObserved
+	weatherMeasurements
+}
+
+type weatherMeasurements struct {
+	RelativeHumidity    *types.NumberProperty `json:"relativeHumidity,omitempty"`
+	AtmosphericPressure *types.NumberProperty `json:"atmosphericPressure,omitempty"`
+	WindSpeed           *types.NumberProperty `json:"windSpeed,omitempty"`
+	WindDirection       *types.NumberProperty `json:"windDirection,omitempty"`
+	Precipitation       *types.NumberProperty `json:"precipitation,omitempty"`
+	SolarRadiation      *types.NumberProperty `json:"solarRadiation,omitempty"`
+}
+
+//attributeColumns maps the attributes that can be used in queries to their stored columns
+var attributeColumns = map[string]string{
+	"refDevice":           "device_id",
+	"temperature":         "temperature",
+	"relativeHumidity":    "humidity",
+	"atmosphericPressure": "pressure",
+	"windSpeed":           "wind_speed",
+	"windDirection":       "wind_direction",
+	"precipitation":       "precipitation",
+	"solarRadiation":      "solar_radiation",
+}
+
+//New returns the WeatherObserved entity type
+func New() entities.EntityType {
+	return entityType{}
+}
+
+//go:embed migrations
+var migrations embed.FS
+
+func init() {
+	database.RegisterMigrations(migrations)
+	database.RegisterObservationKind(Kind)
+	entities.Register(New())
+}
+
+type entityType struct{}
+
+func (entityType) Name() string {
+	return TypeName
+}
+
+func (entityType) IDPrefix() string {
+	return IDPrefix
+}
+
+func (entityType) AttributeColumns() map[string]string {
+	return attributeColumns
+}
+
+func (entityType) ProvidesAttribute(attributeName string) bool {
+	_, ok := attributeColumns[attributeName]
+	return ok || attributeName == "dateObserved"
+}
+
+func (entityType) Decode(body []byte) (ngsi.Entity, error) {
+	wo := &weatherObserved{}
+	err := json.Unmarshal(body, wo)
+	return wo, err
+}
+
+func (entityType) Validate(entity ngsi.Entity) error {
+	wo := entity.(*weatherObserved)
+
+	err := entities.ValidateID(wo.ID, IDPrefix)
+	if err != nil {
+		return err
+	}
+
+	o, err := wo.observation()
+	if err != nil {
+		return err
+	}
+
+	return entities.InvalidEntity(o.validate())
+}
+
+func (entityType) Repository(app application.EnvironmentApp) entities.Repository {
+	return repository{app: app, WholeObservations: entities.WholeObservations{TypeName: TypeName}}
+}
+
+func (entityType) Encode(observation interface{}) (ngsi.Entity, bool) {
+	w, ok := observation.(*Observation)
+	if !ok {
+		return nil, false
+	}
+
+	return newWeatherObserved(w), true
+}
+
+type repository struct {
+	app application.EnvironmentApp
+	entities.WholeObservations
+}
+
+func (r repository) Store(entity ngsi.Entity) (database.StoreResult, error) {
+	o, err := entity.(*weatherObserved).observation()
+	if err != nil {
+		return database.StoreResultCreated, err
+	}
+
+	return r.app.StoreObservation(Kind, o)
+}
+
+func (r repository) StoreBatch(batch []ngsi.Entity, upsert bool) ([]error, error) {
+	observations := []database.Observation{}
+	for _, entity := range batch {
+		o, err := entity.(*weatherObserved).observation()
+		if err != nil {
+			return nil, err
+		}
+		observations = append(observations, o)
+	}
+
+	return entities.BatchErrors(r.app.StoreObservations(Kind, observations, upsert))
+}
+
+func (r repository) Delete(entityIds []string, purge bool) ([]error, error) {
+	return r.app.DeleteObservations(Kind, entityIds, purge)
+}
+
+func (r repository) Retrieve(entityId string) (interface{}, error) {
+	return r.app.RetrieveObservation(Kind, entityId)
+}
+
+func (r repository) Query(deviceId string, from, to time.Time, limit uint64, options ...database.QueryOption) ([]entities.Observation, error) {
+	wos, err := r.app.RetrieveObservations(Kind, deviceId, from, to, limit, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	observations := []entities.Observation{}
+	for _, o := range wos {
+		w := o.(*Observation)
+		observations = append(observations, entities.Observation{ID: w.ID, EntityId: w.EntityId, ObservedAt: w.Timestamp, Value: w})
+	}
+
+	return observations, nil
+}
+
+//newWeatherObserved converts a stored observation into an NGSI-LD entity, leaving out any
+//attributes that were not part of the observation
+func newWeatherObserved(w *Observation) *weatherObserved {
+	wo := &weatherObserved{
+		WeatherObserved: *fiware.NewWeatherObserved(w.EntityId, w.Latitude, w.Longitude, w.Timestamp.UTC().Format(time.RFC3339)),
+	}
+
+	wo.ID = IDPrefix + w.EntityId
+	wo.RefDevice = nil
+
+	if w.DeviceId != "" {
+		wo.RefDevice = types.NewSingleObjectRelationship(fiware.DeviceIDPrefix + w.DeviceId)
+	}
+
+	wo.Temperature = entities.NumberProperty(w.Temperature)
+	wo.RelativeHumidity = entities.NumberProperty(w.Humidity)
+	wo.AtmosphericPressure = entities.NumberProperty(w.Pressure)
+	wo.WindSpeed = entities.NumberProperty(w.WindSpeed)
+	wo.WindDirection = entities.NumberProperty(w.WindDirection)
+	wo.Precipitation = entities.NumberProperty(w.Precipitation)
+	wo.SolarRadiation = entities.NumberProperty(w.SolarRadiation)
+
+	return wo
+}
+
+//observation converts a created entity into an observation that can be stored
+func (wo weatherObserved) observation() (*Observation, error) {
+	dateObserved, err := time.Parse(time.RFC3339, wo.DateObserved.Value.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	latitude, longitude, err := entities.PositionFromLocation(wo.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	refDevice := ""
+	if wo.RefDevice != nil {
+		refDevice = strings.TrimPrefix(wo.RefDevice.Object, fiware.DeviceIDPrefix)
+	}
+
+	return &Observation{
+		EntityId:  strings.TrimPrefix(wo.ID, IDPrefix),
+		DeviceId:  refDevice,
+		Latitude:  latitude,
+		Longitude: longitude,
+		Timestamp: dateObserved.UTC(),
+		Measurements: Measurements{
+			Temperature:    entities.NumberValue(wo.Temperature),
+			Humidity:       entities.NumberValue(wo.RelativeHumidity),
+			Pressure:       entities.NumberValue(wo.AtmosphericPressure),
+			WindSpeed:      entities.NumberValue(wo.WindSpeed),
+			WindDirection:  entities.NumberValue(wo.WindDirection),
+			Precipitation:  entities.NumberValue(wo.Precipitation),
+			SolarRadiation: entities.NumberValue(wo.SolarRadiation),
+		},
+	}, nil
+}
+
+func (wo *weatherObserved) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, &wo.WeatherObserved)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &wo.weatherMeasurements)
+}
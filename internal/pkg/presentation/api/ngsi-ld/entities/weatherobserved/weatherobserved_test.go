@@ -0,0 +1,161 @@
+package weatherobserved
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/models"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/matryer/is"
+	"github.com/rs/zerolog/log"
+)
+
+func TestStoreWeatherObserved(t *testing.T) {
+	is := is.New(t)
+	app := &application.EnvironmentAppMock{
+		StoreObservationFunc: func(kind *database.ObservationKind, observation database.Observation) (database.StoreResult, error) {
+			return database.StoreResultCreated, nil
+		},
+	}
+
+	wot := New()
+	entity, err := wot.Decode([]byte(woJson))
+	is.NoErr(err)
+	is.NoErr(wot.Validate(entity))
+
+	_, err = wot.Repository(app).Store(entity)
+	is.NoErr(err)
+
+	is.Equal(len(app.StoreObservationCalls()), 1)
+	call := app.StoreObservationCalls()[0]
+	is.Equal(call.Kind, Kind)
+
+	wo := call.Observation.(*Observation)
+	is.Equal(wo.EntityId, "wo1")
+	is.Equal(*wo.Humidity, 0.82)
+	is.Equal(*wo.WindDirection, 225.0)
+	is.Equal(wo.SolarRadiation, nil) // solarRadiation was not observed
+	is.Equal(wo.Timestamp.Format(time.RFC3339), "2022-03-21T08:00:00Z")
+}
+
+func TestValidateWeatherObservedWithTheWrongIDPrefix(t *testing.T) {
+	is := is.New(t)
+
+	wot := New()
+	entity, err := wot.Decode([]byte(strings.Replace(woJson, IDPrefix, "urn:ngsi-ld:AirQualityObserved:", 1)))
+	is.NoErr(err)
+
+	err = wot.Validate(entity)
+	is.True(errors.Is(err, entities.ErrInvalidEntity))
+}
+
+func TestValidateWeatherObservedWithImpossibleMeasurements(t *testing.T) {
+	is := is.New(t)
+
+	wot := New()
+	for _, measurement := range []string{`"relativeHumidity": {"type": "Property", "value": 80}`, `"relativeHumidity": {"type": "Property", "value": 0.82}, "precipitation": {"type": "Property", "value": -0.2}`} {
+		entity, err := wot.Decode([]byte(strings.Replace(woJson, `"relativeHumidity": {"type": "Property", "value": 0.82}`, measurement, 1)))
+		is.NoErr(err)
+
+		err = wot.Validate(entity)
+		is.True(errors.Is(err, entities.ErrInvalidEntity))
+	}
+}
+
+func TestEncodeWeatherObserved(t *testing.T) {
+	is := is.New(t)
+
+	temperature := -3.5
+	entity, ok := New().Encode(&Observation{
+		EntityId:     "wo1",
+		Timestamp:    time.Date(2022, 3, 21, 8, 0, 0, 0, time.UTC),
+		Measurements: Measurements{Temperature: &temperature},
+	})
+	is.True(ok)
+
+	b, _ := json.Marshal(entity)
+	wo := map[string]interface{}{}
+	is.NoErr(json.Unmarshal(b, &wo))
+	is.Equal(wo["id"], "urn:ngsi-ld:WeatherObserved:wo1")
+	is.Equal(wo["temperature"].(map[string]interface{})["value"], -3.5)
+	_, ok = wo["windSpeed"]
+	is.True(!ok) // the wind speed was not observed
+
+	_, ok = New().Encode(&models.AirQualityObserved{})
+	is.True(!ok) // observations of other types should not be encoded
+}
+
+func TestThatWeatherObservedsAreStoredInTheirOwnTable(t *testing.T) {
+	is := is.New(t)
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(log.Logger))
+	is.NoErr(err)
+
+	observedAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	weather := func(windSpeed float64, timestamp time.Time) *Observation {
+		return &Observation{
+			EntityId: "wo1", DeviceId: "dev1", Latitude: 62.39, Longitude: 17.30, Timestamp: timestamp,
+			Measurements: Measurements{Temperature: float64Ptr(-2.5), WindSpeed: float64Ptr(windSpeed), WindDirection: float64Ptr(270.0), SolarRadiation: float64Ptr(120.0)},
+		}
+	}
+
+	_, result, err := db.StoreObservation(Kind, weather(7.0, observedAt), database.DuplicatesReject)
+	is.NoErr(err)
+	is.Equal(result, database.StoreResultCreated)
+
+	_, result, err = db.StoreObservation(Kind, weather(7.0, observedAt), database.DuplicatesIgnore)
+	is.NoErr(err)
+	is.Equal(result, database.StoreResultIgnored)
+
+	db.StoreObservation(Kind, weather(2.0, observedAt.Add(time.Hour)), database.DuplicatesReject)
+
+	latest, err := db.GetObservation(Kind, "wo1")
+	is.NoErr(err)
+	wo := latest.(*Observation)
+	is.Equal(*wo.WindSpeed, 2.0)
+	is.Equal(*wo.SolarRadiation, 120.0)
+	is.True(wo.Precipitation == nil)
+
+	wos, err := db.GetObservations(Kind, "dev1", observedAt, observedAt.Add(time.Minute), 100)
+	is.NoErr(err)
+	is.Equal(len(wos), 1)
+
+	wos, err = db.GetObservations(Kind, "", time.Time{}, time.Time{}, 100, database.WithFilter(database.Filter{Column: "wind_speed", Operator: database.FilterGreater, Values: []interface{}{5.0}}))
+	is.NoErr(err)
+	is.Equal(len(wos), 1)
+	is.True(wos[0].(*Observation).Timestamp.Equal(observedAt))
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+const woJson string = `{
+    "id": "urn:ngsi-ld:WeatherObserved:wo1",
+    "type": "WeatherObserved",
+    "dateObserved": {
+        "type": "Property",
+        "value": {
+            "@type": "DateTime",
+            "@value": "2022-03-21T08:00:00Z"
+        }
+    },
+    "location": {
+        "type": "GeoProperty",
+        "value": {
+            "type": "Point",
+            "coordinates": [17.3069, 62.3908]
+        }
+    },
+    "temperature": {"type": "Property", "value": -3.5},
+    "relativeHumidity": {"type": "Property", "value": 0.82},
+    "windDirection": {"type": "Property", "value": 225},
+    "@context": [
+        "https://schema.lab.fiware.org/ld/context",
+        "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+    ]
+}`
@@ -0,0 +1,126 @@
+package geoquery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+type contextKey struct{}
+
+var geoQueryKey = contextKey{}
+
+var geoQueryParameters = []string{"georel", "geometry", "coordinates", "geoproperty"}
+
+//FromContext returns the GeoQuery that was stored in the context by the Middleware, if any
+func FromContext(ctx context.Context) (*database.GeoQuery, bool) {
+	gq, ok := ctx.Value(geoQueryKey).(*database.GeoQuery)
+	return gq, ok
+}
+
+//Middleware parses any geo-query parameters in the request and stores the result in the
+//request context. The parameters are then removed from the URL before the request is passed
+//on, as the ngsi-ld library handlers only understand a subset of the NGSI-LD geo-queries.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gq, err := Parse(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if gq == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(context.WithValue(r.Context(), geoQueryKey, gq))
+
+		params := r.URL.Query()
+		for _, p := range geoQueryParameters {
+			params.Del(p)
+		}
+		r.URL.RawQuery = params.Encode()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Parse extracts a GeoQuery from the georel, geometry, coordinates and geoproperty parameters
+//of a request, or returns nil if the request does not contain a geo-query
+func Parse(r *http.Request) (*database.GeoQuery, error) {
+	params := r.URL.Query()
+
+	georel := params.Get("georel")
+	if georel == "" {
+		return nil, nil
+	}
+
+	geoproperty := params.Get("geoproperty")
+	if geoproperty != "" && geoproperty != "location" {
+		return nil, fmt.Errorf("geo-queries against the property %s are not supported", geoproperty)
+	}
+
+	gq := &database.GeoQuery{Geometry: params.Get("geometry")}
+
+	relation := strings.Split(georel, ";")
+	gq.Relation = relation[0]
+
+	if gq.Relation == database.GeoRelationNear {
+		if len(relation) != 2 || !strings.HasPrefix(relation[1], "maxDistance==") {
+			return nil, errors.New("the geospatial relationship near requires a maxDistance modifier")
+		}
+
+		distance, err := strconv.ParseFloat(strings.TrimPrefix(relation[1], "maxDistance=="), 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse distance: %s", err.Error())
+		}
+		gq.MaxDistance = distance
+	} else if len(relation) > 1 {
+		return nil, fmt.Errorf("unexpected modifier %s for the geospatial relationship %s", relation[1], gq.Relation)
+	}
+
+	coordinates := params.Get("coordinates")
+	if coordinates == "" {
+		return nil, errors.New("required parameter coordinates is missing")
+	}
+
+	var err error
+
+	switch gq.Geometry {
+	case database.GeometryPoint:
+		position := [2]float64{}
+		err = json.Unmarshal([]byte(coordinates), &position)
+		gq.Coordinates = [][2]float64{position}
+	case database.GeometryPolygon:
+		rings := [][][2]float64{}
+		err = json.Unmarshal([]byte(coordinates), &rings)
+		if err == nil && len(rings) != 1 {
+			err = errors.New("only polygons with a single linear ring are supported")
+		} else if err == nil {
+			gq.Coordinates = rings[0]
+		}
+	case "":
+		return nil, errors.New("required parameter geometry is missing")
+	default:
+		return nil, fmt.Errorf("geometry type %s is not supported", gq.Geometry)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse coordinates: %s", err.Error())
+	}
+
+	err = gq.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return gq, nil
+}
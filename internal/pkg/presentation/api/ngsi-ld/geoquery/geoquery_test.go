@@ -0,0 +1,67 @@
+package geoquery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/matryer/is"
+)
+
+func TestParseNearPoint(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?georel=near%3BmaxDistance==2000&geometry=Point&coordinates=[-3.712247,40.423852]", nil)
+
+	gq, err := Parse(req)
+	is.NoErr(err)
+	is.Equal(gq.Relation, database.GeoRelationNear)
+	is.Equal(gq.MaxDistance, 2000.0)
+	is.Equal(gq.Coordinates[0], [2]float64{-3.712247, 40.423852})
+}
+
+func TestParseWithinPolygon(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?georel=within&geometry=Polygon&coordinates=[[[17.30,62.38],[17.32,62.38],[17.32,62.40],[17.30,62.38]]]", nil)
+
+	gq, err := Parse(req)
+	is.NoErr(err)
+	is.Equal(gq.Relation, database.GeoRelationWithin)
+	is.Equal(len(gq.Coordinates), 4)
+}
+
+func TestParseNearPolygonFails(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?georel=near%3BmaxDistance==2000&geometry=Polygon&coordinates=[[[17.30,62.38],[17.32,62.38],[17.32,62.40],[17.30,62.38]]]", nil)
+
+	_, err := Parse(req)
+	is.True(err != nil) // near is only defined for Point
+}
+
+func TestMiddlewareRemovesGeoQueryParameters(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&georel=intersects&geometry=Point&coordinates=[17.3,62.3]", nil)
+	w := httptest.NewRecorder()
+
+	var forwarded *http.Request
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	})).ServeHTTP(w, req)
+
+	is.Equal(forwarded.URL.RawQuery, "type=AirQualityObserved")
+	gq, ok := FromContext(forwarded.Context())
+	is.True(ok) // the parsed geo query should be available in the request context
+	is.Equal(gq.Relation, database.GeoRelationIntersects)
+}
+
+func TestMiddlewareReportsBadRequestForInvalidGeoQuery(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&georel=disjoint&geometry=Point&coordinates=[17.3,62.3]", nil)
+	w := httptest.NewRecorder()
+
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
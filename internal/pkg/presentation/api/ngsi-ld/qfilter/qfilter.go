@@ -0,0 +1,240 @@
+package qfilter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+type contextKey struct{}
+
+var filterKey = contextKey{}
+
+//FromContext returns the Filter that was stored in the context by the Middleware, if any
+func FromContext(ctx context.Context) (*database.Filter, bool) {
+	f, ok := ctx.Value(filterKey).(*database.Filter)
+	return f, ok
+}
+
+//Middleware parses the q parameter of a request and stores the resulting Filter in the request
+//context. The parameter is left in place, as the ngsi-ld library still uses it to find refDevice.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if q == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := Parse(q)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r.Clone(context.WithValue(r.Context(), filterKey, f)))
+	})
+}
+
+//Parse converts a query written in the NGSI-LD query language into a Filter. Comparisons,
+//lists of values, ranges, parentheses and the logical operators ; (and) and | (or) are
+//supported, where and takes precedence over or. The Column of every comparison is left
+//empty and has to be resolved by the caller.
+func Parse(q string) (*database.Filter, error) {
+	p := &parser{input: q}
+
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return &f, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek(token string) bool {
+	return strings.HasPrefix(p.input[p.pos:], token)
+}
+
+func (p *parser) accept(token string) bool {
+	if p.peek(token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid query at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseOr() (database.Filter, error) {
+	return p.parseLogical(database.FilterOr, p.parseAnd)
+}
+
+func (p *parser) parseAnd() (database.Filter, error) {
+	return p.parseLogical(database.FilterAnd, p.parseTerm)
+}
+
+//parseLogical parses one or more terms separated by the logical operator op
+func (p *parser) parseLogical(op string, parseTerm func() (database.Filter, error)) (database.Filter, error) {
+	term, err := parseTerm()
+	if err != nil {
+		return term, err
+	}
+
+	if !p.peek(op) {
+		return term, nil
+	}
+
+	f := database.Filter{Logical: op, Terms: []database.Filter{term}}
+
+	for p.accept(op) {
+		term, err = parseTerm()
+		if err != nil {
+			return f, err
+		}
+		f.Terms = append(f.Terms, term)
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseTerm() (database.Filter, error) {
+	if p.accept("(") {
+		f, err := p.parseOr()
+		if err != nil {
+			return f, err
+		}
+
+		if !p.accept(")") {
+			return f, p.errorf("missing closing parenthesis")
+		}
+
+		return f, nil
+	}
+
+	f := database.Filter{Attribute: p.parseAttribute()}
+	if f.Attribute == "" {
+		return f, p.errorf("expected an attribute name")
+	}
+
+	if p.peek("~=") || p.peek("!~=") {
+		return f, p.errorf("pattern matching is not supported")
+	}
+
+	for _, op := range []string{
+		database.FilterEqual, database.FilterNotEqual,
+		database.FilterGreaterOrEqual, database.FilterGreater,
+		database.FilterLessOrEqual, database.FilterLess,
+	} {
+		if p.accept(op) {
+			f.Operator = op
+			break
+		}
+	}
+
+	if f.Operator == "" {
+		// A bare attribute name only requires the attribute to exist
+		return f, nil
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return f, err
+	}
+	f.Values = []interface{}{value}
+
+	isEquality := f.Operator == database.FilterEqual || f.Operator == database.FilterNotEqual
+
+	if p.accept("..") {
+		if !isEquality {
+			return f, p.errorf("ranges can only be used with == and !=")
+		}
+
+		value, err = p.parseValue()
+		if err != nil {
+			return f, err
+		}
+		f.Values = append(f.Values, value)
+		f.IsRange = true
+	} else {
+		for p.peek(",") && isEquality {
+			p.accept(",")
+
+			value, err = p.parseValue()
+			if err != nil {
+				return f, err
+			}
+			f.Values = append(f.Values, value)
+		}
+	}
+
+	return f, nil
+}
+
+func (p *parser) parseAttribute() string {
+	start := p.pos
+
+	for !p.done() {
+		c := p.input[p.pos]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == ':' ||
+			(c == '.' && !p.peek("..")) {
+			p.pos++
+			continue
+		}
+		break
+	}
+
+	return p.input[start:p.pos]
+}
+
+//parseValue parses a quoted string or a number
+func (p *parser) parseValue() (interface{}, error) {
+	if p.accept(`"`) {
+		end := strings.Index(p.input[p.pos:], `"`)
+		if end < 0 {
+			return nil, p.errorf("unterminated string")
+		}
+
+		value := p.input[p.pos : p.pos+end]
+		p.pos += end + 1
+		return value, nil
+	}
+
+	start := p.pos
+
+	for !p.done() {
+		c := p.input[p.pos]
+		if (c >= '0' && c <= '9') || c == '-' || c == '+' || c == 'e' || c == 'E' || (c == '.' && !p.peek("..")) {
+			p.pos++
+			continue
+		}
+		break
+	}
+
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("expected a number or a quoted string")
+	}
+
+	return value, nil
+}
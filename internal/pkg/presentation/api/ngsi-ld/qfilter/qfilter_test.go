@@ -0,0 +1,90 @@
+package qfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/matryer/is"
+)
+
+func TestParseComparison(t *testing.T) {
+	is := is.New(t)
+
+	f, err := Parse("CO2>1000")
+	is.NoErr(err)
+	is.Equal(f.Attribute, "CO2")
+	is.Equal(f.Operator, database.FilterGreater)
+	is.Equal(f.Values, []interface{}{1000.0})
+}
+
+func TestParseRangeAndList(t *testing.T) {
+	is := is.New(t)
+
+	f, err := Parse("PM2.5==10..25.5;temperature!=1,2,-3.5")
+	is.NoErr(err)
+	is.Equal(f.Logical, database.FilterAnd)
+	is.Equal(f.Terms[0].Attribute, "PM2.5")
+	is.True(f.Terms[0].IsRange)
+	is.Equal(f.Terms[0].Values, []interface{}{10.0, 25.5})
+	is.Equal(f.Terms[1].Operator, database.FilterNotEqual)
+	is.Equal(f.Terms[1].Values, []interface{}{1.0, 2.0, -3.5})
+}
+
+func TestParseGivesAndPrecedenceOverOr(t *testing.T) {
+	is := is.New(t)
+
+	f, err := Parse(`NO2>40|CO2>1000;refDevice=="urn:ngsi-ld:Device:dev1"`)
+	is.NoErr(err)
+	is.Equal(f.Logical, database.FilterOr)
+	is.Equal(len(f.Terms), 2)
+	is.Equal(f.Terms[1].Logical, database.FilterAnd)
+	is.Equal(f.Terms[1].Terms[1].Values, []interface{}{"urn:ngsi-ld:Device:dev1"})
+}
+
+func TestParseParenthesesAndExistence(t *testing.T) {
+	is := is.New(t)
+
+	f, err := Parse("(NO2>40|CO2>1000);temperature")
+	is.NoErr(err)
+	is.Equal(f.Logical, database.FilterAnd)
+	is.Equal(f.Terms[0].Logical, database.FilterOr)
+	is.Equal(f.Terms[1].Attribute, "temperature")
+	is.Equal(f.Terms[1].Operator, "")
+}
+
+func TestParseInvalidQueriesFails(t *testing.T) {
+	is := is.New(t)
+
+	for _, q := range []string{"CO2>", "(CO2>1", "CO2>>1", "CO2>1..2", `name~="foo"`, "CO2==1;", `refDevice=="dev1`} {
+		_, err := Parse(q)
+		is.True(err != nil) // expected the query to be rejected
+	}
+}
+
+func TestMiddlewareStoresFilterInContext(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&q="+url.QueryEscape("CO2>=800"), nil)
+	w := httptest.NewRecorder()
+
+	var forwarded *http.Request
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	})).ServeHTTP(w, req)
+
+	f, ok := FromContext(forwarded.Context())
+	is.True(ok) // the parsed filter should be available in the request context
+	is.Equal(f.Operator, database.FilterGreaterOrEqual)
+}
+
+func TestMiddlewareReportsBadRequestForInvalidQuery(t *testing.T) {
+	is := is.New(t)
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=AirQualityObserved&q="+url.QueryEscape("CO2>"), nil)
+	w := httptest.NewRecorder()
+
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, req)
+
+	is.Equal(w.Code, http.StatusBadRequest)
+}
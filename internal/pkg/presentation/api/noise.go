@@ -0,0 +1,94 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities/noiselevelobserved"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+type noiseIndicatorsJSON struct {
+	EntityID string   `json:"entityId"`
+	DeviceID string   `json:"deviceId,omitempty"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Lday     *float64 `json:"Lday,omitempty"`
+	Levening *float64 `json:"Levening,omitempty"`
+	Lnight   *float64 `json:"Lnight,omitempty"`
+	Lden     *float64 `json:"Lden,omitempty"`
+}
+
+//NewQueryNoiseIndicatorsHandler returns Lday, Levening, Lnight and Lden per NoiseLevelObserved
+//entity, computed from the intervals that were observed between from and to. The indicators can
+//be limited to a device, and the periods of the day are determined in the IANA time zone given
+//by the timezone parameter, or in UTC if it is missing.
+func NewQueryNoiseIndicatorsHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		from, err := parseTimeParameter(params.Get("from"), "from")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		to, err := parseTimeParameter(params.Get("to"), "to")
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if !from.Before(to) {
+			ngsierrors.ReportNewBadRequestData(w, "from must be before to")
+			return
+		}
+
+		location := time.UTC
+		if params.Get("timezone") != "" {
+			location, err = time.LoadLocation(params.Get("timezone"))
+			if err != nil {
+				ngsierrors.ReportNewBadRequestData(w, "unknown timezone "+params.Get("timezone"))
+				return
+			}
+		}
+
+		deviceID := strings.TrimPrefix(params.Get("deviceId"), fiware.DeviceIDPrefix)
+
+		indicators, err := noiselevelobserved.RetrieveNoiseIndicators(app, deviceID, from.UTC(), to.UTC(), location)
+		if err != nil {
+			reportInternalError(w, "failed to retrieve noise indicators: "+err.Error())
+			return
+		}
+
+		response := []noiseIndicatorsJSON{}
+		for _, i := range indicators {
+			response = append(response, noiseIndicatorsJSON{
+				EntityID: noiselevelobserved.IDPrefix + i.EntityId,
+				DeviceID: i.DeviceId,
+				From:     i.From.UTC().Format(time.RFC3339),
+				To:       i.To.UTC().Format(time.RFC3339),
+				Lday:     roundDecibels(i.Lday),
+				Levening: roundDecibels(i.Levening),
+				Lnight:   roundDecibels(i.Lnight),
+				Lden:     roundDecibels(i.Lden),
+			})
+		}
+
+		writeAdminResponse(w, response)
+	})
+}
+
+//roundDecibels rounds a sound level to a precision of 0.1 dB
+func roundDecibels(level *float64) *float64 {
+	if level == nil {
+		return nil
+	}
+
+	rounded := math.Round(*level*10) / 10
+	return &rounded
+}
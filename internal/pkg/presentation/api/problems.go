@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//problemDetails reports problems according to RFC7807 for the NGSI-LD error types that
+//are not provided by the ngsi-ld library
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (p problemDetails) writeResponse(w http.ResponseWriter, statusCode int) {
+	w.Header().Add("Content-Type", "application/problem+json")
+	w.Header().Add("Content-Language", "en")
+	w.WriteHeader(statusCode)
+
+	pdbytes, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		w.Write(pdbytes)
+	}
+}
+
+//reportResourceNotFound reports that the referred entity has not been found
+func reportResourceNotFound(w http.ResponseWriter, detail string) {
+	problemDetails{
+		Type:   "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound",
+		Title:  "Resource Not Found",
+		Detail: detail,
+	}.writeResponse(w, http.StatusNotFound)
+}
+
+//reportAlreadyExists reports that the entity, or in this case the observation, already exists
+func reportAlreadyExists(w http.ResponseWriter, detail string) {
+	problemDetails{
+		Type:   "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists",
+		Title:  "Already Exists",
+		Detail: detail,
+	}.writeResponse(w, http.StatusConflict)
+}
+
+//reportInternalError reports a failure that is not caused by the request. The InternalError of
+//the ngsi-ld library is sent as a 400 Bad Request, which makes clients treat it as permanent.
+func reportInternalError(w http.ResponseWriter, detail string) {
+	problemDetails{
+		Type:   "https://uri.etsi.org/ngsi-ld/errors/InternalError",
+		Title:  "Internal Error",
+		Detail: detail,
+	}.writeResponse(w, http.StatusInternalServerError)
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/context"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/qfilter"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/go-chi/chi/v5"
+)
+
+//NotificationEntityRenderer returns the renderer of the entities that are sent to subscribers
+func NotificationEntityRenderer() application.EntityRenderer {
+	return context.NotificationEntity
+}
+
+//subscriptionJSON is the NGSI-LD representation of a subscription
+type subscriptionJSON struct {
+	ID                string                   `json:"id,omitempty"`
+	Type              string                   `json:"type"`
+	Description       string                   `json:"description,omitempty"`
+	Entities          []subscriptionEntityJSON `json:"entities,omitempty"`
+	WatchedAttributes []string                 `json:"watchedAttributes,omitempty"`
+	Q                 string                   `json:"q,omitempty"`
+	//Throttling is the minimum number of seconds between two notifications
+	Throttling   float64                  `json:"throttling,omitempty"`
+	IsActive     *bool                    `json:"isActive,omitempty"`
+	Status       string                   `json:"status,omitempty"`
+	Notification subscriptionNotification `json:"notification"`
+	CreatedAt    string                   `json:"createdAt,omitempty"`
+	ModifiedAt   string                   `json:"modifiedAt,omitempty"`
+}
+
+type subscriptionEntityJSON struct {
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+}
+
+type subscriptionNotification struct {
+	Attributes       []string             `json:"attributes,omitempty"`
+	Format           string               `json:"format,omitempty"`
+	Endpoint         subscriptionEndpoint `json:"endpoint"`
+	Status           string               `json:"status,omitempty"`
+	TimesSent        int64                `json:"timesSent,omitempty"`
+	LastNotification string               `json:"lastNotification,omitempty"`
+	LastSuccess      string               `json:"lastSuccess,omitempty"`
+	LastFailure      string               `json:"lastFailure,omitempty"`
+}
+
+type subscriptionEndpoint struct {
+	URI    string `json:"uri"`
+	Accept string `json:"accept,omitempty"`
+}
+
+//NewCreateSubscriptionHandler creates a subscription and responds with its location
+func NewCreateSubscriptionHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sj := subscriptionJSON{}
+		err := json.NewDecoder(r.Body).Decode(&sj)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("unable to decode request payload: %s", err.Error()))
+			return
+		}
+
+		subscription, err := sj.subscription()
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		id, err := app.CreateSubscription(subscription)
+		if err != nil {
+			if errors.Is(err, application.ErrSubscriptionExists) {
+				reportAlreadyExists(w, err.Error())
+			} else if errors.Is(err, application.ErrInvalidSubscription) {
+				ngsierrors.ReportNewBadRequestData(w, err.Error())
+			} else {
+				reportInternalError(w, "failed to create subscription: "+err.Error())
+			}
+			return
+		}
+
+		w.Header().Add("Location", "/ngsi-ld/v1/subscriptions/"+id)
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+//NewQuerySubscriptionsHandler returns all subscriptions
+func NewQuerySubscriptionsHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptions, err := app.RetrieveSubscriptions()
+		if err != nil {
+			reportInternalError(w, "failed to retrieve subscriptions: "+err.Error())
+			return
+		}
+
+		response := []subscriptionJSON{}
+		for _, s := range subscriptions {
+			response = append(response, newSubscriptionJSON(s))
+		}
+
+		writeSubscriptionResponse(w, response)
+	})
+}
+
+//NewRetrieveSubscriptionHandler returns a single subscription
+func NewRetrieveSubscriptionHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := chi.URLParam(r, "subscriptionId")
+
+		subscription, err := app.RetrieveSubscription(subscriptionID)
+		if err != nil {
+			reportSubscriptionError(w, subscriptionID, err)
+			return
+		}
+
+		writeSubscriptionResponse(w, newSubscriptionJSON(*subscription))
+	})
+}
+
+//NewUpdateSubscriptionHandler applies the attributes in the request fragment to an existing subscription
+func NewUpdateSubscriptionHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := chi.URLParam(r, "subscriptionId")
+
+		existing, err := app.RetrieveSubscription(subscriptionID)
+		if err != nil {
+			reportSubscriptionError(w, subscriptionID, err)
+			return
+		}
+
+		// Decoding the fragment on top of the current representation replaces the attributes
+		// that are part of the fragment and keeps all others
+		sj := newSubscriptionJSON(*existing)
+		err = json.NewDecoder(r.Body).Decode(&sj)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, fmt.Sprintf("unable to decode request payload: %s", err.Error()))
+			return
+		}
+
+		if sj.ID != subscriptionID {
+			ngsierrors.ReportNewBadRequestData(w, "the id of a subscription can not be changed")
+			return
+		}
+
+		subscription, err := sj.subscription()
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		err = app.UpdateSubscription(subscription)
+		if err != nil {
+			reportSubscriptionError(w, subscriptionID, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//NewDeleteSubscriptionHandler deletes a subscription
+func NewDeleteSubscriptionHandler(app application.EnvironmentApp) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscriptionID := chi.URLParam(r, "subscriptionId")
+
+		err := app.DeleteSubscription(subscriptionID)
+		if err != nil {
+			reportSubscriptionError(w, subscriptionID, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func reportSubscriptionError(w http.ResponseWriter, subscriptionID string, err error) {
+	if errors.Is(err, application.ErrNotFound) {
+		reportResourceNotFound(w, fmt.Sprintf("subscription %s does not exist", subscriptionID))
+	} else if errors.Is(err, application.ErrInvalidSubscription) {
+		ngsierrors.ReportNewBadRequestData(w, err.Error())
+	} else {
+		reportInternalError(w, err.Error())
+	}
+}
+
+func writeSubscriptionResponse(w http.ResponseWriter, response interface{}) {
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		reportInternalError(w, "failed to encode response")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+//subscription validates the NGSI-LD specific parts of a subscription, such as the q expression,
+//and converts it into a subscription of the application
+func (sj subscriptionJSON) subscription() (application.Subscription, error) {
+	if sj.Type != "Subscription" {
+		return application.Subscription{}, fmt.Errorf("the type of a subscription must be Subscription")
+	}
+
+	if len(sj.Entities) != 1 || sj.Entities[0].Type == "" {
+		return application.Subscription{}, fmt.Errorf("a subscription must refer to exactly one entity type")
+	}
+
+	if sj.Notification.Format != "" && sj.Notification.Format != "normalized" {
+		return application.Subscription{}, fmt.Errorf("notification format %s is not supported", sj.Notification.Format)
+	}
+
+	subscription := application.Subscription{
+		ID:                     sj.ID,
+		Description:            sj.Description,
+		EntityType:             sj.Entities[0].Type,
+		EntityID:               sj.Entities[0].ID,
+		WatchedAttributes:      sj.WatchedAttributes,
+		Q:                      sj.Q,
+		NotificationAttributes: sj.Notification.Attributes,
+		Endpoint:               sj.Notification.Endpoint.URI,
+		Accept:                 sj.Notification.Endpoint.Accept,
+		Throttling:             time.Duration(sj.Throttling * float64(time.Second)),
+		IsActive:               sj.IsActive == nil || *sj.IsActive,
+	}
+
+	if sj.Q != "" {
+		filter, err := qfilter.Parse(sj.Q)
+		if err != nil {
+			return application.Subscription{}, err
+		}
+		subscription.Filter = filter
+	}
+
+	return subscription, nil
+}
+
+func newSubscriptionJSON(s application.Subscription) subscriptionJSON {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	isActive := s.IsActive
+	status := "active"
+	if !isActive {
+		status = "paused"
+	}
+
+	notificationStatus := "ok"
+	if !s.LastFailure.IsZero() && s.LastFailure.After(s.LastSuccess) {
+		notificationStatus = "failed"
+	}
+
+	return subscriptionJSON{
+		ID:                s.ID,
+		Type:              "Subscription",
+		Description:       s.Description,
+		Entities:          []subscriptionEntityJSON{{ID: s.EntityID, Type: s.EntityType}},
+		WatchedAttributes: s.WatchedAttributes,
+		Q:                 s.Q,
+		Throttling:        s.Throttling.Seconds(),
+		IsActive:          &isActive,
+		Status:            status,
+		Notification: subscriptionNotification{
+			Attributes:       s.NotificationAttributes,
+			Format:           "normalized",
+			Endpoint:         subscriptionEndpoint{URI: s.Endpoint, Accept: s.Accept},
+			Status:           notificationStatus,
+			TimesSent:        s.TimesSent,
+			LastNotification: formatTime(s.LastNotification),
+			LastSuccess:      formatTime(s.LastSuccess),
+			LastFailure:      formatTime(s.LastFailure),
+		},
+		CreatedAt:  formatTime(s.CreatedAt),
+		ModifiedAt: formatTime(s.ModifiedAt),
+	}
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-environment/internal/pkg/application"
+	"github.com/diwise/api-environment/internal/pkg/infrastructure/repositories/database"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/context"
+	"github.com/diwise/api-environment/internal/pkg/presentation/api/ngsi-ld/entities"
+	"github.com/diwise/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/diwise/ngsi-ld-golang/pkg/ngsi-ld/errors"
+	"github.com/go-chi/chi/v5"
+)
+
+//NewQueryTemporalEntitiesHandler handles GET requests for the temporal evolution of entities
+func NewQueryTemporalEntitiesHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityTypeNames := r.URL.Query().Get("type")
+		if entityTypeNames == "" {
+			ngsierrors.ReportNewBadRequestData(w, "A request for temporal entities MUST specify the entity type.")
+			return
+		}
+
+		query, err := newTemporalQueryFromParameters(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		entities, truncated, err := queryTemporalEntities(ctxReg, strings.Split(entityTypeNames, ","), query)
+		if err != nil {
+			if errors.Is(err, context.ErrUnsupportedTemporalQuery) {
+				ngsierrors.ReportNewBadRequestData(w, err.Error())
+			} else {
+				reportInternalError(w, "failed to query temporal entities: "+err.Error())
+			}
+			return
+		}
+
+		writeTemporalResponse(w, entities, truncated)
+	})
+}
+
+//queryTemporalEntities queries the temporal context sources of every entity type. If any source
+//truncated its entities, the sources are queried again from the start of the truncated range, until
+//the entities of every source cover the same range, so that no instance is repeated on the next page.
+func queryTemporalEntities(ctxReg ngsi.ContextRegistry, typeNames []string, query context.TemporalQuery) ([]ngsi.Entity, *context.TemporalRange, error) {
+	var previous *context.TemporalRange
+
+	for {
+		entities := []ngsi.Entity{}
+		var truncated *context.TemporalRange
+		queried := 0
+
+		for _, typeName := range typeNames {
+			query.EntityType = typeName
+
+			for _, source := range getTemporalContextSources(ctxReg.GetContextSourcesForEntityType(typeName)) {
+				queried++
+
+				sourceRange, err := source.GetTemporalEntities(query, func(entity ngsi.Entity) error {
+					entities = append(entities, entity)
+					return nil
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+
+				if sourceRange != nil && truncated == nil {
+					truncated = sourceRange
+				} else if sourceRange != nil {
+					if sourceRange.From.After(truncated.From) {
+						truncated.From = sourceRange.From
+					}
+					if sourceRange.To.After(truncated.To) {
+						truncated.To = sourceRange.To
+					}
+				}
+			}
+		}
+
+		// Restricting the query to the previous range may leave every source with fewer instances than the limit
+		if truncated == nil && previous != nil {
+			truncated = &context.TemporalRange{From: query.From, To: previous.To}
+		}
+
+		if truncated == nil || queried == 1 || !truncated.From.After(query.From) {
+			return entities, truncated, nil
+		}
+
+		query.From = truncated.From
+		previous = truncated
+	}
+}
+
+//NewRetrieveTemporalEntityHandler handles GET requests for the temporal evolution of a single entity
+func NewRetrieveTemporalEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entityId")
+
+		query, err := newTemporalQueryFromParameters(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+		query.EntityID = entityID
+
+		var entity ngsi.Entity
+		var truncated *context.TemporalRange
+
+		for _, source := range getTemporalContextSources(ctxReg.GetContextSourcesForEntity(entityID)) {
+			truncated, err = source.GetTemporalEntities(query, func(e ngsi.Entity) error {
+				entity = e
+				return nil
+			})
+			if err != nil {
+				if errors.Is(err, context.ErrUnsupportedTemporalQuery) {
+					ngsierrors.ReportNewBadRequestData(w, err.Error())
+				} else {
+					reportInternalError(w, "failed to retrieve temporal entity: "+err.Error())
+				}
+				return
+			}
+		}
+
+		if entity == nil {
+			reportResourceNotFound(w, fmt.Sprintf("no temporal evolution found for entity %s", entityID))
+			return
+		}
+
+		writeTemporalResponse(w, entity, truncated)
+	})
+}
+
+//attributeInstanceDeleter is implemented by context sources that can delete single attribute instances
+type attributeInstanceDeleter interface {
+	DeleteAttributeInstance(entityID, attributeName, instanceID string, purge bool) error
+}
+
+//NewDeleteAttributeInstanceHandler deletes a single instance of an attribute from the temporal
+//evolution of an entity
+func NewDeleteAttributeInstanceHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entityId")
+		attributeName := chi.URLParam(r, "attrId")
+		instanceID := chi.URLParam(r, "instanceId")
+
+		purge, err := purgeRequested(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		var deleter attributeInstanceDeleter
+		if contextSources := ctxReg.GetContextSourcesForEntity(entityID); len(contextSources) > 0 {
+			deleter, _ = contextSources[0].(attributeInstanceDeleter)
+		}
+
+		if deleter == nil {
+			reportResourceNotFound(w, fmt.Sprintf("no context source provides entities with id %s", entityID))
+			return
+		}
+
+		err = deleter.DeleteAttributeInstance(entityID, attributeName, instanceID, purge)
+		if err != nil {
+			if errors.Is(err, application.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("attribute instance %s of %s does not exist", instanceID, entityID))
+				return
+			}
+
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func getTemporalContextSources(sources []ngsi.ContextSource) []context.TemporalContextSource {
+	temporalSources := []context.TemporalContextSource{}
+
+	for _, src := range sources {
+		if temporalSource, ok := src.(context.TemporalContextSource); ok {
+			temporalSources = append(temporalSources, temporalSource)
+		}
+	}
+
+	return temporalSources
+}
+
+//writeTemporalResponse writes the temporal representation of one or more entities. A response
+//that was truncated by the limit is partial content, with the range of the instances that were
+//returned in the Content-Range header.
+func writeTemporalResponse(w http.ResponseWriter, response interface{}, truncated *context.TemporalRange) {
+	bytes, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		reportInternalError(w, "failed to encode response")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+
+	if truncated != nil {
+		w.Header().Add("Content-Range", fmt.Sprintf("date-time %s-%s/*",
+			truncated.From.UTC().Format(time.RFC3339), truncated.To.UTC().Format(time.RFC3339)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	w.Write(bytes)
+}
+
+//newTemporalQueryFromParameters parses the timerel, timeAt, endTimeAt, lastN, attrs, limit,
+//aggrMethods, aggrPeriodDuration and q (refDevice or refPointOfInterest only) parameters of a
+//temporal request
+func newTemporalQueryFromParameters(r *http.Request) (context.TemporalQuery, error) {
+	params := r.URL.Query()
+	query := context.TemporalQuery{}
+
+	if timerel := params.Get("timerel"); timerel != "" {
+		timeAt, err := parseTimeParameter(params.Get("timeAt"), "timeAt")
+		if err != nil {
+			return query, err
+		}
+
+		switch timerel {
+		case ngsi.TemporalRelationBeforeTime:
+			query.To = timeAt
+		case ngsi.TemporalRelationAfterTime:
+			query.From = timeAt
+		case ngsi.TemporalRelationBetweenTimes:
+			query.From = timeAt
+			query.To, err = parseTimeParameter(params.Get("endTimeAt"), "endTimeAt")
+			if err != nil {
+				return query, err
+			}
+			if !query.To.After(query.From) {
+				return query, errors.New("endTimeAt must be after timeAt")
+			}
+		default:
+			return query, fmt.Errorf("temporal relation of type %s not supported", timerel)
+		}
+	}
+
+	if timeproperty := params.Get("timeproperty"); timeproperty != "" && timeproperty != "observedAt" {
+		return query, fmt.Errorf("time property %s is not supported", timeproperty)
+	}
+
+	var err error
+
+	query.LastN, err = parseUintParameter(params.Get("lastN"), "lastN")
+	if err != nil {
+		return query, err
+	}
+
+	query.Limit, err = parseUintParameter(params.Get("limit"), "limit")
+	if err != nil {
+		return query, err
+	}
+
+	if query.Limit > context.MaxTemporalLimit {
+		return query, fmt.Errorf("limit must not exceed %d", context.MaxTemporalLimit)
+	}
+
+	if attrs := params.Get("attrs"); attrs != "" {
+		query.Attributes = strings.Split(attrs, ",")
+	}
+
+	if aggrMethods := params.Get("aggrMethods"); aggrMethods != "" {
+		query.AggregationMethods, err = parseAggregationMethods(aggrMethods)
+		if err != nil {
+			return query, err
+		}
+
+		query.AggregationPeriod, err = parseAggregationPeriod(params.Get("aggrPeriodDuration"))
+		if err != nil {
+			return query, err
+		}
+	} else if params.Get("aggrPeriodDuration") != "" {
+		return query, errors.New("aggrPeriodDuration requires aggrMethods to be specified")
+	}
+
+	const refDevicePrefix string = "refDevice==\""
+	const refPointOfInterestPrefix string = "refPointOfInterest==\""
+
+	if q := params.Get("q"); strings.HasPrefix(q, refDevicePrefix) {
+		query.Device = strings.TrimPrefix(strings.Split(q, "\"")[1], fiware.DeviceIDPrefix)
+	} else if strings.HasPrefix(q, refPointOfInterestPrefix) {
+		query.PointOfInterest = strings.Split(q, "\"")[1]
+	}
+
+	return query, nil
+}
+
+func parseAggregationMethods(value string) ([]string, error) {
+	supported := map[string]bool{
+		entities.AggregationMethodAverage:    true,
+		entities.AggregationMethodMinimum:    true,
+		entities.AggregationMethodMaximum:    true,
+		entities.AggregationMethodSum:        true,
+		entities.AggregationMethodTotalCount: true,
+	}
+
+	methods := strings.Split(value, ",")
+	for _, method := range methods {
+		if !supported[method] {
+			return nil, fmt.Errorf("aggregation method %s is not supported", method)
+		}
+	}
+
+	return methods, nil
+}
+
+//parseAggregationPeriod maps an ISO 8601 duration to one of the supported aggregation periods.
+//An empty or zero duration aggregates over the whole requested time interval.
+func parseAggregationPeriod(value string) (database.AggregationPeriod, error) {
+	periods := map[string]database.AggregationPeriod{
+		"":     database.AggregationPeriodNone,
+		"P0D":  database.AggregationPeriodNone,
+		"PT1M": database.AggregationPeriodMinute,
+		"PT1H": database.AggregationPeriodHour,
+		"P1D":  database.AggregationPeriodDay,
+		"P1W":  database.AggregationPeriodWeek,
+		"P7D":  database.AggregationPeriodWeek,
+		"P1M":  database.AggregationPeriodMonth,
+		"P1Y":  database.AggregationPeriodYear,
+	}
+
+	period, ok := periods[value]
+	if !ok {
+		return database.AggregationPeriodNone, fmt.Errorf("aggrPeriodDuration %s is not supported, use one of PT1M, PT1H, P1D, P1W, P1M, P1Y or P0D", value)
+	}
+
+	return period, nil
+}
+
+func parseTimeParameter(value, name string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing parameter %s", name)
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse %s from %s", name, value)
+	}
+
+	return t, nil
+}
+
+func parseUintParameter(value, name string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+
+	return n, nil
+}